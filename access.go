@@ -0,0 +1,52 @@
+package mirror
+
+import (
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// accessLogger names the logger secondary requests' access logs are written to, if access_log is set
+const accessLogger = "access"
+
+// logAccess logs a secondary request like Caddy's access log does, as "handled request" with the same field names, and
+// the upstream the secondary proxied it to, if it did. Headers aren't logged, since the secondary's credentials are
+// added to them. Like Caddy, server errors are logged at error level.
+func (h *Handler) logAccess(r *http.Request, rec caddyhttp.ResponseRecorder, duration time.Duration, err error) {
+	status := errorStatus(rec.Status(), err)
+
+	remoteIP, remotePort, splitErr := net.SplitHostPort(r.RemoteAddr)
+	if splitErr != nil {
+		remoteIP = r.RemoteAddr
+	}
+	clientIP, _ := caddyhttp.GetVar(r.Context(), caddyhttp.ClientIPVarKey).(string)
+	attrs := []any{
+		slog.Group("request",
+			slog.String("remote_ip", remoteIP),
+			slog.String("remote_port", remotePort),
+			slog.String("client_ip", clientIP),
+			slog.String("proto", r.Proto),
+			slog.String("method", r.Method),
+			slog.String("host", r.Host),
+			slog.String("uri", r.URL.RequestURI()),
+		),
+		slog.Float64("duration", duration.Seconds()),
+		slog.Int("size", rec.Size()),
+		slog.Int("status", status),
+	}
+	if upstream, ok := replacer(r).GetString("http.reverse_proxy.upstream.hostport"); ok && upstream != "" {
+		attrs = append(attrs, slog.String("upstream", upstream))
+	}
+	if err != nil {
+		attrs = append(attrs, slog.String("error", err.Error()))
+	}
+
+	if status >= http.StatusInternalServerError {
+		h.accessSlogger.Error("handled request", attrs...)
+	} else {
+		h.accessSlogger.Info("handled request", attrs...)
+	}
+}
@@ -0,0 +1,83 @@
+package mirror
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func TestHandler_logAccess(t *testing.T) {
+	tests := []struct {
+		name       string
+		status     int
+		err        error
+		wantLevel  string
+		wantStatus int64
+	}{
+		{name: "success", status: http.StatusCreated, wantLevel: "info", wantStatus: http.StatusCreated},
+		{name: "server error", status: http.StatusBadGateway, wantLevel: "error", wantStatus: http.StatusBadGateway},
+		{name: "handler error", err: caddyhttp.Error(http.StatusServiceUnavailable, errors.New("no upstreams")), wantLevel: "error", wantStatus: http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var level string
+			attrs := make(map[string]slog.Value)
+			logAt := func(name string) func(string, ...any) {
+				return func(msg string, in ...any) {
+					if msg != "handled request" {
+						t.Errorf("logged %q, want handled request", msg)
+					}
+					level = name
+					for _, a := range in {
+						attr := a.(slog.Attr)
+						attrs[attr.Key] = attr.Value
+					}
+				}
+			}
+			h := &Handler{accessSlogger: &sloggerMock{info: logAt("info"), err: logAt("error")}}
+
+			r := httptest.NewRequest(http.MethodGet, "http://example.com/users/1?page=2", nil)
+			repl := caddy.NewReplacer()
+			repl.Set("http.reverse_proxy.upstream.hostport", "shadow:8080")
+			ctx := context.WithValue(r.Context(), caddy.ReplacerCtxKey, repl)
+			r = r.WithContext(context.WithValue(ctx, caddyhttp.VarsCtxKey, map[string]any{caddyhttp.ClientIPVarKey: "192.0.2.1"}))
+
+			rec := caddyhttp.NewResponseRecorder(&NopResponseWriter{}, nil, nil)
+			if tt.status != 0 {
+				rec.WriteHeader(tt.status)
+				_, _ = rec.Write([]byte("hello"))
+			}
+			h.logAccess(r, rec, 250*time.Millisecond, tt.err)
+
+			if level != tt.wantLevel {
+				t.Errorf("logged at %s, want %s", level, tt.wantLevel)
+			}
+			if got := attrs["status"].Int64(); got != tt.wantStatus {
+				t.Errorf("status = %d, want %d", got, tt.wantStatus)
+			}
+			if got := attrs["duration"].Float64(); got != 0.25 {
+				t.Errorf("duration = %v, want 0.25", got)
+			}
+			if got := attrs["upstream"].String(); got != "shadow:8080" {
+				t.Errorf("upstream = %q, want shadow:8080", got)
+			}
+			request := make(map[string]string)
+			for _, a := range attrs["request"].Group() {
+				request[a.Key] = a.Value.String()
+			}
+			if request["uri"] != "/users/1?page=2" || request["client_ip"] != "192.0.2.1" {
+				t.Errorf("request = %v", request)
+			}
+			if _, ok := attrs["error"]; ok != (tt.err != nil) {
+				t.Errorf("error logged = %v, want %v", ok, tt.err != nil)
+			}
+		})
+	}
+}
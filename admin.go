@@ -0,0 +1,325 @@
+package mirror
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+var _ caddy.AdminRouter = (*AdminAPI)(nil)
+
+func init() {
+	caddy.RegisterModule(AdminAPI{})
+}
+
+// registry maps names to live values, like handlers and stores, so the admin API can find them
+type registry[T comparable] struct {
+	mu sync.RWMutex
+	m  map[string]T
+}
+
+func newRegistry[T comparable]() *registry[T] {
+	return &registry[T]{m: make(map[string]T)}
+}
+
+func (r *registry[T]) register(name string, v T) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.m[name] = v
+}
+
+// unregister removes name, but only if it's still registered to v. During a config reload, the new config registers
+// itself before the old config is cleaned up.
+func (r *registry[T]) unregister(name string, v T) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.m[name] == v {
+		delete(r.m, name)
+	}
+}
+
+// loadOrRegister returns the value registered to name, or registers v if there isn't one
+func (r *registry[T]) loadOrRegister(name string, v T) T {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if existing, ok := r.m[name]; ok {
+		return existing
+	}
+	r.m[name] = v
+	return v
+}
+
+func (r *registry[T]) lookup(name string) (T, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	v, ok := r.m[name]
+	return v, ok
+}
+
+// namedHandlers are the handlers which can be inspected through the admin API, by name
+var namedHandlers = newRegistry[*Handler]()
+
+// AdminAPI serves mirror data through Caddy's admin API, under /mirror/<name>/
+type AdminAPI struct{}
+
+func (AdminAPI) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "admin.api.mirror",
+		New: func() caddy.Module { return new(AdminAPI) },
+	}
+}
+
+// Routes implements caddy.AdminRouter
+func (a *AdminAPI) Routes() []caddy.AdminRoute {
+	return []caddy.AdminRoute{
+		{
+			Pattern: "/mirror/",
+			Handler: caddy.AdminHandlerFunc(a.serve),
+		},
+	}
+}
+
+// adminActions are the resources which change a handler's state, and are only served for POST requests. Everything
+// else is only served for GET requests.
+var adminActions = map[string]bool{
+	"quota/reset": true,
+	"drain":       true,
+	"resume":      true,
+}
+
+func (a *AdminAPI) serve(w http.ResponseWriter, r *http.Request) error {
+	name, resource, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/mirror/"), "/")
+	if adminActions[resource] && r.Method != http.MethodPost || !adminActions[resource] && r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+
+	switch resource {
+	case "quota/reset":
+		return a.resetQuota(w, name)
+	case "drain":
+		return a.serveDrain(w, r, name)
+	case "resume":
+		return a.serveResume(w, name)
+	case "stats":
+		return a.serveStats(w, name)
+	case "scorecard":
+		return a.serveScorecard(w, name)
+	case "mismatches":
+		return a.serveMismatches(w, r, name)
+	case "recent":
+		return a.serveRecent(w, r, name)
+	default:
+		return caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        fmt.Errorf("unknown resource '%s'", resource),
+		}
+	}
+}
+
+// serveMismatches queries a mismatch store. Records are filtered by the path, status, signature, since, and until query
+// parameters. With group_by, the number of records per path, status, or signature is returned instead.
+func (a *AdminAPI) serveMismatches(w http.ResponseWriter, r *http.Request, name string) error {
+	store, ok := namedStores.lookup(name)
+	if !ok {
+		return caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        fmt.Errorf("no mismatch store named '%s'", name),
+		}
+	}
+
+	q := r.URL.Query()
+	f := MismatchFilter{
+		Path:      q.Get("path"),
+		Status:    q.Get("status"),
+		Signature: q.Get("signature"),
+	}
+
+	var err error
+	f.Since, err = parseQueryTime(q.Get("since"))
+	if err != nil {
+		return badRequest("since", err)
+	}
+	f.Until, err = parseQueryTime(q.Get("until"))
+	if err != nil {
+		return badRequest("until", err)
+	}
+
+	limit := 100
+	if l := q.Get("limit"); l != "" {
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit < 1 {
+			return badRequest("limit", fmt.Errorf("must be a positive integer"))
+		}
+	}
+
+	var result any
+	if groupBy := q.Get("group_by"); groupBy != "" {
+		result, err = store.count(f, groupBy, limit)
+		if err != nil {
+			return badRequest("group_by", err)
+		}
+	} else {
+		result, err = store.query(f, limit)
+		if err != nil {
+			return caddy.APIError{HTTPStatus: http.StatusInternalServerError, Err: err}
+		}
+	}
+
+	return writeJSON(w, result)
+}
+
+// serveStats returns a snapshot of a handler's live stats
+func (a *AdminAPI) serveStats(w http.ResponseWriter, name string) error {
+	h, ok := namedHandlers.lookup(name)
+	if !ok {
+		return caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        fmt.Errorf("no mirror handler named '%s'", name),
+		}
+	}
+	return writeJSON(w, h.statsSnapshot())
+}
+
+// serveScorecard returns a handler's scorecard
+func (a *AdminAPI) serveScorecard(w http.ResponseWriter, name string) error {
+	h, ok := namedHandlers.lookup(name)
+	if !ok {
+		return caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        fmt.Errorf("no mirror handler named '%s'", name),
+		}
+	}
+	if h.scorecard == nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        fmt.Errorf("mirror handler '%s' doesn't keep a scorecard", name),
+		}
+	}
+	return writeJSON(w, h.scorecard.snapshot())
+}
+
+// serveRecent returns a handler's most recent mismatches, newest first, up to the limit query parameter
+func (a *AdminAPI) serveRecent(w http.ResponseWriter, r *http.Request, name string) error {
+	h, ok := namedHandlers.lookup(name)
+	if !ok {
+		return caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        fmt.Errorf("no mirror handler named '%s'", name),
+		}
+	}
+	if h.recent == nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        fmt.Errorf("mirror handler '%s' doesn't keep recent mismatches", name),
+		}
+	}
+
+	limit := h.RecentMismatches
+	if l := r.URL.Query().Get("limit"); l != "" {
+		var err error
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit < 1 {
+			return badRequest("limit", fmt.Errorf("must be a positive integer"))
+		}
+	}
+
+	return writeJSON(w, h.recent.list(limit))
+}
+
+// resetQuota clears a handler's mirrored request quota, and returns its usage afterward
+func (a *AdminAPI) resetQuota(w http.ResponseWriter, name string) error {
+	h, ok := namedHandlers.lookup(name)
+	if !ok {
+		return caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        fmt.Errorf("no mirror handler named '%s'", name),
+		}
+	}
+	if h.quota == nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        fmt.Errorf("mirror handler '%s' doesn't have a quota", name),
+		}
+	}
+
+	h.quota.reset()
+	return writeJSON(w, h.quota.usage())
+}
+
+// serveDrain stops a handler from mirroring new requests, and returns the drain's status. With the wait query parameter,
+// like wait=30s, it returns once the requests already mirrored are done, or after that long, whichever is first.
+func (a *AdminAPI) serveDrain(w http.ResponseWriter, r *http.Request, name string) error {
+	h, ok := namedHandlers.lookup(name)
+	if !ok {
+		return caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        fmt.Errorf("no mirror handler named '%s'", name),
+		}
+	}
+
+	var wait time.Duration
+	if q := r.URL.Query().Get("wait"); q != "" {
+		var err error
+		wait, err = caddy.ParseDuration(q)
+		if err != nil {
+			return badRequest("wait", err)
+		}
+	}
+
+	complete := h.drain.start(h.done)
+	if wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case <-complete:
+		case <-timer.C:
+		case <-r.Context().Done():
+		}
+	}
+	return writeJSON(w, h.drain.status())
+}
+
+// serveResume starts mirroring again after a drain
+func (a *AdminAPI) serveResume(w http.ResponseWriter, name string) error {
+	h, ok := namedHandlers.lookup(name)
+	if !ok {
+		return caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        fmt.Errorf("no mirror handler named '%s'", name),
+		}
+	}
+	h.drain.resume()
+	return writeJSON(w, h.drain.status())
+}
+
+func writeJSON(w http.ResponseWriter, v any) error {
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(v)
+}
+
+// parseQueryTime parses an RFC 3339 time, or a duration like "1h" meaning that long ago
+func parseQueryTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if dur, err := caddy.ParseDuration(s); err == nil {
+		return time.Now().Add(-dur), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+func badRequest(param string, err error) error {
+	return caddy.APIError{
+		HTTPStatus: http.StatusBadRequest,
+		Err:        fmt.Errorf("invalid %s: %w", param, err),
+	}
+}
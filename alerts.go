@@ -0,0 +1,169 @@
+package mirror
+
+import (
+	"log/slog"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+var _ caddyfile.Unmarshaler = (*AlertConfig)(nil)
+
+// AlertConfig sets thresholds for the secondary. When a threshold is crossed, the handler logs a shadow_alert warning
+// and emits a mirror_alert event. When it's no longer crossed, it logs shadow_alert_resolved and emits
+// mirror_alert_resolved. Thresholds which aren't set aren't checked.
+type AlertConfig struct {
+	// Interval is how often thresholds are checked, against the requests since the last check. Defaults to 1 minute.
+	Interval caddy.Duration `json:"interval,omitempty"`
+	// MinRequests is how many requests an interval needs for its thresholds to be checked, so a handful of requests
+	// can't raise or resolve an alert. Defaults to 10.
+	MinRequests int64 `json:"min_requests,omitempty"`
+
+	// MinMatchRate is the lowest acceptable percentage of compared requests which match
+	MinMatchRate *float64 `json:"min_match_rate,omitempty"`
+	// MaxP95Increase is how much slower the secondary's p95 latency may be than the primary's
+	MaxP95Increase *caddy.Duration `json:"max_p95_increase,omitempty"`
+	// MaxSecondaryErrorRate is the highest acceptable percentage of secondary requests which fail, with a handler
+	// error or a 5xx response
+	MaxSecondaryErrorRate *float64 `json:"max_secondary_error_rate,omitempty"`
+}
+
+func (a *AlertConfig) provision() {
+	if a.Interval == 0 {
+		a.Interval = caddy.Duration(time.Minute)
+	}
+	if a.MinRequests == 0 {
+		a.MinRequests = 10
+	}
+}
+
+func (a *AlertConfig) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume "alerts"
+	for d.NextBlock(0) {
+		opt := d.Val()
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		switch opt {
+		case "interval", "max_p95_increase":
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("error parsing %s: %v", opt, err)
+			}
+			if opt == "interval" {
+				a.Interval = caddy.Duration(dur)
+			} else {
+				a.MaxP95Increase = ptr(caddy.Duration(dur))
+			}
+		case "min_requests":
+			n, err := strconv.ParseInt(d.Val(), 10, 64)
+			if err != nil {
+				return d.Errf("error parsing min_requests: %v", err)
+			}
+			a.MinRequests = n
+		case "min_match_rate", "max_secondary_error_rate":
+			rate, err := strconv.ParseFloat(strings.TrimSuffix(d.Val(), "%"), 64)
+			if err != nil {
+				return d.Errf("error parsing %s: %v", opt, err)
+			}
+			if opt == "min_match_rate" {
+				a.MinMatchRate = &rate
+			} else {
+				a.MaxSecondaryErrorRate = &rate
+			}
+		default:
+			return d.Errf("unrecognized alerts option '%s'", opt)
+		}
+	}
+	return nil
+}
+
+// alerter checks a handler's stats against its thresholds, and tracks which alerts are firing
+type alerter struct {
+	cfg     AlertConfig
+	name    string
+	stats   *stats
+	slogger slogger
+	// emit emits a Caddy event
+	emit func(event string, data map[string]any)
+
+	last   statsTotals
+	firing map[string]bool
+}
+
+// alertCheck is the outcome of checking one threshold
+type alertCheck struct {
+	alert     string
+	value     float64
+	threshold float64
+	crossed   bool
+}
+
+// watch checks thresholds every interval, until done is closed
+func (a *alerter) watch(done <-chan struct{}) {
+	ticker := time.NewTicker(time.Duration(a.cfg.Interval))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			a.check()
+		}
+	}
+}
+
+// check checks every threshold against the requests since the last check, and raises or resolves alerts which
+// changed
+func (a *alerter) check() {
+	totals := a.stats.totals()
+	window := totals.sub(a.last)
+	a.last = totals
+	primary := a.stats.primary.alertLatencies.reset()
+	secondary := a.stats.secondary.alertLatencies.reset()
+
+	var checks []alertCheck
+	if a.cfg.MinMatchRate != nil && window.Matched+window.Mismatched >= a.cfg.MinRequests {
+		rate := window.matchRate() * 100
+		checks = append(checks, alertCheck{"match_rate", rate, *a.cfg.MinMatchRate, rate < *a.cfg.MinMatchRate})
+	}
+	if a.cfg.MaxP95Increase != nil && min(window.PrimaryRequests, window.SecondaryRequests) >= a.cfg.MinRequests {
+		increase, threshold := secondary.P95-primary.P95, time.Duration(*a.cfg.MaxP95Increase).Seconds()
+		checks = append(checks, alertCheck{"p95_increase", increase, threshold, increase > threshold})
+	}
+	if a.cfg.MaxSecondaryErrorRate != nil && window.SecondaryRequests >= a.cfg.MinRequests {
+		rate := float64(window.SecondaryErrors) / float64(window.SecondaryRequests) * 100
+		checks = append(checks, alertCheck{"secondary_error_rate", rate, *a.cfg.MaxSecondaryErrorRate, rate > *a.cfg.MaxSecondaryErrorRate})
+	}
+
+	for _, c := range checks {
+		if c.crossed == a.firing[c.alert] || math.IsNaN(c.value) {
+			continue
+		}
+		a.firing[c.alert] = c.crossed
+
+		attrs := []any{
+			slog.String("alert", c.alert),
+			slog.Float64("value", c.value),
+			slog.Float64("threshold", c.threshold),
+		}
+		data := map[string]any{
+			"handler":   a.name,
+			"alert":     c.alert,
+			"value":     c.value,
+			"threshold": c.threshold,
+		}
+		if c.crossed {
+			a.slogger.Warn("shadow_alert", attrs...)
+			a.emit("mirror_alert", data)
+		} else {
+			a.slogger.Info("shadow_alert_resolved", attrs...)
+			a.emit("mirror_alert_resolved", data)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package mirror
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func Test_alerter_check(t *testing.T) {
+	var logged, events []string
+	a := &alerter{
+		cfg: AlertConfig{
+			MinRequests:           10,
+			MinMatchRate:          ptr(90.0),
+			MaxP95Increase:        ptr(caddy.Duration(50 * time.Millisecond)),
+			MaxSecondaryErrorRate: ptr(5.0),
+		},
+		name:  "test",
+		stats: newStats(),
+		slogger: &sloggerMock{
+			warn: func(str string, in ...any) { logged = append(logged, str) },
+			info: func(str string, in ...any) { logged = append(logged, str) },
+		},
+		emit: func(event string, data map[string]any) {
+			events = append(events, event+":"+data["alert"].(string))
+		},
+		firing: make(map[string]bool),
+	}
+	a.stats.primary.alertLatencies = new(reservoir)
+	a.stats.secondary.alertLatencies = new(reservoir)
+
+	requests := func(n int, match bool, secondaryLatency time.Duration, secondaryStatus int) {
+		for range n {
+			a.stats.observe("primary", 10*time.Millisecond, 200, nil)
+			a.stats.observe("secondary", secondaryLatency, secondaryStatus, nil)
+			a.stats.compared(Report{Match: match})
+		}
+	}
+
+	// Too few requests to check anything
+	requests(5, false, time.Second, 500)
+	a.check()
+	if len(events) != 0 {
+		t.Fatalf("alerts raised below min_requests: %v", events)
+	}
+
+	requests(20, false, 100*time.Millisecond, 200)
+	a.check()
+	if want := "mirror_alert:match_rate mirror_alert:p95_increase"; strings.Join(events, " ") != want {
+		t.Errorf("events = %s, want %s", strings.Join(events, " "), want)
+	}
+	if want := "shadow_alert shadow_alert"; strings.Join(logged, " ") != want {
+		t.Errorf("logged = %s, want %s", strings.Join(logged, " "), want)
+	}
+
+	// Still firing, so nothing new is raised
+	events = nil
+	requests(20, false, 100*time.Millisecond, 200)
+	a.check()
+	if len(events) != 0 {
+		t.Errorf("alerts raised again while firing: %v", events)
+	}
+
+	requests(20, true, 10*time.Millisecond, 503)
+	a.check()
+	want := "mirror_alert_resolved:match_rate mirror_alert_resolved:p95_increase mirror_alert:secondary_error_rate"
+	if strings.Join(events, " ") != want {
+		t.Errorf("events = %s, want %s", strings.Join(events, " "), want)
+	}
+}
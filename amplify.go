@@ -0,0 +1,137 @@
+package mirror
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+var _ caddyfile.Unmarshaler = (*AmplifyConfig)(nil)
+
+// AmplifyConfig sends several copies of each mirrored request to the secondary, to load test it with live traffic at a
+// multiple of production volume. Only the first copy is compared. The others are sent, and their responses discarded.
+type AmplifyConfig struct {
+	// Copies is how many times each mirrored request is sent to the secondary, including the one which is compared
+	Copies int `json:"copies"`
+	// Pacing, if set, spaces the extra copies this far apart, starting when the first is sent. By default, they're all
+	// sent at once.
+	Pacing caddy.Duration `json:"pacing,omitempty"`
+}
+
+func (c *AmplifyConfig) provision() error {
+	if c.Copies < 1 {
+		return fmt.Errorf("secondary_amplify copies must be at least 1, got %d", c.Copies)
+	}
+	return nil
+}
+
+// extra is how many copies are sent besides the one which is compared
+func (c *AmplifyConfig) extra() int {
+	if c == nil {
+		return 0
+	}
+	return c.Copies - 1
+}
+
+func (c *AmplifyConfig) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume "secondary_amplify"
+	args := d.RemainingArgs()
+	if len(args) < 1 || len(args) > 2 {
+		return d.ArgErr()
+	}
+	copies, err := strconv.Atoi(args[0])
+	if err != nil {
+		return d.Errf("error parsing copies: %v", err)
+	}
+	c.Copies = copies
+	if len(args) == 2 {
+		pacing, err := caddy.ParseDuration(args[1])
+		if err != nil {
+			return d.Errf("error parsing pacing: %v", err)
+		}
+		c.Pacing = caddy.Duration(pacing)
+	}
+	return nil
+}
+
+// cloneCopies clones the extra copies of a mirrored request, each with its own mirror_correlation_id, and a mirror_copy
+// var counting from 1. Their bodies are set once the original's is read.
+func (h *Handler) cloneCopies(r *http.Request) []*http.Request {
+	n := h.Amplify.extra()
+	if n < 1 {
+		return nil
+	}
+	copies := make([]*http.Request, n)
+	for i := range copies {
+		cr := cloneRequest(r)
+		h.rewriteSecondary(cr)
+		cr.Body = http.NoBody
+		if cr.Context().Value(caddyhttp.VarsCtxKey) != nil {
+			caddyhttp.SetVar(cr.Context(), "mirror_correlation_id", newUUID())
+			caddyhttp.SetVar(cr.Context(), "mirror_copy", i+1)
+		}
+		copies[i] = cr
+	}
+	return copies
+}
+
+// sendCopies sends the extra copies of a mirrored request, spaced by the pacing. Each takes a slot of max_in_flight, and
+// is skipped if none are free. They're counted in the secondary's metrics, and logged by access_log.
+func (h *Handler) sendCopies(copies []*http.Request, body []byte, trailer http.Header, route string, next caddyhttp.Handler) {
+	h.stats.started()
+	go func() {
+		defer h.stats.finished()
+		var pacing <-chan time.Time
+		if h.Amplify.Pacing > 0 {
+			ticker := time.NewTicker(time.Duration(h.Amplify.Pacing))
+			defer ticker.Stop()
+			pacing = ticker.C
+		}
+		for _, cr := range copies {
+			if pacing != nil {
+				select {
+				case <-pacing:
+				case <-h.done:
+					return
+				}
+			}
+			if !h.inFlightLimit.acquire(1) {
+				if h.MetricsName != "" {
+					h.metrics.capped.Inc()
+				}
+				continue
+			}
+			if body != nil {
+				cr.Body = io.NopCloser(bytes.NewReader(body))
+			}
+			cr.Trailer = trailer.Clone()
+			h.stats.started()
+			send := func(dropped bool) {
+				defer h.stats.finished()
+				defer h.inFlightLimit.release(1)
+				if dropped || !h.prepareSecondary(cr) {
+					return
+				}
+				var timing responseTiming
+				rec := caddyhttp.NewResponseRecorder(&NopResponseWriter{}, nil, nil)
+				// Errors are logged by the request processor
+				err := h.requestProcessor("secondary", h.secondaryHandler(), route, &timing)(rec, cr, h.secondaryNext(next))
+				if h.AccessLog {
+					h.logAccess(cr, rec, timing.total, err)
+				}
+			}
+			if h.pool != nil {
+				h.pool.submit(send)
+			} else {
+				go send(false)
+			}
+		}
+	}()
+}
@@ -0,0 +1,84 @@
+package mirror
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func TestAmplifyConfig_UnmarshalCaddyfile(t *testing.T) {
+	c := new(AmplifyConfig)
+	if err := c.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`secondary_amplify 3 100ms`)); err != nil {
+		t.Fatal(err)
+	}
+	if c.Copies != 3 || time.Duration(c.Pacing) != 100*time.Millisecond {
+		t.Errorf("copies = %d, pacing = %v, want 3, 100ms", c.Copies, time.Duration(c.Pacing))
+	}
+	if err := (&AmplifyConfig{}).provision(); err == nil {
+		t.Errorf("provision() with no copies didn't fail")
+	}
+}
+
+func TestHandler_ServeHTTP_amplify(t *testing.T) {
+	var mu sync.Mutex
+	bodies := make(map[string]string)
+	var compared int
+	h := &Handler{
+		ComparisonConfig:       ComparisonConfig{CompareStatus: true},
+		SecondaryRequestConfig: SecondaryRequestConfig{Amplify: &AmplifyConfig{Copies: 3, Pacing: 1}},
+		MirrorRate:             1,
+		stats:                  newStats(),
+		slogger:                nullLogger{},
+		comparisonSlogger:      nullLogger{},
+		now:                    time.Now,
+		reporters: []Reporter{reporterFunc(func(Report) {
+			mu.Lock()
+			defer mu.Unlock()
+			compared++
+		})},
+		primary: middlewareHandlerFunc(func(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+			_, _ = io.Copy(io.Discard, r.Body)
+			w.WriteHeader(http.StatusOK)
+			return nil
+		}),
+		secondary: middlewareHandlerFunc(func(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+			body, _ := io.ReadAll(r.Body)
+			mu.Lock()
+			defer mu.Unlock()
+			bodies[caddyhttp.GetVar(r.Context(), "mirror_correlation_id").(string)] = string(body)
+			w.WriteHeader(http.StatusOK)
+			return nil
+		}),
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/orders", strings.NewReader(`{"id":1}`))
+	r = r.WithContext(context.WithValue(r.Context(), caddyhttp.VarsCtxKey, make(map[string]any)))
+	if err := h.ServeHTTP(&NopResponseWriter{}, r, nil); err != nil {
+		t.Fatal(err)
+	}
+	for h.stats.comparing.Load() > 0 || h.stats.inFlight.Load() > 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(bodies) != 3 {
+		t.Errorf("the secondary got %d distinct correlation IDs, want 3", len(bodies))
+	}
+	for id, body := range bodies {
+		if body != `{"id":1}` {
+			t.Errorf("copy %s got body %q", id, body)
+		}
+	}
+	if compared != 1 {
+		t.Errorf("%d copies were compared, want 1", compared)
+	}
+}
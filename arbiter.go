@@ -0,0 +1,183 @@
+package mirror
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+var (
+	_ Comparer              = (*ArbiterComparer)(nil)
+	_ RequestAwareComparer  = (*ArbiterComparer)(nil)
+	_ caddy.Provisioner     = (*ArbiterComparer)(nil)
+	_ caddyfile.Unmarshaler = (*ArbiterComparer)(nil)
+)
+
+func init() {
+	caddy.RegisterModule(ArbiterComparer{})
+}
+
+// RequestAwareComparer is implemented by comparers which need to know which request was mirrored. If a comparer
+// implements it, CompareRequest is called instead of Compare.
+type RequestAwareComparer interface {
+	CompareRequest(req RequestSummary, primary, secondary ResponseArtifact) Result
+}
+
+// ArbiterRequest is the payload the ArbiterComparer POSTs to the arbiter service. Bodies are base64 encoded.
+type ArbiterRequest struct {
+	Request   RequestSummary   `json:"request"`
+	Primary   ResponseArtifact `json:"primary"`
+	Secondary ResponseArtifact `json:"secondary"`
+}
+
+// ArbiterVerdict is the response the arbiter service is expected to return
+type ArbiterVerdict struct {
+	Match bool `json:"match"`
+	// Details are optional, and included in the mismatch log as-is
+	Details map[string]any `json:"details,omitempty"`
+}
+
+// ArbiterComparer delegates comparison to an external HTTP service, and trusts its verdict. This keeps comparison logic
+// involving business rules out of Caddy.
+type ArbiterComparer struct {
+	// URL of the arbiter service, which receives an ArbiterRequest and must respond with an ArbiterVerdict
+	URL string `json:"url"`
+	// Headers are added to every request to the arbiter service, for example for authentication. Values may contain
+	// global placeholders like {env.ARBITER_TOKEN}.
+	Headers map[string]string `json:"headers,omitempty"`
+	// Timeout for the whole exchange with the arbiter service. Defaults to 10s.
+	Timeout caddy.Duration `json:"timeout,omitempty"`
+
+	client  *http.Client
+	headers http.Header
+	slogger slogger
+}
+
+func (ArbiterComparer) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "mirror.comparers.arbiter",
+		New: func() caddy.Module { return new(ArbiterComparer) },
+	}
+}
+
+// Provision implements caddy.Provisioner
+func (c *ArbiterComparer) Provision(ctx caddy.Context) error {
+	if c.URL == "" {
+		return fmt.Errorf("arbiter url is required")
+	}
+
+	if c.Timeout == 0 {
+		c.Timeout = caddy.Duration(10 * time.Second)
+	}
+	c.client = &http.Client{Timeout: time.Duration(c.Timeout)}
+
+	repl := caddy.NewReplacer()
+	c.headers = make(http.Header, len(c.Headers))
+	for k, v := range c.Headers {
+		c.headers.Set(k, repl.ReplaceKnown(v, ""))
+	}
+
+	c.slogger = ctx.Slogger()
+	return nil
+}
+
+func (c *ArbiterComparer) Compare(primary, secondary ResponseArtifact) Result {
+	return c.CompareRequest(RequestSummary{}, primary, secondary)
+}
+
+func (c *ArbiterComparer) CompareRequest(req RequestSummary, primary, secondary ResponseArtifact) Result {
+	res := Result{Comparer: "arbiter"}
+
+	verdict, err := c.ask(ArbiterRequest{
+		Request:   req,
+		Primary:   primary,
+		Secondary: secondary,
+	})
+	if err != nil {
+		// Without a verdict, this is neither a match nor a mismatch
+		c.slogger.Error("arbiter_error", slog.String("error", err.Error()))
+		res.Skipped = true
+		return res
+	}
+
+	res.Match = verdict.Match
+	if verdict.Details != nil {
+		res.Attrs = []slog.Attr{slog.Any("details", verdict.Details)}
+	}
+	return res
+}
+
+func (c *ArbiterComparer) ask(areq ArbiterRequest) (verdict ArbiterVerdict, err error) {
+	body, err := json.Marshal(areq)
+	if err != nil {
+		return verdict, fmt.Errorf("error encoding arbiter request: %w", err)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, c.URL, bytes.NewReader(body))
+	if err != nil {
+		return verdict, fmt.Errorf("error creating arbiter request: %w", err)
+	}
+	req.Header = c.headers.Clone()
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return verdict, fmt.Errorf("error sending arbiter request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		return verdict, fmt.Errorf("arbiter responded with status %d", resp.StatusCode)
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(&verdict)
+	if err != nil {
+		return verdict, fmt.Errorf("error decoding arbiter verdict: %w", err)
+	}
+	return verdict, nil
+}
+
+func (c *ArbiterComparer) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume comparer name
+	if d.NextArg() {
+		c.URL = d.Val()
+	}
+	for d.NextBlock(0) {
+		switch d.Val() {
+		case "url":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			c.URL = d.Val()
+		case "header":
+			args := d.RemainingArgs()
+			if len(args) != 2 {
+				return d.Err("header requires a name and a value")
+			}
+			if c.Headers == nil {
+				c.Headers = make(map[string]string)
+			}
+			c.Headers[args[0]] = args[1]
+		case "timeout":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("error parsing timeout: %v", err)
+			}
+			c.Timeout = caddy.Duration(dur)
+		default:
+			return d.Errf("unrecognized arbiter comparer option '%s'", d.Val())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package mirror
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestArbiterComparer_CompareRequest(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var areq ArbiterRequest
+		if err := json.NewDecoder(r.Body).Decode(&areq); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(ArbiterVerdict{
+			Match:   string(areq.Primary.Body) == string(areq.Secondary.Body),
+			Details: map[string]any{"uri": areq.Request.URI},
+		})
+	}))
+	defer srv.Close()
+
+	c := &ArbiterComparer{
+		URL:     srv.URL,
+		client:  &http.Client{Timeout: time.Second},
+		headers: http.Header{"Authorization": []string{"Bearer secret"}},
+		slogger: nullLogger{},
+	}
+	req := RequestSummary{Method: "GET", URI: "/foo"}
+
+	res := c.CompareRequest(req,
+		ResponseArtifact{Status: 200, Body: []byte("Hello, world!"), Buffered: true},
+		ResponseArtifact{Status: 200, Body: []byte("Hello, world!"), Buffered: true},
+	)
+	if res.Skipped || !res.Match {
+		t.Errorf("expected arbiter to report a match, got %+v", res)
+	}
+
+	res = c.CompareRequest(req,
+		ResponseArtifact{Status: 200, Body: []byte("Hello, world!"), Buffered: true},
+		ResponseArtifact{Status: 200, Body: []byte("Goodbye, world!"), Buffered: true},
+	)
+	if res.Skipped || res.Match {
+		t.Errorf("expected arbiter to report a mismatch, got %+v", res)
+	}
+
+	c.headers = http.Header{}
+	res = c.CompareRequest(req, ResponseArtifact{}, ResponseArtifact{})
+	if !res.Skipped {
+		t.Errorf("expected arbiter errors to skip the comparison, got %+v", res)
+	}
+}
@@ -0,0 +1,391 @@
+package mirror
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/dustin/go-humanize"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+var _ caddyfile.Unmarshaler = (*ArtifactsConfig)(nil)
+
+// ArtifactsConfig writes the artifacts of every mismatch to a directory: the report as JSON, both bodies, and a diff.
+// Mismatch logs then reference the artifacts instead of including bodies, JSON patches, and hex previews, which keeps
+// log volume down without losing any detail.
+type ArtifactsConfig struct {
+	// Dir is the directory artifacts are written to. Each mismatch gets its own directory inside it, named like
+	// <yyyy>/<mm>/<dd>/<hh>/<time>-<random>.
+	Dir string `json:"dir"`
+	// BaseURL, if set, is where Dir is served from, so mismatch logs reference artifacts by URL instead of by path
+	BaseURL string `json:"base_url,omitempty"`
+	// Compression of written files. One of "gzip", "zstd", or "none" (default).
+	Compression string `json:"compression,omitempty"`
+	// EncryptionKey, if set, encrypts written files with AES-256-GCM. It's 32 bytes, hex or base64 encoded, and may
+	// contain global placeholders like {file./run/secrets/artifacts_key}.
+	EncryptionKey string `json:"encryption_key,omitempty"`
+
+	// MaxAge, MaxCount, and MaxTotalBytes, if set, are how long the artifacts of a mismatch are kept, and how many
+	// mismatches' artifacts and how many bytes of them are kept in total. The oldest are removed first.
+	MaxAge        caddy.Duration `json:"max_age,omitempty"`
+	MaxCount      int            `json:"max_count,omitempty"`
+	MaxTotalBytes int64          `json:"max_total_bytes,omitempty"`
+	// CleanupInterval is how often artifacts beyond the limits are removed. Defaults to 1m.
+	CleanupInterval caddy.Duration `json:"cleanup_interval,omitempty"`
+}
+
+func (c *ArtifactsConfig) provision() error {
+	if c.Dir == "" {
+		return fmt.Errorf("artifacts requires a dir")
+	}
+	switch c.Compression {
+	case "":
+		c.Compression = "none"
+	case "gzip", "zstd", "none":
+	default:
+		return fmt.Errorf("unrecognized artifacts compression '%s'", c.Compression)
+	}
+	if c.CleanupInterval == 0 {
+		c.CleanupInterval = caddy.Duration(time.Minute)
+	}
+	return nil
+}
+
+// retained reports whether any retention limit is set
+func (c *ArtifactsConfig) retained() bool {
+	return c.MaxAge > 0 || c.MaxCount > 0 || c.MaxTotalBytes > 0
+}
+
+func (c *ArtifactsConfig) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume "artifacts"
+	if d.NextArg() {
+		c.Dir = d.Val()
+	}
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	for d.NextBlock(0) {
+		opt := d.Val()
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		switch opt {
+		case "dir":
+			c.Dir = d.Val()
+		case "base_url":
+			c.BaseURL = d.Val()
+		case "compression":
+			c.Compression = d.Val()
+		case "encryption_key":
+			c.EncryptionKey = d.Val()
+		case "max_age", "cleanup_interval":
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("error parsing %s: %v", opt, err)
+			}
+			if opt == "max_age" {
+				c.MaxAge = caddy.Duration(dur)
+			} else {
+				c.CleanupInterval = caddy.Duration(dur)
+			}
+		case "max_count":
+			n, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("error parsing max_count: %v", err)
+			}
+			c.MaxCount = n
+		case "max_total_size":
+			size, err := humanize.ParseBytes(d.Val())
+			if err != nil {
+				return d.Errf("error parsing max_total_size: %v", err)
+			}
+			c.MaxTotalBytes = int64(size)
+		default:
+			return d.Errf("unrecognized artifacts option '%s'", opt)
+		}
+	}
+	return nil
+}
+
+// artifactStore writes the artifacts of mismatches to a directory, and removes them once they're past its retention
+// limits
+type artifactStore struct {
+	cfg     ArtifactsConfig
+	zstd    *zstd.Encoder
+	aead    cipher.AEAD
+	slogger slogger
+	now     func() time.Time
+}
+
+func newArtifactStore(cfg ArtifactsConfig, slogger slogger, now func() time.Time) (s *artifactStore, err error) {
+	s = &artifactStore{cfg: cfg, slogger: slogger, now: now}
+	if cfg.Compression == "zstd" {
+		s.zstd, err = zstd.NewWriter(nil)
+		if err != nil {
+			return nil, fmt.Errorf("error creating zstd encoder: %w", err)
+		}
+	}
+	if cfg.EncryptionKey != "" {
+		s.aead, err = newArtifactCipher(cfg.EncryptionKey)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing artifacts encryption_key: %w", err)
+		}
+	}
+	return s, nil
+}
+
+// write writes a mismatch's artifacts, and returns a reference to them: their URL under the base URL, if there is one,
+// or the path of their directory
+func (s *artifactStore) write(rep Report) (string, error) {
+	rel := artifactDir(rep)
+	dir := filepath.Join(s.cfg.Dir, filepath.FromSlash(rel))
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return "", err
+	}
+	for _, f := range mismatchArtifacts(rep) {
+		f = encryptArtifact(compressArtifact(f, s.cfg.Compression, s.zstd), s.aead)
+		if err := os.WriteFile(filepath.Join(dir, f.Name), f.Data, 0o640); err != nil {
+			return "", err
+		}
+	}
+
+	if s.cfg.BaseURL != "" {
+		return strings.TrimSuffix(s.cfg.BaseURL, "/") + "/" + rel + "/", nil
+	}
+	return dir, nil
+}
+
+// artifactFile is one file of a mismatch's artifacts
+type artifactFile struct {
+	Name        string
+	ContentType string
+	Data        []byte
+}
+
+// mismatchArtifacts returns the files describing a mismatch: the report as an Event, both bodies, and a diff between
+// them. The files are copies, and remain valid after Report returns.
+func mismatchArtifacts(rep Report) []artifactFile {
+	files := make([]artifactFile, 0, 4)
+
+	ev := newEvent(rep, false)
+	meta, _ := json.MarshalIndent(ev, "", "  ")
+	files = append(files, artifactFile{Name: "report.json", ContentType: "application/json", Data: meta})
+
+	if rep.Primary.Buffered {
+		files = append(files, bodyArtifact("primary", rep.Primary))
+	}
+	if rep.Secondary.Buffered {
+		files = append(files, bodyArtifact("secondary", rep.Secondary))
+	}
+	if rep.Primary.Buffered && rep.Secondary.Buffered {
+		if diff := bodyDiff(rep.Primary.Body, rep.Secondary.Body); diff != "" {
+			diff, _, _ = truncateDiff(diff, rep.maxDiffBytes)
+			files = append(files, artifactFile{Name: "body.diff", ContentType: "text/x-diff", Data: []byte(diff)})
+		}
+	}
+
+	return files
+}
+
+func bodyArtifact(name string, a ResponseArtifact) artifactFile {
+	contentType := a.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = http.DetectContentType(a.Body)
+	}
+	return artifactFile{
+		Name:        name + artifactExtension(contentType),
+		ContentType: contentType,
+		Data:        append([]byte(nil), a.Body...),
+	}
+}
+
+// artifactExtension picks a file extension for a content type, so artifacts open in the right program
+func artifactExtension(contentType string) string {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch mediaType {
+	case "application/json":
+		return ".json"
+	case "text/html":
+		return ".html"
+	case "text/plain":
+		return ".txt"
+	}
+	if exts, _ := mime.ExtensionsByType(mediaType); len(exts) > 0 {
+		return exts[0]
+	}
+	return ".bin"
+}
+
+// artifactDir is the relative directory a mismatch's artifacts are kept in. It starts with the UTC date and hour, so
+// lifecycle and retention rules can match whole days by prefix, and sorts by time.
+func artifactDir(rep Report) string {
+	suffix := make([]byte, 4)
+	_, _ = rand.Read(suffix)
+
+	t := rep.Time.UTC()
+	return path.Join(t.Format("2006/01/02/15"), t.Format("150405.000000000")+"-"+hex.EncodeToString(suffix))
+}
+
+// storedMismatch is the directory of one mismatch's artifacts
+type storedMismatch struct {
+	dir     string
+	modTime time.Time
+	size    int64
+}
+
+// watch removes artifacts past the retention limits every cleanup interval, until done is closed
+func (s *artifactStore) watch(done <-chan struct{}) {
+	ticker := time.NewTicker(time.Duration(s.cfg.CleanupInterval))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			s.clean()
+		}
+	}
+}
+
+// clean removes the artifacts of the mismatches which are older than max_age, and then the oldest, until there are no
+// more than max_count, taking no more than max_total_bytes. Directories emptied along the way are removed too.
+func (s *artifactStore) clean() {
+	stored, err := s.list()
+	if err != nil {
+		s.slogger.Error("artifacts_cleanup_error", slog.String("error", err.Error()))
+		return
+	}
+
+	var total int64
+	for _, m := range stored {
+		total += m.size
+	}
+	var removed int
+	var removedBytes int64
+	for i, m := range stored {
+		remaining := len(stored) - i
+		expired := s.cfg.MaxAge > 0 && s.now().Sub(m.modTime) > time.Duration(s.cfg.MaxAge)
+		if !expired &&
+			(s.cfg.MaxCount <= 0 || remaining <= s.cfg.MaxCount) &&
+			(s.cfg.MaxTotalBytes <= 0 || total <= s.cfg.MaxTotalBytes) {
+			break
+		}
+		if err := os.RemoveAll(m.dir); err != nil {
+			s.slogger.Error("artifacts_cleanup_error", slog.String("dir", m.dir), slog.String("error", err.Error()))
+			continue
+		}
+		total -= m.size
+		removed++
+		removedBytes += m.size
+		s.removeEmptyParents(m.dir)
+	}
+
+	if removed > 0 {
+		s.slogger.Info("artifacts_cleaned", slog.Int("removed", removed), slog.Int64("removed_bytes", removedBytes))
+	}
+}
+
+// list returns the mismatches with artifacts in the directory, oldest first. Only directories laid out like
+// artifactDir's are listed, so nothing else in the directory is ever removed.
+func (s *artifactStore) list() ([]storedMismatch, error) {
+	dirs, err := filepath.Glob(filepath.Join(s.cfg.Dir, "[0-9]*", "[0-9]*", "[0-9]*", "[0-9]*", "*-*"))
+	if err != nil {
+		return nil, err
+	}
+	// Names sort by time, since they start with the date and time
+	slices.Sort(dirs)
+
+	stored := make([]storedMismatch, 0, len(dirs))
+	for _, dir := range dirs {
+		info, err := os.Stat(dir)
+		if err != nil || !info.IsDir() {
+			continue
+		}
+		m := storedMismatch{dir: dir, modTime: info.ModTime()}
+		entries, _ := os.ReadDir(dir)
+		for _, e := range entries {
+			if fi, err := e.Info(); err == nil {
+				m.size += fi.Size()
+			}
+		}
+		stored = append(stored, m)
+	}
+	return stored, nil
+}
+
+// removeEmptyParents removes the hour, day, month, and year directories above a removed mismatch, if they're empty
+func (s *artifactStore) removeEmptyParents(dir string) {
+	for range 4 {
+		dir = filepath.Dir(dir)
+		// Remove fails on directories which aren't empty
+		if os.Remove(dir) != nil {
+			return
+		}
+	}
+}
+
+// compressArtifact compresses a file with gzip or zstd, adding the compression's extension to its name. Files are left
+// as they are with any other compression.
+func compressArtifact(f artifactFile, compression string, zstdEnc *zstd.Encoder) artifactFile {
+	switch compression {
+	case "gzip":
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		_, _ = zw.Write(f.Data)
+		_ = zw.Close()
+		return artifactFile{Name: f.Name + ".gz", ContentType: "application/gzip", Data: buf.Bytes()}
+	case "zstd":
+		return artifactFile{Name: f.Name + ".zst", ContentType: "application/zstd", Data: zstdEnc.EncodeAll(f.Data, nil)}
+	}
+	return f
+}
+
+// encryptArtifact encrypts a file, if aead is set, adding .enc to its name. The encrypted file is a random nonce,
+// followed by the sealed data.
+func encryptArtifact(f artifactFile, aead cipher.AEAD) artifactFile {
+	if aead == nil {
+		return f
+	}
+	nonce := make([]byte, aead.NonceSize())
+	_, _ = rand.Read(nonce)
+	return artifactFile{Name: f.Name + ".enc", ContentType: "application/octet-stream", Data: aead.Seal(nonce, nonce, f.Data, nil)}
+}
+
+// newArtifactCipher returns an AES-256-GCM cipher for a hex or base64 encoded 32-byte key, after replacing global
+// placeholders in it
+func newArtifactCipher(key string) (cipher.AEAD, error) {
+	key = strings.TrimSpace(caddy.NewReplacer().ReplaceKnown(key, ""))
+	raw, err := hex.DecodeString(key)
+	if err != nil {
+		raw, err = base64.StdEncoding.DecodeString(key)
+	}
+	if err != nil || len(raw) != 32 {
+		return nil, fmt.Errorf("key must be 32 bytes, hex or base64 encoded")
+	}
+	block, err := aes.NewCipher(raw)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,175 @@
+package mirror
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestArtifactStore_write(t *testing.T) {
+	rep := Report{
+		ID:        "abc",
+		Time:      time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC),
+		Primary:   ResponseArtifact{Body: []byte("a\n"), Buffered: true},
+		Secondary: ResponseArtifact{Body: []byte("b\n"), Buffered: true},
+	}
+
+	dir := t.TempDir()
+	s, _ := newArtifactStore(ArtifactsConfig{Dir: dir}, nullLogger{}, time.Now)
+	ref, err := s.write(rep)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(ref, filepath.Join(dir, "2024", "01", "02", "15")) {
+		t.Errorf("write() = %s, want a directory under %s", ref, dir)
+	}
+	entries, err := os.ReadDir(ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	if want := []string{"body.diff", "primary.txt", "report.json", "secondary.txt"}; !slices.Equal(names, want) {
+		t.Errorf("wrote %v, want %v", names, want)
+	}
+
+	s, _ = newArtifactStore(ArtifactsConfig{Dir: dir, BaseURL: "https://artifacts.example.com/"}, nullLogger{}, time.Now)
+	ref, err = s.write(rep)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(ref, "https://artifacts.example.com/2024/01/02/15/150405.000000000-") || !strings.HasSuffix(ref, "/") {
+		t.Errorf("write() = %s, want a URL under the base URL", ref)
+	}
+}
+
+func TestArtifactStore_writeEncrypted(t *testing.T) {
+	key := strings.Repeat("ab", 32)
+	cfg := ArtifactsConfig{Dir: t.TempDir(), Compression: "gzip", EncryptionKey: key}
+	if err := cfg.provision(); err != nil {
+		t.Fatal(err)
+	}
+	s, err := newArtifactStore(cfg, nullLogger{}, time.Now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref, err := s.write(Report{Primary: ResponseArtifact{Body: []byte("secret"), Buffered: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(ref, "primary.txt.gz.enc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, _ := newArtifactCipher(key)
+	compressed, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], nil)
+	if err != nil {
+		t.Fatalf("error decrypting artifact: %v", err)
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body, _ := io.ReadAll(zr); string(body) != "secret" {
+		t.Errorf("decrypted body = %q, want secret", body)
+	}
+
+	for _, key := range []string{"not a key", strings.Repeat("ab", 16)} {
+		if _, err := newArtifactStore(ArtifactsConfig{Dir: cfg.Dir, EncryptionKey: key}, nullLogger{}, time.Now); err == nil {
+			t.Errorf("newArtifactStore() accepted encryption key %q", key)
+		}
+	}
+	cfg.Compression = "lz4"
+	if err := cfg.provision(); err == nil {
+		t.Errorf("provision() accepted an unrecognized compression")
+	}
+}
+
+func TestHandler_compareArtifacts(t *testing.T) {
+	var reports []Report
+	store, _ := newArtifactStore(ArtifactsConfig{Dir: t.TempDir()}, nullLogger{}, time.Now)
+	h := &Handler{
+		ComparisonConfig: ComparisonConfig{CompareBody: true},
+		ReportingConfig:  ReportingConfig{NoLog: true},
+		artifacts:        store,
+		reporters:        []Reporter{reporterFunc(func(r Report) { reports = append(reports, r) })},
+		now:              time.Now,
+	}
+	same := ResponseArtifact{Body: []byte("a"), Buffered: true}
+	h.compare("", RequestSummary{Method: "GET", URI: "/"}, same, same)
+	h.compare("", RequestSummary{Method: "GET", URI: "/"}, same, ResponseArtifact{Body: []byte("b"), Buffered: true})
+
+	if reports[0].Artifacts != "" {
+		t.Errorf("wrote artifacts of a match, to %s", reports[0].Artifacts)
+	}
+	if _, err := os.Stat(filepath.Join(reports[1].Artifacts, "report.json")); err != nil {
+		t.Errorf("didn't write artifacts of a mismatch: %v", err)
+	}
+}
+
+func TestArtifactStore_clean(t *testing.T) {
+	now := time.Date(2024, 1, 2, 15, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		cfg  ArtifactsConfig
+		want int
+	}{
+		{name: "no limits", cfg: ArtifactsConfig{}, want: 4},
+		{name: "max age", cfg: ArtifactsConfig{MaxAge: caddy.Duration(90 * time.Minute)}, want: 2},
+		{name: "max count", cfg: ArtifactsConfig{MaxCount: 3}, want: 3},
+		{name: "max total bytes", cfg: ArtifactsConfig{MaxTotalBytes: 250}, want: 2},
+		{name: "strictest limit", cfg: ArtifactsConfig{MaxAge: caddy.Duration(90 * time.Minute), MaxCount: 1}, want: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.cfg.Dir = t.TempDir()
+			unrelated := filepath.Join(tt.cfg.Dir, "keep.txt")
+			if err := os.WriteFile(unrelated, []byte("keep"), 0o640); err != nil {
+				t.Fatal(err)
+			}
+			// Four mismatches, an hour apart, with 100 bytes of artifacts each
+			var dirs []string
+			for i := range 4 {
+				written := now.Add(time.Duration(i-3) * time.Hour)
+				dir := filepath.Join(tt.cfg.Dir, artifactDir(Report{Time: written}))
+				if err := os.MkdirAll(dir, 0o750); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(filepath.Join(dir, "body.diff"), bytes.Repeat([]byte("x"), 100), 0o640); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.Chtimes(dir, written, written); err != nil {
+					t.Fatal(err)
+				}
+				dirs = append(dirs, dir)
+			}
+
+			s, _ := newArtifactStore(tt.cfg, nullLogger{}, func() time.Time { return now })
+			s.clean()
+
+			for i, dir := range dirs {
+				_, err := os.Stat(dir)
+				if kept := i >= len(dirs)-tt.want; kept != (err == nil) {
+					t.Errorf("mismatch %d kept = %v, want %v", i, err == nil, kept)
+				}
+			}
+			if _, err := os.Stat(filepath.Dir(dirs[0])); tt.want < 4 && err == nil {
+				t.Errorf("clean() left the empty directory %s", filepath.Dir(dirs[0]))
+			}
+			if _, err := os.Stat(unrelated); err != nil {
+				t.Errorf("clean() removed a file it didn't write: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,85 @@
+package mirror
+
+import (
+	"bytes"
+	"encoding/hex"
+	"log/slog"
+	"mime"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+)
+
+// hexPreviewBytes is how much of each body is included, in hex, around the first difference of binary bodies
+const hexPreviewBytes = 32
+
+// binaryBody reports whether a response's body is binary, and shouldn't be logged as a string. Bodies are binary if
+// their content type isn't text, or sniffed as such if there's none, or if they aren't valid UTF-8.
+func binaryBody(a ResponseArtifact) bool {
+	contentType := a.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = http.DetectContentType(a.Body)
+	}
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	return !textMediaType(mediaType) || !utf8.Valid(a.Body)
+}
+
+func textMediaType(mediaType string) bool {
+	switch {
+	case strings.HasPrefix(mediaType, "text/"),
+		strings.HasSuffix(mediaType, "+json"),
+		strings.HasSuffix(mediaType, "+xml"):
+		return true
+	}
+	switch mediaType {
+	case "application/json", "application/xml", "application/javascript", "application/x-www-form-urlencoded",
+		"application/x-ndjson", "application/graphql":
+		return true
+	}
+	return false
+}
+
+// binaryBodyAttrs describe mismatched binary bodies by their lengths and hashes, and a hex preview of each, starting
+// just before the first byte at which they differ
+func binaryBodyAttrs(primary, secondary []byte) []slog.Attr {
+	attrs := []slog.Attr{
+		slog.String("primary_body_sha256", sha256Hex(primary)),
+		slog.Int("primary_body_length", len(primary)),
+		slog.String("shadow_body_sha256", sha256Hex(secondary)),
+		slog.Int("shadow_body_length", len(secondary)),
+	}
+	offset := firstDifference(primary, secondary)
+	if offset < 0 {
+		return attrs
+	}
+
+	// Start the preview on a 16-byte boundary, so it lines up with hex dumps of the bodies
+	start := offset &^ 15
+	return append(attrs,
+		slog.Int("first_difference", offset),
+		slog.Int("preview_offset", start),
+		slog.String("primary_hex", hexPreview(primary, start)),
+		slog.String("shadow_hex", hexPreview(secondary, start)),
+	)
+}
+
+// firstDifference is the offset of the first byte at which a and b differ, or -1 if they're equal
+func firstDifference(a, b []byte) int {
+	if bytes.Equal(a, b) {
+		return -1
+	}
+	n := min(len(a), len(b))
+	for i := range n {
+		if a[i] != b[i] {
+			return i
+		}
+	}
+	return n
+}
+
+func hexPreview(body []byte, start int) string {
+	if start >= len(body) {
+		return ""
+	}
+	return hex.EncodeToString(body[start:min(start+hexPreviewBytes, len(body))])
+}
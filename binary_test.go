@@ -0,0 +1,63 @@
+package mirror
+
+import (
+	"net/http"
+	"testing"
+)
+
+func Test_binaryBody(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        []byte
+		want        bool
+	}{
+		{"json", "application/json", []byte(`{"a":1}`), false},
+		{"structured json", "application/problem+json", []byte(`{"a":1}`), false},
+		{"html", "text/html; charset=utf-8", []byte("<p>hi</p>"), false},
+		{"image", "image/png", []byte("\x89PNG\r\n\x1a\n"), true},
+		{"octet stream", "application/octet-stream", []byte("plain"), true},
+		{"sniffed text", "", []byte("Hello, world!"), false},
+		{"sniffed binary", "", []byte{0x00, 0x01, 0x02, 0xff}, true},
+		{"text which isn't utf-8", "text/plain", []byte{'a', 0xff, 'b'}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := ResponseArtifact{Header: http.Header{}, Body: tt.body}
+			if tt.contentType != "" {
+				a.Header.Set("Content-Type", tt.contentType)
+			}
+			if got := binaryBody(a); got != tt.want {
+				t.Errorf("binaryBody() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBodyComparer_CompareBinary(t *testing.T) {
+	primary := make([]byte, 100)
+	secondary := make([]byte, 100)
+	secondary[40] = 0xff
+	hdr := http.Header{"Content-Type": {"application/octet-stream"}}
+
+	res := (&BodyComparer{}).Compare(
+		ResponseArtifact{Header: hdr, Body: primary, Buffered: true},
+		ResponseArtifact{Header: hdr, Body: secondary, Buffered: true},
+	)
+	attrs := attrsToMap(res.Attrs)
+	if _, ok := attrs["primary_body"]; ok {
+		t.Errorf("binary body was logged as a string")
+	}
+	want := map[string]any{
+		"primary_body_length": int64(100),
+		"first_difference":    int64(40),
+		"preview_offset":      int64(32),
+		"primary_hex":         "0000000000000000000000000000000000000000000000000000000000000000",
+		"shadow_hex":          "0000000000000000ff0000000000000000000000000000000000000000000000",
+	}
+	for key, value := range want {
+		if attrs[key] != value {
+			t.Errorf("%s = %v, want %v", key, attrs[key], value)
+		}
+	}
+}
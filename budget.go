@@ -0,0 +1,156 @@
+package mirror
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+var _ caddyfile.Unmarshaler = (*ErrorBudgetConfig)(nil)
+
+// ErrorBudgetConfig tracks the secondary's success ratio over rolling windows, and how much of its error budget it has
+// consumed since the handler was provisioned. A secondary request succeeds unless it fails with a handler error or a
+// 5xx response. The error budget is the share of requests which may fail under the objective.
+type ErrorBudgetConfig struct {
+	// Objective is the target success ratio, as a percentage, like 99.9
+	Objective float64 `json:"objective"`
+	// Windows are the rolling windows the success ratio is tracked over. Defaults to 5m and 1h.
+	Windows []caddy.Duration `json:"windows,omitempty"`
+}
+
+func (c *ErrorBudgetConfig) provision() error {
+	if c.Objective <= 0 || c.Objective >= 100 {
+		return fmt.Errorf("error_budget objective must be between 0 and 100, got %v", c.Objective)
+	}
+	if len(c.Windows) == 0 {
+		c.Windows = []caddy.Duration{caddy.Duration(5 * time.Minute), caddy.Duration(time.Hour)}
+	}
+	return nil
+}
+
+func (c *ErrorBudgetConfig) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume "error_budget"
+	if d.NextArg() {
+		if err := c.parseObjective(d); err != nil {
+			return err
+		}
+	}
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	for d.NextBlock(0) {
+		opt := d.Val()
+		switch opt {
+		case "objective":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			if err := c.parseObjective(d); err != nil {
+				return err
+			}
+		case "windows":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return d.ArgErr()
+			}
+			for _, arg := range args {
+				window, err := caddy.ParseDuration(arg)
+				if err != nil {
+					return d.Errf("error parsing window: %v", err)
+				}
+				c.Windows = append(c.Windows, caddy.Duration(window))
+			}
+		default:
+			return d.Errf("unrecognized error_budget option '%s'", opt)
+		}
+	}
+	return nil
+}
+
+func (c *ErrorBudgetConfig) parseObjective(d *caddyfile.Dispenser) error {
+	objective, err := strconv.ParseFloat(strings.TrimSuffix(d.Val(), "%"), 64)
+	if err != nil {
+		return d.Errf("error parsing objective: %v", err)
+	}
+	c.Objective = objective
+	return nil
+}
+
+// errorBudget counts the secondary's requests and errors over each of its windows. Methods are safe to call on a nil
+// *errorBudget, which records nothing.
+type errorBudget struct {
+	// objective is a fraction, from 0.0 to 1.0
+	objective float64
+	windows   []*slidingWindow
+}
+
+func newErrorBudget(cfg ErrorBudgetConfig) *errorBudget {
+	b := &errorBudget{objective: cfg.Objective / 100}
+	for _, window := range cfg.Windows {
+		size := time.Duration(window)
+		b.windows = append(b.windows, newSlidingWindow(size, max(size/60, time.Second)))
+	}
+	return b
+}
+
+func (b *errorBudget) record(fn func(*windowCounts)) {
+	if b == nil {
+		return
+	}
+	for _, w := range b.windows {
+		w.record(fn)
+	}
+}
+
+// successRatio is the fraction of secondary requests which succeeded, or NaN if there were none
+func successRatio(requests, errors int64) float64 {
+	if requests == 0 {
+		return math.NaN()
+	}
+	return float64(requests-errors) / float64(requests)
+}
+
+// consumed is the fraction of the error budget the secondary's errors used up, out of its requests. It's over 1 once
+// the budget is exhausted, and NaN if there were no requests.
+func (b *errorBudget) consumed(requests, errors int64) float64 {
+	if requests == 0 {
+		return math.NaN()
+	}
+	return float64(errors) / (float64(requests) * (1 - b.objective))
+}
+
+// errorBudgetSnapshot is the error budget as served by the admin API. Ratios and the budget consumed are percentages,
+// omitted if there were no secondary requests.
+type errorBudgetSnapshot struct {
+	Objective float64 `json:"objective"`
+	// SuccessRatios are by window
+	SuccessRatios map[string]*float64 `json:"success_ratios"`
+	// Consumed is how much of the budget has been used since the handler was provisioned
+	Consumed *float64 `json:"consumed"`
+}
+
+func (b *errorBudget) snapshot(totals statsTotals) errorBudgetSnapshot {
+	snap := errorBudgetSnapshot{
+		Objective:     b.objective * 100,
+		SuccessRatios: make(map[string]*float64, len(b.windows)),
+	}
+	for _, w := range b.windows {
+		counts := w.sum()
+		snap.SuccessRatios[w.size().String()] = percent(successRatio(counts.SecondaryRequests, counts.SecondaryErrors))
+	}
+	snap.Consumed = percent(b.consumed(totals.SecondaryRequests, totals.SecondaryErrors))
+	return snap
+}
+
+// percent converts a fraction to a percentage, or nil if it's NaN
+func percent(fraction float64) *float64 {
+	if math.IsNaN(fraction) {
+		return nil
+	}
+	return ptr(fraction * 100)
+}
@@ -0,0 +1,70 @@
+package mirror
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+func Test_errorBudget_snapshot(t *testing.T) {
+	now := time.Unix(1000, 0)
+	cfg := ErrorBudgetConfig{Objective: 99}
+	if err := cfg.provision(); err != nil {
+		t.Fatal(err)
+	}
+	s := newStats()
+	s.budget = newErrorBudget(cfg)
+	for _, w := range s.budget.windows {
+		w.now = func() time.Time { return now }
+	}
+
+	snap := s.budget.snapshot(s.totals())
+	if snap.Consumed != nil || snap.SuccessRatios["5m0s"] != nil {
+		t.Errorf("snapshot() without requests = %+v, want no ratios", snap)
+	}
+
+	for range 98 {
+		s.observe("secondary", time.Millisecond, 200, nil)
+	}
+	s.observe("secondary", time.Millisecond, 503, nil)
+	s.observe("secondary", time.Millisecond, 0, errors.New("oops"))
+	// The primary's errors don't count against the secondary's budget
+	s.observe("primary", time.Millisecond, 500, nil)
+
+	snap = s.budget.snapshot(s.totals())
+	if *snap.SuccessRatios["5m0s"] != 98 || *snap.SuccessRatios["1h0m0s"] != 98 {
+		t.Errorf("success ratios = %v, want 98 in every window", snap.SuccessRatios)
+	}
+	// 2 errors out of the 1 allowed in 100 requests
+	if *snap.Consumed < 199.99 || *snap.Consumed > 200.01 {
+		t.Errorf("consumed = %v, want 200", *snap.Consumed)
+	}
+
+	// The short window forgets, but the budget is cumulative
+	now = now.Add(10 * time.Minute)
+	s.observe("secondary", time.Millisecond, 200, nil)
+	snap = s.budget.snapshot(s.totals())
+	if *snap.SuccessRatios["5m0s"] != 100 || *snap.Consumed < 198 {
+		t.Errorf("snapshot() after 10m = %v and %v consumed", snap.SuccessRatios, *snap.Consumed)
+	}
+}
+
+func TestErrorBudgetConfig_UnmarshalCaddyfile(t *testing.T) {
+	var c ErrorBudgetConfig
+	err := c.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`error_budget 99.9% {
+		windows 1h 1d
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Objective != 99.9 || len(c.Windows) != 2 || c.Windows[1] != caddy.Duration(24*time.Hour) {
+		t.Errorf("UnmarshalCaddyfile() = %+v", c)
+	}
+
+	if err := new(ErrorBudgetConfig).provision(); err == nil {
+		t.Error("provision() without an objective didn't fail")
+	}
+}
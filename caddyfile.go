@@ -7,8 +7,11 @@ import (
 	"strings"
 
 	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/dustin/go-humanize"
 )
 
 func init() {
@@ -49,12 +52,233 @@ func ParseCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error)
 			if err != nil {
 				return nil, fmt.Errorf("error parsing mirror_rate: %w", err)
 			}
+		case "ramp_up_duration", "slow_start_duration":
+			if !h.NextArg() {
+				return nil, h.ArgErr()
+			}
+			dur, err := caddy.ParseDuration(h.Val())
+			if err != nil {
+				return nil, fmt.Errorf("error parsing %s: %w", handlerName, err)
+			}
+			if handlerName == "ramp_up_duration" {
+				hnd.RampUpDuration = caddy.Duration(dur)
+			} else {
+				hnd.SlowStartDuration = caddy.Duration(dur)
+			}
+		case "max_heap":
+			if !h.NextArg() {
+				return nil, h.ArgErr()
+			}
+			size, err := humanize.ParseBytes(h.Val())
+			if err != nil {
+				return nil, fmt.Errorf("error parsing max_heap: %w", err)
+			}
+			hnd.MaxHeapBytes = size
+		case "max_diff":
+			if !h.NextArg() {
+				return nil, h.ArgErr()
+			}
+			size, err := humanize.ParseBytes(h.Val())
+			if err != nil {
+				return nil, fmt.Errorf("error parsing max_diff: %w", err)
+			}
+			hnd.ReportingConfig.MaxDiffBytes = int(size)
+		case "secondary_max_body":
+			if !h.NextArg() {
+				return nil, h.ArgErr()
+			}
+			size, err := humanize.ParseBytes(h.Val())
+			if err != nil {
+				return nil, fmt.Errorf("error parsing secondary_max_body: %w", err)
+			}
+			hnd.SecondaryRequestConfig.MaxBodyBytes = int64(size)
+		case "load_governor":
+			hnd.LoadGovernor = new(LoadGovernorConfig)
+			if err := hnd.LoadGovernor.UnmarshalCaddyfile(h.NewFromNextSegment()); err != nil {
+				return nil, err
+			}
+		case "max_in_flight":
+			if !h.NextArg() {
+				return nil, h.ArgErr()
+			}
+			n, err := strconv.ParseInt(h.Val(), 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("error parsing max_in_flight: %w", err)
+			}
+			hnd.MaxInFlight = n
+		case "max_mirrored_requests_per_day", "max_mirrored_requests":
+			if !h.NextArg() {
+				return nil, h.ArgErr()
+			}
+			n, err := strconv.ParseInt(h.Val(), 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("error parsing %s: %w", handlerName, err)
+			}
+			if handlerName == "max_mirrored_requests_per_day" {
+				hnd.MaxMirroredPerDay = n
+			} else {
+				hnd.MaxMirrored = n
+			}
+		case "sampler":
+			if !h.NextArg() {
+				return nil, h.ArgErr()
+			}
+			name := h.Val()
+			unm, err := caddyfile.UnmarshalModule(h.Dispenser, "mirror.samplers."+name)
+			if err != nil {
+				return nil, fmt.Errorf("error unmarshaling sampler %s: %w", name, err)
+			}
+			hnd.SamplerRaw = caddyconfig.JSONModuleObject(unm, "sampler", name, nil)
 		case "compare_body":
 			hnd.ComparisonConfig.CompareBody = true
 		case "compare_status":
 			hnd.ComparisonConfig.CompareStatus = true
+		case "compare_events":
+			hnd.ComparisonConfig.CompareEvents = true
+		case "on_primary_error":
+			if !h.NextArg() {
+				return nil, h.ArgErr()
+			}
+			hnd.ComparisonConfig.OnPrimaryError = h.Val()
+		case "decompress":
+			hnd.ComparisonConfig.Decompress = true
+		case "identity_encoding":
+			if !h.NextArg() {
+				return nil, h.ArgErr()
+			}
+			hnd.ComparisonConfig.IdentityEncoding = h.Val()
+		case "skip_disconnected":
+			hnd.ComparisonConfig.SkipDisconnected = true
+		case "exclude_secondary_errors":
+			hnd.ComparisonConfig.ExcludeSecondaryErrors = true
 		case "compare_headers":
 			hnd.ComparisonConfig.CompareHeaders = h.RemainingArgs()
+		case "compare_upload_fields":
+			hnd.ComparisonConfig.CompareUploadFields = h.RemainingArgs()
+		case "compare_latency":
+			hnd.ComparisonConfig.CompareLatency = new(LatencyComparer)
+			if err := hnd.ComparisonConfig.CompareLatency.UnmarshalCaddyfile(h.NewFromNextSegment()); err != nil {
+				return nil, err
+			}
+		case "classify":
+			var rule ClassifyRule
+			if err := rule.UnmarshalCaddyfile(h.NewFromNextSegment()); err != nil {
+				return nil, err
+			}
+			hnd.ComparisonConfig.Classify = append(hnd.ComparisonConfig.Classify, rule)
+		case "compare_by_status":
+			seg := h.NewFromNextSegment()
+			seg.Next() // consume "compare_by_status"
+			for seg.NextBlock(0) {
+				status, comparers := seg.Val(), seg.RemainingArgs()
+				if len(comparers) == 0 {
+					return nil, seg.ArgErr()
+				}
+				if len(comparers) == 1 && comparers[0] == "skip" {
+					comparers = []string{}
+				}
+				if hnd.ComparisonConfig.CompareByStatus == nil {
+					hnd.ComparisonConfig.CompareByStatus = make(map[string][]string)
+				}
+				hnd.ComparisonConfig.CompareByStatus[status] = comparers
+			}
+		case "match_require":
+			hnd.ComparisonConfig.MatchRequire = append(hnd.ComparisonConfig.MatchRequire, h.RemainingArgs()...)
+		case "match_advisory":
+			hnd.ComparisonConfig.MatchAdvisory = append(hnd.ComparisonConfig.MatchAdvisory, h.RemainingArgs()...)
+		case "secondary_header_allow":
+			hnd.SecondaryRequestConfig.HeaderAllow = append(hnd.SecondaryRequestConfig.HeaderAllow, h.RemainingArgs()...)
+		case "secondary_header_deny":
+			hnd.SecondaryRequestConfig.HeaderDeny = append(hnd.SecondaryRequestConfig.HeaderDeny, h.RemainingArgs()...)
+		case "secondary_host":
+			if !h.NextArg() {
+				return nil, h.ArgErr()
+			}
+			hnd.SecondaryRequestConfig.Host = h.Val()
+		case "secondary_vars":
+			args := h.RemainingArgs()
+			if len(args) != 2 {
+				return nil, fmt.Errorf("secondary_vars requires a name and a value")
+			}
+			if hnd.SecondaryRequestConfig.Vars == nil {
+				hnd.SecondaryRequestConfig.Vars = make(map[string]string)
+			}
+			hnd.SecondaryRequestConfig.Vars[args[0]] = args[1]
+		case "secondary_body_jq", "secondary_body_template":
+			opt := h.Val()
+			if !h.NextArg() {
+				return nil, h.ArgErr()
+			}
+			if opt == "secondary_body_jq" {
+				hnd.SecondaryRequestConfig.BodyJQ = JQQuery(h.Val())
+			} else {
+				hnd.SecondaryRequestConfig.BodyTemplate = h.Val()
+			}
+		case "secondary_delay":
+			args := h.RemainingArgs()
+			if len(args) < 1 || len(args) > 2 {
+				return nil, fmt.Errorf("secondary_delay requires a delay, and optionally a jitter")
+			}
+			durs := make([]caddy.Duration, len(args))
+			for i, arg := range args {
+				dur, err := caddy.ParseDuration(arg)
+				if err != nil {
+					return nil, fmt.Errorf("error parsing secondary_delay: %w", err)
+				}
+				durs[i] = caddy.Duration(dur)
+			}
+			hnd.SecondaryRequestConfig.Delay = durs[0]
+			if len(durs) == 2 {
+				hnd.SecondaryRequestConfig.DelayJitter = durs[1]
+			}
+		case "secondary_retry":
+			hnd.SecondaryRequestConfig.Retry = new(RetryPolicy)
+			if err := hnd.SecondaryRequestConfig.Retry.UnmarshalCaddyfile(h.NewFromNextSegment()); err != nil {
+				return nil, err
+			}
+		case "secondary_amplify":
+			hnd.SecondaryRequestConfig.Amplify = new(AmplifyConfig)
+			if err := hnd.SecondaryRequestConfig.Amplify.UnmarshalCaddyfile(h.NewFromNextSegment()); err != nil {
+				return nil, err
+			}
+		case "secondary_strip_credentials":
+			hnd.SecondaryRequestConfig.StripCredentials = true
+		case "secondary_authorization", "secondary_cookie":
+			opt := h.Val()
+			if !h.NextArg() {
+				return nil, h.ArgErr()
+			}
+			if opt == "secondary_authorization" {
+				hnd.SecondaryRequestConfig.Authorization = h.Val()
+			} else {
+				hnd.SecondaryRequestConfig.Cookie = h.Val()
+			}
+		case "secondary_query":
+			// Like the header directive: "name value" sets, "+name value" adds, and "-name" deletes
+			args := h.RemainingArgs()
+			if len(args) < 1 {
+				return nil, h.ArgErr()
+			}
+			if hnd.SecondaryRequestConfig.Query == nil {
+				hnd.SecondaryRequestConfig.Query = new(QueryRewrite)
+			}
+			q := hnd.SecondaryRequestConfig.Query
+			switch name := args[0]; {
+			case strings.HasPrefix(name, "-") && len(args) == 1:
+				q.Delete = append(q.Delete, name[1:])
+			case strings.HasPrefix(name, "+") && len(args) == 2:
+				if q.Add == nil {
+					q.Add = make(map[string]string)
+				}
+				q.Add[name[1:]] = args[1]
+			case len(args) == 2:
+				if q.Set == nil {
+					q.Set = make(map[string]string)
+				}
+				q.Set[name] = args[1]
+			default:
+				return nil, h.ArgErr()
+			}
 		case "compare_jq":
 			args := h.RemainingArgs()
 			if len(args) < 1 {
@@ -63,8 +287,81 @@ func ParseCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error)
 			for _, qStr := range args {
 				hnd.ComparisonConfig.CompareJQ = append(hnd.ComparisonConfig.CompareJQ, JQQuery(qStr))
 			}
+		case "normalize":
+			args := h.RemainingArgs()
+			if len(args) < 1 || len(args) > 2 {
+				return nil, fmt.Errorf("normalize requires a pattern and an optional replacement")
+			}
+			rule := NormalizeRule{Pattern: args[0]}
+			if len(args) == 2 {
+				rule.Replacement = args[1]
+			}
+			hnd.ComparisonConfig.Normalize = append(hnd.ComparisonConfig.Normalize, rule)
+		case "match_similarity_threshold":
+			args := h.RemainingArgs()
+			if len(args) < 1 {
+				return nil, fmt.Errorf("match_similarity_threshold requires a threshold")
+			}
+			var err error
+			hnd.ComparisonConfig.MatchSimilarityThreshold, err = strconv.ParseFloat(args[0], 64)
+			if err != nil {
+				return nil, fmt.Errorf("error parsing match_similarity_threshold: %w", err)
+			}
+		case "comparer":
+			if !h.NextArg() {
+				return nil, h.ArgErr()
+			}
+			name := h.Val()
+			unm, err := caddyfile.UnmarshalModule(h.Dispenser, "mirror.comparers."+name)
+			if err != nil {
+				return nil, fmt.Errorf("error unmarshaling comparer %s: %w", name, err)
+			}
+			hnd.ComparersRaw = append(hnd.ComparersRaw, caddyconfig.JSONModuleObject(unm, "comparer", name, nil))
+		case "reporter":
+			if !h.NextArg() {
+				return nil, h.ArgErr()
+			}
+			name := h.Val()
+			unm, err := caddyfile.UnmarshalModule(h.Dispenser, "mirror.reporters."+name)
+			if err != nil {
+				return nil, fmt.Errorf("error unmarshaling reporter %s: %w", name, err)
+			}
+			hnd.ReportersRaw = append(hnd.ReportersRaw, caddyconfig.JSONModuleObject(unm, "reporter", name, nil))
+		case "secondary_credentials":
+			if !h.NextArg() {
+				return nil, h.ArgErr()
+			}
+			name := h.Val()
+			unm, err := caddyfile.UnmarshalModule(h.Dispenser, "mirror.credentials."+name)
+			if err != nil {
+				return nil, fmt.Errorf("error unmarshaling secondary credentials %s: %w", name, err)
+			}
+			hnd.CredentialsRaw = append(hnd.CredentialsRaw, caddyconfig.JSONModuleObject(unm, "credentials", name, nil))
 		case "no_log":
 			hnd.ReportingConfig.NoLog = true
+		case "log_status_mismatch", "log_header_mismatch", "log_body_mismatch", "log_events_mismatch",
+			"log_upload_mismatch", "log_arbiter_mismatch":
+			if !h.NextArg() {
+				return nil, h.ArgErr()
+			}
+			if hnd.ReportingConfig.MismatchLogLevels == nil {
+				hnd.ReportingConfig.MismatchLogLevels = make(map[string]LogLevel)
+			}
+			comparer := strings.TrimSuffix(strings.TrimPrefix(handlerName, "log_"), "_mismatch")
+			hnd.ReportingConfig.MismatchLogLevels[comparer] = LogLevel(h.Val())
+		case "hash_bodies":
+			hnd.ReportingConfig.HashBodies = true
+		case "omit_bodies":
+			hnd.ReportingConfig.OmitBodies = true
+		case "access_log":
+			hnd.ReportingConfig.AccessLog = true
+		case "log_matches":
+			hnd.ReportingConfig.LogMatches = true
+		case "logger":
+			if !h.NextArg() {
+				return nil, h.ArgErr()
+			}
+			hnd.ReportingConfig.Logger = h.Val()
 		case "log_level":
 			args := h.RemainingArgs()
 			if len(args) < 1 {
@@ -72,12 +369,149 @@ func ParseCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error)
 			}
 			ll := LogLevel(args[0])
 			hnd.ReportingConfig.LogLevel = &ll
+		case "name":
+			if !h.NextArg() {
+				return nil, h.ArgErr()
+			}
+			hnd.Name = h.Val()
+		case "summary_interval":
+			if !h.NextArg() {
+				return nil, h.ArgErr()
+			}
+			dur, err := caddy.ParseDuration(h.Val())
+			if err != nil {
+				return nil, fmt.Errorf("error parsing summary_interval: %w", err)
+			}
+			hnd.ReportingConfig.SummaryInterval = caddy.Duration(dur)
+		case "recent_mismatches":
+			if !h.NextArg() {
+				return nil, h.ArgErr()
+			}
+			n, err := strconv.Atoi(h.Val())
+			if err != nil {
+				return nil, fmt.Errorf("error parsing recent_mismatches: %w", err)
+			}
+			hnd.ReportingConfig.RecentMismatches = n
 		case "metrics":
 			args := h.RemainingArgs()
 			if len(args) < 1 {
 				return nil, fmt.Errorf("metrics requires a prefix/namespace")
 			}
 			hnd.MetricsName = args[0]
+		case "alerts":
+			hnd.Alerts = new(AlertConfig)
+			if err := hnd.Alerts.UnmarshalCaddyfile(h.NewFromNextSegment()); err != nil {
+				return nil, err
+			}
+		case "scorecard":
+			hnd.Scorecard = new(ScorecardConfig)
+			if err := hnd.Scorecard.UnmarshalCaddyfile(h.NewFromNextSegment()); err != nil {
+				return nil, err
+			}
+		case "error_budget":
+			hnd.ErrorBudget = new(ErrorBudgetConfig)
+			if err := hnd.ErrorBudget.UnmarshalCaddyfile(h.NewFromNextSegment()); err != nil {
+				return nil, err
+			}
+		case "artifacts":
+			hnd.Artifacts = new(ArtifactsConfig)
+			if err := hnd.Artifacts.UnmarshalCaddyfile(h.NewFromNextSegment()); err != nil {
+				return nil, err
+			}
+		case "slo":
+			hnd.SLO = new(SLOConfig)
+			if err := hnd.SLO.UnmarshalCaddyfile(h.NewFromNextSegment()); err != nil {
+				return nil, err
+			}
+		case "worker_pool":
+			hnd.WorkerPool = new(WorkerPoolConfig)
+			if err := hnd.WorkerPool.UnmarshalCaddyfile(h.NewFromNextSegment()); err != nil {
+				return nil, err
+			}
+		case "tenant":
+			hnd.Tenant = new(TenantConfig)
+			if err := hnd.Tenant.UnmarshalCaddyfile(h.NewFromNextSegment()); err != nil {
+				return nil, err
+			}
+		case "dedupe":
+			hnd.Dedupe = new(DedupeConfig)
+			if err := hnd.Dedupe.UnmarshalCaddyfile(h.NewFromNextSegment()); err != nil {
+				return nil, err
+			}
+		case "sampling_seed":
+			if !h.NextArg() {
+				return nil, h.ArgErr()
+			}
+			seed, err := strconv.ParseUint(h.Val(), 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("error parsing sampling_seed: %w", err)
+			}
+			hnd.SamplingSeed = seed
+		case "sampling_key":
+			if !h.NextArg() {
+				return nil, h.ArgErr()
+			}
+			hnd.SamplingKey = h.Val()
+		case "exclude":
+			if hnd.Exclude == nil {
+				hnd.Exclude = new(ExcludeConfig)
+			}
+			if err := hnd.Exclude.UnmarshalCaddyfile(h.NewFromNextSegment()); err != nil {
+				return nil, err
+			}
+		case "health_check":
+			hnd.HealthCheck = new(HealthCheckConfig)
+			if err := hnd.HealthCheck.UnmarshalCaddyfile(h.NewFromNextSegment()); err != nil {
+				return nil, err
+			}
+		case "metrics_label":
+			args := h.RemainingArgs()
+			if len(args) < 1 || len(args) > 2 {
+				return nil, fmt.Errorf("metrics_label requires a placeholder, and optionally a limit")
+			}
+			hnd.MetricsLabel = args[0]
+			if len(args) == 2 {
+				limit, err := strconv.Atoi(args[1])
+				if err != nil {
+					return nil, fmt.Errorf("error parsing metrics_label limit: %w", err)
+				}
+				hnd.MetricsLabelLimit = limit
+			}
+		case "match_rate_window":
+			if !h.NextArg() {
+				return nil, h.ArgErr()
+			}
+			dur, err := caddy.ParseDuration(h.Val())
+			if err != nil {
+				return nil, fmt.Errorf("error parsing match_rate_window: %w", err)
+			}
+			hnd.MatchRateWindow = caddy.Duration(dur)
+		case "secondary_context":
+			if !h.NextArg() {
+				return nil, h.ArgErr()
+			}
+			hnd.SecondaryRequestConfig.Context = h.Val()
+		case "secondary_next":
+			if !h.NextArg() {
+				return nil, h.ArgErr()
+			}
+			hnd.SecondaryRequestConfig.Next = h.Val()
+		case "websocket":
+			if !h.NextArg() {
+				return nil, h.ArgErr()
+			}
+			hnd.SecondaryRequestConfig.WebSocket = h.Val()
+		case "primary_timeout":
+			if !h.NextArg() {
+				return nil, h.ArgErr()
+			}
+			dur, err := caddy.ParseDuration(h.Val())
+			if err != nil {
+				return nil, fmt.Errorf("error parsing primary_timeout: %w", err)
+			}
+			hnd.PrimaryTimeout = caddy.Duration(dur)
+		case "synchronous":
+			hnd.Synchronous = true
 		case "secondary_timeout":
 			args := h.RemainingArgs()
 			if len(args) < 1 {
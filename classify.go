@@ -0,0 +1,159 @@
+package mirror
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"slices"
+	"strconv"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/itchyny/gojq"
+)
+
+var _ caddyfile.Unmarshaler = (*ClassifyRule)(nil)
+
+// uncategorized is the category of mismatches which no rule matched, in metrics
+const uncategorized = "uncategorized"
+
+// ClassifyRule tags mismatches with a category, like a known issue or a source of noise, so they can be tracked apart
+// from real regressions without being hidden. A rule matches a mismatch if every condition which is set holds. Rules
+// are tried in order, and the first which matches decides the category.
+type ClassifyRule struct {
+	// Category is what matching mismatches are tagged with, in logs, reports, and metrics
+	Category string `json:"category"`
+	// PrimaryStatus and SecondaryStatus match the responses' statuses, like 200, or a class, like 5xx
+	PrimaryStatus   string `json:"primary_status,omitempty"`
+	SecondaryStatus string `json:"secondary_status,omitempty"`
+	// Header matches if the responses' values of this header differ
+	Header string `json:"header,omitempty"`
+	// JQPath is a jq path, like .meta.generated_at. It matches if the responses' JSON bodies differ at the path, and
+	// nowhere else.
+	JQPath   JQQuery `json:"jq_path,omitempty"`
+	at, rest *gojq.Query
+}
+
+func (r *ClassifyRule) provision() (err error) {
+	if r.Category == "" {
+		return fmt.Errorf("classify rule requires a category")
+	}
+	for _, status := range []string{r.PrimaryStatus, r.SecondaryStatus} {
+		if status != "" && !validStatusPattern(status) {
+			return fmt.Errorf("error parsing classify status '%s'", status)
+		}
+	}
+	if r.JQPath != "" {
+		if r.at, err = gojq.Parse(string(r.JQPath)); err != nil {
+			return fmt.Errorf("error parsing classify jq_path: %w", err)
+		}
+		if r.rest, err = gojq.Parse(fmt.Sprintf("del(%s)", r.JQPath)); err != nil {
+			return fmt.Errorf("error parsing classify jq_path: %w", err)
+		}
+	}
+	return nil
+}
+
+func (r *ClassifyRule) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume "classify"
+	if !d.NextArg() {
+		return d.ArgErr()
+	}
+	r.Category = d.Val()
+	for d.NextBlock(0) {
+		opt := d.Val()
+		args := d.RemainingArgs()
+		switch opt {
+		case "status":
+			if len(args) != 2 {
+				return d.ArgErr()
+			}
+			r.PrimaryStatus, r.SecondaryStatus = args[0], args[1]
+		case "header":
+			if len(args) != 1 {
+				return d.ArgErr()
+			}
+			r.Header = args[0]
+		case "jq_path":
+			if len(args) != 1 {
+				return d.ArgErr()
+			}
+			r.JQPath = JQQuery(args[0])
+		default:
+			return d.Errf("unrecognized classify option '%s'", opt)
+		}
+	}
+	return nil
+}
+
+// matches reports whether the rule matches a mismatched report
+func (r *ClassifyRule) matches(rep Report) bool {
+	if !statusMatches(r.PrimaryStatus, rep.Primary.Status) || !statusMatches(r.SecondaryStatus, rep.Secondary.Status) {
+		return false
+	}
+	if r.Header != "" && slices.Equal(rep.Primary.Header.Values(r.Header), rep.Secondary.Header.Values(r.Header)) {
+		return false
+	}
+	if r.at != nil && !r.onlyDiffersAt(rep.Primary, rep.Secondary) {
+		return false
+	}
+	return true
+}
+
+// onlyDiffersAt reports whether two JSON bodies differ at the rule's path, and are the same without it
+func (r *ClassifyRule) onlyDiffersAt(primary, secondary ResponseArtifact) bool {
+	if !primary.Buffered || !secondary.Buffered {
+		return false
+	}
+	var p, s any
+	if json.Unmarshal(primary.Body, &p) != nil || json.Unmarshal(secondary.Body, &s) != nil {
+		return false
+	}
+	return !reflect.DeepEqual(runJQ(r.at, p), runJQ(r.at, s)) && reflect.DeepEqual(runJQ(r.rest, p), runJQ(r.rest, s))
+}
+
+// runJQ collects every result of a query. Errors are results too, so they can be compared.
+func runJQ(q *gojq.Query, v any) []any {
+	var results []any
+	iter := q.Run(v)
+	for {
+		result, ok := iter.Next()
+		if !ok {
+			return results
+		}
+		if err, ok := result.(error); ok {
+			result = err.Error()
+		}
+		results = append(results, result)
+	}
+}
+
+// classify returns the category of the first rule which matches a mismatched report, or "" if none do
+func (c *ComparisonConfig) classify(rep Report) string {
+	for i := range c.Classify {
+		if c.Classify[i].matches(rep) {
+			return c.Classify[i].Category
+		}
+	}
+	return ""
+}
+
+// validStatusPattern reports whether s is a status, like 200, or a status class, like 5xx
+func validStatusPattern(s string) bool {
+	if len(s) == 3 && s[1:] == "xx" {
+		return s[0] >= '1' && s[0] <= '5'
+	}
+	status, err := strconv.Atoi(s)
+	return err == nil && status >= 100 && status <= 599
+}
+
+// statusMatches reports whether a status matches a pattern. An empty pattern matches any status.
+func statusMatches(pattern string, status int) bool {
+	switch {
+	case pattern == "":
+		return true
+	case len(pattern) == 3 && pattern[1:] == "xx":
+		return status/100 == int(pattern[0]-'0')
+	default:
+		return pattern == strconv.Itoa(status)
+	}
+}
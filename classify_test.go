@@ -0,0 +1,82 @@
+package mirror
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+func TestComparisonConfig_classify(t *testing.T) {
+	var c ComparisonConfig
+	for _, config := range []string{
+		`classify timestamp-noise {
+			jq_path .meta.generated_at
+		}`,
+		`classify known-issue-123 {
+			status 2xx 503
+		}`,
+		`classify cache {
+			header Cache-Control
+		}`,
+	} {
+		var rule ClassifyRule
+		if err := rule.UnmarshalCaddyfile(caddyfile.NewTestDispenser(config)); err != nil {
+			t.Fatal(err)
+		}
+		c.Classify = append(c.Classify, rule)
+	}
+	if err := c.provision(); err != nil {
+		t.Fatal(err)
+	}
+
+	body := func(s string) ResponseArtifact {
+		return ResponseArtifact{Status: 200, Body: []byte(s), Buffered: true}
+	}
+	tests := []struct {
+		name string
+		p, s ResponseArtifact
+		want string
+	}{
+		{
+			name: "only differs at the path",
+			p:    body(`{"id":1,"meta":{"generated_at":"10:00"}}`),
+			s:    body(`{"id":1,"meta":{"generated_at":"10:01"}}`),
+			want: "timestamp-noise",
+		},
+		{
+			name: "differs elsewhere too",
+			p:    body(`{"id":1,"meta":{"generated_at":"10:00"}}`),
+			s:    body(`{"id":2,"meta":{"generated_at":"10:01"}}`),
+		},
+		{
+			name: "status pair",
+			p:    ResponseArtifact{Status: 201},
+			s:    ResponseArtifact{Status: 503},
+			want: "known-issue-123",
+		},
+		{
+			name: "header",
+			p:    ResponseArtifact{Status: 200, Header: http.Header{"Cache-Control": {"no-cache"}}},
+			s:    ResponseArtifact{Status: 200, Header: http.Header{"Cache-Control": {"max-age=60"}}},
+			want: "cache",
+		},
+		{
+			name: "no rule matches",
+			p:    ResponseArtifact{Status: 200},
+			s:    ResponseArtifact{Status: 500},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := c.classify(Report{Primary: tt.p, Secondary: tt.s}); got != tt.want {
+				t.Errorf("classify() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	bad := ComparisonConfig{Classify: []ClassifyRule{{Category: "x", PrimaryStatus: "6xx"}}}
+	if err := bad.provision(); err == nil {
+		t.Errorf("provision() with an invalid status didn't fail")
+	}
+}
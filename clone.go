@@ -0,0 +1,88 @@
+package mirror
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// routeGroupCtxKey is where caddyhttp keeps the route groups a request has matched, so only one route in each group
+// handles it. It's unexported there.
+const routeGroupCtxKey = caddy.CtxKey("route_group")
+
+// deepCopyVars copies a request's vars, including any maps and slices nested in them, so the secondary's routes can
+// change them without racing with the primary's. Other values, including pointers, are shared, since they can't be
+// copied in general.
+func deepCopyVars(vars map[string]any) map[string]any {
+	if vars == nil {
+		return nil
+	}
+	return deepCopy(reflect.ValueOf(vars)).Interface().(map[string]any)
+}
+
+func deepCopy(v reflect.Value) reflect.Value {
+	switch v.Kind() {
+	case reflect.Map:
+		if v.IsNil() {
+			return v
+		}
+		c := reflect.MakeMapWithSize(v.Type(), v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			c.SetMapIndex(iter.Key(), deepCopy(iter.Value()))
+		}
+		return c
+	case reflect.Slice:
+		if v.IsNil() {
+			return v
+		}
+		c := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		switch v.Type().Elem().Kind() {
+		case reflect.Map, reflect.Slice, reflect.Interface:
+			for i := range v.Len() {
+				c.Index(i).Set(deepCopy(v.Index(i)))
+			}
+		default:
+			reflect.Copy(c, v)
+		}
+		return c
+	case reflect.Interface:
+		if v.IsNil() {
+			return v
+		}
+		c := reflect.New(v.Type()).Elem()
+		c.Set(deepCopy(v.Elem()))
+		return c
+	}
+	return v
+}
+
+// cloneReplacer gives the mirrored request its own replacer, so http.request.* placeholders in the secondary reflect
+// the mirrored request, and values set while the secondary runs, like by its matchers, don't race with the primary's.
+// Anything it doesn't have, like values the original request's matchers set, is looked up in the original replacer.
+func cloneReplacer(sr *http.Request, orig *caddy.Replacer) {
+	vars, _ := sr.Context().Value(caddyhttp.VarsCtxKey).(map[string]any)
+	startTime, uuid := vars["start_time"], vars["uuid"]
+
+	// This sets up the same http.* placeholders as Caddy's server does, except for the response's headers, since
+	// there's no response writer for the secondary yet
+	repl := caddyhttp.NewTestReplacer(sr)
+	repl.Map(func(key string) (any, bool) {
+		if strings.HasPrefix(key, "http.response.") {
+			// These would be the primary's
+			return nil, false
+		}
+		return orig.Get(key)
+	})
+
+	// The mirrored request keeps the original's start time and ID, so they can be correlated
+	if startTime != nil {
+		vars["start_time"] = startTime
+	}
+	if uuid != nil {
+		vars["uuid"] = uuid
+	}
+}
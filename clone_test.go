@@ -0,0 +1,109 @@
+package mirror
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func Test_deepCopyVars(t *testing.T) {
+	vars := map[string]any{
+		"tenant": map[string]any{"id": "a", "tags": []string{"x"}},
+		"list":   []any{map[string]string{"k": "v"}},
+		"raw":    []byte("abc"),
+		"n":      1,
+		"nil":    nil,
+	}
+	c := deepCopyVars(vars)
+
+	c["tenant"].(map[string]any)["id"] = "b"
+	c["tenant"].(map[string]any)["tags"].([]string)[0] = "y"
+	c["list"].([]any)[0].(map[string]string)["k"] = "w"
+	c["raw"].([]byte)[0] = 'z'
+
+	if id := vars["tenant"].(map[string]any)["id"]; id != "a" {
+		t.Errorf("original nested map changed: id = %v", id)
+	}
+	if tag := vars["tenant"].(map[string]any)["tags"].([]string)[0]; tag != "x" {
+		t.Errorf("original nested slice changed: tag = %v", tag)
+	}
+	if k := vars["list"].([]any)[0].(map[string]string)["k"]; k != "v" {
+		t.Errorf("original map in a slice changed: k = %v", k)
+	}
+	if raw := string(vars["raw"].([]byte)); raw != "abc" {
+		t.Errorf("original bytes changed: raw = %v", raw)
+	}
+	if c["n"] != 1 || c["nil"] != nil {
+		t.Errorf("scalars weren't copied: n = %v, nil = %v", c["n"], c["nil"])
+	}
+	if deepCopyVars(nil) != nil {
+		t.Errorf("deepCopyVars(nil) isn't nil")
+	}
+}
+
+func Test_cloneRequest_context(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/path", nil)
+	groups := map[string]struct{}{}
+	fields := new(caddyhttp.ExtraLogFields)
+	ctx := context.WithValue(r.Context(), caddyhttp.VarsCtxKey, map[string]any{"nested": map[string]any{}})
+	ctx = context.WithValue(ctx, routeGroupCtxKey, groups)
+	ctx = context.WithValue(ctx, caddyhttp.OriginalRequestCtxKey, http.Request{URL: r.URL})
+	ctx = context.WithValue(ctx, caddyhttp.ExtraLogFieldsCtxKey, fields)
+	r = r.WithContext(ctx)
+
+	sr := cloneRequest(r)
+	sctx := sr.Context()
+	sctx.Value(caddyhttp.VarsCtxKey).(map[string]any)["nested"].(map[string]any)["set"] = true
+	sctx.Value(routeGroupCtxKey).(map[string]struct{})["group"] = struct{}{}
+	sctx.Value(caddyhttp.OriginalRequestCtxKey).(http.Request).URL.Path = "/changed"
+
+	if len(ctx.Value(caddyhttp.VarsCtxKey).(map[string]any)["nested"].(map[string]any)) != 0 {
+		t.Errorf("the secondary changed the primary's nested vars")
+	}
+	if len(groups) != 0 {
+		t.Errorf("the secondary changed the primary's route groups")
+	}
+	if r.URL.Path != "/path" {
+		t.Errorf("the secondary changed the original request's URL")
+	}
+	if sctx.Value(caddyhttp.ExtraLogFieldsCtxKey).(*caddyhttp.ExtraLogFields) == fields {
+		t.Errorf("the secondary shares the primary's extra log fields")
+	}
+}
+
+func Test_cloneReplacer(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/orders?id=1", nil)
+	ctx := context.WithValue(r.Context(), caddyhttp.VarsCtxKey, make(map[string]any))
+	r = r.WithContext(context.WithValue(ctx, caddyhttp.ExtraLogFieldsCtxKey, new(caddyhttp.ExtraLogFields)))
+	repl := caddyhttp.NewTestReplacer(r)
+	repl.Set("http.regexp.order.1", "1")
+	uuid := repl.ReplaceAll("{http.request.uuid}", "")
+
+	sr := cloneRequest(r)
+	sr.URL.RawQuery = "id=1&shadow=true"
+	srepl := sr.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	if srepl == repl {
+		t.Fatalf("the mirrored request shares the original's replacer")
+	}
+	srepl.Set("http.regexp.shadow.1", "x")
+
+	tests := []struct {
+		repl        *caddy.Replacer
+		input, want string
+	}{
+		{srepl, "{http.request.uri}", "/orders?id=1&shadow=true"},
+		{repl, "{http.request.uri}", "/orders?id=1"},
+		{srepl, "{http.regexp.order.1}", "1"},
+		{srepl, "{http.request.uuid}", uuid},
+		{repl, "{http.regexp.shadow.1}", ""},
+	}
+	for _, tt := range tests {
+		if got := tt.repl.ReplaceAll(tt.input, ""); got != tt.want {
+			t.Errorf("ReplaceAll(%s) = %q, want %q", tt.input, got, tt.want)
+		}
+	}
+}
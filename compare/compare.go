@@ -0,0 +1,213 @@
+// Package compare is the comparison logic of the mirror handler, for reuse outside Caddy. Contract tests which compare
+// responses with this package get the same results the handler would for the same configuration.
+//
+// Comparisons are safe for concurrent use, and never modify the bodies or headers they're given.
+package compare
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"regexp"
+	"slices"
+
+	"github.com/itchyny/gojq"
+)
+
+// Normalizer replaces every match of Pattern with Replacement. It's useful for volatile values like UUIDs, timestamps,
+// and trace IDs which are expected to differ.
+type Normalizer struct {
+	Pattern     *regexp.Regexp
+	Replacement string
+}
+
+// NewNormalizer compiles a Normalizer
+func NewNormalizer(pattern, replacement string) (Normalizer, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return Normalizer{}, err
+	}
+	return Normalizer{Pattern: re, Replacement: replacement}, nil
+}
+
+// Apply returns bs with every match of the pattern replaced
+func (n Normalizer) Apply(bs []byte) []byte {
+	return n.Pattern.ReplaceAll(bs, []byte(n.Replacement))
+}
+
+// ParseJQ parses jq queries, for Body.JQ
+func ParseJQ(queries ...string) ([]*gojq.Query, error) {
+	if len(queries) == 0 {
+		return nil, nil
+	}
+
+	parsed := make([]*gojq.Query, len(queries))
+	for i, qStr := range queries {
+		var err error
+		parsed[i], err = gojq.Parse(qStr)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing jq query %d: %w", i, err)
+		}
+	}
+	return parsed, nil
+}
+
+// Body compares response bodies. The zero Body compares them byte for byte.
+type Body struct {
+	// JQ, if set, compares the results of these queries on the JSON bodies, instead of the whole bodies
+	JQ []*gojq.Query
+	// Normalize is applied to both bodies, in order, before they're compared
+	Normalize []Normalizer
+	// MatchSimilarityThreshold is a similarity score from 0.0 to 1.0. Bodies which don't match exactly, but score at or
+	// above the threshold, are counted as matches.
+	MatchSimilarityThreshold float64
+}
+
+// BodyResult is the outcome of comparing two bodies
+type BodyResult struct {
+	Match bool
+	// Similarity is scored from 0.0 to 1.0 if the bodies didn't match exactly, and MatchSimilarityThreshold is set.
+	// Otherwise, it's 1.
+	Similarity float64
+}
+
+// Compare compares a primary body to its secondary body
+func (b Body) Compare(primary, secondary []byte) BodyResult {
+	primaryNorm, shadowNorm := b.Normalized(primary), b.Normalized(secondary)
+
+	res := BodyResult{Similarity: 1}
+	if b.JQ != nil {
+		res.Match = JSON(b.JQ, primaryNorm, shadowNorm)
+	} else {
+		res.Match = slices.Equal(primaryNorm, shadowNorm)
+	}
+
+	if !res.Match && b.MatchSimilarityThreshold > 0 {
+		if b.JQ != nil {
+			res.Similarity = JQSimilarity(b.JQ, primaryNorm, shadowNorm)
+		} else {
+			res.Similarity = Similarity(primaryNorm, shadowNorm)
+		}
+		res.Match = res.Similarity >= b.MatchSimilarityThreshold
+	}
+
+	return res
+}
+
+// Normalized applies the Body's normalizers, in order, to a body
+func (b Body) Normalized(bs []byte) []byte {
+	for _, n := range b.Normalize {
+		bs = n.Apply(bs)
+	}
+	return bs
+}
+
+// JSON reports whether every jq query has the same results on both JSON bodies
+func JSON(queries []*gojq.Query, primaryBS, shadowBS []byte) bool {
+	for _, jq := range queries {
+		var primary, shadow any
+		_ = json.Unmarshal(primaryBS, &primary)
+		_ = json.Unmarshal(shadowBS, &shadow)
+
+		pi, si := jq.Run(primary), jq.Run(shadow)
+		// These iterators should never be nil but just to be safe...
+		// If both iterators are nil, something is REALLY unexpected, but *technically* that's a match
+		if pi == nil && si == nil {
+			continue
+		}
+		// If only one iterator is nil, something is REALLY unexpected, but *technically* that's a mismatch
+		if (pi == nil) != (si == nil) {
+			return false
+		}
+
+		for {
+			pn, pok := pi.Next()
+			sn, sok := si.Next()
+			if sok != pok {
+				// If the iterators have a different result length, that's a mismatch
+				return false
+			}
+			if !pok {
+				break
+			}
+
+			// Results may be nested objects and arrays, which aren't comparable with ==
+			if !reflect.DeepEqual(pn, sn) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// HeaderDiff is a header whose values differ between the responses. A response without the header has nil values, and
+// one with an empty header has an empty value.
+type HeaderDiff struct {
+	Name      string
+	Primary   []string
+	Secondary []string
+}
+
+// How a header's values differ, as described by HeaderDiff.Change
+const (
+	HeaderAdded     = "added"
+	HeaderRemoved   = "removed"
+	HeaderReordered = "reordered"
+	HeaderChanged   = "changed"
+)
+
+// Change is how the header differs: HeaderAdded if only the secondary has it, HeaderRemoved if only the primary does,
+// HeaderReordered if both have the same values in a different order, and HeaderChanged otherwise
+func (d HeaderDiff) Change() string {
+	switch {
+	case d.Primary == nil:
+		return HeaderAdded
+	case d.Secondary == nil:
+		return HeaderRemoved
+	case len(d.Added()) == 0 && len(d.Removed()) == 0:
+		return HeaderReordered
+	}
+	return HeaderChanged
+}
+
+// Added are the secondary's values which the primary doesn't have, in the secondary's order. A value repeated more
+// times by the secondary is added as many more times.
+func (d HeaderDiff) Added() []string {
+	return valuesMissing(d.Secondary, d.Primary)
+}
+
+// Removed are the primary's values which the secondary doesn't have, in the primary's order
+func (d HeaderDiff) Removed() []string {
+	return valuesMissing(d.Primary, d.Secondary)
+}
+
+// valuesMissing returns the values of a which aren't in b, as multisets
+func valuesMissing(a, b []string) []string {
+	counts := make(map[string]int, len(b))
+	for _, v := range b {
+		counts[v]++
+	}
+	var missing []string
+	for _, v := range a {
+		if counts[v] > 0 {
+			counts[v]--
+		} else {
+			missing = append(missing, v)
+		}
+	}
+	return missing
+}
+
+// Headers compares the values of the given headers, and returns those which differ, in the order they were given
+func Headers(primary, secondary http.Header, names ...string) []HeaderDiff {
+	var diffs []HeaderDiff
+	for _, k := range names {
+		ph, sh := primary.Values(k), secondary.Values(k)
+		if !slices.Equal(ph, sh) {
+			diffs = append(diffs, HeaderDiff{Name: k, Primary: ph, Secondary: sh})
+		}
+	}
+	return diffs
+}
@@ -0,0 +1,375 @@
+package compare
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"testing"
+)
+
+func TestJSON(t *testing.T) {
+	type args struct {
+		primaryBS []byte
+		shadowBS  []byte
+	}
+	tests := []struct {
+		name    string
+		queries []string
+		args    args
+		want    bool
+	}{
+		{
+			name:    "string match",
+			queries: []string{".greeting"},
+			args: args{
+				primaryBS: []byte(`{"greeting": "Hello, world!", "foo": "bar"}`),
+				shadowBS:  []byte(`{"greeting": "Hello, world!", "bar": "foo"}`),
+			},
+			want: true,
+		},
+		{
+			name:    "string mismatch",
+			queries: []string{".greeting"},
+			args: args{
+				primaryBS: []byte(`{"greeting": "Hello, world!"}`),
+				shadowBS:  []byte(`{"greeting": "안녕하세요!"}`),
+			},
+			want: false,
+		},
+		{
+			name:    "missing prop in secondary",
+			queries: []string{".greeting"},
+			args: args{
+				primaryBS: []byte(`{"greeting": "Hello, world!"}`),
+				shadowBS:  []byte(`{"foo": "bar"}`),
+			},
+			want: false,
+		},
+		{
+			name:    "object match",
+			queries: []string{".greetings"},
+			args: args{
+				primaryBS: []byte(`{"greetings": {"en_US": "Hello, world!"}}`),
+				shadowBS:  []byte(`{"greetings": {"en_US": "Hello, world!"}}`),
+			},
+			want: true,
+		},
+		{
+			name:    "primary object, secondary string",
+			queries: []string{".greetings"},
+			args: args{
+				primaryBS: []byte(`{"greetings": {"en_US": "Hello, world!"}}`),
+				shadowBS:  []byte(`{"greetings": "bar"`),
+			},
+			want: false,
+		},
+		{
+			name:    "object mismatch",
+			queries: []string{".greetings"},
+			args: args{
+				primaryBS: []byte(`{"greetings": {"en_US": "Hello, world!"}}`),
+				shadowBS:  []byte(`{"greetings": {"ko_KR": "안녕하세요!"}}`),
+			},
+			want: false,
+		},
+		{
+			name:    "array match",
+			queries: []string{".greetings"},
+			args: args{
+				primaryBS: []byte(`{"greetings": ["Hello, world!"]}`),
+				shadowBS:  []byte(`{"greetings": ["Hello, world!"]}`),
+			},
+			want: true,
+		},
+		{
+			name:    "array mismatch",
+			queries: []string{".greetings"},
+			args: args{
+				primaryBS: []byte(`{"greetings": ["Hello, world!", "안녕하세요!"]}`),
+				shadowBS:  []byte(`{"greetings": ["안녕하세요!"]}`),
+			},
+			want: false,
+		},
+		{
+			name:    "primary array, secondary string",
+			queries: []string{".greetings"},
+			args: args{
+				primaryBS: []byte(`{"greetings": ["Hello, world!", "안녕하세요!"]}`),
+				shadowBS:  []byte(`{"greetings": "안녕하세요!"}`),
+			},
+			want: false,
+		},
+		{
+			name:    "primary string, secondary array",
+			queries: []string{".greetings"},
+			args: args{
+				primaryBS: []byte(`{"greetings": "안녕하세요!"}`),
+				shadowBS:  []byte(`{"greetings": ["Hello, world!", "안녕하세요!"]}`),
+			},
+			want: false,
+		},
+		{
+			name:    "nested object match",
+			queries: []string{"."},
+			args: args{
+				primaryBS: []byte(`{"greetings": {"en": {"text": "Hello"}}, "tags": [{"id": 1}]}`),
+				shadowBS:  []byte(`{"tags": [{"id": 1}], "greetings": {"en": {"text": "Hello"}}}`),
+			},
+			want: true,
+		},
+		{
+			name:    "nested object mismatch",
+			queries: []string{"."},
+			args: args{
+				primaryBS: []byte(`{"greetings": {"en": {"text": "Hello"}}}`),
+				shadowBS:  []byte(`{"greetings": {"en": {"text": "Hi"}}}`),
+			},
+			want: false,
+		},
+		{
+			name:    "nested array match",
+			queries: []string{".greetings"},
+			args: args{
+				primaryBS: []byte(`{"greetings": [["Hello", "world"], {"ko": ["안녕하세요"]}]}`),
+				shadowBS:  []byte(`{"greetings": [["Hello", "world"], {"ko": ["안녕하세요"]}]}`),
+			},
+			want: true,
+		},
+		{
+			name:    "nested array mismatch",
+			queries: []string{".greetings"},
+			args: args{
+				primaryBS: []byte(`{"greetings": [["Hello", "world"]]}`),
+				shadowBS:  []byte(`{"greetings": [["world", "Hello"]]}`),
+			},
+			want: false,
+		},
+		{
+			name:    "primary string, secondary bool",
+			queries: []string{".done"},
+			args: args{
+				primaryBS: []byte(`{"done": "true"}`),
+				shadowBS:  []byte(`{"done": true}`),
+			},
+			want: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			queries, err := ParseJQ(tt.queries...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := JSON(queries, tt.args.primaryBS, tt.args.shadowBS); got != tt.want {
+				t.Errorf("JSON() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSimilarity(t *testing.T) {
+	tests := []struct {
+		name      string
+		primaryBS []byte
+		shadowBS  []byte
+		wantMin   float64
+		wantMax   float64
+	}{
+		{
+			name:      "identical json",
+			primaryBS: []byte(`{"greeting": "Hello, world!", "items": [1, 2, 3]}`),
+			shadowBS:  []byte(`{"items": [1, 2, 3], "greeting": "Hello, world!"}`),
+			wantMin:   1,
+			wantMax:   1,
+		},
+		{
+			name:      "one differing json field",
+			primaryBS: []byte(`{"a": 1, "b": 2, "c": 3, "d": 4, "e": 5, "f": 6, "g": 7, "h": 8, "i": 9, "j": 10}`),
+			shadowBS:  []byte(`{"a": 1, "b": 2, "c": 3, "d": 4, "e": 5, "f": 6, "g": 7, "h": 8, "i": 9, "j": 11}`),
+			wantMin:   0.9,
+			wantMax:   0.9,
+		},
+		{
+			name:      "completely different json",
+			primaryBS: []byte(`{"a": 1}`),
+			shadowBS:  []byte(`{"b": 2}`),
+			wantMin:   0,
+			wantMax:   0,
+		},
+		{
+			name:      "reordered json array",
+			primaryBS: []byte(`{"items": [{"id": 1, "tags": ["a", "b"]}, {"id": 2}, {"id": 3}]}`),
+			shadowBS:  []byte(`{"items": [{"id": 3}, {"id": 1, "tags": ["b", "a"]}, {"id": 2}]}`),
+			wantMin:   1,
+			wantMax:   1,
+		},
+		{
+			name:      "reordered json array with one differing element",
+			primaryBS: []byte(`[{"id": 1, "name": "a"}, {"id": 2, "name": "b"}, {"id": 3, "name": "c"}]`),
+			shadowBS:  []byte(`[{"id": 3, "name": "c"}, {"id": 2, "name": "x"}, {"id": 1, "name": "a"}]`),
+			wantMin:   0.83,
+			wantMax:   0.84,
+		},
+		{
+			name:      "json array with an extra element",
+			primaryBS: []byte(`[1, 2, 3]`),
+			shadowBS:  []byte(`[3, 4, 2, 1]`),
+			wantMin:   0.85,
+			wantMax:   0.86,
+		},
+		{
+			name:      "text with one differing word",
+			primaryBS: []byte("the quick brown fox jumps"),
+			shadowBS:  []byte("the quick brown cat jumps"),
+			wantMin:   0.8,
+			wantMax:   0.8,
+		},
+		{
+			name:      "empty bodies",
+			primaryBS: []byte{},
+			shadowBS:  []byte{},
+			wantMin:   1,
+			wantMax:   1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Similarity(tt.primaryBS, tt.shadowBS); got < tt.wantMin || got > tt.wantMax {
+				t.Errorf("Similarity() = %v, want between %v and %v", got, tt.wantMin, tt.wantMax)
+			}
+		})
+	}
+}
+
+func TestJSONPatch(t *testing.T) {
+	tests := []struct {
+		name      string
+		primaryBS string
+		shadowBS  string
+		want      string
+	}{
+		{"identical", `{"a": 1, "b": [1, 2]}`, `{"b": [1, 2], "a": 1}`, `[]`},
+		{"replaced value", `{"a": {"b": 1}}`, `{"a": {"b": 2}}`, `[{"op":"replace","path":"/a/b","value":2}]`},
+		{"replaced with null", `{"a": 1}`, `{"a": null}`, `[{"op":"replace","path":"/a","value":null}]`},
+		{"added and removed keys", `{"a": 1, "b": 2}`, `{"b": 2, "c": [3]}`, `[{"op":"remove","path":"/a"},{"op":"add","path":"/c","value":[3]}]`},
+		{"escaped keys", `{"a/b": 1, "c~d": 1}`, `{"a/b": 2}`, `[{"op":"replace","path":"/a~1b","value":2},{"op":"remove","path":"/c~0d"}]`},
+		{"shorter array", `[1, 2, 3]`, `[1]`, `[{"op":"remove","path":"/2"},{"op":"remove","path":"/1"}]`},
+		{"longer array", `[1]`, `[2, 3]`, `[{"op":"replace","path":"/0","value":2},{"op":"add","path":"/1","value":3}]`},
+		{"different types", `{"a": [1]}`, `{"a": {"0": 1}}`, `[{"op":"replace","path":"/a","value":{"0":1}}]`},
+		{"replaced document", `1`, `"one"`, `[{"op":"replace","path":"","value":"one"}]`},
+		{"not json", `{"a": 1}`, `not json`, `null`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := json.Marshal(JSONPatch([]byte(tt.primaryBS), []byte(tt.shadowBS)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("JSONPatch() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBody_JSONPatch(t *testing.T) {
+	uuid, err := NewNormalizer(`[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}`, "<uuid>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	total, err := ParseJQ(".total")
+	if err != nil {
+		t.Fatal(err)
+	}
+	primary := []byte(`{"id": "2b1c7e64-5f0a-4f4e-9d1e-0c7a3b8e9f10", "name": "foo", "total": 1}`)
+	shadow := []byte(`{"id": "9a7d1f3c-2e4b-4c6d-8f0a-1b2c3d4e5f60", "name": "bar", "total": 2}`)
+
+	tests := []struct {
+		name string
+		body Body
+		want string
+	}{
+		{"whole bodies", Body{}, `[{"op":"replace","path":"/id","value":"9a7d1f3c-2e4b-4c6d-8f0a-1b2c3d4e5f60"},{"op":"replace","path":"/name","value":"bar"},{"op":"replace","path":"/total","value":2}]`},
+		{"normalized", Body{Normalize: []Normalizer{uuid}}, `[{"op":"replace","path":"/name","value":"bar"},{"op":"replace","path":"/total","value":2}]`},
+		{"jq results", Body{JQ: total}, `[{"op":"replace","path":"/0","value":2}]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := json.Marshal(tt.body.JSONPatch(primary, shadow))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("JSONPatch() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+
+	if patch := (Body{JQ: total}).JSONPatch(primary, []byte("not json")); patch != nil {
+		t.Errorf("JSONPatch() = %v, want nil for a body which isn't JSON", patch)
+	}
+}
+
+func TestBody_Compare(t *testing.T) {
+	uuid, err := NewNormalizer(`[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}`, "<uuid>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := Body{Normalize: []Normalizer{uuid}}
+
+	res := b.Compare(
+		[]byte(`{"id": "2b1c7e64-5f0a-4f4e-9d1e-0c7a3b8e9f10", "name": "foo"}`),
+		[]byte(`{"id": "9a7d1f3c-2e4b-4c6d-8f0a-1b2c3d4e5f60", "name": "foo"}`),
+	)
+	if !res.Match || res.Similarity != 1 {
+		t.Errorf("Compare() = %+v, want a match with similarity 1", res)
+	}
+
+	b.MatchSimilarityThreshold = 0.8
+	res = b.Compare([]byte("the quick brown fox jumps"), []byte("the quick brown cat jumps"))
+	if !res.Match || res.Similarity != 0.8 {
+		t.Errorf("Compare() = %+v, want a match with similarity 0.8", res)
+	}
+}
+
+func TestHeaders(t *testing.T) {
+	primary := http.Header{"Content-Type": {"application/json"}, "Etag": {"a"}}
+	secondary := http.Header{"Content-Type": {"application/json"}, "Etag": {"b"}}
+
+	diffs := Headers(primary, secondary, "Content-Type", "ETag")
+	if len(diffs) != 1 || diffs[0].Name != "ETag" || diffs[0].Primary[0] != "a" || diffs[0].Secondary[0] != "b" {
+		t.Errorf("Headers() = %+v, want only ETag to differ", diffs)
+	}
+}
+
+func TestHeaderDiff(t *testing.T) {
+	tests := []struct {
+		name        string
+		primary     []string
+		secondary   []string
+		wantChange  string
+		wantAdded   []string
+		wantRemoved []string
+	}{
+		{"added", nil, []string{"a"}, HeaderAdded, []string{"a"}, nil},
+		{"removed", []string{"a"}, nil, HeaderRemoved, nil, []string{"a"}},
+		{"emptied", []string{"a"}, []string{""}, HeaderChanged, []string{""}, []string{"a"}},
+		{"added empty", nil, []string{""}, HeaderAdded, []string{""}, nil},
+		{"reordered", []string{"a", "b"}, []string{"b", "a"}, HeaderReordered, nil, nil},
+		{"changed", []string{"a", "b", "b"}, []string{"b", "c"}, HeaderChanged, []string{"c"}, []string{"a", "b"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := HeaderDiff{Name: "Vary", Primary: tt.primary, Secondary: tt.secondary}
+			if got := d.Change(); got != tt.wantChange {
+				t.Errorf("Change() = %s, want %s", got, tt.wantChange)
+			}
+			if got := d.Added(); !slices.Equal(got, tt.wantAdded) {
+				t.Errorf("Added() = %q, want %q", got, tt.wantAdded)
+			}
+			if got := d.Removed(); !slices.Equal(got, tt.wantRemoved) {
+				t.Errorf("Removed() = %q, want %q", got, tt.wantRemoved)
+			}
+		})
+	}
+}
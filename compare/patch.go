@@ -0,0 +1,123 @@
+package compare
+
+import (
+	"encoding/json"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// PatchOperation is an operation of a JSON Patch, as described by RFC 6902
+type PatchOperation struct {
+	// Op is add, remove, or replace
+	Op string `json:"op"`
+	// Path is a JSON Pointer, as described by RFC 6901
+	Path string `json:"path"`
+	// Value is the value added or replaced with. It's omitted for removals.
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// JSONPatch returns a JSON Patch which turns the primary's JSON body into the secondary's, or nil if either isn't JSON.
+// Objects are patched key by key, and arrays index by index, so a change to one value is a single replace operation.
+// Array elements past the end of the shorter array are added or removed from the end.
+func JSONPatch(primaryBS, shadowBS []byte) []PatchOperation {
+	var primary, shadow any
+	if json.Unmarshal(primaryBS, &primary) != nil || json.Unmarshal(shadowBS, &shadow) != nil {
+		return nil
+	}
+
+	return jsonPatch(primary, shadow)
+}
+
+// JSONPatch returns a JSON Patch between the documents the Body compares, so values it ignores aren't in it: both
+// bodies after normalization, or with JQ, the arrays of its queries' results, like JQSimilarity scores. It's nil if
+// either body isn't JSON.
+func (b Body) JSONPatch(primary, secondary []byte) []PatchOperation {
+	p, s, ok := b.documents(primary, secondary)
+	if !ok {
+		return nil
+	}
+	return jsonPatch(p, s)
+}
+
+// documents decodes the documents the Body compares, reporting whether both bodies are JSON
+func (b Body) documents(primaryBS, shadowBS []byte) (primary, shadow any, ok bool) {
+	primaryBS, shadowBS = b.Normalized(primaryBS), b.Normalized(shadowBS)
+	if b.JQ != nil {
+		if !json.Valid(primaryBS) || !json.Valid(shadowBS) {
+			return nil, nil, false
+		}
+		return jqResults(b.JQ, primaryBS), jqResults(b.JQ, shadowBS), true
+	}
+	if json.Unmarshal(primaryBS, &primary) != nil || json.Unmarshal(shadowBS, &shadow) != nil {
+		return nil, nil, false
+	}
+	return primary, shadow, true
+}
+
+func jsonPatch(primary, shadow any) []PatchOperation {
+	patch := []PatchOperation{}
+	diffJSON("", primary, shadow, &patch)
+	return patch
+}
+
+func diffJSON(path string, primary, shadow any, patch *[]PatchOperation) {
+	switch p := primary.(type) {
+	case map[string]any:
+		if s, ok := shadow.(map[string]any); ok {
+			keys := make([]string, 0, len(p)+len(s))
+			for k := range p {
+				keys = append(keys, k)
+			}
+			for k := range s {
+				if _, ok := p[k]; !ok {
+					keys = append(keys, k)
+				}
+			}
+			slices.Sort(keys)
+			for _, k := range keys {
+				pv, inPrimary := p[k]
+				sv, inShadow := s[k]
+				child := path + "/" + escapePointer(k)
+				switch {
+				case !inShadow:
+					*patch = append(*patch, PatchOperation{Op: "remove", Path: child})
+				case !inPrimary:
+					*patch = append(*patch, PatchOperation{Op: "add", Path: child, Value: marshalValue(sv)})
+				default:
+					diffJSON(child, pv, sv, patch)
+				}
+			}
+			return
+		}
+	case []any:
+		if s, ok := shadow.([]any); ok {
+			for i := range min(len(p), len(s)) {
+				diffJSON(path+"/"+strconv.Itoa(i), p[i], s[i], patch)
+			}
+			// Removals go from the end, so each index is still valid when it's applied
+			for i := len(p) - 1; i >= len(s); i-- {
+				*patch = append(*patch, PatchOperation{Op: "remove", Path: path + "/" + strconv.Itoa(i)})
+			}
+			for i := len(p); i < len(s); i++ {
+				*patch = append(*patch, PatchOperation{Op: "add", Path: path + "/" + strconv.Itoa(i), Value: marshalValue(s[i])})
+			}
+			return
+		}
+	}
+
+	if !reflect.DeepEqual(primary, shadow) {
+		*patch = append(*patch, PatchOperation{Op: "replace", Path: path, Value: marshalValue(shadow)})
+	}
+}
+
+// escapePointer escapes an object key as a JSON Pointer reference token
+func escapePointer(key string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(key)
+}
+
+func marshalValue(v any) json.RawMessage {
+	bs, _ := json.Marshal(v)
+	return bs
+}
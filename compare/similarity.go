@@ -0,0 +1,227 @@
+package compare
+
+import (
+	"bytes"
+	"encoding/json"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/itchyny/gojq"
+)
+
+// Similarity scores how alike two response bodies are on a 0.0 to 1.0 scale, where 1.0 is identical.
+//
+// If both bodies are valid JSON, the score is the Dice coefficient of their flattened leaf values, so a single differing
+// field in a large document only costs a tiny fraction of the score. Array elements are matched regardless of their
+// order, so a reordered array scores as identical. Otherwise, the bodies are treated as text and the
+// score is the Dice coefficient of their whitespace-separated tokens.
+func Similarity(primaryBS, shadowBS []byte) float64 {
+	var primary, shadow any
+	if json.Unmarshal(primaryBS, &primary) == nil && json.Unmarshal(shadowBS, &shadow) == nil {
+		return jsonSimilarity(primary, shadow)
+	}
+
+	return dice(tokenCounts(primaryBS), tokenCounts(shadowBS))
+}
+
+// JQSimilarity scores the similarity of the results of the given jq queries, rather than the whole bodies
+func JQSimilarity(queries []*gojq.Query, primaryBS, shadowBS []byte) float64 {
+	return jsonSimilarity(jqResults(queries, primaryBS), jqResults(queries, shadowBS))
+}
+
+func jqResults(queries []*gojq.Query, bs []byte) []any {
+	var v any
+	_ = json.Unmarshal(bs, &v)
+
+	results := make([]any, 0, len(queries))
+	for _, jq := range queries {
+		iter := jq.Run(v)
+		for {
+			r, ok := iter.Next()
+			if !ok {
+				break
+			}
+			if _, isErr := r.(error); isErr {
+				r = nil
+			}
+			results = append(results, r)
+		}
+	}
+
+	return results
+}
+
+// maxAlignments caps how many pairs of elements are scored when aligning two arrays, since each pair is scored against
+// every other. Past it, the elements which aren't identical are paired in order.
+const maxAlignments = 10000
+
+func jsonSimilarity(primary, shadow any) float64 {
+	pLeaves, sLeaves := make(map[string]int), make(map[string]int)
+	flatten("", primary, pLeaves)
+	flatten("", align(primary, shadow), sLeaves)
+	return dice(pLeaves, sLeaves)
+}
+
+// align returns the shadow value with the elements of its arrays moved under the indexes of the primary's elements they
+// best match, so that reordering an array doesn't change its leaves' paths. Aligned arrays are returned as objects keyed
+// by index, which flatten the same way as arrays.
+func align(primary, shadow any) any {
+	switch p := primary.(type) {
+	case map[string]any:
+		s, ok := shadow.(map[string]any)
+		if !ok {
+			return shadow
+		}
+		aligned := make(map[string]any, len(s))
+		for k, v := range s {
+			if pv, ok := p[k]; ok {
+				v = align(pv, v)
+			}
+			aligned[k] = v
+		}
+		return aligned
+	case []any:
+		s, ok := shadow.([]any)
+		if !ok || len(s) == 0 {
+			return shadow
+		}
+		return alignElements(p, s)
+	default:
+		return shadow
+	}
+}
+
+// alignElements pairs each shadow element with a primary element. Identical elements are paired first, then each
+// remaining primary element is paired with the most similar remaining shadow element. Shadow elements left over are
+// placed after the primary's.
+func alignElements(primary, shadow []any) map[string]any {
+	aligned := make(map[string]any, len(shadow))
+	paired := make([]bool, len(primary))
+	used := make([]bool, len(shadow))
+
+	identical := make(map[string][]int)
+	for j, v := range shadow {
+		bs, _ := json.Marshal(v)
+		identical[string(bs)] = append(identical[string(bs)], j)
+	}
+	for i, v := range primary {
+		bs, _ := json.Marshal(v)
+		if js := identical[string(bs)]; len(js) > 0 {
+			aligned[strconv.Itoa(i)] = shadow[js[0]]
+			identical[string(bs)] = js[1:]
+			paired[i], used[js[0]] = true, true
+		}
+	}
+
+	var pRest, sRest []int
+	for i := range primary {
+		if !paired[i] {
+			pRest = append(pRest, i)
+		}
+	}
+	for j := range shadow {
+		if !used[j] {
+			sRest = append(sRest, j)
+		}
+	}
+	bestMatch := len(pRest)*len(sRest) <= maxAlignments
+	for _, i := range pRest {
+		if len(sRest) == 0 {
+			break
+		}
+		best, bestScore := 0, -1.0
+		for k := 0; bestMatch && k < len(sRest); k++ {
+			if score := jsonSimilarity(primary[i], shadow[sRest[k]]); score > bestScore {
+				best, bestScore = k, score
+			}
+		}
+		aligned[strconv.Itoa(i)] = align(primary[i], shadow[sRest[best]])
+		sRest = slices.Delete(sRest, best, best+1)
+	}
+	for k, j := range sRest {
+		aligned[strconv.Itoa(len(primary)+k)] = shadow[j]
+	}
+	return aligned
+}
+
+// flatten walks a decoded JSON value and counts each leaf as a "path=value" key, so that leaves only match if both the
+// location and the value are the same.
+func flatten(path string, v any, leaves map[string]int) {
+	switch v := v.(type) {
+	case map[string]any:
+		if len(v) == 0 {
+			leaves[path+"={}"]++
+		}
+		for k, child := range v {
+			flatten(path+"/"+k, child, leaves)
+		}
+	case []any:
+		if len(v) == 0 {
+			leaves[path+"=[]"]++
+		}
+		for i, child := range v {
+			flatten(path+"/"+strconv.Itoa(i), child, leaves)
+		}
+	default:
+		bs, _ := json.Marshal(v)
+		leaves[path+"="+string(bs)]++
+	}
+}
+
+func tokenCounts(bs []byte) map[string]int {
+	counts := make(map[string]int)
+	for _, tok := range bytes.Fields(bs) {
+		counts[string(tok)]++
+	}
+	return counts
+}
+
+// dice computes the Sørensen–Dice coefficient of two multisets
+func dice(a, b map[string]int) float64 {
+	var total, common int
+	for k, n := range a {
+		total += n
+		common += min(n, b[k])
+	}
+	for _, n := range b {
+		total += n
+	}
+
+	if total == 0 { // Two empty bodies are identical
+		return 1
+	}
+
+	return float64(2*common) / float64(total)
+}
+
+// DiffPaths returns the sorted paths of every JSON leaf which differs between two bodies, or nil if either isn't JSON
+func DiffPaths(primaryBS, shadowBS []byte) []string {
+	var primary, shadow any
+	if json.Unmarshal(primaryBS, &primary) != nil || json.Unmarshal(shadowBS, &shadow) != nil {
+		return nil
+	}
+
+	pLeaves, sLeaves := make(map[string]int), make(map[string]int)
+	flatten("", primary, pLeaves)
+	flatten("", shadow, sLeaves)
+
+	diff := make(map[string]struct{})
+	addDiff := func(leaves, other map[string]int) {
+		for leaf, n := range leaves {
+			if other[leaf] != n {
+				path, _, _ := strings.Cut(leaf, "=")
+				diff[path] = struct{}{}
+			}
+		}
+	}
+	addDiff(pLeaves, sLeaves)
+	addDiff(sLeaves, pLeaves)
+
+	paths := make([]string, 0, len(diff))
+	for path := range diff {
+		paths = append(paths, path)
+	}
+	slices.Sort(paths)
+	return paths
+}
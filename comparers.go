@@ -0,0 +1,280 @@
+package mirror
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+
+	"github.com/itchyny/gojq"
+
+	"github.com/dotvezz/caddy-mirror/compare"
+)
+
+var (
+	_ Comparer              = StatusComparer{}
+	_ Comparer              = HeaderComparer{}
+	_ Comparer              = (*BodyComparer)(nil)
+	_ caddy.Provisioner     = (*BodyComparer)(nil)
+	_ caddyfile.Unmarshaler = (*StatusComparer)(nil)
+	_ caddyfile.Unmarshaler = (*HeaderComparer)(nil)
+	_ caddyfile.Unmarshaler = (*BodyComparer)(nil)
+)
+
+func init() {
+	caddy.RegisterModule(StatusComparer{})
+	caddy.RegisterModule(HeaderComparer{})
+	caddy.RegisterModule(BodyComparer{})
+}
+
+// ResponseArtifact is a response from the primary or secondary handler, as captured for comparison
+type ResponseArtifact struct {
+	Status int         `json:"status"`
+	Header http.Header `json:"headers"`
+	// Body is only set if the response was buffered. Compressed and non-2xx responses usually aren't buffered. With
+	// decompress, Body is the decompressed body, though Header still has its Content-Encoding.
+	Body     []byte `json:"body"`
+	Buffered bool   `json:"buffered"`
+	// Error is the error the handler returned, if any. If the handler hadn't written a status, Status is the one Caddy
+	// responds to the error with.
+	Error string `json:"error,omitempty"`
+	// Events and EventsHash are the number of events in a Server-Sent Events response, and a hash of them. They're only
+	// set for event streams.
+	Events     int    `json:"events,omitempty"`
+	EventsHash string `json:"events_hash,omitempty"`
+	// Duration is how long the handler took to respond
+	Duration time.Duration `json:"duration,omitempty"`
+}
+
+// Result is the outcome of a single Comparer
+type Result struct {
+	// Comparer is a short name for what was compared, like "status" or "body". Mismatches are logged as
+	// "shadow_mismatch", with it as the comparer attribute.
+	Comparer string
+	Match    bool
+	// Skipped results are neither matches nor mismatches. For example, bodies can't be compared if they weren't buffered.
+	Skipped bool
+	// Advisory results are reported, but don't decide whether the report matches. They're set by the handler's
+	// match_require and match_advisory.
+	Advisory bool
+	// Attrs describe the mismatch, and are included in the mismatch log
+	Attrs []slog.Attr
+}
+
+// Comparer compares a primary response to its secondary response. Comparers are loaded from the mirror.comparers
+// namespace, so custom comparison logic can be shipped as a Caddy plugin.
+//
+// Compare is called after both handlers have finished, from a goroutine separate from the request. It must be safe for
+// concurrent use, and must not modify either ResponseArtifact.
+type Comparer interface {
+	Compare(primary, secondary ResponseArtifact) Result
+}
+
+// StatusComparer compares response status codes
+type StatusComparer struct{}
+
+func (StatusComparer) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "mirror.comparers.status",
+		New: func() caddy.Module { return new(StatusComparer) },
+	}
+}
+
+func (StatusComparer) Compare(primary, secondary ResponseArtifact) Result {
+	return Result{
+		Comparer: "status",
+		Match:    primary.Status == secondary.Status,
+		Attrs: []slog.Attr{
+			slog.Int("primary_status", primary.Status),
+			slog.Int("shadow_status", secondary.Status),
+		},
+	}
+}
+
+func (*StatusComparer) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume comparer name
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	return nil
+}
+
+// HeaderComparer compares the values of the given response headers
+type HeaderComparer struct {
+	// Headers are the names of the headers which are compared
+	Headers []string `json:"headers,omitempty"`
+}
+
+func (HeaderComparer) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "mirror.comparers.header",
+		New: func() caddy.Module { return new(HeaderComparer) },
+	}
+}
+
+func (c HeaderComparer) Compare(primary, secondary ResponseArtifact) Result {
+	res := Result{
+		Comparer: "header",
+		Match:    true,
+	}
+	for _, diff := range compare.Headers(primary.Header, secondary.Header, c.Headers...) {
+		res.Match = false
+		attrs := []any{
+			slog.String("change", diff.Change()),
+			slog.Any("primary_values", diff.Primary),
+			slog.Any("shadow_values", diff.Secondary),
+		}
+		if added := diff.Added(); len(added) > 0 {
+			attrs = append(attrs, slog.Any("added_values", added))
+		}
+		if removed := diff.Removed(); len(removed) > 0 {
+			attrs = append(attrs, slog.Any("removed_values", removed))
+		}
+		res.Attrs = append(res.Attrs, slog.Group(diff.Name, attrs...))
+	}
+	return res
+}
+
+func (c *HeaderComparer) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume comparer name
+	c.Headers = d.RemainingArgs()
+	if len(c.Headers) < 1 {
+		return d.Err("header comparer requires at least one header name")
+	}
+	return nil
+}
+
+// BodyComparer compares response bodies, either in full or selectively with jq queries
+type BodyComparer struct {
+	// JQ, if set, compares JSON bodies by the results of these queries, instead of in full
+	JQ []JQQuery `json:"jq,omitempty"`
+	// Normalize rewrites both bodies, in order, before they're compared
+	Normalize []NormalizeRule `json:"normalize,omitempty"`
+
+	// MatchSimilarityThreshold is a similarity score from 0.0 to 1.0. Bodies which don't match exactly, but score at or
+	// above the threshold, are counted as matches.
+	MatchSimilarityThreshold float64 `json:"match_similarity_threshold,omitempty"`
+
+	jq []*gojq.Query
+}
+
+func (BodyComparer) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "mirror.comparers.body",
+		New: func() caddy.Module { return new(BodyComparer) },
+	}
+}
+
+// Provision implements caddy.Provisioner
+func (c *BodyComparer) Provision(_ caddy.Context) (err error) {
+	c.jq, err = parseJQ(c.JQ)
+	if err != nil {
+		return err
+	}
+
+	err = compileNormalizeRules(c.Normalize)
+	if err != nil {
+		return err
+	}
+
+	if c.MatchSimilarityThreshold < 0 || c.MatchSimilarityThreshold > 1 {
+		return fmt.Errorf("match_similarity_threshold must be between 0.0 and 1.0, got %v", c.MatchSimilarityThreshold)
+	}
+
+	return nil
+}
+
+func (c *BodyComparer) Compare(primary, secondary ResponseArtifact) Result {
+	res := Result{Comparer: "body"}
+	if !primary.Buffered || !secondary.Buffered {
+		res.Skipped = true
+		return res
+	}
+
+	b := c.body()
+	body := b.Compare(primary.Body, secondary.Body)
+	res.Match = body.Match
+
+	// Mismatch logs include the original bodies, not the normalized ones, unless they're binary. Matches don't, so
+	// bodies aren't copied or hashed on every comparison.
+	if !res.Match {
+		if binaryBody(primary) || binaryBody(secondary) {
+			res.Attrs = binaryBodyAttrs(primary.Body, secondary.Body)
+		} else {
+			res.Attrs = []slog.Attr{
+				slog.String("primary_body", string(primary.Body)),
+				slog.String("shadow_body", string(secondary.Body)),
+			}
+		}
+	}
+	if c.MatchSimilarityThreshold > 0 {
+		res.Attrs = append(res.Attrs, slog.Float64("similarity", body.Similarity))
+	}
+	if !res.Match {
+		// The patch is of what was compared, so values ignored by normalize rules or jq queries aren't in it
+		if patch := b.JSONPatch(primary.Body, secondary.Body); patch != nil {
+			paths := make([]string, len(patch))
+			for i, op := range patch {
+				paths[i] = op.Path
+			}
+			res.Attrs = append(res.Attrs, slog.Any("diff_paths", paths), slog.Any("json_patch", patch))
+		}
+	}
+
+	return res
+}
+
+// body is the comparison of the comparer's configuration
+func (c *BodyComparer) body() compare.Body {
+	b := compare.Body{
+		JQ:                       c.jq,
+		Normalize:                make([]compare.Normalizer, len(c.Normalize)),
+		MatchSimilarityThreshold: c.MatchSimilarityThreshold,
+	}
+	for i, rule := range c.Normalize {
+		b.Normalize[i] = compare.Normalizer{Pattern: rule.re, Replacement: rule.Replacement}
+	}
+	return b
+}
+
+func (c *BodyComparer) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume comparer name
+	for d.NextBlock(0) {
+		switch d.Val() {
+		case "jq":
+			args := d.RemainingArgs()
+			if len(args) < 1 {
+				return d.Err("jq requires at least one jq query")
+			}
+			for _, qStr := range args {
+				c.JQ = append(c.JQ, JQQuery(qStr))
+			}
+		case "normalize":
+			args := d.RemainingArgs()
+			if len(args) < 1 || len(args) > 2 {
+				return d.Err("normalize requires a pattern and an optional replacement")
+			}
+			rule := NormalizeRule{Pattern: args[0]}
+			if len(args) == 2 {
+				rule.Replacement = args[1]
+			}
+			c.Normalize = append(c.Normalize, rule)
+		case "match_similarity_threshold":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			var err error
+			c.MatchSimilarityThreshold, err = strconv.ParseFloat(d.Val(), 64)
+			if err != nil {
+				return d.Errf("error parsing match_similarity_threshold: %v", err)
+			}
+		default:
+			return d.Errf("unrecognized body comparer option '%s'", d.Val())
+		}
+	}
+	return nil
+}
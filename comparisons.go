@@ -1,153 +1,402 @@
 package mirror
 
 import (
-	"encoding/json"
+	"cmp"
+	"fmt"
 	"log/slog"
-	"maps"
 	"net/http"
+	"regexp"
 	"slices"
+	"strconv"
 
+	"github.com/caddyserver/caddy/v2"
 	"github.com/itchyny/gojq"
-)
 
-type LogLevel string
+	"github.com/dotvezz/caddy-mirror/compare"
+)
 
+// JQQuery is a jq query, like .data.items, which is parsed when the handler is provisioned
 type JQQuery string
 
+// NormalizeRule replaces every match of Pattern with Replacement in both response bodies before they're compared. This
+// is useful for volatile values like UUIDs, timestamps, and trace IDs which are expected to differ.
+type NormalizeRule struct {
+	// Pattern is a regular expression, in Go's syntax
+	Pattern string `json:"pattern"`
+	// Replacement replaces each match. It may refer to submatches, like $1. Defaults to removing the match.
+	Replacement string `json:"replacement,omitempty"`
+	re          *regexp.Regexp
+}
+
+// ComparisonConfig is shorthand configuration for the built-in comparers
 type ComparisonConfig struct {
-	CompareStatus  bool      `json:"compare_status,omitempty"`
-	CompareBody    bool      `json:"compare_body,omitempty"`
-	CompareHeaders []string  `json:"compare_headers,omitempty"`
-	CompareJQ      []JQQuery `json:"compare_jq,omitempty"`
-	compareJQ      []*gojq.Query
+	// CompareStatus compares the responses' status codes
+	CompareStatus bool `json:"compare_status,omitempty"`
+	// CompareBody compares the responses' bodies, in full unless CompareJQ is set
+	CompareBody bool `json:"compare_body,omitempty"`
+	// CompareHeaders compares the values of these response headers
+	CompareHeaders []string `json:"compare_headers,omitempty"`
+	// CompareJQ compares JSON bodies by the results of these jq queries, instead of in full
+	CompareJQ []JQQuery `json:"compare_jq,omitempty"`
+	compareJQ []*gojq.Query
+	// CompareEvents compares Server-Sent Events responses by a hash of their events. Event streams are never buffered,
+	// so their bodies can't be compared otherwise.
+	CompareEvents bool `json:"compare_events,omitempty"`
+	// CompareUploadFields compares these fields of the responses to multipart/form-data uploads, instead of their whole
+	// bodies
+	CompareUploadFields []string `json:"compare_upload_fields,omitempty"`
+	// CompareLatency, if set, flags requests which the secondary took too much longer than the primary to respond to
+	CompareLatency *LatencyComparer `json:"compare_latency,omitempty"`
+
+	// Normalize rewrites both bodies, in order, before they're compared
+	Normalize []NormalizeRule `json:"normalize,omitempty"`
+
+	// OnPrimaryError is what happens when the primary fails: "skip" doesn't compare the request, "record" reports it
+	// without comparing it, "compare_status" only compares statuses, "compare" compares whatever the primary wrote
+	// before it failed, and "cancel" cancels the secondary too. Defaults to skip. With compare, responses are buffered
+	// whatever their status, so error responses can be compared too.
+	OnPrimaryError string `json:"on_primary_error,omitempty"`
+
+	// Decompress buffers compressed responses too, and decompresses them before they're compared. gzip, br, and zstd
+	// are supported. Responses with any other Content-Encoding still aren't buffered.
+	Decompress bool `json:"decompress,omitempty"`
+
+	// IdentityEncoding asks the backends for uncompressed responses, since compressed ones aren't compared, by setting
+	// Accept-Encoding to identity: "secondary" only for the mirrored request, and "both" for the primary's request too.
+	// The client's Accept-Encoding is put back once the primary is done, so it's logged as it was sent.
+	IdentityEncoding string `json:"identity_encoding,omitempty"`
+
+	// SkipDisconnected skips comparing requests whose client disconnected before the primary's response was sent. By
+	// default, they're compared as long as the primary had responded.
+	SkipDisconnected bool `json:"skip_disconnected,omitempty"`
+
+	// ExcludeSecondaryErrors excludes requests whose secondary failed, with a handler error or a 5xx response, from
+	// comparison. They're reported as excluded rather than as mismatches, and counted apart from compared requests, so
+	// flakiness in the secondary's environment doesn't skew match rates.
+	ExcludeSecondaryErrors bool `json:"exclude_secondary_errors,omitempty"`
+
+	// MatchSimilarityThreshold is a similarity score from 0.0 to 1.0. Bodies which don't match exactly, but score at or
+	// above the threshold, are counted as matches.
+	MatchSimilarityThreshold float64 `json:"match_similarity_threshold,omitempty"`
+
+	// MatchRequire, if set, are the comparers which must match for a request to count as a match. Results of other
+	// comparers are advisory: they're still reported, but don't count. MatchAdvisory makes only these comparers
+	// advisory instead. By default, every comparer must match.
+	MatchRequire  []string `json:"match_require,omitempty"`
+	MatchAdvisory []string `json:"match_advisory,omitempty"`
+
+	// Classify are rules which tag mismatches with a category, in reports and metrics
+	Classify []ClassifyRule `json:"classify,omitempty"`
+
+	// CompareByStatus, if set, picks which comparers run by the primary's status, like 404, or status class, like 2xx.
+	// Comparers are named as in MatchRequire, and a status without any isn't compared at all. A status takes precedence
+	// over its class, and statuses without a rule run every comparer. Bodies of statuses whose comparers include body
+	// or upload are buffered, even if they aren't 2xx.
+	CompareByStatus map[string][]string `json:"compare_by_status,omitempty"`
 }
 
-type ReportingConfig struct {
-	NoLog    bool      `json:"no_log,omitempty"`
-	LogLevel *LogLevel `json:"log_level,omitempty"`
+func (c *ComparisonConfig) provision() (err error) {
+	c.compareJQ, err = parseJQ(c.CompareJQ)
+	if err != nil {
+		return err
+	}
+
+	err = compileNormalizeRules(c.Normalize)
+	if err != nil {
+		return err
+	}
+
+	switch c.OnPrimaryError {
+	case "", primaryErrorSkip, primaryErrorRecord, primaryErrorCompareStatus, primaryErrorCompare, primaryErrorCancel:
+	default:
+		return fmt.Errorf("unrecognized on_primary_error '%s'", c.OnPrimaryError)
+	}
+
+	switch c.IdentityEncoding {
+	case "", identityEncodingSecondary, identityEncodingBoth:
+	default:
+		return fmt.Errorf("unrecognized identity_encoding '%s'", c.IdentityEncoding)
+	}
+
+	if c.MatchSimilarityThreshold < 0 || c.MatchSimilarityThreshold > 1 {
+		return fmt.Errorf("match_similarity_threshold must be between 0.0 and 1.0, got %v", c.MatchSimilarityThreshold)
+	}
+
+	for i := range c.Classify {
+		if err := c.Classify[i].provision(); err != nil {
+			return err
+		}
+	}
+
+	for status := range c.CompareByStatus {
+		if !validStatusPattern(status) {
+			return fmt.Errorf("error parsing compare_by_status status '%s'", status)
+		}
+	}
+
+	for _, comparer := range c.MatchAdvisory {
+		if slices.Contains(c.MatchRequire, comparer) {
+			return fmt.Errorf("comparer '%s' can't be both required and advisory", comparer)
+		}
+	}
+
+	return nil
 }
 
-func (h *Handler) compareStatus(primaryStatus, shadowStatus int) {
-	if primaryStatus != shadowStatus {
-		h.slogger.Info("shadow_status_mismatch",
-			slog.Int("primary_status", primaryStatus),
-			slog.Int("shadow_status", shadowStatus),
-		)
+const (
+	primaryErrorSkip          = "skip"
+	primaryErrorRecord        = "record"
+	primaryErrorCompareStatus = "compare_status"
+	primaryErrorCompare       = "compare"
+	primaryErrorCancel        = "cancel"
+)
+
+const (
+	identityEncodingSecondary = "secondary"
+	identityEncodingBoth      = "both"
+)
+
+// reportsPrimaryErrors reports whether requests whose primary failed are still reported
+func (c *ComparisonConfig) reportsPrimaryErrors() bool {
+	switch c.OnPrimaryError {
+	case primaryErrorRecord, primaryErrorCompareStatus, primaryErrorCompare:
+		return true
 	}
+	return false
 }
 
-func (h *Handler) compareHeaders(primaryH, shadowH http.Header) {
-	for _, k := range h.CompareHeaders {
-		ph, sh := primaryH.Values(k), shadowH.Values(k)
-		if slices.Equal(ph, sh) {
-			h.slogger.Info(
-				"shadow_header_mismatch",
-				slog.String("key", k),
-				slog.Any("primary_values", ph),
-				slog.Any("shadow_values", sh),
-			)
-		}
+// advisory reports whether a comparer's results don't decide whether a request matches
+func (c *ComparisonConfig) advisory(comparer string) bool {
+	if slices.Contains(c.MatchAdvisory, comparer) {
+		return true
 	}
+	return len(c.MatchRequire) > 0 && !slices.Contains(c.MatchRequire, comparer)
 }
 
-func (h *Handler) compareBody(primaryBS, shadowBS []byte) {
-	var match bool
-	if h.CompareJQ != nil {
-		match = h.compareJSON(primaryBS, shadowBS)
-	} else {
-		match = slices.Equal(primaryBS, shadowBS)
+// statusComparers returns the names of the comparers compare_by_status picks for a primary status, and whether a rule
+// matched it at all
+func (c *ComparisonConfig) statusComparers(status int) ([]string, bool) {
+	if names, ok := c.CompareByStatus[strconv.Itoa(status)]; ok {
+		return names, true
 	}
+	names, ok := c.CompareByStatus[strconv.Itoa(status/100)+"xx"]
+	return names, ok
+}
 
-	if h.MetricsName != "" {
-		if match {
-			h.metrics.match.Inc()
-		} else {
-			h.metrics.mismatch.Inc()
+// builtinComparers returns the comparers enabled by the ComparisonConfig shorthand for a request
+func (c *ComparisonConfig) builtinComparers(req RequestSummary) []Comparer {
+	var comparers []Comparer
+	if c.CompareStatus {
+		comparers = append(comparers, StatusComparer{})
+	}
+	if len(c.CompareHeaders) > 0 {
+		comparers = append(comparers, HeaderComparer{Headers: c.CompareHeaders})
+	}
+	if len(c.CompareUploadFields) > 0 && req.upload() {
+		comparers = append(comparers, UploadComparer{Fields: c.CompareUploadFields})
+	} else if c.CompareBody || len(c.compareJQ) > 0 {
+		comparers = append(comparers, c.bodyComparer())
+	}
+	if c.CompareEvents {
+		comparers = append(comparers, EventStreamComparer{})
+	}
+	if c.CompareLatency != nil {
+		comparers = append(comparers, *c.CompareLatency)
+	}
+	return comparers
+}
+
+func (c *ComparisonConfig) bodyComparer() *BodyComparer {
+	return &BodyComparer{
+		JQ:                       c.CompareJQ,
+		Normalize:                c.Normalize,
+		MatchSimilarityThreshold: c.MatchSimilarityThreshold,
+		jq:                       c.compareJQ,
+	}
+}
+
+func parseJQ(queries []JQQuery) ([]*gojq.Query, error) {
+	qStrs := make([]string, len(queries))
+	for i, qStr := range queries {
+		qStrs[i] = string(qStr)
+	}
+	return compare.ParseJQ(qStrs...)
+}
+
+func compileNormalizeRules(rules []NormalizeRule) (err error) {
+	for i := range rules {
+		rules[i].re, err = regexp.Compile(rules[i].Pattern)
+		if err != nil {
+			return fmt.Errorf("error parsing normalize pattern %d: %w", i, err)
 		}
 	}
+	return nil
+}
 
-	if match { // If we've matched, nothing left to do
+// compare runs every comparer against the primary and secondary responses, then counts and reports the results. The
+// report's ID is the request's correlation ID, or a new one if it's empty.
+func (h *Handler) compare(id string, req RequestSummary, primary, secondary ResponseArtifact) {
+	only, byStatus := h.statusComparers(primary.Status)
+	if byStatus && len(only) == 0 {
 		return
 	}
 
-	if !h.NoLog {
-		h.slogger.Info("shadow_mismatch",
-			"primary_body", string(primaryBS),
-			"shadow_body", string(shadowBS),
-		)
+	comparers := h.builtinComparers(req)
+	comparers = append(comparers, h.comparers...)
+	if primary.Error != "" {
+		if h.MetricsName != "" {
+			h.metrics.primaryErrors.Inc()
+		}
+		switch h.OnPrimaryError {
+		case primaryErrorRecord:
+			comparers = nil
+		case primaryErrorCompareStatus:
+			comparers = []Comparer{StatusComparer{}}
+		}
+	}
+	if byStatus {
+		comparers = slices.DeleteFunc(comparers, func(c Comparer) bool {
+			name, ok := comparerName(c)
+			return ok && !slices.Contains(only, name)
+		})
+	}
+	excluded := h.ExcludeSecondaryErrors && (secondary.Error != "" || secondary.Status >= 500)
+	if excluded {
+		comparers = nil
 	}
-}
 
-func (h *Handler) compareJSON(primaryBS, shadowBS []byte) bool {
-	for _, jq := range h.compareJQ {
-		var primary, shadow any
-		_ = json.Unmarshal(primaryBS, &primary)
-		_ = json.Unmarshal(shadowBS, &shadow)
+	if id == "" {
+		id = newUUID()
+	}
+	rep := Report{
+		ID:        id,
+		Time:      h.now(),
+		Request:   req,
+		Results:   make([]Result, 0, len(comparers)),
+		Match:     true,
+		Excluded:  excluded,
+		Primary:   primary,
+		Secondary: secondary,
 
-		pi, si := jq.Run(primary), jq.Run(shadow)
-		// These iterators should never be nil but just to be safe...
-		// If both iterators are nil, something is REALLY unexpected, but *technically* that's a match
-		if pi == nil && si == nil {
+		maxDiffBytes: h.MaxDiffBytes,
+	}
+	for _, c := range comparers {
+		var res Result
+		if rc, ok := c.(RequestAwareComparer); ok {
+			res = rc.CompareRequest(req, primary, secondary)
+		} else {
+			res = c.Compare(primary, secondary)
+		}
+		// Comparers which aren't modules are only named by their results
+		if byStatus && !slices.Contains(only, res.Comparer) {
 			continue
 		}
-		// If only one iterator is nil, something is REALLY unexpected, but *technically* that's a mismatch
-		if (pi == nil) != (si == nil) {
-			return false
+		res.Advisory = !res.Skipped && h.advisory(res.Comparer)
+		rep.Results = append(rep.Results, res)
+		if res.Skipped {
+			continue
+		}
+		if !res.Advisory {
+			rep.Match = rep.Match && res.Match
 		}
 
-		for {
-			pn, pok := pi.Next()
-			sn, sok := si.Next()
-			if sok != pok {
-				// If the iterators have a different result length, that's a mismatch
-				return false
-			}
-			if !pok {
-				break
+		if res.Comparer == "body" && h.MetricsName != "" {
+			if res.Match {
+				h.metrics.match.WithLabelValues(h.metrics.labelValues(req.Route)...).Inc()
+			} else {
+				h.metrics.mismatch.WithLabelValues(h.metrics.labelValues(req.Route)...).Inc()
 			}
+		}
+		if res.Comparer == "latency" && !res.Match && h.MetricsName != "" {
+			h.metrics.latencyRegressions.WithLabelValues(h.metrics.labelValues(req.Route)...).Inc()
+		}
+	}
 
-			switch pn.(type) {
-			case map[string]any:
-				pm := pn.(map[string]any)
-				sm, ok := sn.(map[string]any)
-				if !ok {
-					return false
-				}
-
-				if !maps.Equal(pm, sm) {
-					return false
-				}
-			case []any:
-				psl := pn.([]any)
-				ssl, ok := sn.([]any)
-				if !ok {
-					return false
-				}
-
-				if !slices.Equal(psl, ssl) {
-					return false
-				}
-			default:
-				if pn != sn {
-					return false
-				}
+	// Requests which were only recorded weren't compared, so they don't count as matches
+	if len(comparers) > 0 {
+		if !rep.Match {
+			rep.Category = h.classify(rep)
+		}
+		if h.MetricsName != "" {
+			h.metrics.compared(rep)
+			if rep.Match {
+				h.metrics.reportMatch.WithLabelValues(h.metrics.labelValues(req.Route)...).Inc()
+			} else {
+				h.metrics.reportMismatch.WithLabelValues(h.metrics.labelValues(req.Route)...).Inc()
+				h.metrics.mismatchCategories.WithLabelValues(cmp.Or(rep.Category, uncategorized)).Inc()
 			}
 		}
+		h.stats.compared(rep)
+		h.recent.add(rep)
+		h.scorecard.record(rep)
 	}
+	if excluded {
+		if h.MetricsName != "" {
+			h.metrics.excluded.Inc()
+		}
+		h.stats.exclude()
+	}
+	if !rep.Match && h.artifacts != nil {
+		ref, err := h.artifacts.write(rep)
+		if err != nil {
+			// The mismatch is still logged in full
+			h.slogger.Error("artifacts_error", slog.String("id", rep.ID), slog.String("error", err.Error()))
+		}
+		rep.Artifacts = ref
+	}
+	h.report(rep)
+}
 
-	return true
+// comparerName returns the name a comparer reports its results under, if it's known before it runs. Comparers which
+// are modules are named by their module ID, like body for mirror.comparers.body.
+func comparerName(c Comparer) (string, bool) {
+	if m, ok := c.(caddy.Module); ok {
+		return m.CaddyModule().ID.Name(), true
+	}
+	return "", false
+}
+
+// report fans a Report out to the handler's own log (unless no_log is set) and every configured reporter
+func (h *Handler) report(rep Report) {
+	if !h.NoLog {
+		lr := &LogReporter{
+			slogger:    h.comparisonSlogger,
+			Matches:    h.LogMatches,
+			Levels:     h.MismatchLogLevels,
+			HashBodies: h.HashBodies,
+			OmitBodies: h.OmitBodies,
+		}
+		if h.LogLevel != nil {
+			lr.Level = *h.LogLevel
+		}
+		lr.Report(rep)
+	}
+	for _, r := range h.reporters {
+		r.Report(rep)
+	}
 }
 
 func (h *Handler) shouldBuffer(status int, hdr http.Header) bool {
 	return status >= 200 &&
-		status < 300 &&
+		(status < 300 || h.OnPrimaryError == primaryErrorCompare || h.comparesBodiesOf(status)) &&
 		h.shouldCompare() &&
-		hdr.Get("Content-Encoding") == ""
+		(hdr.Get("Content-Encoding") == "" || h.Decompress && decompressible(hdr.Get("Content-Encoding"))) &&
+		!isEventStream(hdr)
+}
+
+// comparesBodiesOf reports whether compare_by_status compares the bodies of responses with a status
+func (h *Handler) comparesBodiesOf(status int) bool {
+	only, _ := h.statusComparers(status)
+	return slices.Contains(only, "body") || slices.Contains(only, "upload")
 }
 
 func (h *Handler) shouldCompare() bool {
 	return h.CompareBody ||
 		len(h.compareJQ) > 0 ||
 		h.CompareStatus ||
-		len(h.CompareHeaders) > 0
+		len(h.CompareHeaders) > 0 ||
+		h.CompareEvents ||
+		len(h.CompareUploadFields) > 0 ||
+		h.CompareLatency != nil ||
+		len(h.comparers) > 0
 }
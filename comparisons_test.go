@@ -1,9 +1,16 @@
 package mirror
 
 import (
-	"github.com/itchyny/gojq"
 	"net/http"
+	"regexp"
+	"slices"
 	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+
+	"github.com/dotvezz/caddy-mirror/compare"
 )
 
 func TestHandler_shouldCompare(t *testing.T) {
@@ -49,6 +56,15 @@ func TestHandler_shouldCompare(t *testing.T) {
 			},
 			want: true,
 		},
+		{
+			name: "latency comparison",
+			fields: fields{
+				ComparisonConfig: ComparisonConfig{
+					CompareLatency: &LatencyComparer{},
+				},
+			},
+			want: true,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -115,6 +131,19 @@ func TestHandler_shouldBuffer(t *testing.T) {
 			},
 			want: false,
 		},
+		{
+			name: "error status compared on primary error",
+			fields: fields{
+				ComparisonConfig: ComparisonConfig{
+					CompareBody:    true,
+					OnPrimaryError: primaryErrorCompare,
+				},
+			},
+			args: args{
+				status: 500,
+			},
+			want: true,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -128,227 +157,408 @@ func TestHandler_shouldBuffer(t *testing.T) {
 	}
 }
 
-func TestHandler_compareJSON(t *testing.T) {
-	type fields struct {
-		ComparisonConfig ComparisonConfig
+func TestBodyComparer_CompareSimilarityThreshold(t *testing.T) {
+	c := &BodyComparer{
+		MatchSimilarityThreshold: 0.8,
 	}
-	type args struct {
-		primaryBS []byte
-		shadowBS  []byte
+	buffered := func(body string) ResponseArtifact {
+		return ResponseArtifact{Body: []byte(body), Buffered: true}
 	}
-	tests := []struct {
-		name   string
-		fields fields
-		args   args
-		want   bool
-	}{
-		{
-			name: "string match",
-			fields: fields{
-				ComparisonConfig: ComparisonConfig{
-					compareJQ: []*gojq.Query{
-						func() *gojq.Query {
-							q, _ := gojq.Parse(".greeting")
-							return q
-						}(),
-					},
-				},
-			},
-			args: args{
-				primaryBS: []byte(`{"greeting": "Hello, world!", "foo": "bar"}`),
-				shadowBS:  []byte(`{"greeting": "Hello, world!", "bar": "foo"}`),
-			},
-			want: true,
-		},
-		{
-			name: "string mismatch",
-			fields: fields{
-				ComparisonConfig: ComparisonConfig{
-					compareJQ: []*gojq.Query{
-						func() *gojq.Query {
-							q, _ := gojq.Parse(".greeting")
-							return q
-						}(),
-					},
-				},
-			},
-			args: args{
-				primaryBS: []byte(`{"greeting": "Hello, world!"}`),
-				shadowBS:  []byte(`{"greeting": "안녕하세요!"}`),
-			},
-			want: false,
-		},
-		{
-			name: "missing prop in secondary",
-			fields: fields{
-				ComparisonConfig: ComparisonConfig{
-					compareJQ: []*gojq.Query{
-						func() *gojq.Query {
-							q, _ := gojq.Parse(".greeting")
-							return q
-						}(),
-					},
-				},
-			},
-			args: args{
-				primaryBS: []byte(`{"greeting": "Hello, world!"}`),
-				shadowBS:  []byte(`{"foo": "bar"}`),
-			},
-			want: false,
-		},
-		{
-			name: "object match",
-			fields: fields{
-				ComparisonConfig: ComparisonConfig{
-					compareJQ: []*gojq.Query{
-						func() *gojq.Query {
-							q, _ := gojq.Parse(".greetings")
-							return q
-						}(),
-					},
-				},
-			},
-			args: args{
-				primaryBS: []byte(`{"greetings": {"en_US": "Hello, world!"}}`),
-				shadowBS:  []byte(`{"greetings": {"en_US": "Hello, world!"}}`),
-			},
-			want: true,
-		},
-		{
-			name: "primary object, secondary string",
-			fields: fields{
-				ComparisonConfig: ComparisonConfig{
-					compareJQ: []*gojq.Query{
-						func() *gojq.Query {
-							q, _ := gojq.Parse(".greetings")
-							return q
-						}(),
-					},
-				},
-			},
-			args: args{
-				primaryBS: []byte(`{"greetings": {"en_US": "Hello, world!"}}`),
-				shadowBS:  []byte(`{"greetings": "bar"`),
-			},
-			want: false,
-		},
-		{
-			name: "object mismatch",
-			fields: fields{
-				ComparisonConfig: ComparisonConfig{
-					compareJQ: []*gojq.Query{
-						func() *gojq.Query {
-							q, _ := gojq.Parse(".greetings")
-							return q
-						}(),
-					},
-				},
-			},
-			args: args{
-				primaryBS: []byte(`{"greetings": {"en_US": "Hello, world!"}}`),
-				shadowBS:  []byte(`{"greetings": {"ko_KR": "안녕하세요!"}}`),
-			},
-			want: false,
-		},
-		{
-			name: "array match",
-			fields: fields{
-				ComparisonConfig: ComparisonConfig{
-					compareJQ: []*gojq.Query{
-						func() *gojq.Query {
-							q, _ := gojq.Parse(".greetings")
-							return q
-						}(),
-					},
-				},
-			},
-			args: args{
-				primaryBS: []byte(`{"greetings": ["Hello, world!"]}`),
-				shadowBS:  []byte(`{"greetings": ["Hello, world!"]}`),
-			},
-			want: true,
-		},
-		{
-			name: "array mismatch",
-			fields: fields{
-				ComparisonConfig: ComparisonConfig{
-					compareJQ: []*gojq.Query{
-						func() *gojq.Query {
-							q, _ := gojq.Parse(".greetings")
-							return q
-						}(),
-					},
-				},
-			},
-			args: args{
-				primaryBS: []byte(`{"greetings": ["Hello, world!", "안녕하세요!"]}`),
-				shadowBS:  []byte(`{"greetings": ["안녕하세요!"]}`),
+
+	if res := c.Compare(buffered("the quick brown fox jumps"), buffered("the quick brown cat jumps")); !res.Match {
+		t.Errorf("expected bodies within the similarity threshold to match")
+	}
+
+	if res := c.Compare(buffered("the quick brown fox jumps"), buffered("a lazy dog sleeps")); res.Match {
+		t.Errorf("expected bodies outside the similarity threshold to mismatch")
+	}
+}
+
+func TestBodyComparer_CompareNormalize(t *testing.T) {
+	c := &BodyComparer{
+		Normalize: []NormalizeRule{
+			{
+				Pattern:     `[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}`,
+				Replacement: "<uuid>",
+				re:          regexp.MustCompile(`[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}`),
 			},
-			want: false,
 		},
-		{
-			name: "primary array, secondary string",
-			fields: fields{
-				ComparisonConfig: ComparisonConfig{
-					compareJQ: []*gojq.Query{
-						func() *gojq.Query {
-							q, _ := gojq.Parse(".greetings")
-							return q
-						}(),
-					},
-				},
-			},
-			args: args{
-				primaryBS: []byte(`{"greetings": ["Hello, world!", "안녕하세요!"]}`),
-				shadowBS:  []byte(`{"greetings": "안녕하세요!"}`),
-			},
-			want: false,
+	}
+	buffered := func(body string) ResponseArtifact {
+		return ResponseArtifact{Body: []byte(body), Buffered: true}
+	}
+
+	res := c.Compare(
+		buffered(`{"id": "2b1c7e64-5f0a-4f4e-9d1e-0c7a3b8e9f10", "name": "foo"}`),
+		buffered(`{"id": "9a7d1f3c-2e4b-4c6d-8f0a-1b2c3d4e5f60", "name": "foo"}`),
+	)
+	if !res.Match {
+		t.Errorf("expected bodies differing only by normalized values to match")
+	}
+	if len(res.Attrs) != 0 {
+		t.Errorf("expected no attrs for a match, got %v", res.Attrs)
+	}
+
+	res = c.Compare(
+		buffered(`{"id": "2b1c7e64-5f0a-4f4e-9d1e-0c7a3b8e9f10", "name": "foo"}`),
+		buffered(`{"id": "9a7d1f3c-2e4b-4c6d-8f0a-1b2c3d4e5f60", "name": "bar"}`),
+	)
+	if res.Match {
+		t.Errorf("expected bodies differing outside normalized values to mismatch")
+	}
+}
+
+func TestHeaderComparer_Compare(t *testing.T) {
+	c := HeaderComparer{Headers: []string{"Content-Type"}}
+
+	res := c.Compare(
+		ResponseArtifact{Header: http.Header{"Content-Type": []string{"application/json"}}},
+		ResponseArtifact{Header: http.Header{"Content-Type": []string{"application/json"}}},
+	)
+	if !res.Match {
+		t.Errorf("expected equal headers to match")
+	}
+
+	res = c.Compare(
+		ResponseArtifact{Header: http.Header{"Content-Type": []string{"application/json"}}},
+		ResponseArtifact{Header: http.Header{"Content-Type": []string{"text/plain"}}},
+	)
+	if res.Match {
+		t.Errorf("expected differing headers to mismatch")
+	}
+
+	res = c.Compare(
+		ResponseArtifact{Header: http.Header{"Content-Type": []string{"application/json"}}},
+		ResponseArtifact{Header: http.Header{}},
+	)
+	group, _ := attrsToMap(res.Attrs)["Content-Type"].(map[string]any)
+	if group["change"] != "removed" || !slices.Equal(group["removed_values"].([]string), []string{"application/json"}) {
+		t.Errorf("expected a removed header, got %v", group)
+	}
+}
+
+func TestBodyComparer_CompareUnbuffered(t *testing.T) {
+	c := &BodyComparer{}
+	res := c.Compare(
+		ResponseArtifact{Body: []byte("Hello, world!"), Buffered: true},
+		ResponseArtifact{},
+	)
+	if !res.Skipped {
+		t.Errorf("expected comparison of an unbuffered body to be skipped")
+	}
+}
+
+func TestBodyComparer_CompareJSONPaths(t *testing.T) {
+	c := &BodyComparer{}
+	res := c.Compare(
+		ResponseArtifact{Body: []byte(`{"id": 1, "total": 9.99}`), Buffered: true},
+		ResponseArtifact{Body: []byte(`{"id": 1, "total": 10}`), Buffered: true},
+	)
+	var patch []compare.PatchOperation
+	var paths []string
+	for _, attr := range res.Attrs {
+		switch attr.Key {
+		case "diff_paths":
+			paths = attr.Value.Any().([]string)
+		case "json_patch":
+			patch = attr.Value.Any().([]compare.PatchOperation)
+		}
+	}
+	if len(patch) != 1 || patch[0].Op != "replace" || patch[0].Path != "/total" || string(patch[0].Value) != "10" {
+		t.Errorf("json_patch = %+v, want a replace of /total with 10", patch)
+	}
+	if !slices.Equal(paths, []string{"/total"}) {
+		t.Errorf("diff_paths = %v, want [/total]", paths)
+	}
+
+	res = c.Compare(
+		ResponseArtifact{Body: []byte("Hello, world!"), Buffered: true},
+		ResponseArtifact{Body: []byte("Goodbye, world!"), Buffered: true},
+	)
+	for _, attr := range res.Attrs {
+		if attr.Key == "json_patch" {
+			t.Errorf("expected no json_patch for text bodies, got %v", attr.Value)
+		}
+	}
+}
+
+type reporterFunc func(Report)
+
+func (f reporterFunc) Report(rep Report) {
+	f(rep)
+}
+
+// countingComparer counts how many times it runs
+type countingComparer struct {
+	runs *int
+}
+
+func (countingComparer) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{ID: "mirror.comparers.counting"}
+}
+
+func (c countingComparer) Compare(ResponseArtifact, ResponseArtifact) Result {
+	*c.runs++
+	return Result{Comparer: "counting", Match: true}
+}
+
+func TestHandler_compareReporters(t *testing.T) {
+	var reports []Report
+	h := &Handler{
+		ComparisonConfig: ComparisonConfig{
+			CompareStatus: true,
 		},
-		{
-			name: "primary string, secondary array",
-			fields: fields{
-				ComparisonConfig: ComparisonConfig{
-					compareJQ: []*gojq.Query{
-						func() *gojq.Query {
-							q, _ := gojq.Parse(".greetings")
-							return q
-						}(),
-					},
-				},
-			},
-			args: args{
-				primaryBS: []byte(`{"greetings": "안녕하세요!"}`),
-				shadowBS:  []byte(`{"greetings": ["Hello, world!", "안녕하세요!"]}`),
-			},
-			want: false,
+		ReportingConfig: ReportingConfig{
+			NoLog: true,
 		},
-		{
-			name: "primary string, secondary bool",
-			fields: fields{
-				ComparisonConfig: ComparisonConfig{
-					compareJQ: []*gojq.Query{
-						func() *gojq.Query {
-							q, _ := gojq.Parse(".done")
-							return q
-						}(),
-					},
-				},
-			},
-			args: args{
-				primaryBS: []byte(`{"done": "true"}`),
-				shadowBS:  []byte(`{"done": true}`),
-			},
-			want: false,
+		reporters: []Reporter{
+			reporterFunc(func(rep Report) {
+				reports = append(reports, rep)
+			}),
 		},
+		now: time.Now,
+	}
+
+	h.compare("", RequestSummary{Method: "GET", URI: "/"}, ResponseArtifact{Status: 200}, ResponseArtifact{Status: 200})
+	h.compare("", RequestSummary{Method: "GET", URI: "/"}, ResponseArtifact{Status: 200}, ResponseArtifact{Status: 500})
+
+	if len(reports) != 2 {
+		t.Fatalf("expected 2 reports, got %d", len(reports))
+	}
+	if !reports[0].Match {
+		t.Errorf("expected first report to match")
+	}
+	if reports[1].Match {
+		t.Errorf("expected second report to mismatch")
+	}
+}
+
+func TestHandler_compareMatchDefinition(t *testing.T) {
+	tests := []struct {
+		name         string
+		config       ComparisonConfig
+		wantMatch    bool
+		wantAdvisory []string
+	}{
+		{"every comparer required", ComparisonConfig{}, false, nil},
+		{"headers and latency advisory", ComparisonConfig{MatchAdvisory: []string{"header", "latency"}}, true, []string{"header", "latency"}},
+		{"status required", ComparisonConfig{MatchRequire: []string{"status"}}, true, []string{"header", "latency"}},
+		{"latency required", ComparisonConfig{MatchRequire: []string{"status", "latency"}}, false, []string{"header"}},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
+			var rep Report
+			tt.config.CompareStatus = true
+			tt.config.CompareHeaders = []string{"Cache-Control"}
+			if err := tt.config.provision(); err != nil {
+				t.Fatal(err)
+			}
 			h := &Handler{
-				ComparisonConfig: tt.fields.ComparisonConfig,
+				ComparisonConfig: tt.config,
+				ReportingConfig:  ReportingConfig{NoLog: true},
+				comparers:        []Comparer{LatencyComparer{MaxRatio: 2}},
+				reporters:        []Reporter{reporterFunc(func(r Report) { rep = r })},
+				now:              time.Now,
 			}
-			if got := h.compareJSON(tt.args.primaryBS, tt.args.shadowBS); got != tt.want {
-				t.Errorf("compareJSON() = %v, want %v", got, tt.want)
+			h.compare("", RequestSummary{Method: "GET", URI: "/"},
+				ResponseArtifact{Status: 200, Header: http.Header{"Cache-Control": {"no-cache"}}, Duration: 10 * time.Millisecond},
+				ResponseArtifact{Status: 200, Duration: 30 * time.Millisecond},
+			)
+
+			var advisory []string
+			for _, res := range rep.Results {
+				if res.Advisory {
+					advisory = append(advisory, res.Comparer)
+				}
+			}
+			if rep.Match != tt.wantMatch || !slices.Equal(advisory, tt.wantAdvisory) {
+				t.Errorf("match = %v, advisory = %v, want %v, %v", rep.Match, advisory, tt.wantMatch, tt.wantAdvisory)
 			}
 		})
 	}
+
+	c := ComparisonConfig{MatchRequire: []string{"body"}, MatchAdvisory: []string{"body"}}
+	if err := c.provision(); err == nil {
+		t.Errorf("provision() with a comparer both required and advisory didn't fail")
+	}
+}
+
+func TestHandler_compareByStatus(t *testing.T) {
+	byStatus := map[string][]string{"2xx": {"status", "body"}, "3xx": {"status"}, "304": {}, "5xx": {}}
+	tests := []struct {
+		name         string
+		status       int
+		wantReported bool
+		wantCompared []string
+	}{
+		{"2xx compares status and body", 200, true, []string{"status", "body"}},
+		{"3xx compares status", 302, true, []string{"status"}},
+		{"status takes precedence over class", 304, false, nil},
+		{"5xx skipped", 503, false, nil},
+		{"status without a rule compares everything", 404, true, []string{"status", "header", "body"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var rep *Report
+			cfg := ComparisonConfig{
+				CompareStatus:   true,
+				CompareBody:     true,
+				CompareHeaders:  []string{"Cache-Control"},
+				CompareByStatus: byStatus,
+			}
+			if err := cfg.provision(); err != nil {
+				t.Fatal(err)
+			}
+			h := &Handler{
+				ComparisonConfig: cfg,
+				ReportingConfig:  ReportingConfig{NoLog: true},
+				reporters:        []Reporter{reporterFunc(func(r Report) { rep = &r })},
+				now:              time.Now,
+			}
+			resp := ResponseArtifact{Status: tt.status, Body: []byte("ok"), Buffered: true}
+			h.compare("", RequestSummary{Method: "GET", URI: "/"}, resp, resp)
+
+			if (rep != nil) != tt.wantReported {
+				t.Fatalf("reported = %v, want %v", rep != nil, tt.wantReported)
+			}
+			if rep == nil {
+				return
+			}
+			var compared []string
+			for _, res := range rep.Results {
+				compared = append(compared, res.Comparer)
+			}
+			if !slices.Equal(compared, tt.wantCompared) {
+				t.Errorf("compared = %v, want %v", compared, tt.wantCompared)
+			}
+		})
+	}
+
+	var runs int
+	h := &Handler{
+		ComparisonConfig: ComparisonConfig{CompareByStatus: map[string][]string{"2xx": {"counting"}, "3xx": {"status"}}},
+		ReportingConfig:  ReportingConfig{NoLog: true},
+		comparers:        []Comparer{countingComparer{runs: &runs}},
+		now:              time.Now,
+	}
+	h.compare("", RequestSummary{Method: "GET", URI: "/"}, ResponseArtifact{Status: 302}, ResponseArtifact{Status: 302})
+	if runs != 0 {
+		t.Errorf("excluded comparer ran %d times, want 0", runs)
+	}
+	h.compare("", RequestSummary{Method: "GET", URI: "/"}, ResponseArtifact{Status: 200}, ResponseArtifact{Status: 200})
+	if runs != 1 {
+		t.Errorf("included comparer ran %d times, want 1", runs)
+	}
+
+	h = &Handler{ComparisonConfig: ComparisonConfig{CompareBody: true, CompareByStatus: byStatus}}
+	if !h.shouldBuffer(200, nil) || h.shouldBuffer(302, nil) {
+		t.Errorf("shouldBuffer() didn't follow compare_by_status")
+	}
+	h.CompareByStatus = map[string][]string{"4xx": {"body"}}
+	if !h.shouldBuffer(404, nil) {
+		t.Errorf("shouldBuffer(404) = false, want true for a 4xx rule comparing bodies")
+	}
+
+	c := ComparisonConfig{CompareByStatus: map[string][]string{"2xxx": {"status"}}}
+	if err := c.provision(); err == nil {
+		t.Errorf("provision() with an invalid status didn't fail")
+	}
+}
+
+func TestHandler_compareExcludeSecondaryErrors(t *testing.T) {
+	tests := []struct {
+		name         string
+		secondary    ResponseArtifact
+		wantExcluded bool
+	}{
+		{"succeeded", ResponseArtifact{Status: 200}, false},
+		{"4xx", ResponseArtifact{Status: 404}, false},
+		{"5xx", ResponseArtifact{Status: 503}, true},
+		{"handler error", ResponseArtifact{Status: 502, Error: "dial tcp: connection refused"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var rep Report
+			h := &Handler{
+				ComparisonConfig: ComparisonConfig{CompareStatus: true, ExcludeSecondaryErrors: true},
+				ReportingConfig:  ReportingConfig{NoLog: true},
+				reporters:        []Reporter{reporterFunc(func(r Report) { rep = r })},
+				stats:            newStats(),
+				now:              time.Now,
+			}
+			h.compare("", RequestSummary{Method: "GET", URI: "/"}, ResponseArtifact{Status: 200}, tt.secondary)
+
+			if rep.Excluded != tt.wantExcluded {
+				t.Errorf("Excluded = %v, want %v", rep.Excluded, tt.wantExcluded)
+			}
+			totals := h.stats.totals()
+			compared := totals.Matched + totals.Mismatched
+			if tt.wantExcluded && (totals.Excluded != 1 || compared != 0 || len(rep.Results) != 0) {
+				t.Errorf("excluded request was compared: %+v, %+v", totals, rep.Results)
+			}
+			if !tt.wantExcluded && (totals.Excluded != 0 || compared != 1) {
+				t.Errorf("compared request wasn't counted: %+v", totals)
+			}
+		})
+	}
+}
+
+func TestLatencyComparer_Compare(t *testing.T) {
+	c := LatencyComparer{}
+	p := ResponseArtifact{Duration: 100 * time.Millisecond}
+	if res := c.Compare(p, ResponseArtifact{Duration: 200 * time.Millisecond}); !res.Match {
+		t.Errorf("Compare() of twice the primary's latency = mismatch, want a match by default")
+	}
+	if res := c.Compare(p, ResponseArtifact{Duration: 201 * time.Millisecond}); res.Match || len(res.Attrs) != 2 {
+		t.Errorf("Compare() of over twice the primary's latency = %v (%v), want a mismatch with both durations", res.Match, res.Attrs)
+	}
+	if res := c.Compare(ResponseArtifact{}, p); !res.Skipped {
+		t.Errorf("Compare() without a primary duration wasn't skipped")
+	}
+
+	// With an absolute threshold, the ratio only applies if it's set too
+	c = LatencyComparer{MaxIncrease: caddy.Duration(50 * time.Millisecond)}
+	if res := c.Compare(p, ResponseArtifact{Duration: 150 * time.Millisecond}); !res.Match {
+		t.Errorf("Compare() within max_increase = mismatch, want a match")
+	}
+	if res := c.Compare(p, ResponseArtifact{Duration: 151 * time.Millisecond}); res.Match {
+		t.Errorf("Compare() over max_increase = match, want a mismatch")
+	}
+	c.MaxRatio = 1.2
+	if res := c.Compare(p, ResponseArtifact{Duration: 130 * time.Millisecond}); res.Match {
+		t.Errorf("Compare() over max_ratio, within max_increase = match, want a mismatch")
+	}
+}
+
+func TestLatencyComparer_UnmarshalCaddyfile(t *testing.T) {
+	tests := []struct {
+		config  string
+		want    LatencyComparer
+		wantErr bool
+	}{
+		{config: `latency`, want: LatencyComparer{}},
+		{config: `latency 1.5x`, want: LatencyComparer{MaxRatio: 1.5}},
+		{config: `latency 3`, want: LatencyComparer{MaxRatio: 3}},
+		{config: `latency 100ms 2x`, want: LatencyComparer{MaxRatio: 2, MaxIncrease: caddy.Duration(100 * time.Millisecond)}},
+		{config: `latency {
+			max_ratio 2x
+			max_increase 1s
+		}`, want: LatencyComparer{MaxRatio: 2, MaxIncrease: caddy.Duration(time.Second)}},
+		{config: `latency fast`, wantErr: true},
+		{config: `latency 2x 1s 3x`, wantErr: true},
+		{config: `latency {
+			max_p99 1s
+		}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		var c LatencyComparer
+		err := c.UnmarshalCaddyfile(caddyfile.NewTestDispenser(tt.config))
+		if (err != nil) != tt.wantErr {
+			t.Errorf("UnmarshalCaddyfile(%q) error = %v, wantErr %v", tt.config, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && c != tt.want {
+			t.Errorf("UnmarshalCaddyfile(%q) = %+v, want %+v", tt.config, c, tt.want)
+		}
+	}
 }
@@ -0,0 +1,349 @@
+package mirror
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+var (
+	_ Credentials           = (*HeaderCredentials)(nil)
+	_ Credentials           = (*HMACCredentials)(nil)
+	_ Credentials           = (*TokenCredentials)(nil)
+	_ caddy.Provisioner     = (*HMACCredentials)(nil)
+	_ caddy.Provisioner     = (*TokenCredentials)(nil)
+	_ caddyfile.Unmarshaler = (*HeaderCredentials)(nil)
+	_ caddyfile.Unmarshaler = (*HMACCredentials)(nil)
+	_ caddyfile.Unmarshaler = (*TokenCredentials)(nil)
+)
+
+func init() {
+	caddy.RegisterModule(HeaderCredentials{})
+	caddy.RegisterModule(HMACCredentials{})
+	caddy.RegisterModule(TokenCredentials{})
+}
+
+// Credentials add credentials for the secondary to a mirrored request, which the original client never sent.
+// Credentials are loaded from the mirror.credentials namespace.
+//
+// Apply is called on the secondary's goroutine, after the request is cloned and its headers are filtered, and must be
+// safe for concurrent use. If it returns an error, the request isn't sent to the secondary.
+type Credentials interface {
+	Apply(r *http.Request) error
+}
+
+// HeaderCredentials sets a static header on every mirrored request
+type HeaderCredentials struct {
+	// Name is the name of the header, like X-Api-Key
+	Name string `json:"name"`
+	// Value supports placeholders, like {env.SHADOW_API_KEY}, and request placeholders
+	Value string `json:"value"`
+}
+
+func (HeaderCredentials) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "mirror.credentials.header",
+		New: func() caddy.Module { return new(HeaderCredentials) },
+	}
+}
+
+func (c *HeaderCredentials) Apply(r *http.Request) error {
+	value := c.Value
+	if repl, ok := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer); ok {
+		value = repl.ReplaceKnown(value, "")
+	}
+	r.Header.Set(c.Name, value)
+	return nil
+}
+
+func (c *HeaderCredentials) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume credentials name
+	if !d.Args(&c.Name, &c.Value) {
+		return d.ArgErr()
+	}
+	return nil
+}
+
+// HMACCredentials sign every mirrored request with an HMAC of its method, host, URI, a timestamp, and a hash of its
+// body. The string signed is those values, each followed by a newline:
+//
+//	<method>\n<host>\n<uri>\n<unix timestamp>\n<hex sha256 of the body>\n
+type HMACCredentials struct {
+	// Secret is the HMAC key. Placeholders are supported, like {env.SHADOW_SIGNING_KEY}.
+	Secret string `json:"secret"`
+	// Algorithm is sha256 or sha512. Defaults to sha256.
+	Algorithm string `json:"algorithm,omitempty"`
+	// Encoding of the signature, hex or base64. Defaults to hex.
+	Encoding string `json:"encoding,omitempty"`
+	// Header is the header the signature is sent in. Defaults to X-Signature.
+	Header string `json:"header,omitempty"`
+	// TimestampHeader is the header the timestamp is sent in. Defaults to X-Signature-Timestamp.
+	TimestampHeader string `json:"timestamp_header,omitempty"`
+
+	secret []byte
+	hash   func() hash.Hash
+	now    func() time.Time
+}
+
+func (HMACCredentials) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "mirror.credentials.hmac",
+		New: func() caddy.Module { return new(HMACCredentials) },
+	}
+}
+
+// Provision implements caddy.Provisioner
+func (c *HMACCredentials) Provision(_ caddy.Context) error {
+	if c.Header == "" {
+		c.Header = "X-Signature"
+	}
+	if c.TimestampHeader == "" {
+		c.TimestampHeader = "X-Signature-Timestamp"
+	}
+	switch c.Algorithm {
+	case "", "sha256":
+		c.hash = sha256.New
+	case "sha512":
+		c.hash = sha512.New
+	default:
+		return fmt.Errorf("unrecognized hmac algorithm '%s'", c.Algorithm)
+	}
+	switch c.Encoding {
+	case "", "hex", "base64":
+	default:
+		return fmt.Errorf("unrecognized hmac encoding '%s'", c.Encoding)
+	}
+
+	c.secret = []byte(caddy.NewReplacer().ReplaceKnown(c.Secret, ""))
+	if len(c.secret) == 0 {
+		return fmt.Errorf("hmac credentials require a secret")
+	}
+	c.now = time.Now
+	return nil
+}
+
+func (c *HMACCredentials) Apply(r *http.Request) error {
+	body := []byte{}
+	if r.Body != nil {
+		var err error
+		body, err = io.ReadAll(r.Body)
+		if err != nil {
+			return fmt.Errorf("error reading body to sign: %w", err)
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	timestamp := strconv.FormatInt(c.now().Unix(), 10)
+	bodyHash := sha256.Sum256(body)
+	mac := hmac.New(c.hash, c.secret)
+	for _, part := range []string{r.Method, r.Host, r.URL.RequestURI(), timestamp, hex.EncodeToString(bodyHash[:])} {
+		mac.Write([]byte(part))
+		mac.Write([]byte{'\n'})
+	}
+
+	signature := hex.EncodeToString(mac.Sum(nil))
+	if c.Encoding == "base64" {
+		signature = base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	}
+	r.Header.Set(c.TimestampHeader, timestamp)
+	r.Header.Set(c.Header, signature)
+	return nil
+}
+
+func (c *HMACCredentials) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume credentials name
+	if d.NextArg() {
+		c.Secret = d.Val()
+	}
+	for d.NextBlock(0) {
+		opt := d.Val()
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		switch opt {
+		case "secret":
+			c.Secret = d.Val()
+		case "algorithm":
+			c.Algorithm = d.Val()
+		case "encoding":
+			c.Encoding = d.Val()
+		case "header":
+			c.Header = d.Val()
+		case "timestamp_header":
+			c.TimestampHeader = d.Val()
+		default:
+			return d.Errf("unrecognized hmac credentials option '%s'", opt)
+		}
+	}
+	return nil
+}
+
+// TokenCredentials fetch a token with the OAuth 2.0 client credentials grant, and send it as a bearer token. The token
+// is cached, and fetched again shortly before it expires.
+type TokenCredentials struct {
+	// TokenURL is the authorization server's token endpoint, which is sent ClientID and Scopes to fetch a token
+	TokenURL string   `json:"token_url"`
+	ClientID string   `json:"client_id"`
+	Scopes   []string `json:"scopes,omitempty"`
+	// ClientSecret supports placeholders, like {env.SHADOW_CLIENT_SECRET}
+	ClientSecret string `json:"client_secret"`
+	// Header is the header the token is sent in, as "Bearer <token>". Defaults to Authorization.
+	Header string `json:"header,omitempty"`
+
+	clientSecret string
+	client       *http.Client
+	now          func() time.Time
+	cache        *tokenCache
+}
+
+// tokenCache is the last token fetched, and when it should be fetched again. If the last fetch failed, its error is
+// returned until retryAt, so requests don't each wait on a token endpoint which is down.
+type tokenCache struct {
+	mu      sync.Mutex
+	token   string
+	expiry  time.Time
+	err     error
+	retryAt time.Time
+}
+
+// tokenRetryInterval is how long a failed token fetch is returned before another is tried
+const tokenRetryInterval = 5 * time.Second
+
+func (TokenCredentials) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "mirror.credentials.token",
+		New: func() caddy.Module { return new(TokenCredentials) },
+	}
+}
+
+// Provision implements caddy.Provisioner
+func (c *TokenCredentials) Provision(_ caddy.Context) error {
+	if c.TokenURL == "" {
+		return fmt.Errorf("token credentials require a token_url")
+	}
+	if c.Header == "" {
+		c.Header = "Authorization"
+	}
+	c.clientSecret = caddy.NewReplacer().ReplaceKnown(c.ClientSecret, "")
+	c.client = &http.Client{Timeout: 10 * time.Second}
+	c.now = time.Now
+	c.cache = new(tokenCache)
+	return nil
+}
+
+func (c *TokenCredentials) Apply(r *http.Request) error {
+	token, err := c.currentToken()
+	if err != nil {
+		return err
+	}
+	r.Header.Set(c.Header, "Bearer "+token)
+	return nil
+}
+
+// currentToken returns the cached token, fetching a new one if it's expired or about to. Requests wait for the fetch,
+// so only one is made at a time. A failed fetch isn't tried again for tokenRetryInterval.
+func (c *TokenCredentials) currentToken() (string, error) {
+	c.cache.mu.Lock()
+	defer c.cache.mu.Unlock()
+	if c.cache.token != "" && c.now().Before(c.cache.expiry) {
+		return c.cache.token, nil
+	}
+	if c.cache.err != nil && c.now().Before(c.cache.retryAt) {
+		return "", c.cache.err
+	}
+
+	token, lifetime, err := c.fetchToken()
+	if err != nil {
+		c.cache.err, c.cache.retryAt = err, c.now().Add(tokenRetryInterval)
+		return "", err
+	}
+	c.cache.token, c.cache.expiry, c.cache.err = token, c.now().Add(lifetime), nil
+	return token, nil
+}
+
+// fetchToken fetches a token from the token endpoint, and returns it with how long it should be used for
+func (c *TokenCredentials) fetchToken() (string, time.Duration, error) {
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if len(c.Scopes) > 0 {
+		form.Set("scope", strings.Join(c.Scopes, " "))
+	}
+	req, err := http.NewRequest(http.MethodPost, c.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", 0, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(c.ClientID), url.QueryEscape(c.clientSecret))
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return "", 0, fmt.Errorf("error fetching token: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", 0, fmt.Errorf("error fetching token: %s", resp.Status)
+	}
+
+	var tok struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tok); err != nil {
+		return "", 0, fmt.Errorf("error decoding token: %w", err)
+	}
+	if tok.AccessToken == "" {
+		return "", 0, fmt.Errorf("token response has no access_token")
+	}
+
+	// Tokens without an expiry are refreshed every 5 minutes anyway. Others are refreshed when 90% of their lifetime
+	// has passed, so a request never goes out with a token that's about to expire.
+	lifetime := 5 * time.Minute
+	if tok.ExpiresIn > 0 {
+		lifetime = time.Duration(tok.ExpiresIn) * time.Second * 9 / 10
+	}
+	return tok.AccessToken, lifetime, nil
+}
+
+func (c *TokenCredentials) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume credentials name
+	if d.NextArg() {
+		c.TokenURL = d.Val()
+	}
+	for d.NextBlock(0) {
+		opt := d.Val()
+		args := d.RemainingArgs()
+		if len(args) < 1 {
+			return d.ArgErr()
+		}
+		switch opt {
+		case "token_url":
+			c.TokenURL = args[0]
+		case "client_id":
+			c.ClientID = args[0]
+		case "client_secret":
+			c.ClientSecret = args[0]
+		case "scopes":
+			c.Scopes = append(c.Scopes, args...)
+		case "header":
+			c.Header = args[0]
+		default:
+			return d.Errf("unrecognized token credentials option '%s'", opt)
+		}
+	}
+	return nil
+}
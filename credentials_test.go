@@ -0,0 +1,127 @@
+package mirror
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestHMACCredentials_Apply(t *testing.T) {
+	c := &HMACCredentials{Secret: "secret"}
+	if err := c.Provision(caddy.Context{}); err != nil {
+		t.Fatal(err)
+	}
+	c.now = func() time.Time { return time.Unix(1700000000, 0) }
+
+	r := httptest.NewRequest(http.MethodPost, "http://example.com/things?a=1", strings.NewReader(`{"a":1}`))
+	if err := c.Apply(r); err != nil {
+		t.Fatalf("Apply() error = %v", err)
+	}
+
+	bodyHash := sha256.Sum256([]byte(`{"a":1}`))
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte("POST\nexample.com\n/things?a=1\n1700000000\n" + hex.EncodeToString(bodyHash[:]) + "\n"))
+	if got, want := r.Header.Get("X-Signature"), hex.EncodeToString(mac.Sum(nil)); got != want {
+		t.Errorf("X-Signature = %s, want %s", got, want)
+	}
+	if got := r.Header.Get("X-Signature-Timestamp"); got != "1700000000" {
+		t.Errorf("X-Signature-Timestamp = %s, want 1700000000", got)
+	}
+
+	// The body must still be readable by the secondary
+	if body, _ := io.ReadAll(r.Body); string(body) != `{"a":1}` {
+		t.Errorf("body after signing = %q", body)
+	}
+}
+
+func TestTokenCredentials_Apply(t *testing.T) {
+	var fetches atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, secret, _ := r.BasicAuth()
+		if id != "mirror" || secret != "s3cret" || r.FormValue("grant_type") != "client_credentials" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		n := fetches.Add(1)
+		_, _ = w.Write([]byte(`{"access_token":"token` + string(rune('0'+n)) + `","expires_in":100}`))
+	}))
+	defer srv.Close()
+
+	t.Setenv("SHADOW_CLIENT_SECRET", "s3cret")
+	c := &TokenCredentials{TokenURL: srv.URL, ClientID: "mirror", ClientSecret: "{env.SHADOW_CLIENT_SECRET}"}
+	if err := c.Provision(caddy.Context{}); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	c.now = func() time.Time { return now }
+
+	apply := func() string {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if err := c.Apply(r); err != nil {
+			t.Fatalf("Apply() error = %v", err)
+		}
+		return r.Header.Get("Authorization")
+	}
+
+	if got := apply(); got != "Bearer token1" {
+		t.Errorf("Authorization = %s, want Bearer token1", got)
+	}
+	now = now.Add(80 * time.Second)
+	if got := apply(); got != "Bearer token1" {
+		t.Errorf("Authorization before refresh = %s, want the cached Bearer token1", got)
+	}
+	now = now.Add(20 * time.Second)
+	if got := apply(); got != "Bearer token2" {
+		t.Errorf("Authorization after refresh = %s, want Bearer token2", got)
+	}
+}
+
+func TestTokenCredentials_ApplyFailed(t *testing.T) {
+	var fetches atomic.Int32
+	var down atomic.Bool
+	down.Store(true)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		if down.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte(`{"access_token":"token","expires_in":100}`))
+	}))
+	defer srv.Close()
+
+	c := &TokenCredentials{TokenURL: srv.URL, ClientID: "mirror"}
+	if err := c.Provision(caddy.Context{}); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	c.now = func() time.Time { return now }
+
+	// While the endpoint is down, requests fail without each fetching a token
+	for range 3 {
+		if err := c.Apply(httptest.NewRequest(http.MethodGet, "/", nil)); err == nil {
+			t.Fatal("Apply() succeeded while the token endpoint is down")
+		}
+	}
+	if n := fetches.Load(); n != 1 {
+		t.Errorf("fetched %d times while the token endpoint was down, want 1", n)
+	}
+
+	down.Store(false)
+	now = now.Add(tokenRetryInterval)
+	if err := c.Apply(httptest.NewRequest(http.MethodGet, "/", nil)); err != nil {
+		t.Errorf("Apply() after the retry interval error = %v", err)
+	}
+	if n := fetches.Load(); n != 2 {
+		t.Errorf("fetched %d times, want a second fetch after the retry interval", n)
+	}
+}
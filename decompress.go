@@ -0,0 +1,72 @@
+package mirror
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// zstdDecoder is only used with DecodeAll, which is safe for concurrent use
+var zstdDecoder = sync.OnceValues(func() (*zstd.Decoder, error) {
+	return zstd.NewReader(nil)
+})
+
+// decompressible reports whether a response with this Content-Encoding can be decompressed to be compared
+func decompressible(encoding string) bool {
+	switch strings.ToLower(encoding) {
+	case "gzip", "x-gzip", "br", "zstd":
+		return true
+	}
+	return false
+}
+
+// decompress decodes a response body by its Content-Encoding
+func decompress(encoding string, body []byte) ([]byte, error) {
+	var r io.Reader
+	switch strings.ToLower(encoding) {
+	case "gzip", "x-gzip":
+		zr, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		r = zr
+	case "br":
+		r = brotli.NewReader(bytes.NewReader(body))
+	case "zstd":
+		dec, err := zstdDecoder()
+		if err != nil {
+			return nil, err
+		}
+		return dec.DecodeAll(body, nil)
+	default:
+		return nil, fmt.Errorf("unsupported encoding '%s'", encoding)
+	}
+	return io.ReadAll(r)
+}
+
+// decompressArtifact replaces a buffered, compressed response's body with the decompressed body. If it can't be
+// decompressed, the error is logged, and the body is dropped, so it isn't compared.
+func (h *Handler) decompressArtifact(name string, a *ResponseArtifact) {
+	encoding := a.Header.Get("Content-Encoding")
+	if !a.Buffered || encoding == "" || len(a.Body) == 0 {
+		return
+	}
+	body, err := decompress(encoding, a.Body)
+	if err != nil {
+		h.slogger.Warn("decompress_error",
+			slog.String("response", name),
+			slog.String("encoding", encoding),
+			slog.String("error", err.Error()),
+		)
+		a.Body, a.Buffered = nil, false
+		return
+	}
+	a.Body = body
+}
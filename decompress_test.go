@@ -0,0 +1,79 @@
+package mirror
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+func Test_decompress(t *testing.T) {
+	body := []byte(`{"id":1,"name":"widget"}`)
+	compress := func(w io.WriteCloser, buf *bytes.Buffer) []byte {
+		_, _ = w.Write(body)
+		_ = w.Close()
+		return buf.Bytes()
+	}
+
+	gz := new(bytes.Buffer)
+	br := new(bytes.Buffer)
+	zs := new(bytes.Buffer)
+	zw, err := zstd.NewWriter(zs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		encoding string
+		body     []byte
+	}{
+		{"gzip", compress(gzip.NewWriter(gz), gz)},
+		{"br", compress(brotli.NewWriter(br), br)},
+		{"zstd", compress(zw, zs)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.encoding, func(t *testing.T) {
+			if !decompressible(tt.encoding) {
+				t.Fatalf("decompressible(%s) = false", tt.encoding)
+			}
+			got, err := decompress(tt.encoding, tt.body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, body) {
+				t.Errorf("decompress() = %s, want %s", got, body)
+			}
+		})
+	}
+
+	if decompressible("deflate") {
+		t.Errorf("decompressible(deflate) = true")
+	}
+}
+
+func TestHandler_decompressArtifact(t *testing.T) {
+	var warned string
+	h := &Handler{slogger: &sloggerMock{warn: func(msg string, _ ...any) { warned = msg }}}
+
+	a := ResponseArtifact{Header: http.Header{"Content-Encoding": {"gzip"}}, Body: []byte("not gzip"), Buffered: true}
+	h.decompressArtifact("primary", &a)
+	if a.Buffered || a.Body != nil {
+		t.Errorf("a body which can't be decompressed is still buffered")
+	}
+	if warned != "decompress_error" {
+		t.Errorf("logged %q, want decompress_error", warned)
+	}
+}
+
+func TestHandler_shouldBuffer_decompress(t *testing.T) {
+	h := &Handler{ComparisonConfig: ComparisonConfig{CompareBody: true, Decompress: true}}
+	for encoding, want := range map[string]bool{"gzip": true, "br": true, "zstd": true, "deflate": false} {
+		if got := h.shouldBuffer(http.StatusOK, http.Header{"Content-Encoding": {encoding}}); got != want {
+			t.Errorf("shouldBuffer() with %s = %v, want %v", encoding, got, want)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package mirror
+
+import (
+	"crypto/sha256"
+	"hash"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+var _ caddyfile.Unmarshaler = (*DedupeConfig)(nil)
+
+// DedupeConfig sends each distinct request to the secondary only once per window, so thousands of identical polling
+// requests don't add load without adding information. Requests are told apart by their fingerprint: their method, host,
+// cleaned path, query with its parameters sorted, and body. Duplicates are only known once the body is read, after
+// they're sampled, so they still count as mirrored.
+type DedupeConfig struct {
+	// Window is how long a fingerprint is remembered after its request is mirrored. Defaults to 1m.
+	Window caddy.Duration `json:"window,omitempty"`
+	// MaxFingerprints caps how many fingerprints are remembered. Once it's reached, and none have expired, every
+	// fingerprint is forgotten, so a few duplicates are mirrored instead of memory growing. Defaults to 100000.
+	MaxFingerprints int `json:"max_fingerprints,omitempty"`
+}
+
+func (c *DedupeConfig) provision() {
+	if c.Window == 0 {
+		c.Window = caddy.Duration(time.Minute)
+	}
+	if c.MaxFingerprints == 0 {
+		c.MaxFingerprints = 100000
+	}
+}
+
+func (c *DedupeConfig) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume "dedupe"
+	if d.NextArg() {
+		window, err := caddy.ParseDuration(d.Val())
+		if err != nil {
+			return d.Errf("error parsing window: %v", err)
+		}
+		c.Window = caddy.Duration(window)
+	}
+	for d.NextBlock(0) {
+		opt := d.Val()
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		switch opt {
+		case "window":
+			window, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("error parsing window: %v", err)
+			}
+			c.Window = caddy.Duration(window)
+		case "max_fingerprints":
+			n, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("error parsing max_fingerprints: %v", err)
+			}
+			c.MaxFingerprints = n
+		default:
+			return d.Errf("unrecognized dedupe option '%s'", opt)
+		}
+	}
+	return nil
+}
+
+// fingerprint is a hash of a request's method, host, path, query, and body
+type fingerprint [sha256.Size]byte
+
+// fingerprintRequest starts a request's fingerprint. The body is written to the hash once it's read.
+func fingerprintRequest(r *http.Request) hash.Hash {
+	p := r.URL.Path
+	if p == "" {
+		p = "/"
+	}
+	fp := sha256.New()
+	for _, part := range []string{strings.ToUpper(r.Method), strings.ToLower(r.Host), path.Clean(p), r.URL.Query().Encode()} {
+		fp.Write([]byte(part))
+		fp.Write([]byte{0})
+	}
+	return fp
+}
+
+// deduper remembers the fingerprints of mirrored requests, each until its window is over. Methods are safe to call on a
+// nil *deduper, which treats every request as distinct.
+type deduper struct {
+	window time.Duration
+	max    int
+	now    func() time.Time
+
+	mu sync.Mutex
+	// expires is when each fingerprint is forgotten
+	expires map[fingerprint]time.Time
+}
+
+func newDeduper(c DedupeConfig, now func() time.Time) *deduper {
+	return &deduper{
+		window:  time.Duration(c.Window),
+		max:     c.MaxFingerprints,
+		now:     now,
+		expires: make(map[fingerprint]time.Time),
+	}
+}
+
+// fingerprint starts a request's fingerprint, or returns nil if requests aren't deduplicated
+func (d *deduper) fingerprint(r *http.Request) hash.Hash {
+	if d == nil {
+		return nil
+	}
+	return fingerprintRequest(r)
+}
+
+// first finishes a fingerprint with the request's body, and reports whether it's the first with that fingerprint in
+// the window. If it is, the fingerprint is remembered.
+func (d *deduper) first(fp hash.Hash, body []byte) bool {
+	if d == nil {
+		return true
+	}
+	fp.Write(body)
+	var key fingerprint
+	fp.Sum(key[:0])
+
+	now := d.now()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if expires, ok := d.expires[key]; ok && now.Before(expires) {
+		return false
+	}
+	if len(d.expires) >= d.max {
+		for k, expires := range d.expires {
+			if !now.Before(expires) {
+				delete(d.expires, k)
+			}
+		}
+		if len(d.expires) >= d.max {
+			clear(d.expires)
+		}
+	}
+	d.expires[key] = now.Add(d.window)
+	return true
+}
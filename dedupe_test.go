@@ -0,0 +1,87 @@
+package mirror
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func Test_deduper_first(t *testing.T) {
+	now := time.Now()
+	c := DedupeConfig{Window: caddy.Duration(time.Minute), MaxFingerprints: 2}
+	d := newDeduper(c, func() time.Time { return now })
+	first := func(target, body string) bool {
+		return d.first(d.fingerprint(httptest.NewRequest(http.MethodPost, target, nil)), []byte(body))
+	}
+
+	if !first("/poll?b=2&a=1", "{}") {
+		t.Errorf("first() = false for a new request")
+	}
+	if first("/./poll?a=1&b=2", "{}") {
+		t.Errorf("first() = true for the same request with its path and query normalized differently")
+	}
+	if !first("/poll?a=1&b=2", `{"id":1}`) {
+		t.Errorf("first() = false for a request with another body")
+	}
+
+	now = now.Add(time.Minute)
+	if !first("/poll?a=1&b=2", "{}") {
+		t.Errorf("first() = false once the window was over")
+	}
+	if !first("/other", "") || len(d.expires) > c.MaxFingerprints {
+		t.Errorf("remembered %d fingerprints, want at most %d", len(d.expires), c.MaxFingerprints)
+	}
+
+	var none *deduper
+	if none.fingerprint(httptest.NewRequest(http.MethodGet, "/", nil)) != nil || !none.first(nil, nil) {
+		t.Errorf("a nil deduper deduplicated")
+	}
+}
+
+func TestHandler_ServeHTTP_dedupe(t *testing.T) {
+	var sent, compared atomic.Int64
+	h := &Handler{
+		ComparisonConfig:  ComparisonConfig{CompareStatus: true},
+		Dedupe:            &DedupeConfig{},
+		MirrorRate:        1,
+		stats:             newStats(),
+		slogger:           nullLogger{},
+		comparisonSlogger: nullLogger{},
+		now:               time.Now,
+		reporters: []Reporter{reporterFunc(func(Report) {
+			compared.Add(1)
+		})},
+		primary: middlewareHandlerFunc(func(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+			w.WriteHeader(http.StatusOK)
+			return nil
+		}),
+		secondary: middlewareHandlerFunc(func(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+			sent.Add(1)
+			w.WriteHeader(http.StatusOK)
+			return nil
+		}),
+	}
+	h.Dedupe.provision()
+	h.dedupe = newDeduper(*h.Dedupe, h.now)
+
+	for _, body := range []string{"a", "a", "b"} {
+		r := httptest.NewRequest(http.MethodPost, "/jobs", strings.NewReader(body))
+		r = r.WithContext(context.WithValue(r.Context(), caddyhttp.VarsCtxKey, make(map[string]any)))
+		if err := h.ServeHTTP(&NopResponseWriter{}, r, nil); err != nil {
+			t.Fatal(err)
+		}
+		for h.stats.comparing.Load() > 0 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	if sent.Load() != 2 || compared.Load() != 2 {
+		t.Errorf("sent %d and compared %d requests, want 2 and 2", sent.Load(), compared.Load())
+	}
+}
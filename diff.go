@@ -0,0 +1,186 @@
+package mirror
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+const (
+	// diffContext is the number of unchanged lines around each hunk
+	diffContext = 3
+	// maxDiffCells bounds the work done to diff the changed middle of two bodies. Bodies which differ in more lines
+	// than this allows aren't diffed.
+	maxDiffCells = 4_000_000
+)
+
+type diffOp struct {
+	kind byte // ' ', '-', or '+'
+	line string
+}
+
+// bodyDiff returns a unified diff from the primary body to the secondary body. JSON bodies are indented first, so a
+// change to a single value shows up as a change to a single line. An empty string means the bodies are equal, or too
+// different to diff.
+func bodyDiff(primary, secondary []byte) string {
+	return unifiedDiff(diffLines(primary), diffLines(secondary))
+}
+
+// diffStats counts the lines the diff from the primary body to the secondary body adds and removes. ok is false if the
+// bodies are too different to diff.
+func diffStats(primary, secondary []byte) (added, removed int, ok bool) {
+	a, b := diffLines(primary), diffLines(secondary)
+	ops := diffOps(a, b)
+	if ops == nil {
+		return 0, 0, slices.Equal(a, b)
+	}
+	for _, op := range ops {
+		switch op.kind {
+		case '+':
+			added++
+		case '-':
+			removed++
+		}
+	}
+	return added, removed, true
+}
+
+func diffLines(body []byte) []string {
+	var indented bytes.Buffer
+	if json.Valid(body) && json.Indent(&indented, body, "", "  ") == nil {
+		body = indented.Bytes()
+	}
+	if len(body) == 0 {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(string(body), "\n"), "\n")
+}
+
+func unifiedDiff(a, b []string) string {
+	ops := diffOps(a, b)
+	if ops == nil {
+		return ""
+	}
+
+	var sb strings.Builder
+	sb.WriteString("--- primary\n+++ secondary\n")
+
+	// Line numbers, 1-indexed, of the current op in a and b
+	ai, bi := 1, 1
+	for start := 0; start < len(ops); {
+		// Find the next change
+		for start < len(ops) && ops[start].kind == ' ' {
+			ai, bi, start = ai+1, bi+1, start+1
+		}
+		if start == len(ops) {
+			break
+		}
+
+		// Extend the hunk until there are more than twice the context lines unchanged
+		end := start
+		for unchanged := 0; end < len(ops) && unchanged <= 2*diffContext; end++ {
+			if ops[end].kind == ' ' {
+				unchanged++
+			} else {
+				unchanged = 0
+			}
+		}
+		for end > start && ops[end-1].kind == ' ' {
+			end--
+		}
+
+		lead := min(diffContext, start)
+		trail := min(diffContext, len(ops)-end)
+		hunk := ops[start-lead : end+trail]
+
+		var aLen, bLen int
+		for _, op := range hunk {
+			if op.kind != '+' {
+				aLen++
+			}
+			if op.kind != '-' {
+				bLen++
+			}
+		}
+		_, _ = fmt.Fprintf(&sb, "@@ -%d,%d +%d,%d @@\n", ai-lead, aLen, bi-lead, bLen)
+		for _, op := range hunk {
+			sb.WriteByte(op.kind)
+			sb.WriteString(op.line)
+			sb.WriteByte('\n')
+		}
+
+		for _, op := range ops[start:end] {
+			if op.kind != '+' {
+				ai++
+			}
+			if op.kind != '-' {
+				bi++
+			}
+		}
+		start = end
+	}
+
+	return sb.String()
+}
+
+// diffOps returns the edit script from a to b, or nil if they're equal or too different to diff
+func diffOps(a, b []string) []diffOp {
+	// Trim the common prefix and suffix, which are usually most of a body
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	if prefix == len(a) && prefix == len(b) {
+		return nil
+	}
+
+	am, bm := a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]
+	if (len(am)+1)*(len(bm)+1) > maxDiffCells {
+		return nil
+	}
+
+	ops := make([]diffOp, 0, len(a)+len(b))
+	for _, line := range a[:prefix] {
+		ops = append(ops, diffOp{' ', line})
+	}
+
+	// Longest common subsequence of the middle, where lcs[i][j] is the LCS length of am[i:] and bm[j:]
+	lcs := make([][]int, len(am)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(bm)+1)
+	}
+	for i := len(am) - 1; i >= 0; i-- {
+		for j := len(bm) - 1; j >= 0; j-- {
+			if am[i] == bm[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+	i, j := 0, 0
+	for i < len(am) || j < len(bm) {
+		switch {
+		case i < len(am) && j < len(bm) && am[i] == bm[j]:
+			ops = append(ops, diffOp{' ', am[i]})
+			i, j = i+1, j+1
+		case j == len(bm) || (i < len(am) && lcs[i+1][j] >= lcs[i][j+1]):
+			ops = append(ops, diffOp{'-', am[i]})
+			i++
+		default:
+			ops = append(ops, diffOp{'+', bm[j]})
+			j++
+		}
+	}
+
+	for _, line := range a[len(a)-suffix:] {
+		ops = append(ops, diffOp{' ', line})
+	}
+	return ops
+}
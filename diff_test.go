@@ -0,0 +1,61 @@
+package mirror
+
+import "testing"
+
+func Test_bodyDiff(t *testing.T) {
+	tests := []struct {
+		name      string
+		primary   string
+		secondary string
+		want      string
+	}{
+		{
+			name:      "equal",
+			primary:   "a\nb\n",
+			secondary: "a\nb\n",
+			want:      "",
+		},
+		{
+			name:      "changed line",
+			primary:   "1\n2\n3\n4\n5\n6\n7\n8\n9\n",
+			secondary: "1\n2\n3\n4\nfive\n6\n7\n8\n9\n",
+			want:      "--- primary\n+++ secondary\n@@ -2,7 +2,7 @@\n 2\n 3\n 4\n-5\n+five\n 6\n 7\n 8\n",
+		},
+		{
+			name:      "separate hunks",
+			primary:   "a\n1\n2\n3\n4\n5\n6\n7\n8\nb\n",
+			secondary: "A\n1\n2\n3\n4\n5\n6\n7\n8\nB\n",
+			want: "--- primary\n+++ secondary\n@@ -1,4 +1,4 @@\n-a\n+A\n 1\n 2\n 3\n" +
+				"@@ -7,4 +7,4 @@\n 6\n 7\n 8\n-b\n+B\n",
+		},
+		{
+			name:      "insertion",
+			primary:   "a\nc\n",
+			secondary: "a\nb\nc\n",
+			want:      "--- primary\n+++ secondary\n@@ -1,2 +1,3 @@\n a\n+b\n c\n",
+		},
+		{
+			name:      "json is indented",
+			primary:   `{"a":1,"b":2}`,
+			secondary: `{"a":1,"b":3}`,
+			want:      "--- primary\n+++ secondary\n@@ -1,4 +1,4 @@\n {\n   \"a\": 1,\n-  \"b\": 2\n+  \"b\": 3\n }\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := bodyDiff([]byte(tt.primary), []byte(tt.secondary)); got != tt.want {
+				t.Errorf("bodyDiff() =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_diffStats(t *testing.T) {
+	added, removed, ok := diffStats([]byte(`{"a":1,"b":2}`), []byte(`{"a":1,"b":3,"c":4}`))
+	if !ok || added != 2 || removed != 1 {
+		t.Errorf("diffStats() = %d, %d, %v, want 2, 1, true", added, removed, ok)
+	}
+	if _, _, ok := diffStats([]byte("same"), []byte("same")); !ok {
+		t.Errorf("diffStats() of equal bodies isn't ok")
+	}
+}
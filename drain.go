@@ -0,0 +1,117 @@
+package mirror
+
+import (
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// drainer stops a handler from mirroring new requests, and tracks when the requests already mirrored are done. Methods
+// are safe to call on a nil *drainer, which is never draining.
+type drainer struct {
+	stats   *stats
+	slogger slogger
+	now     func() time.Time
+	// poll is how often in-flight requests are checked while draining
+	poll time.Duration
+
+	// draining is read on every request, so it's atomic. It's only changed while holding mu, along with the rest.
+	draining           atomic.Bool
+	mu                 sync.Mutex
+	started, completed time.Time
+	// complete is closed when the current drain completes
+	complete chan struct{}
+}
+
+// drainStatus is the state of a drain, as served by the admin API
+type drainStatus struct {
+	Draining  bool       `json:"draining"`
+	Complete  bool       `json:"complete"`
+	Started   *time.Time `json:"started,omitempty"`
+	Completed *time.Time `json:"completed,omitempty"`
+	// InFlight and Comparing are the secondary requests and comparisons still running
+	InFlight  int64 `json:"in_flight"`
+	Comparing int64 `json:"comparing"`
+}
+
+func newDrainer(stats *stats, slogger slogger, now func() time.Time) *drainer {
+	return &drainer{stats: stats, slogger: slogger, now: now, poll: 100 * time.Millisecond}
+}
+
+// active reports whether new requests shouldn't be mirrored
+func (d *drainer) active() bool {
+	if d == nil {
+		return false
+	}
+	return d.draining.Load()
+}
+
+// start stops mirroring, and waits in the background for in-flight requests to finish, until done is closed. It
+// returns a channel which is closed when the drain completes. Starting a drain which already started does nothing.
+func (d *drainer) start(done <-chan struct{}) <-chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.draining.Load() {
+		return d.complete
+	}
+
+	d.draining.Store(true)
+	d.started, d.completed = d.now(), time.Time{}
+	complete := make(chan struct{})
+	d.complete = complete
+	d.slogger.Info("mirror_drain_started")
+	go d.wait(complete, done)
+	return complete
+}
+
+func (d *drainer) wait(complete chan struct{}, done <-chan struct{}) {
+	ticker := time.NewTicker(d.poll)
+	defer ticker.Stop()
+	for d.stats.inFlight.Load() > 0 || d.stats.comparing.Load() > 0 {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.complete != complete {
+		// Mirroring resumed, and maybe another drain started, before this one completed
+		return
+	}
+	d.completed = d.now()
+	close(complete)
+	d.slogger.Info("mirror_drain_complete", slog.Duration("duration", d.completed.Sub(d.started)))
+}
+
+// resume starts mirroring again
+func (d *drainer) resume() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.draining.Load() {
+		d.slogger.Info("mirror_drain_resumed")
+	}
+	d.draining.Store(false)
+	d.started, d.completed, d.complete = time.Time{}, time.Time{}, nil
+}
+
+func (d *drainer) status() drainStatus {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	s := drainStatus{
+		Draining:  d.draining.Load(),
+		Complete:  !d.completed.IsZero(),
+		InFlight:  d.stats.inFlight.Load(),
+		Comparing: d.stats.comparing.Load(),
+	}
+	if !d.started.IsZero() {
+		s.Started = ptr(d.started)
+	}
+	if !d.completed.IsZero() {
+		s.Completed = ptr(d.completed)
+	}
+	return s
+}
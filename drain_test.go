@@ -0,0 +1,84 @@
+package mirror
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func Test_drainer(t *testing.T) {
+	s := newStats()
+	d := newDrainer(s, nullLogger{}, time.Now)
+	d.poll = time.Millisecond
+	done := make(chan struct{})
+	defer close(done)
+
+	s.started()
+	s.comparisonStarted()
+	complete := d.start(done)
+	if !d.active() {
+		t.Fatalf("active() = false after start")
+	}
+	if again := d.start(done); again != complete {
+		t.Errorf("start() while draining started another drain")
+	}
+
+	s.finished()
+	select {
+	case <-complete:
+		t.Fatalf("drain completed while a comparison was running")
+	case <-time.After(20 * time.Millisecond):
+	}
+	if st := d.status(); !st.Draining || st.Complete || st.Comparing != 1 {
+		t.Errorf("status() = %+v, want draining with a comparison running", st)
+	}
+
+	s.comparisonFinished()
+	select {
+	case <-complete:
+	case <-time.After(time.Second):
+		t.Fatalf("drain didn't complete")
+	}
+	if st := d.status(); !st.Complete || st.Completed == nil {
+		t.Errorf("status() = %+v, want complete", st)
+	}
+
+	d.resume()
+	if d.active() || d.status().Started != nil {
+		t.Errorf("still draining after resume()")
+	}
+
+	var unset *drainer
+	if unset.active() {
+		t.Errorf("nil active() = true")
+	}
+}
+
+func TestAdminAPI_serveDrain(t *testing.T) {
+	h := &Handler{Name: "drain-test", MirrorRate: 1, stats: newStats(), done: make(chan struct{})}
+	h.drain = newDrainer(h.stats, nullLogger{}, time.Now)
+	defer close(h.done)
+	namedHandlers.register(h.Name, h)
+	defer namedHandlers.unregister(h.Name, h)
+
+	w := httptest.NewRecorder()
+	if err := new(AdminAPI).serve(w, httptest.NewRequest(http.MethodPost, "/mirror/drain-test/drain?wait=1s", nil)); err != nil {
+		t.Fatalf("serve() error = %v", err)
+	}
+	var got drainStatus
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil || !got.Draining || !got.Complete {
+		t.Errorf("unexpected drain status: %s", w.Body)
+	}
+	if h.shouldMirror(httptest.NewRequest(http.MethodGet, "/", nil)) {
+		t.Errorf("shouldMirror() = true while draining")
+	}
+
+	if err := new(AdminAPI).serve(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/mirror/drain-test/resume", nil)); err != nil {
+		t.Fatalf("serve() error = %v", err)
+	}
+	if !h.shouldMirror(httptest.NewRequest(http.MethodGet, "/", nil)) {
+		t.Errorf("shouldMirror() = false after resuming")
+	}
+}
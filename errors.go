@@ -0,0 +1,103 @@
+package mirror
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"runtime/debug"
+	"syscall"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// Error classes, for the shadow_errors metric
+const (
+	errorTimeout    = "timeout"
+	errorConnection = "connection"
+	errorHandler    = "handler"
+	errorPanic      = "panic"
+)
+
+var errorClasses = []string{errorTimeout, errorConnection, errorHandler, errorPanic}
+
+// Context outcomes, for the timeouts_total metric
+const (
+	contextDeadlineExceeded = "deadline_exceeded"
+	contextCanceled         = "canceled"
+)
+
+var contextOutcomes = []string{contextDeadlineExceeded, contextCanceled}
+
+// panicError is a recovered panic
+type panicError struct {
+	value any
+	stack []byte
+}
+
+func (p *panicError) Error() string {
+	return fmt.Sprintf("panic: %v\n%s", p.value, p.stack)
+}
+
+// recoverHandler turns panics in a handler into errors. The secondary is run in its own goroutine, outside Caddy's own
+// panic recovery, so a panic there would otherwise take down the whole server.
+type recoverHandler struct {
+	caddyhttp.MiddlewareHandler
+}
+
+func (rh recoverHandler) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = &panicError{value: p, stack: debug.Stack()}
+		}
+	}()
+	return rh.MiddlewareHandler.ServeHTTP(w, r, next)
+}
+
+// contextOutcome tells whether a handler which failed with err ran out of time, or was cancelled, going by the error
+// and by ctx, the context the handler ran with. It's "" if the handler didn't fail, or failed for any other reason.
+func contextOutcome(ctx context.Context, err error) string {
+	switch {
+	case err == nil:
+		return ""
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(ctx.Err(), context.DeadlineExceeded):
+		return contextDeadlineExceeded
+	case errors.Is(err, context.Canceled), errors.Is(ctx.Err(), context.Canceled):
+		return contextCanceled
+	}
+	return ""
+}
+
+// classifyError tells whether a handler failed because it timed out, couldn't connect to its backend, panicked, or
+// returned any other error
+func classifyError(err error) string {
+	var (
+		pe  *panicError
+		he  caddyhttp.HandlerError
+		ne  net.Error
+		ope *net.OpError
+		dne *net.DNSError
+	)
+	switch {
+	case errors.As(err, &pe):
+		return errorPanic
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &ne) && ne.Timeout():
+		return errorTimeout
+	case errors.As(err, &ope), errors.As(err, &dne),
+		errors.Is(err, syscall.ECONNREFUSED), errors.Is(err, syscall.ECONNRESET), errors.Is(err, io.ErrUnexpectedEOF):
+		return errorConnection
+	}
+
+	// reverse_proxy wraps its errors, reporting timeouts as 504s and failures to reach the upstream as 502s
+	if errors.As(err, &he) {
+		switch he.StatusCode {
+		case http.StatusGatewayTimeout:
+			return errorTimeout
+		case http.StatusBadGateway:
+			return errorConnection
+		}
+	}
+	return errorHandler
+}
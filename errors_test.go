@@ -0,0 +1,75 @@
+package mirror
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func Test_classifyError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{"deadline", fmt.Errorf("wrapped: %w", context.DeadlineExceeded), errorTimeout},
+		{"gateway timeout", caddyhttp.Error(http.StatusGatewayTimeout, errors.New("upstream slow")), errorTimeout},
+		{"refused", &net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}, errorConnection},
+		{"bad gateway", caddyhttp.Error(http.StatusBadGateway, errors.New("no upstreams")), errorConnection},
+		{"panic", &panicError{value: "oops"}, errorPanic},
+		{"other", caddyhttp.Error(http.StatusForbidden, errors.New("nope")), errorHandler},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := classifyError(tt.err); got != tt.want {
+				t.Errorf("classifyError() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_contextOutcome(t *testing.T) {
+	expired, cancel := context.WithDeadline(context.Background(), time.Unix(0, 0))
+	defer cancel()
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		name string
+		ctx  context.Context
+		err  error
+		want string
+	}{
+		{"no error", expired, nil, ""},
+		{"deadline", context.Background(), fmt.Errorf("wrapped: %w", context.DeadlineExceeded), contextDeadlineExceeded},
+		{"expired context", expired, caddyhttp.Error(http.StatusGatewayTimeout, errors.New("upstream slow")), contextDeadlineExceeded},
+		{"canceled", context.Background(), context.Canceled, contextCanceled},
+		{"canceled context", canceled, caddyhttp.Error(http.StatusBadGateway, errors.New("no upstreams")), contextCanceled},
+		{"other", context.Background(), caddyhttp.Error(http.StatusGatewayTimeout, errors.New("upstream slow")), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := contextOutcome(tt.ctx, tt.err); got != tt.want {
+				t.Errorf("contextOutcome() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_recoverHandler(t *testing.T) {
+	rh := recoverHandler{middlewareHandlerFunc(func(http.ResponseWriter, *http.Request, caddyhttp.Handler) error {
+		panic("oops")
+	})}
+	err := rh.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil), nil)
+	if classifyError(err) != errorPanic {
+		t.Errorf("ServeHTTP() error = %v, want a panic", err)
+	}
+}
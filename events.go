@@ -0,0 +1,207 @@
+package mirror
+
+import (
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+)
+
+// EventVersion is the version of the Event schema, which is described by event.schema.json. It's only incremented for
+// changes which aren't backward compatible, like a field being removed or changing its type. Fields may be added to
+// the same version.
+const EventVersion = 1
+
+// defaultMaxDiffBytes bounds the size of a report's diffs, unless max_diff_bytes is set
+const defaultMaxDiffBytes = 16 << 10
+
+// Event is the JSON representation of a Report, used by every reporter which publishes or keeps reports
+type Event struct {
+	// Version is the EventVersion the event was written with
+	Version int `json:"version"`
+	// ID identifies the report. Every reporter gets the same ID for the same report, and mismatch logs include it.
+	ID      string         `json:"id"`
+	Time    time.Time      `json:"time"`
+	Request RequestSummary `json:"request"`
+	Match   bool           `json:"match"`
+	// Category is the category classify rules gave a mismatch, if any did
+	Category string `json:"category,omitempty"`
+	// Excluded is set if the request wasn't compared because its secondary failed
+	Excluded bool `json:"excluded,omitempty"`
+	// Artifacts references where the mismatch's artifacts were written, if the handler writes them
+	Artifacts string        `json:"artifacts,omitempty"`
+	Results   []EventResult `json:"results"`
+
+	PrimaryStatus   int          `json:"primary_status"`
+	SecondaryStatus int          `json:"secondary_status"`
+	Timings         EventTimings `json:"timings"`
+
+	// Diff is a unified diff from the primary's body to the secondary's, if their bodies mismatched. A diff longer than
+	// the handler's max_diff_bytes is cut short, with a marker line, and DiffTruncated is set. DiffHunksOmitted counts
+	// the hunks which were left out.
+	Diff             string `json:"diff,omitempty"`
+	DiffTruncated    bool   `json:"diff_truncated,omitempty"`
+	DiffHunksOmitted int    `json:"diff_hunks_omitted,omitempty"`
+
+	// Primary and Secondary are only included if the reporter is configured to include artifacts
+	Primary   *ResponseArtifact `json:"primary,omitempty"`
+	Secondary *ResponseArtifact `json:"secondary,omitempty"`
+}
+
+// EventTimings are how long each handler took to respond, in milliseconds
+type EventTimings struct {
+	PrimaryMS   float64 `json:"primary_ms"`
+	SecondaryMS float64 `json:"secondary_ms"`
+}
+
+// EventResult is the JSON representation of a Result
+type EventResult struct {
+	Comparer string         `json:"comparer"`
+	Match    bool           `json:"match"`
+	Skipped  bool           `json:"skipped,omitempty"`
+	Advisory bool           `json:"advisory,omitempty"`
+	Details  map[string]any `json:"details,omitempty"`
+}
+
+// newEvent converts a Report to an Event. Artifacts are copied, so the Event remains valid after Report returns.
+func newEvent(rep Report, includeArtifacts bool) Event {
+	ev := Event{
+		Version:         EventVersion,
+		ID:              rep.ID,
+		Time:            rep.Time,
+		Request:         rep.Request,
+		Match:           rep.Match,
+		Category:        rep.Category,
+		Excluded:        rep.Excluded,
+		Artifacts:       rep.Artifacts,
+		Results:         eventResults(rep, includeArtifacts),
+		PrimaryStatus:   rep.Primary.Status,
+		SecondaryStatus: rep.Secondary.Status,
+		Timings: EventTimings{
+			PrimaryMS:   milliseconds(rep.Primary.Duration),
+			SecondaryMS: milliseconds(rep.Secondary.Duration),
+		},
+	}
+	for _, res := range ev.Results {
+		if res.Comparer == "body" && !res.Match && !res.Skipped {
+			ev.setDiff(bodyDiff(rep.Primary.Body, rep.Secondary.Body), rep.maxDiffBytes)
+			break
+		}
+	}
+
+	if includeArtifacts {
+		ev.Primary, ev.Secondary = copyArtifact(rep.Primary), copyArtifact(rep.Secondary)
+	}
+
+	return ev
+}
+
+// eventResults converts a Report's results. Only mismatches have details. Bodies, and previews of binary ones, are
+// only in the details if artifacts are included.
+func eventResults(rep Report, includeArtifacts bool) []EventResult {
+	results := make([]EventResult, len(rep.Results))
+	for i, res := range rep.Results {
+		results[i] = EventResult{
+			Comparer: res.Comparer,
+			Match:    res.Match,
+			Skipped:  res.Skipped,
+			Advisory: res.Advisory,
+		}
+		if !res.Match && !res.Skipped {
+			attrs := res.Attrs
+			if !includeArtifacts {
+				attrs = slices.DeleteFunc(slices.Clone(attrs), func(attr slog.Attr) bool {
+					switch attr.Key {
+					case "primary_body", "shadow_body", "primary_hex", "shadow_hex":
+						return true
+					}
+					return false
+				})
+			}
+			results[i].Details = attrsToMap(attrs)
+		}
+	}
+	return results
+}
+
+func (ev *Event) setDiff(diff string, limit int) {
+	ev.Diff, ev.DiffHunksOmitted, ev.DiffTruncated = truncateDiff(diff, limit)
+}
+
+// truncateDiff cuts a diff longer than limit bytes short, or defaultMaxDiffBytes if limit isn't set, and reports how
+// many hunks it left out, and whether it cut the diff at all. The diff is cut after the last whole hunk which fits, or
+// at the last whole line of the first hunk if none does, and ends with a marker line saying how much was left out.
+func truncateDiff(diff string, limit int) (truncated string, omitted int, ok bool) {
+	if limit <= 0 {
+		limit = defaultMaxDiffBytes
+	}
+	if len(diff) <= limit {
+		return diff, 0, false
+	}
+
+	var hunks []int
+	for i := strings.Index(diff, "\n@@ "); i >= 0; {
+		hunks = append(hunks, i+1)
+		next := strings.Index(diff[i+1:], "\n@@ ")
+		if next < 0 {
+			break
+		}
+		i += 1 + next
+	}
+
+	// Leave room for the marker
+	budget := max(limit-diffMarkerBytes, 0)
+	cut := strings.LastIndexByte(diff[:budget], '\n') + 1
+	for i := len(hunks) - 1; i > 0; i-- {
+		if hunks[i] <= budget {
+			cut = hunks[i]
+			break
+		}
+	}
+	// The marker describes what's left once the diff is cut: how much of it is kept, and how many hunks don't start in
+	// what's kept
+	kept := diff[:cut]
+	total := countHunks(diff)
+	omitted = total - countHunks(kept)
+	marker := fmt.Sprintf("\\ Diff truncated after %d of %d bytes, %d of %d hunks omitted\n", len(kept), len(diff), omitted, total)
+	return kept + marker, omitted, true
+}
+
+// countHunks counts the hunks which start in a diff
+func countHunks(diff string) int {
+	return strings.Count("\n"+diff, "\n@@ ")
+}
+
+// diffMarkerBytes is enough room for truncateDiff's marker line
+const diffMarkerBytes = 96
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func copyArtifact(a ResponseArtifact) *ResponseArtifact {
+	a.Header = a.Header.Clone()
+	if a.Body != nil {
+		a.Body = append([]byte(nil), a.Body...)
+	}
+	return &a
+}
+
+// attrsToMap converts slog attributes to a map, with groups as nested maps
+func attrsToMap(attrs []slog.Attr) map[string]any {
+	if len(attrs) == 0 {
+		return nil
+	}
+
+	m := make(map[string]any, len(attrs))
+	for _, attr := range attrs {
+		v := attr.Value.Resolve()
+		if v.Kind() == slog.KindGroup {
+			m[attr.Key] = attrsToMap(v.Group())
+		} else {
+			m[attr.Key] = v.Any()
+		}
+	}
+	return m
+}
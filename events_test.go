@@ -0,0 +1,212 @@
+package mirror
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_newEvent(t *testing.T) {
+	rep := Report{
+		Time:    time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		Request: RequestSummary{Method: "GET", Host: "example.com", URI: "/a?b=c"},
+		Results: []Result{
+			{Comparer: "status", Match: true, Attrs: []slog.Attr{slog.Int("primary_status", 200)}},
+			{Comparer: "header", Attrs: []slog.Attr{slog.Group("Content-Type",
+				slog.Any("primary_values", []string{"text/plain"}),
+				slog.Any("shadow_values", []string{"text/html"}),
+			)}},
+			{Comparer: "body", Skipped: true},
+		},
+		Primary:   ResponseArtifact{Status: 200, Header: http.Header{"A": {"b"}}, Body: []byte("primary"), Buffered: true},
+		Secondary: ResponseArtifact{Status: 200, Body: []byte("secondary"), Buffered: true},
+	}
+
+	ev := newEvent(rep, false)
+	if ev.Primary != nil || ev.Secondary != nil {
+		t.Errorf("expected no artifacts")
+	}
+	if ev.Results[0].Details != nil {
+		t.Errorf("expected no details for a match, got %v", ev.Results[0].Details)
+	}
+	if ev.Results[2].Details != nil {
+		t.Errorf("expected no details for a skipped result, got %v", ev.Results[2].Details)
+	}
+	group, ok := ev.Results[1].Details["Content-Type"].(map[string]any)
+	if !ok {
+		t.Fatalf("expected group to be a nested map, got %T", ev.Results[1].Details["Content-Type"])
+	}
+	if _, ok := group["shadow_values"]; !ok {
+		t.Errorf("expected shadow_values in group, got %v", group)
+	}
+
+	ev = newEvent(rep, true)
+	rep.Primary.Body[0] = 'X'
+	if string(ev.Primary.Body) != "primary" {
+		t.Errorf("expected artifact body to be copied, got %q", ev.Primary.Body)
+	}
+
+	bs, err := json.Marshal(ev)
+	if err != nil {
+		t.Fatalf("error encoding event: %v", err)
+	}
+	var decoded Event
+	if err := json.Unmarshal(bs, &decoded); err != nil {
+		t.Fatalf("error decoding event: %v", err)
+	}
+	if decoded.Request != rep.Request || decoded.Match != rep.Match || len(decoded.Results) != 3 {
+		t.Errorf("unexpected round trip: %+v", decoded)
+	}
+}
+
+func Test_newEvent_bodies(t *testing.T) {
+	primary := ResponseArtifact{Body: []byte(`{"card":"4111"}`), Buffered: true}
+	secondary := ResponseArtifact{Body: []byte(`{"card":"4242"}`), Buffered: true}
+	rep := Report{Primary: primary, Secondary: secondary, Results: []Result{(&BodyComparer{}).Compare(primary, secondary)}}
+
+	details := newEvent(rep, false).Results[0].Details
+	if _, ok := details["primary_body"]; ok {
+		t.Errorf("expected no bodies without artifacts, got %v", details)
+	}
+	if _, ok := details["diff_paths"]; !ok {
+		t.Errorf("expected diff_paths without artifacts, got %v", details)
+	}
+	if details = newEvent(rep, true).Results[0].Details; details["shadow_body"] != `{"card":"4242"}` {
+		t.Errorf("expected bodies with artifacts, got %v", details)
+	}
+}
+
+func Test_newEvent_schema(t *testing.T) {
+	rep := Report{
+		ID:        "4bf92f35-77b3-4da6-a3ce-929d0e0e4736",
+		Time:      time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		Request:   RequestSummary{Method: "POST", Host: "example.com", URI: "/a", Tenant: "acme", ContentType: "application/json", TraceID: "t", SpanID: "s", Route: "r"},
+		Results:   []Result{{Comparer: "body", Attrs: []slog.Attr{slog.Float64("similarity", 0.5)}}},
+		Primary:   ResponseArtifact{Status: 200, Body: []byte(`{"a":1}`), Buffered: true, Error: "e", Events: 1, EventsHash: "h", Duration: 1500 * time.Microsecond},
+		Secondary: ResponseArtifact{Status: 200, Body: []byte(`{"a":2}`), Buffered: true, Duration: 3 * time.Millisecond},
+	}
+	ev := newEvent(rep, true)
+	if ev.Version != EventVersion || ev.ID != rep.ID {
+		t.Errorf("version = %d, id = %q, want %d, %q", ev.Version, ev.ID, EventVersion, rep.ID)
+	}
+	if ev.Timings != (EventTimings{PrimaryMS: 1.5, SecondaryMS: 3}) {
+		t.Errorf("timings = %+v", ev.Timings)
+	}
+	if !strings.Contains(ev.Diff, `-  "a": 1`) || !strings.Contains(ev.Diff, `+  "a": 2`) {
+		t.Errorf("diff = %q, want the changed value", ev.Diff)
+	}
+
+	// Every field an event can have is described by the schema
+	raw, err := os.ReadFile("event.schema.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var schema struct {
+		Properties map[string]struct {
+			Properties map[string]any `json:"properties"`
+		} `json:"properties"`
+		Defs map[string]struct {
+			Properties map[string]any `json:"properties"`
+		} `json:"$defs"`
+	}
+	if err := json.Unmarshal(raw, &schema); err != nil {
+		t.Fatal(err)
+	}
+	ev.DiffTruncated = true
+	ev.Results[0].Skipped = true
+	bs, _ := json.Marshal(ev)
+	var fields map[string]json.RawMessage
+	_ = json.Unmarshal(bs, &fields)
+	for name, value := range fields {
+		prop, ok := schema.Properties[name]
+		if !ok {
+			t.Errorf("%s isn't in the schema", name)
+			continue
+		}
+		var nested map[string]any
+		if json.Unmarshal(value, &nested) != nil {
+			continue
+		}
+		described := prop.Properties
+		if name == "primary" || name == "secondary" {
+			described = schema.Defs["response"].Properties
+		}
+		for key := range nested {
+			if _, ok := described[key]; !ok {
+				t.Errorf("%s.%s isn't in the schema", name, key)
+			}
+		}
+	}
+}
+
+func Test_truncateDiff(t *testing.T) {
+	var primary, secondary strings.Builder
+	for i := range 100 {
+		_, _ = fmt.Fprintf(&primary, "line %d\n", i)
+		if i%10 == 5 {
+			_, _ = fmt.Fprintf(&secondary, "changed %d\n", i)
+		} else {
+			_, _ = fmt.Fprintf(&secondary, "line %d\n", i)
+		}
+	}
+	diff := bodyDiff([]byte(primary.String()), []byte(secondary.String()))
+	hunks := strings.Count(diff, "\n@@ ")
+
+	tests := []struct {
+		name          string
+		limit         int
+		wantTruncated bool
+		wantOmitted   int
+	}{
+		{"fits", len(diff), false, 0},
+		{"whole hunks", 400, true, hunks - 3},
+		{"first hunk cut short", 160, true, hunks - 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, omitted, truncated := truncateDiff(diff, tt.limit)
+			if truncated != tt.wantTruncated || omitted != tt.wantOmitted {
+				t.Fatalf("truncateDiff() omitted %d hunks, truncated %v, want %d, %v", omitted, truncated, tt.wantOmitted, tt.wantTruncated)
+			}
+			if len(got) > tt.limit {
+				t.Errorf("truncateDiff() = %d bytes, want at most %d", len(got), tt.limit)
+			}
+			if !truncated {
+				return
+			}
+			kept, _, _ := strings.Cut(got, "\\ Diff truncated")
+			marker := fmt.Sprintf("\\ Diff truncated after %d of %d bytes, %d of %d hunks omitted\n", len(kept), len(diff), omitted, hunks)
+			if !strings.HasSuffix(got, marker) {
+				t.Errorf("truncateDiff() doesn't end with the marker:\n%s", got)
+			}
+			if remaining := hunks - strings.Count("\n"+kept, "\n@@ "); remaining != omitted {
+				t.Errorf("truncateDiff() kept %d hunks, but counted %d of %d omitted", hunks-remaining, omitted, hunks)
+			}
+		})
+	}
+}
+
+func Test_truncateDiff_marker(t *testing.T) {
+	hunk := func(n int) string {
+		return fmt.Sprintf("@@ -%d +%d @@\n-primary %d\n+secondary %d\n", n, n, n, n)
+	}
+	header := "--- primary\n+++ secondary\n"
+	diff := header
+	for n := range 8 {
+		diff += hunk(n + 1)
+	}
+
+	// Room for the header and two hunks, with the marker after them
+	limit := len(header+hunk(1)+hunk(2)) + diffMarkerBytes
+	got, omitted, truncated := truncateDiff(diff, limit)
+	want := header + hunk(1) + hunk(2) + fmt.Sprintf("\\ Diff truncated after %d of %d bytes, 6 of 8 hunks omitted\n",
+		len(header+hunk(1)+hunk(2)), len(diff))
+	if got != want || omitted != 6 || !truncated {
+		t.Errorf("truncateDiff() = %q, %d, %v, want %q, 6, true", got, omitted, truncated, want)
+	}
+}
@@ -0,0 +1,91 @@
+package mirror
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+var _ caddyfile.Unmarshaler = (*ExcludeConfig)(nil)
+
+// ExcludeConfig keeps requests from ever being mirrored, like health checks, metrics scrapes, and static assets, even
+// when the handler wraps a broad route. Excluded requests are only served by the primary, before they're sampled, so
+// they don't count towards the mirror rate or stats.
+type ExcludeConfig struct {
+	// Paths are globs of request paths, like /health or /static/*. As with Caddy's path matcher, * matches within a
+	// path segment, except a trailing * matches the rest of the path.
+	Paths []string `json:"paths,omitempty"`
+	// Extensions are file extensions of request paths, like .css
+	Extensions []string `json:"extensions,omitempty"`
+	// Methods are request methods, like OPTIONS
+	Methods []string `json:"methods,omitempty"`
+}
+
+func (c *ExcludeConfig) provision() error {
+	for _, pattern := range c.Paths {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("error parsing exclude path '%s': %w", pattern, err)
+		}
+	}
+	for i, ext := range c.Extensions {
+		if !strings.HasPrefix(ext, ".") {
+			c.Extensions[i] = "." + ext
+		}
+	}
+	for i, method := range c.Methods {
+		c.Methods[i] = strings.ToUpper(method)
+	}
+	return nil
+}
+
+// excludes reports whether r is excluded from mirroring. It's safe to call on a nil *ExcludeConfig, which excludes
+// nothing.
+func (c *ExcludeConfig) excludes(r *http.Request) bool {
+	if c == nil {
+		return false
+	}
+	if slices.Contains(c.Methods, r.Method) {
+		return true
+	}
+	p := r.URL.Path
+	if ext := path.Ext(p); ext != "" && slices.ContainsFunc(c.Extensions, func(e string) bool { return strings.EqualFold(e, ext) }) {
+		return true
+	}
+	return slices.ContainsFunc(c.Paths, func(pattern string) bool { return matchPath(pattern, p) })
+}
+
+// matchPath matches a path against a glob. A trailing * matches the rest of the path, across segments.
+func matchPath(pattern, p string) bool {
+	if prefix, ok := strings.CutSuffix(pattern, "*"); ok && !strings.ContainsAny(prefix, "*?[\\") {
+		return strings.HasPrefix(p, prefix)
+	}
+	matched, _ := path.Match(pattern, p)
+	return matched
+}
+
+func (c *ExcludeConfig) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume "exclude"
+	c.Paths = append(c.Paths, d.RemainingArgs()...)
+	for d.NextBlock(0) {
+		opt := d.Val()
+		args := d.RemainingArgs()
+		if len(args) < 1 {
+			return d.ArgErr()
+		}
+		switch opt {
+		case "path":
+			c.Paths = append(c.Paths, args...)
+		case "extension":
+			c.Extensions = append(c.Extensions, args...)
+		case "method":
+			c.Methods = append(c.Methods, args...)
+		default:
+			return d.Errf("unrecognized exclude option '%s'", opt)
+		}
+	}
+	return nil
+}
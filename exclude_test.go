@@ -0,0 +1,52 @@
+package mirror
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+func TestExcludeConfig_excludes(t *testing.T) {
+	c := new(ExcludeConfig)
+	d := caddyfile.NewTestDispenser(`exclude /health {
+		path /metrics /static/* /api/*/internal
+		extension css .PNG
+		method options
+	}`)
+	if err := c.UnmarshalCaddyfile(d); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.provision(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		method, target string
+		want           bool
+	}{
+		{http.MethodGet, "/health", true},
+		{http.MethodGet, "/healthz", false},
+		{http.MethodGet, "/metrics", true},
+		{http.MethodGet, "/static/js/app.js", true},
+		{http.MethodGet, "/api/users/internal", true},
+		{http.MethodGet, "/api/users/1/internal", false},
+		{http.MethodGet, "/theme.css?v=2", true},
+		{http.MethodGet, "/logo.png", true},
+		{http.MethodOptions, "/users", true},
+		{http.MethodGet, "/users", false},
+	}
+	for _, tt := range tests {
+		if got := c.excludes(httptest.NewRequest(tt.method, tt.target, nil)); got != tt.want {
+			t.Errorf("excludes(%s %s) = %v, want %v", tt.method, tt.target, got, tt.want)
+		}
+	}
+
+	if (*ExcludeConfig)(nil).excludes(httptest.NewRequest(http.MethodGet, "/health", nil)) {
+		t.Errorf("a nil ExcludeConfig excluded a request")
+	}
+	if err := (&ExcludeConfig{Paths: []string{"/[a"}}).provision(); err == nil {
+		t.Errorf("provision() accepted a malformed path")
+	}
+}
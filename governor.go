@@ -0,0 +1,244 @@
+package mirror
+
+import (
+	"bytes"
+	"log/slog"
+	"math"
+	"os"
+	runtimemetrics "runtime/metrics"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+var _ caddyfile.Unmarshaler = (*LoadGovernorConfig)(nil)
+
+// LoadGovernorConfig reduces the mirror rate while the host is under CPU pressure, and restores it once load subsides.
+// Every interval the governor halves the rate if a threshold is crossed, and otherwise restores a tenth of the
+// configured rate, up to all of it. Thresholds which aren't set aren't checked, and intervals without a new
+// measurement leave the rate as it is.
+type LoadGovernorConfig struct {
+	// Interval is how often load is checked. Defaults to 1 second.
+	Interval caddy.Duration `json:"interval,omitempty"`
+	// MaxCPU is the highest acceptable percentage of the host's CPU time which is busy, across every CPU, as reported
+	// by /proc/stat. It isn't checked where /proc/stat isn't available.
+	MaxCPU float64 `json:"max_cpu,omitempty"`
+	// MaxSchedulerLatency is the highest acceptable p99 latency of goroutines waiting to be scheduled
+	MaxSchedulerLatency caddy.Duration `json:"max_scheduler_latency,omitempty"`
+}
+
+func (c *LoadGovernorConfig) provision() {
+	if c.Interval == 0 {
+		c.Interval = caddy.Duration(time.Second)
+	}
+}
+
+func (c *LoadGovernorConfig) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume "load_governor"
+	for d.NextBlock(0) {
+		opt := d.Val()
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		switch opt {
+		case "interval", "max_scheduler_latency":
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("error parsing %s: %v", opt, err)
+			}
+			if opt == "interval" {
+				c.Interval = caddy.Duration(dur)
+			} else {
+				c.MaxSchedulerLatency = caddy.Duration(dur)
+			}
+		case "max_cpu":
+			cpu, err := strconv.ParseFloat(strings.TrimSuffix(d.Val(), "%"), 64)
+			if err != nil {
+				return d.Errf("error parsing max_cpu: %v", err)
+			}
+			c.MaxCPU = cpu
+		default:
+			return d.Errf("unrecognized load_governor option '%s'", opt)
+		}
+	}
+	return nil
+}
+
+// loadSample is a reading of the host's cumulative CPU time, and the runtime's scheduler metrics
+type loadSample struct {
+	// cpuTotal and cpuIdle are in clock ticks, and only set if hasCPU is
+	cpuTotal, cpuIdle float64
+	hasCPU            bool
+	// schedCounts are the counts of the scheduler latency histogram, whose buckets are bounded by schedBuckets
+	schedCounts  []uint64
+	schedBuckets []float64
+}
+
+func readLoad() loadSample {
+	var s loadSample
+	if stat, err := os.ReadFile("/proc/stat"); err == nil {
+		s.cpuTotal, s.cpuIdle, s.hasCPU = parseProcStat(stat)
+	}
+
+	samples := []runtimemetrics.Sample{{Name: "/sched/latencies:seconds"}}
+	runtimemetrics.Read(samples)
+	if samples[0].Value.Kind() == runtimemetrics.KindFloat64Histogram {
+		hist := samples[0].Value.Float64Histogram()
+		s.schedCounts = append([]uint64(nil), hist.Counts...)
+		s.schedBuckets = hist.Buckets
+	}
+	return s
+}
+
+// parseProcStat reads the total and idle CPU time of every CPU from the aggregate cpu line of /proc/stat. Idle time
+// includes time waiting on I/O. Guest time is already counted in user time, so it's left out of the total.
+func parseProcStat(stat []byte) (total, idle float64, ok bool) {
+	line, _, _ := bytes.Cut(stat, []byte("\n"))
+	fields := strings.Fields(string(line))
+	if len(fields) < 5 || fields[0] != "cpu" {
+		return 0, 0, false
+	}
+	// user, nice, system, idle, iowait, irq, softirq, steal
+	for i, field := range fields[1:min(len(fields), 9)] {
+		ticks, err := strconv.ParseFloat(field, 64)
+		if err != nil {
+			return 0, 0, false
+		}
+		total += ticks
+		if i == 3 || i == 4 {
+			idle += ticks
+		}
+	}
+	return total, idle, true
+}
+
+// cpu is the fraction of the host's CPU time which was busy between two samples. It isn't ok unless both samples
+// have CPU times, and time passed between them.
+func (s loadSample) cpu(prev loadSample) (float64, bool) {
+	total := s.cpuTotal - prev.cpuTotal
+	if !s.hasCPU || !prev.hasCPU || total <= 0 {
+		return 0, false
+	}
+	return 1 - (s.cpuIdle-prev.cpuIdle)/total, true
+}
+
+// schedulerP99 is the p99 scheduler latency between two samples, in seconds. It's the upper bound of the histogram
+// bucket the p99 falls in, or its lower bound for the last bucket, which is unbounded. It isn't ok unless goroutines
+// were scheduled between the samples.
+func (s loadSample) schedulerP99(prev loadSample) (float64, bool) {
+	deltas := make([]uint64, len(s.schedCounts))
+	var total uint64
+	for i, c := range s.schedCounts {
+		if i < len(prev.schedCounts) {
+			c -= prev.schedCounts[i]
+		}
+		deltas[i] = c
+		total += c
+	}
+	if total == 0 {
+		return 0, false
+	}
+
+	rank := uint64(math.Ceil(float64(total) * 0.99))
+	var seen uint64
+	for i, c := range deltas {
+		seen += c
+		if seen >= rank {
+			if upper := s.schedBuckets[i+1]; !math.IsInf(upper, 1) {
+				return upper, true
+			}
+			return s.schedBuckets[i], true
+		}
+	}
+	return 0, false
+}
+
+// governor scales the mirror rate down under load. Methods are safe to call on a nil *governor, which never reduces
+// the rate.
+type governor struct {
+	cfg     LoadGovernorConfig
+	slogger slogger
+	// read returns the runtime's current load metrics
+	read func() loadSample
+
+	last loadSample
+	// factor is the fraction of the configured rate which is mirrored, as float64 bits
+	factor atomic.Uint64
+}
+
+func newGovernor(cfg LoadGovernorConfig, slogger slogger) *governor {
+	g := &governor{cfg: cfg, slogger: slogger, read: readLoad}
+	g.factor.Store(math.Float64bits(1))
+	g.last = g.read()
+	if cfg.MaxCPU > 0 && !g.last.hasCPU {
+		slogger.Warn("load_governor_no_cpu", slog.String("reason", "/proc/stat isn't available, so max_cpu isn't checked"))
+	}
+	return g
+}
+
+// rate is the fraction of the configured rate which is currently mirrored, from 0 to 1
+func (g *governor) rate() float64 {
+	if g == nil {
+		return 1
+	}
+	return math.Float64frombits(g.factor.Load())
+}
+
+// sample decides whether a request the sampler would mirror is let through, with probability rate, where u is a draw
+// from SamplingRand
+func (g *governor) sample(u float64) bool {
+	f := g.rate()
+	return f >= 1 || u < f
+}
+
+// watch checks load every interval, until done is closed
+func (g *governor) watch(done <-chan struct{}) {
+	ticker := time.NewTicker(time.Duration(g.cfg.Interval))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			g.check()
+		}
+	}
+}
+
+// check compares the load since the last check against the thresholds, and adjusts the rate
+func (g *governor) check() {
+	cur := g.read()
+	cpu, cpuOK := cur.cpu(g.last)
+	latency, latencyOK := cur.schedulerP99(g.last)
+	g.last = cur
+	cpu *= 100
+
+	// Without a new measurement for any threshold, there's nothing to decide on, and load mustn't be assumed to have
+	// subsided
+	checkCPU := g.cfg.MaxCPU > 0 && cpuOK
+	checkLatency := g.cfg.MaxSchedulerLatency > 0 && latencyOK
+	if !checkCPU && !checkLatency {
+		return
+	}
+	overloaded := checkCPU && cpu > g.cfg.MaxCPU ||
+		checkLatency && latency > time.Duration(g.cfg.MaxSchedulerLatency).Seconds()
+
+	prev := g.rate()
+	next := min(prev+0.1, 1)
+	if overloaded {
+		next = prev / 2
+	}
+	g.factor.Store(math.Float64bits(next))
+
+	attrs := []any{slog.Float64("cpu_percent", cpu), slog.Float64("scheduler_p99_seconds", latency)}
+	if overloaded && prev == 1 {
+		g.slogger.Warn("load_governor_reducing", attrs...)
+	} else if next == 1 && prev < 1 {
+		g.slogger.Info("load_governor_restored", attrs...)
+	}
+}
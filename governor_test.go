@@ -0,0 +1,94 @@
+package mirror
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func Test_loadSample(t *testing.T) {
+	buckets := []float64{0, 0.001, 0.01, math.Inf(1)}
+	prev := loadSample{cpuTotal: 10, cpuIdle: 5, hasCPU: true, schedCounts: []uint64{100, 0, 0}, schedBuckets: buckets}
+	cur := loadSample{cpuTotal: 20, cpuIdle: 7, hasCPU: true, schedCounts: []uint64{150, 48, 2}, schedBuckets: buckets}
+
+	if got, ok := cur.cpu(prev); !ok || math.Abs(got-0.8) > 1e-9 {
+		t.Errorf("cpu() = %v, %v, want 0.8, true", got, ok)
+	}
+	if _, ok := prev.cpu(prev); ok {
+		t.Errorf("cpu() without CPU time passing is ok")
+	}
+	if _, ok := cur.cpu(loadSample{}); ok {
+		t.Errorf("cpu() without a previous CPU time is ok")
+	}
+	if got, ok := cur.schedulerP99(prev); !ok || got != 0.01 {
+		t.Errorf("schedulerP99() = %v, %v, want 0.01, true", got, ok)
+	}
+
+	cur.schedCounts = []uint64{150, 0, 10}
+	if got, _ := cur.schedulerP99(prev); got != 0.01 {
+		t.Errorf("schedulerP99() in the last bucket = %v, want its lower bound 0.01", got)
+	}
+	if _, ok := prev.schedulerP99(prev); ok {
+		t.Errorf("schedulerP99() without samples is ok")
+	}
+}
+
+func Test_parseProcStat(t *testing.T) {
+	stat := "cpu  100 5 50 800 40 3 2 0 10 0\ncpu0 50 2 25 400 20 1 1 0 5 0\nintr 12345\n"
+	total, idle, ok := parseProcStat([]byte(stat))
+	if !ok || total != 1000 || idle != 840 {
+		t.Errorf("parseProcStat() = %v, %v, %v, want 1000, 840, true", total, idle, ok)
+	}
+	if _, _, ok := parseProcStat([]byte("intr 12345\n")); ok {
+		t.Errorf("parseProcStat() accepted a stat without a cpu line")
+	}
+}
+
+func Test_governor_check(t *testing.T) {
+	var cpuTotal, cpuIdle float64
+	g := &governor{
+		cfg:     LoadGovernorConfig{MaxCPU: 80, MaxSchedulerLatency: caddy.Duration(time.Millisecond)},
+		slogger: nullLogger{},
+		read: func() loadSample {
+			return loadSample{cpuTotal: cpuTotal, cpuIdle: cpuIdle, hasCPU: true}
+		},
+	}
+	g.factor.Store(math.Float64bits(1))
+
+	// Each check covers 10 CPU seconds, with idle seconds to spare
+	tick := func(idle float64) {
+		cpuTotal += 10
+		cpuIdle += idle
+		g.check()
+	}
+
+	tick(5)
+	if g.rate() != 1 {
+		t.Errorf("rate() at 50%% CPU = %v, want 1", g.rate())
+	}
+	tick(1)
+	tick(1)
+	if g.rate() != 0.25 {
+		t.Errorf("rate() after two checks at 90%% CPU = %v, want 0.25", g.rate())
+	}
+	// Without a new measurement, load hasn't subsided
+	for range 3 {
+		g.check()
+	}
+	if g.rate() != 0.25 {
+		t.Errorf("rate() after checks without new measurements = %v, want 0.25", g.rate())
+	}
+	for range 10 {
+		tick(5)
+	}
+	if g.rate() != 1 {
+		t.Errorf("rate() after load subsided = %v, want 1", g.rate())
+	}
+
+	var unset *governor
+	if !unset.sample(0.99) {
+		t.Errorf("nil sample() = false")
+	}
+}
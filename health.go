@@ -0,0 +1,203 @@
+package mirror
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+var _ caddyfile.Unmarshaler = (*HealthCheckConfig)(nil)
+
+// HealthCheckConfig actively checks the secondary's health. While it's unhealthy, requests aren't mirrored. When it
+// becomes unhealthy, the handler logs a secondary_unhealthy warning and emits a mirror_secondary_unhealthy event. When
+// it recovers, mirroring resumes, and the handler logs secondary_healthy and emits mirror_secondary_healthy.
+type HealthCheckConfig struct {
+	// URL is requested with GET to check the secondary. Placeholders are supported, like {env.SHADOW_HEALTH_URL}.
+	URL string `json:"url"`
+	// Interval is how often the secondary is checked. Defaults to 10 seconds.
+	Interval caddy.Duration `json:"interval,omitempty"`
+	// Timeout is how long a check may take before it fails. Defaults to 5 seconds.
+	Timeout caddy.Duration `json:"timeout,omitempty"`
+	// ExpectStatus is the status a healthy secondary responds with. Defaults to any 2xx status.
+	ExpectStatus int `json:"expect_status,omitempty"`
+	// Fails is how many checks in a row have to fail for the secondary to be unhealthy. Defaults to 1.
+	Fails int `json:"fails,omitempty"`
+	// Passes is how many checks in a row have to pass for an unhealthy secondary to be healthy again. Defaults to 1.
+	Passes int `json:"passes,omitempty"`
+}
+
+func (c *HealthCheckConfig) provision() error {
+	if c.URL == "" {
+		return fmt.Errorf("health_check requires a url")
+	}
+	if c.Interval == 0 {
+		c.Interval = caddy.Duration(10 * time.Second)
+	}
+	if c.Timeout == 0 {
+		c.Timeout = caddy.Duration(5 * time.Second)
+	}
+	if c.Fails == 0 {
+		c.Fails = 1
+	}
+	if c.Passes == 0 {
+		c.Passes = 1
+	}
+	return nil
+}
+
+func (c *HealthCheckConfig) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume "health_check"
+	if d.NextArg() {
+		c.URL = d.Val()
+	}
+	for d.NextBlock(0) {
+		opt := d.Val()
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		switch opt {
+		case "url":
+			c.URL = d.Val()
+		case "interval", "timeout":
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("error parsing %s: %v", opt, err)
+			}
+			if opt == "interval" {
+				c.Interval = caddy.Duration(dur)
+			} else {
+				c.Timeout = caddy.Duration(dur)
+			}
+		case "expect_status", "fails", "passes":
+			n, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("error parsing %s: %v", opt, err)
+			}
+			switch opt {
+			case "expect_status":
+				c.ExpectStatus = n
+			case "fails":
+				c.Fails = n
+			case "passes":
+				c.Passes = n
+			}
+		default:
+			return d.Errf("unrecognized health_check option '%s'", opt)
+		}
+	}
+	return nil
+}
+
+// healthChecker checks the secondary, and tracks whether it's healthy. Methods are safe to call on a nil
+// *healthChecker, which is always healthy.
+type healthChecker struct {
+	cfg     HealthCheckConfig
+	name    string
+	url     string
+	client  *http.Client
+	slogger slogger
+	// emit emits a Caddy event
+	emit func(event string, data map[string]any)
+	// onHealthy, if set, is called when the secondary recovers
+	onHealthy func()
+
+	unhealthy atomic.Bool
+	// streak is how many checks in a row have disagreed with the current state
+	streak int
+}
+
+func newHealthChecker(cfg HealthCheckConfig, name string, slogger slogger, emit func(string, map[string]any)) *healthChecker {
+	return &healthChecker{
+		cfg:     cfg,
+		name:    name,
+		url:     caddy.NewReplacer().ReplaceKnown(cfg.URL, ""),
+		client:  &http.Client{Timeout: time.Duration(cfg.Timeout)},
+		slogger: slogger,
+		emit:    emit,
+	}
+}
+
+// healthy reports whether requests should be mirrored to the secondary
+func (hc *healthChecker) healthy() bool {
+	return hc == nil || !hc.unhealthy.Load()
+}
+
+// watch checks the secondary right away, and then every interval, until done is closed
+func (hc *healthChecker) watch(done <-chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-done
+		cancel()
+	}()
+
+	ticker := time.NewTicker(time.Duration(hc.cfg.Interval))
+	defer ticker.Stop()
+
+	for {
+		hc.record(hc.check(ctx))
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// check requests the health check URL once, and returns why it failed, or nil if it passed
+func (hc *healthChecker) check(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, hc.url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := hc.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<20))
+
+	if hc.cfg.ExpectStatus != 0 && resp.StatusCode != hc.cfg.ExpectStatus ||
+		hc.cfg.ExpectStatus == 0 && resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	return nil
+}
+
+// record updates the secondary's health with the outcome of a check, and announces when it changes
+func (hc *healthChecker) record(err error) {
+	unhealthy := hc.unhealthy.Load()
+	if (err != nil) == unhealthy {
+		hc.streak = 0
+		return
+	}
+
+	hc.streak++
+	if unhealthy && hc.streak < hc.cfg.Passes || !unhealthy && hc.streak < hc.cfg.Fails {
+		return
+	}
+	hc.streak = 0
+	if unhealthy && hc.onHealthy != nil {
+		// Before mirroring resumes, so it doesn't resume at full volume
+		hc.onHealthy()
+	}
+	hc.unhealthy.Store(!unhealthy)
+
+	data := map[string]any{"handler": hc.name, "url": hc.url}
+	if err != nil {
+		data["error"] = err.Error()
+		hc.slogger.Warn("secondary_unhealthy", slog.String("url", hc.url), slog.String("error", err.Error()))
+		hc.emit("mirror_secondary_unhealthy", data)
+	} else {
+		hc.slogger.Info("secondary_healthy", slog.String("url", hc.url))
+		hc.emit("mirror_secondary_healthy", data)
+	}
+}
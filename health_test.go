@@ -0,0 +1,118 @@
+package mirror
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_healthChecker_check(t *testing.T) {
+	status := http.StatusOK
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		name    string
+		expect  int
+		status  int
+		wantErr bool
+	}{
+		{"any 2xx", 0, http.StatusNoContent, false},
+		{"5xx", 0, http.StatusServiceUnavailable, true},
+		{"expected status", http.StatusTeapot, http.StatusTeapot, false},
+		{"unexpected status", http.StatusTeapot, http.StatusOK, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := HealthCheckConfig{URL: srv.URL, ExpectStatus: tt.expect}
+			if err := cfg.provision(); err != nil {
+				t.Fatal(err)
+			}
+			status = tt.status
+			err := newHealthChecker(cfg, "test", nullLogger{}, nil).check(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Errorf("check() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_healthChecker_record(t *testing.T) {
+	var events []string
+	hc := newHealthChecker(HealthCheckConfig{URL: "http://shadow/health", Fails: 2, Passes: 3}, "test", nullLogger{}, func(event string, data map[string]any) {
+		events = append(events, event)
+	})
+
+	failed := errors.New("connection refused")
+	steps := []struct {
+		err         error
+		wantHealthy bool
+	}{
+		{failed, true}, // one failure isn't enough
+		{nil, true},    // and a pass resets the streak
+		{failed, true},
+		{failed, false},
+		{nil, false},
+		{nil, false},
+		{failed, false}, // a failure resets the streak of passes
+		{nil, false},
+		{nil, false},
+		{nil, true},
+	}
+	for i, step := range steps {
+		hc.record(step.err)
+		if hc.healthy() != step.wantHealthy {
+			t.Fatalf("step %d: healthy() = %v, want %v", i, hc.healthy(), step.wantHealthy)
+		}
+	}
+
+	if want := "mirror_secondary_unhealthy mirror_secondary_healthy"; strings.Join(events, " ") != want {
+		t.Errorf("events = %s, want %s", strings.Join(events, " "), want)
+	}
+}
+
+func TestHandler_shouldMirror_unhealthy(t *testing.T) {
+	h := &Handler{MirrorRate: 1}
+	if !h.shouldMirror(httptest.NewRequest(http.MethodGet, "/", nil)) {
+		t.Errorf("shouldMirror() = false without health checks")
+	}
+
+	h.health = newHealthChecker(HealthCheckConfig{URL: "http://shadow/health", Fails: 1, Passes: 1}, "test", nullLogger{}, func(string, map[string]any) {})
+	h.health.record(errors.New("connection refused"))
+	if h.shouldMirror(httptest.NewRequest(http.MethodGet, "/", nil)) {
+		t.Errorf("shouldMirror() = true while the secondary is unhealthy")
+	}
+}
+
+func TestHandler_shouldMirror_slowStart(t *testing.T) {
+	now := time.Unix(1000, 0)
+	h := &Handler{MirrorRate: 1, now: func() time.Time { return now }}
+	h.slowStart = &rampUp{duration: time.Minute, now: h.now}
+	h.health = newHealthChecker(HealthCheckConfig{URL: "http://shadow/health", Fails: 1, Passes: 1}, "test", nullLogger{}, func(string, map[string]any) {})
+	h.health.onHealthy = h.slowStart.restart
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	if !h.shouldMirror(r) {
+		t.Errorf("shouldMirror() = false before slow start began")
+	}
+
+	h.health.record(errors.New("connection refused"))
+	h.health.record(nil)
+	if got := h.slowStart.factor(); got != 0 {
+		t.Errorf("factor() on recovery = %v, want 0", got)
+	}
+	if h.shouldMirror(r) {
+		t.Errorf("shouldMirror() = true at the start of slow start")
+	}
+
+	now = now.Add(time.Minute)
+	if !h.shouldMirror(r) {
+		t.Errorf("shouldMirror() = false after slow start")
+	}
+}
@@ -0,0 +1,51 @@
+package mirror
+
+import "sync/atomic"
+
+// inFlightLimit caps the goroutines a handler runs for mirrored requests, for secondary requests and comparisons
+// combined. Slots are acquired before a request is mirrored, so the cap is never exceeded. Methods are safe to call on
+// a nil *inFlightLimit, which has no cap.
+type inFlightLimit struct {
+	limit int64
+	used  atomic.Int64
+}
+
+func newInFlightLimit(limit int64) *inFlightLimit {
+	return &inFlightLimit{limit: limit}
+}
+
+// acquire takes n slots, and reports whether there were that many free
+func (l *inFlightLimit) acquire(n int64) bool {
+	if l == nil {
+		return true
+	}
+	for {
+		used := l.used.Load()
+		if used+n > l.limit {
+			return false
+		}
+		if l.used.CompareAndSwap(used, used+n) {
+			return true
+		}
+	}
+}
+
+func (l *inFlightLimit) release(n int64) {
+	if l != nil {
+		l.used.Add(-n)
+	}
+}
+
+// goroutinesPerMirror is how many goroutines a mirrored request runs: one for the secondary request, and one which waits
+// for it, if its response is compared or measured
+func (h *Handler) goroutinesPerMirror() int64 {
+	if h.waitsForSecondary() {
+		return 2
+	}
+	return 1
+}
+
+// waitsForSecondary reports whether a goroutine waits for each secondary response, to compare it or record its metrics
+func (h *Handler) waitsForSecondary() bool {
+	return h.MetricsName != "" || h.shouldCompare()
+}
@@ -0,0 +1,75 @@
+package mirror
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func Test_inFlightLimit(t *testing.T) {
+	l := newInFlightLimit(3)
+	if !l.acquire(2) {
+		t.Fatalf("acquire(2) = false with 3 free")
+	}
+	if l.acquire(2) {
+		t.Errorf("acquire(2) = true with 1 free")
+	}
+	if !l.acquire(1) {
+		t.Errorf("acquire(1) = false with 1 free")
+	}
+	l.release(3)
+	if !l.acquire(3) {
+		t.Errorf("acquire(3) = false after releasing everything")
+	}
+
+	var unset *inFlightLimit
+	if !unset.acquire(100) {
+		t.Errorf("nil acquire() = false")
+	}
+}
+
+func TestHandler_ServeHTTP_maxInFlight(t *testing.T) {
+	release := make(chan struct{})
+	h := &Handler{
+		ComparisonConfig: ComparisonConfig{CompareStatus: true},
+		MirrorRate:       1,
+		inFlightLimit:    newInFlightLimit(2),
+		stats:            newStats(),
+		primary: middlewareHandlerFunc(func(w http.ResponseWriter, r *http.Request, _ caddyhttp.Handler) error {
+			w.WriteHeader(http.StatusOK)
+			return nil
+		}),
+		secondary: middlewareHandlerFunc(func(w http.ResponseWriter, r *http.Request, _ caddyhttp.Handler) error {
+			<-release
+			w.WriteHeader(http.StatusOK)
+			return nil
+		}),
+		slogger:           nullLogger{},
+		comparisonSlogger: nullLogger{},
+	}
+	h.now = time.Now
+
+	newRequest := func() *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		return r.WithContext(context.WithValue(r.Context(), caddyhttp.VarsCtxKey, make(map[string]any)))
+	}
+
+	// The first request takes both slots, for its secondary request and its comparison, until the secondary responds
+	_ = h.ServeHTTP(httptest.NewRecorder(), newRequest(), nil)
+	_ = h.ServeHTTP(httptest.NewRecorder(), newRequest(), nil)
+	if got := h.stats.totals(); got.Mirrored != 1 || got.NotMirrored != 1 {
+		t.Errorf("mirrored %d and not %d, want 1 and 1", got.Mirrored, got.NotMirrored)
+	}
+
+	close(release)
+	for h.inFlightLimit.used.Load() > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if !h.shouldMirror(newRequest()) {
+		t.Errorf("shouldMirror() = false after the first request finished")
+	}
+}
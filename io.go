@@ -1,9 +1,14 @@
 package mirror
 
 import (
+	"bufio"
 	"bytes"
 	"io"
+	"net"
 	"net/http"
+	"strings"
+	"sync"
+	"time"
 )
 
 type FinishReader struct {
@@ -69,13 +74,55 @@ func (f *TimedWriter) Write(p []byte) (n int, err error) {
 }
 
 func (f *TimedWriter) WriteHeader(status int) {
-	// We're also calling f.started here just in case f.Write was not used (for default 200 behavior, etc)
-	f.started()
+	// Interim responses, like 100 Continue, are passed through, but they aren't the first byte of the response
+	if !informational(status) {
+		// We're also calling f.started here just in case f.Write was not used (for default 200 behavior, etc)
+		f.started()
+	}
 	f.ResponseWriter.WriteHeader(status)
 }
 
+// Unwrap lets http.ResponseController reach the wrapped writer, for hijacking and deadlines
+func (f *TimedWriter) Unwrap() http.ResponseWriter {
+	return f.ResponseWriter
+}
+
+// FlushError flushes through to the wrapped writer, so streamed responses are still delivered incrementally
+func (f *TimedWriter) FlushError() error {
+	return http.NewResponseController(f.ResponseWriter).Flush()
+}
+
+// Flush implements http.Flusher, for handlers which check for it directly
+func (f *TimedWriter) Flush() {
+	_ = f.FlushError()
+}
+
+// Hijack implements http.Hijacker, for handlers which check for it directly, like WebSocket libraries
+func (f *TimedWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(f.ResponseWriter).Hijack()
+}
+
+// Push implements http.Pusher. http.ResponseController doesn't cover server push, so it isn't reached through Unwrap.
+func (f *TimedWriter) Push(target string, opts *http.PushOptions) error {
+	return push(f.ResponseWriter, target, opts)
+}
+
+// push pushes through w, if it supports server push
+func push(w http.ResponseWriter, target string, opts *http.PushOptions) error {
+	if p, ok := w.(http.Pusher); ok {
+		return p.Push(target, opts)
+	}
+	return http.ErrNotSupported
+}
+
 func noop() {}
 
+// informational reports whether status is an interim response, which comes before the final one. 101 Switching
+// Protocols is final.
+func informational(status int) bool {
+	return status >= 100 && status < 200 && status != http.StatusSwitchingProtocols
+}
+
 type NopResponseWriter struct {
 	header http.Header
 	status int
@@ -96,16 +143,117 @@ func (w *NopResponseWriter) Write(p []byte) (n int, err error) {
 	return len(p), nil
 }
 
+// Flush does nothing, but lets the secondary stream its response like it would to a client
+func (w *NopResponseWriter) Flush() {}
+
+// Hijack returns a connection which is already closed, so a secondary which upgrades the connection, like to a
+// WebSocket, hangs up right away instead of holding on to its backend
+func (w *NopResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, peer := net.Pipe()
+	_ = peer.Close()
+	return conn, bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn)), nil
+}
+
+// Push discards pushed resources, like the rest of the response
+func (w *NopResponseWriter) Push(string, *http.PushOptions) error {
+	return nil
+}
+
+// SetReadDeadline, SetWriteDeadline, and EnableFullDuplex do nothing, so http.ResponseController calls succeed for the
+// secondary like they would for a client
+func (w *NopResponseWriter) SetReadDeadline(time.Time) error { return nil }
+
+func (w *NopResponseWriter) SetWriteDeadline(time.Time) error { return nil }
+
+func (w *NopResponseWriter) EnableFullDuplex() error { return nil }
+
 type PassthroughCloser struct {
 	io.Reader
 	io.Closer
 }
 
-// duplex duplicates a single io.ReadCloser across two io.ReadClosers
+// duplex duplicates a single io.ReadCloser across two io.ReadClosers. If limit is set and the body is any larger, only
+// the start of it is buffered, the first io.ReadCloser streams the rest, and the second is nil.
 // TODO: Strategy to reduce or eliminate the need for the buffers
-func duplex(r io.ReadCloser, pbuf, sbuf *bytes.Buffer) (io.ReadCloser, io.ReadCloser) {
-	defer r.Close()
-	io.Copy(pbuf, r)
+func duplex(r io.ReadCloser, pbuf, sbuf *bytes.Buffer, limit int64) (io.ReadCloser, io.ReadCloser) {
+	if limit > 0 {
+		// The length of chunked bodies isn't known up front, so it's checked as they're read
+		if n, _ := io.Copy(pbuf, io.LimitReader(r, limit+1)); n > limit {
+			return PassthroughCloser{io.MultiReader(pbuf, r), r}, nil
+		}
+	} else {
+		io.Copy(pbuf, r)
+	}
+	r.Close()
 	sbuf.Write(pbuf.Bytes())
 	return io.NopCloser(pbuf), io.NopCloser(sbuf)
 }
+
+// expectsContinue reports whether the client waits for a 100 Continue response before sending the request body
+func expectsContinue(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Expect"), "100-continue")
+}
+
+// teeBody copies a request body into buf as the primary reads it, instead of reading it up front like duplex. It's for
+// requests which expect 100 Continue, since the client doesn't send the body until the primary starts reading it.
+type teeBody struct {
+	io.ReadCloser
+
+	mu  sync.Mutex
+	buf *bytes.Buffer
+	// limit, if set, is the most which is copied. Copying stops once the body is any larger, and overLimit is set.
+	limit int64
+	// done is closed when the primary is done with the body, and complete is set if it read all of it
+	done      chan struct{}
+	finished  bool
+	complete  bool
+	overLimit bool
+}
+
+func newTeeBody(r io.ReadCloser, buf *bytes.Buffer, limit int64) *teeBody {
+	return &teeBody{ReadCloser: r, buf: buf, limit: limit, done: make(chan struct{})}
+}
+
+func (t *teeBody) Read(p []byte) (int, error) {
+	n, err := t.ReadCloser.Read(p)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.finished {
+		return n, err
+	}
+	if t.limit > 0 && int64(t.buf.Len()+n) > t.limit {
+		t.overLimit = true
+		t.finishLocked()
+		return n, err
+	}
+	t.buf.Write(p[:n])
+	if err == io.EOF {
+		t.complete = true
+	}
+	if err != nil {
+		t.finishLocked()
+	}
+	return n, err
+}
+
+func (t *teeBody) Close() error {
+	t.finish()
+	return t.ReadCloser.Close()
+}
+
+// finish stops copying the body, so buf can be read. It's safe to call more than once, and on a nil *teeBody.
+func (t *teeBody) finish() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.finishLocked()
+}
+
+func (t *teeBody) finishLocked() {
+	if !t.finished {
+		t.finished = true
+		close(t.done)
+	}
+}
@@ -0,0 +1,164 @@
+package mirror
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func TestTimedWriter_Flush(t *testing.T) {
+	tests := []struct {
+		name        string
+		buffer      bool
+		wantFlushed bool
+	}{
+		{"streamed", false, true},
+		{"buffered", true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := httptest.NewRecorder()
+			rec := caddyhttp.NewResponseRecorder(client, new(bytes.Buffer), func(int, http.Header) bool { return tt.buffer })
+			started := false
+			w := NewTimedWriter(rec, func() { started = true })
+
+			w.WriteHeader(http.StatusOK)
+			_, _ = w.Write([]byte("data: 1\n\n"))
+			if err := http.NewResponseController(w).Flush(); err != nil {
+				t.Fatalf("Flush() error = %v", err)
+			}
+			if client.Flushed != tt.wantFlushed {
+				t.Errorf("client flushed = %v, want %v", client.Flushed, tt.wantFlushed)
+			}
+			if _, ok := w.(http.Flusher); !ok {
+				t.Errorf("TimedWriter isn't an http.Flusher")
+			}
+			if !started {
+				t.Errorf("time to first byte wasn't recorded")
+			}
+		})
+	}
+}
+
+func TestNopResponseWriter_Flush(t *testing.T) {
+	rec := caddyhttp.NewResponseRecorder(&NopResponseWriter{}, nil, func(int, http.Header) bool { return false })
+	rec.WriteHeader(http.StatusOK)
+	if err := http.NewResponseController(rec).Flush(); err != nil {
+		t.Errorf("Flush() error = %v", err)
+	}
+}
+
+func Test_teeBody(t *testing.T) {
+	buf := new(bytes.Buffer)
+	tee := newTeeBody(io.NopCloser(strings.NewReader("upload")), buf, 0)
+	if _, err := io.ReadAll(tee); err != nil {
+		t.Fatal(err)
+	}
+	<-tee.done
+	if !tee.complete || buf.String() != "upload" {
+		t.Errorf("complete = %v, buf = %q, want true and %q", tee.complete, buf.String(), "upload")
+	}
+
+	buf = new(bytes.Buffer)
+	tee = newTeeBody(io.NopCloser(strings.NewReader("upload")), buf, 0)
+	_, _ = tee.Read(make([]byte, 2))
+	tee.finish()
+	_, _ = io.ReadAll(tee)
+	if tee.complete || buf.String() != "up" {
+		t.Errorf("complete = %v, buf = %q, want false and %q", tee.complete, buf.String(), "up")
+	}
+}
+
+// pushRecorder is a response recorder which supports server push
+type pushRecorder struct {
+	*httptest.ResponseRecorder
+	pushed []string
+}
+
+func (w *pushRecorder) Push(target string, _ *http.PushOptions) error {
+	w.pushed = append(w.pushed, target)
+	return nil
+}
+
+func TestTimedWriter_passthrough(t *testing.T) {
+	client := &pushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	w := NewTimedWriter(client, func() {})
+
+	if err := w.(http.Pusher).Push("/app.css", nil); err != nil || len(client.pushed) != 1 {
+		t.Errorf("Push() error = %v, pushed = %v", err, client.pushed)
+	}
+	// httptest.ResponseRecorder can't be hijacked, so the error has to come from it
+	if _, _, err := w.(http.Hijacker).Hijack(); !errors.Is(err, http.ErrNotSupported) {
+		t.Errorf("Hijack() error = %v, want http.ErrNotSupported", err)
+	}
+	if err := NewTimedWriter(httptest.NewRecorder(), func() {}).(http.Pusher).Push("/app.css", nil); !errors.Is(err, http.ErrNotSupported) {
+		t.Errorf("Push() without push support error = %v, want http.ErrNotSupported", err)
+	}
+}
+
+func TestNopResponseWriter_ResponseController(t *testing.T) {
+	rec := caddyhttp.NewResponseRecorder(&NopResponseWriter{}, nil, nil)
+	rc := http.NewResponseController(rec)
+	if err := rc.SetWriteDeadline(time.Now().Add(time.Second)); err != nil {
+		t.Errorf("SetWriteDeadline() error = %v", err)
+	}
+	if err := rc.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
+		t.Errorf("SetReadDeadline() error = %v", err)
+	}
+	conn, _, err := rc.Hijack()
+	if err != nil {
+		t.Fatalf("Hijack() error = %v", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		t.Errorf("Read() on the hijacked connection error = %v, want EOF", err)
+	}
+}
+
+func Test_duplex(t *testing.T) {
+	tests := []struct {
+		name          string
+		limit         int64
+		wantSecondary bool
+	}{
+		{"no limit", 0, true},
+		{"under the limit", 6, true},
+		{"over the limit", 5, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pr, sr := duplex(io.NopCloser(strings.NewReader("upload")), new(bytes.Buffer), new(bytes.Buffer), tt.limit)
+			if got, _ := io.ReadAll(pr); string(got) != "upload" {
+				t.Errorf("primary body = %q, want %q", got, "upload")
+			}
+			if (sr != nil) != tt.wantSecondary {
+				t.Fatalf("secondary body = %v, want one: %v", sr, tt.wantSecondary)
+			}
+			if sr == nil {
+				return
+			}
+			if got, _ := io.ReadAll(sr); string(got) != "upload" {
+				t.Errorf("secondary body = %q, want %q", got, "upload")
+			}
+		})
+	}
+}
+
+func Test_teeBody_limit(t *testing.T) {
+	buf := new(bytes.Buffer)
+	tee := newTeeBody(io.NopCloser(strings.NewReader("upload")), buf, 5)
+	if got, _ := io.ReadAll(tee); string(got) != "upload" {
+		t.Errorf("body = %q, want %q", got, "upload")
+	}
+	<-tee.done
+	if !tee.overLimit || tee.complete {
+		t.Errorf("overLimit = %v, complete = %v, want true and false", tee.overLimit, tee.complete)
+	}
+}
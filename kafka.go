@@ -0,0 +1,162 @@
+package mirror
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+
+	"github.com/segmentio/kafka-go"
+)
+
+var (
+	_ Reporter              = (*KafkaReporter)(nil)
+	_ caddy.Provisioner     = (*KafkaReporter)(nil)
+	_ caddy.CleanerUpper    = (*KafkaReporter)(nil)
+	_ caddyfile.Unmarshaler = (*KafkaReporter)(nil)
+)
+
+func init() {
+	caddy.RegisterModule(KafkaReporter{})
+}
+
+// KafkaReporter publishes every report as a JSON Event to a Kafka topic. Messages are written asynchronously in
+// batches, so a slow or unavailable broker never holds up comparisons.
+type KafkaReporter struct {
+	// Brokers are the addresses of the Kafka brokers, like kafka-1:9092, and Topic is where events are published
+	Brokers []string `json:"brokers"`
+	Topic   string   `json:"topic"`
+	// Key selects the message key, which also decides the partition. One of "path" (default), "fingerprint", or "none".
+	Key string `json:"key,omitempty"`
+	// IncludeArtifacts adds both full responses to each event
+	IncludeArtifacts bool `json:"include_artifacts,omitempty"`
+	// BatchTimeout is the longest a message waits to be batched before being written. Defaults to 1s.
+	BatchTimeout caddy.Duration `json:"batch_timeout,omitempty"`
+
+	writer  *kafka.Writer
+	slogger slogger
+}
+
+func (KafkaReporter) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "mirror.reporters.kafka",
+		New: func() caddy.Module { return new(KafkaReporter) },
+	}
+}
+
+// Provision implements caddy.Provisioner
+func (k *KafkaReporter) Provision(ctx caddy.Context) error {
+	if len(k.Brokers) == 0 {
+		return fmt.Errorf("kafka reporter requires at least one broker")
+	}
+	if k.Topic == "" {
+		return fmt.Errorf("kafka reporter requires a topic")
+	}
+
+	switch k.Key {
+	case "":
+		k.Key = "path"
+	case "path", "fingerprint", "none":
+	default:
+		return fmt.Errorf("unrecognized kafka key '%s'", k.Key)
+	}
+
+	if k.BatchTimeout == 0 {
+		k.BatchTimeout = caddy.Duration(time.Second)
+	}
+
+	k.slogger = ctx.Slogger()
+	k.writer = &kafka.Writer{
+		Addr:         kafka.TCP(k.Brokers...),
+		Topic:        k.Topic,
+		Balancer:     &kafka.Hash{},
+		BatchTimeout: time.Duration(k.BatchTimeout),
+		Async:        true,
+		Completion: func(messages []kafka.Message, err error) {
+			if err != nil {
+				k.slogger.Error("kafka_reporter_error",
+					slog.String("error", err.Error()),
+					slog.Int("messages", len(messages)),
+				)
+			}
+		},
+	}
+
+	return nil
+}
+
+// Cleanup implements caddy.CleanerUpper. Closing the writer flushes any pending messages.
+func (k *KafkaReporter) Cleanup() error {
+	// Cleanup is called even if Provision failed, before the writer was created
+	if k.writer == nil {
+		return nil
+	}
+	return k.writer.Close()
+}
+
+func (k *KafkaReporter) Report(rep Report) {
+	value, err := json.Marshal(newEvent(rep, k.IncludeArtifacts))
+	if err != nil {
+		k.slogger.Error("kafka_reporter_error", slog.String("error", err.Error()))
+		return
+	}
+
+	// The writer is asynchronous, so this only enqueues the message. Errors are reported through Completion.
+	_ = k.writer.WriteMessages(context.Background(), kafka.Message{
+		Key:   k.key(rep.Request),
+		Value: value,
+		Time:  rep.Time,
+	})
+}
+
+func (k *KafkaReporter) key(req RequestSummary) []byte {
+	switch k.Key {
+	case "fingerprint":
+		return []byte(req.Fingerprint())
+	case "none":
+		return nil
+	default:
+		return []byte(req.Path())
+	}
+}
+
+func (k *KafkaReporter) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume reporter name
+	for d.NextBlock(0) {
+		switch d.Val() {
+		case "brokers":
+			k.Brokers = append(k.Brokers, d.RemainingArgs()...)
+			if len(k.Brokers) == 0 {
+				return d.ArgErr()
+			}
+		case "topic":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			k.Topic = d.Val()
+		case "key":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			k.Key = d.Val()
+		case "include_artifacts":
+			k.IncludeArtifacts = true
+		case "batch_timeout":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("error parsing batch_timeout: %v", err)
+			}
+			k.BatchTimeout = caddy.Duration(dur)
+		default:
+			return d.Errf("unrecognized kafka reporter option '%s'", d.Val())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,18 @@
+package mirror
+
+import (
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestKafkaReporter_CleanupInvalid(t *testing.T) {
+	for _, k := range []*KafkaReporter{{Topic: "mirror"}, {Brokers: []string{"localhost:9092"}}} {
+		if err := k.Provision(caddy.Context{}); err == nil {
+			t.Fatalf("Provision() accepted %+v", k)
+		}
+		if err := k.Cleanup(); err != nil {
+			t.Errorf("Cleanup() = %v", err)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package mirror
+
+import (
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+var (
+	_ Comparer              = LatencyComparer{}
+	_ caddyfile.Unmarshaler = (*LatencyComparer)(nil)
+)
+
+func init() {
+	caddy.RegisterModule(LatencyComparer{})
+}
+
+// LatencyComparer compares how long the handlers took to respond, to flag latency regressions. The secondary
+// mismatches if it took more than MaxRatio times as long as the primary, or more than MaxIncrease longer, whichever are
+// set. Responses without a duration are skipped.
+type LatencyComparer struct {
+	// MaxRatio is how many times as long as the primary the secondary may take. Defaults to 2, unless MaxIncrease is
+	// set.
+	MaxRatio float64 `json:"max_ratio,omitempty"`
+	// MaxIncrease, if set, is how much longer than the primary the secondary may take
+	MaxIncrease caddy.Duration `json:"max_increase,omitempty"`
+}
+
+func (LatencyComparer) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "mirror.comparers.latency",
+		New: func() caddy.Module { return new(LatencyComparer) },
+	}
+}
+
+func (c LatencyComparer) Compare(primary, secondary ResponseArtifact) Result {
+	res := Result{Comparer: "latency"}
+	if primary.Duration <= 0 || secondary.Duration <= 0 {
+		res.Skipped = true
+		return res
+	}
+	ratio := c.MaxRatio
+	if ratio == 0 && c.MaxIncrease == 0 {
+		ratio = 2
+	}
+	res.Match = (ratio == 0 || secondary.Duration <= time.Duration(float64(primary.Duration)*ratio)) &&
+		(c.MaxIncrease == 0 || secondary.Duration-primary.Duration <= time.Duration(c.MaxIncrease))
+	res.Attrs = []slog.Attr{
+		slog.Duration("primary_duration", primary.Duration),
+		slog.Duration("shadow_duration", secondary.Duration),
+	}
+	return res
+}
+
+func (c *LatencyComparer) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume comparer name
+	// Arguments are thresholds, a ratio like 2x, and an increase like 100ms, in either order
+	args := d.RemainingArgs()
+	if len(args) > 2 {
+		return d.ArgErr()
+	}
+	for _, arg := range args {
+		if ratio, err := strconv.ParseFloat(strings.TrimSuffix(arg, "x"), 64); err == nil {
+			c.MaxRatio = ratio
+			continue
+		}
+		increase, err := caddy.ParseDuration(arg)
+		if err != nil {
+			return d.Errf("error parsing latency threshold '%s': not a ratio or a duration", arg)
+		}
+		c.MaxIncrease = caddy.Duration(increase)
+	}
+	for d.NextBlock(0) {
+		opt := d.Val()
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		switch opt {
+		case "max_ratio":
+			ratio, err := strconv.ParseFloat(strings.TrimSuffix(d.Val(), "x"), 64)
+			if err != nil {
+				return d.Errf("error parsing max_ratio: %v", err)
+			}
+			c.MaxRatio = ratio
+		case "max_increase":
+			increase, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("error parsing max_increase: %v", err)
+			}
+			c.MaxIncrease = caddy.Duration(increase)
+		default:
+			return d.Errf("unrecognized latency option '%s'", opt)
+		}
+	}
+	return nil
+}
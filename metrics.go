@@ -1,51 +1,468 @@
 package mirror
 
 import (
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
 
 	"github.com/prometheus/client_golang/prometheus"
 )
 
 type metrics struct {
-	ttfb            map[string]prometheus.Histogram
-	totalTime       map[string]prometheus.Histogram
-	match, mismatch prometheus.Counter
+	// Timing and match metrics have a route label if metrics_label is set, and no labels otherwise
+	ttfb            map[string]*prometheus.HistogramVec
+	totalTime       map[string]*prometheus.HistogramVec
+	match, mismatch *prometheus.CounterVec
+	// reportMatch and reportMismatch count whole requests, by whether every required comparer matched
+	reportMatch, reportMismatch *prometheus.CounterVec
+	// latencyRegressions count requests which a latency comparer flagged, for taking too much longer on the secondary
+	latencyRegressions *prometheus.CounterVec
+	// mismatchCategories count mismatched requests by the category classify rules gave them
+	mismatchCategories *prometheus.CounterVec
+	// ttfbDelta is the secondary's time to first byte minus the primary's
+	ttfbDelta *prometheus.HistogramVec
+	// routes caps the number of distinct route label values
+	routes *labelLimiter
+
+	bodySize map[string]prometheus.Histogram
+	// bodySizeDelta is the secondary's body size minus the primary's
+	bodySizeDelta prometheus.Histogram
+	// errors are secondary errors, by class
+	errors *prometheus.CounterVec
+	// retries are secondary retries
+	retries prometheus.Counter
+	// shed are requests which weren't mirrored because of memory pressure
+	shed prometheus.Counter
+	// capped are requests which weren't mirrored because max_in_flight was reached
+	capped prometheus.Counter
+	// duplicates are mirrored requests which weren't sent, because dedupe had seen them within its window
+	duplicates prometheus.Counter
+	// primaryErrors are mirrored requests whose primary failed, which were still compared or recorded
+	primaryErrors prometheus.Counter
+	// excluded are mirrored requests which weren't compared because their secondary failed
+	excluded prometheus.Counter
+	// disconnected are comparisons completed after the client disconnected
+	disconnected prometheus.Counter
+	// timeouts are primary and secondary requests which ran out of time or were cancelled, by role and reason
+	timeouts *prometheus.CounterVec
+	// dropped are secondary requests dropped by the worker pool, by reason
+	dropped *prometheus.CounterVec
+	// responses are counted by handler and status class
+	responses *prometheus.CounterVec
+
+	// matchWindows count matches and mismatches over a sliding window, by comparer, for the shadow_match_percent
+	// gauges. "all" counts whole reports.
+	matchWindows map[string]*slidingWindow
 }
 
 const millisecond = float64(time.Millisecond) / float64(time.Second)
 
-func (m *metrics) provision(ctx caddy.Context, name string) {
-	m.ttfb = make(map[string]prometheus.Histogram, 2)
-	m.ttfb["primary"] = prometheus.NewHistogram(prometheus.HistogramOpts{
+// provision registers the handler's metrics. If routes is set, timing and match metrics get a route label.
+func (m *metrics) provision(ctx caddy.Context, name string, routes *labelLimiter) {
+	m.routes = routes
+	var labels []string
+	if routes != nil {
+		labels = []string{"route"}
+	}
+
+	m.ttfb = make(map[string]*prometheus.HistogramVec, 2)
+	m.ttfb["primary"] = prometheus.NewHistogramVec(prometheus.HistogramOpts{
 		Namespace: name,
 		Name:      "primary_time_to_first_byte_seconds",
 		Help:      "Number of seconds before first byte of response from primary",
 		Buckets:   prometheus.ExponentialBuckets(millisecond, 2, 16),
-	})
+	}, labels)
 	ctx.GetMetricsRegistry().Register(m.ttfb["primary"])
-	m.ttfb["secondary"] = prometheus.NewHistogram(prometheus.HistogramOpts{
+	m.ttfb["secondary"] = prometheus.NewHistogramVec(prometheus.HistogramOpts{
 		Namespace: name,
 		Name:      "shadow_time_to_first_byte_seconds",
 		Help:      "Number of seconds before first byte of response from secondary",
 		Buckets:   prometheus.ExponentialBuckets(millisecond, 2, 16),
-	})
+	}, labels)
 	ctx.GetMetricsRegistry().Register(m.ttfb["secondary"])
+	m.ttfbDelta = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: name,
+		Name:      "shadow_time_to_first_byte_delta_seconds",
+		Help:      "Number of seconds before first byte of response from secondary, minus the number from primary",
+		Buckets:   signedBuckets(millisecond, 2, 14),
+	}, labels)
+	ctx.GetMetricsRegistry().Register(m.ttfbDelta)
 
-	m.totalTime = make(map[string]prometheus.Histogram, 2)
-	m.totalTime["primary"] = prometheus.NewHistogram(prometheus.HistogramOpts{
+	m.totalTime = make(map[string]*prometheus.HistogramVec, 2)
+	m.totalTime["primary"] = prometheus.NewHistogramVec(prometheus.HistogramOpts{
 		Namespace: name,
 		Name:      "primary_total_time_seconds",
 		Help:      "Number of seconds for full response from primary",
 		Buckets:   prometheus.ExponentialBuckets(millisecond*2, 2, 16),
-	})
+	}, labels)
 	ctx.GetMetricsRegistry().Register(m.totalTime["primary"])
-	m.totalTime["secondary"] = prometheus.NewHistogram(prometheus.HistogramOpts{
+	m.totalTime["secondary"] = prometheus.NewHistogramVec(prometheus.HistogramOpts{
 		Namespace: name,
 		Name:      "shadow_total_time_seconds",
 		Help:      "Number of seconds for full response from secondary",
 		Buckets:   prometheus.ExponentialBuckets(millisecond*2, 2, 16),
-	})
+	}, labels)
 	ctx.GetMetricsRegistry().Register(m.totalTime["secondary"])
+
+	m.bodySize = make(map[string]prometheus.Histogram, 2)
+	m.bodySize["primary"] = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: name,
+		Name:      "primary_body_size_bytes",
+		Help:      "Size of response bodies from primary",
+		Buckets:   prometheus.ExponentialBuckets(64, 4, 10),
+	})
+	ctx.GetMetricsRegistry().Register(m.bodySize["primary"])
+	m.bodySize["secondary"] = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: name,
+		Name:      "shadow_body_size_bytes",
+		Help:      "Size of response bodies from secondary",
+		Buckets:   prometheus.ExponentialBuckets(64, 4, 10),
+	})
+	ctx.GetMetricsRegistry().Register(m.bodySize["secondary"])
+	m.bodySizeDelta = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: name,
+		Name:      "shadow_body_size_delta_bytes",
+		Help:      "Size of response bodies from secondary minus the size from primary",
+		Buckets:   signedBuckets(16, 4, 8),
+	})
+	ctx.GetMetricsRegistry().Register(m.bodySizeDelta)
+
+	m.match = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: name,
+		Name:      "shadow_body_match",
+		Help:      "Number of responses that matched",
+	}, labels)
+	ctx.GetMetricsRegistry().Register(m.match)
+	m.mismatch = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: name,
+		Name:      "shadow_body_mismatch",
+		Help:      "Number of responses that did not match",
+	}, labels)
+	ctx.GetMetricsRegistry().Register(m.mismatch)
+	m.reportMatch = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: name,
+		Name:      "shadow_match",
+		Help:      "Number of compared requests where every required comparer matched",
+	}, labels)
+	ctx.GetMetricsRegistry().Register(m.reportMatch)
+	m.reportMismatch = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: name,
+		Name:      "shadow_mismatch",
+		Help:      "Number of compared requests where a required comparer mismatched",
+	}, labels)
+	ctx.GetMetricsRegistry().Register(m.reportMismatch)
+	m.latencyRegressions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: name,
+		Name:      "shadow_latency_regressions",
+		Help:      "Number of compared requests where the secondary was slower than the primary by more than a latency threshold",
+	}, labels)
+	ctx.GetMetricsRegistry().Register(m.latencyRegressions)
+	m.mismatchCategories = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: name,
+		Name:      "shadow_mismatch_categories",
+		Help:      "Number of mismatched requests, by the category classify rules gave them",
+	}, []string{"category"})
+	ctx.GetMetricsRegistry().Register(m.mismatchCategories)
+
+	m.errors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: name,
+		Name:      "shadow_errors",
+		Help:      "Number of secondary errors, by class: timeout, connection, handler, or panic",
+	}, []string{"class"})
+	for _, class := range errorClasses {
+		m.errors.WithLabelValues(class) // so every class is exported, even before its first error
+	}
+	ctx.GetMetricsRegistry().Register(m.errors)
+
+	m.retries = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: name,
+		Name:      "shadow_retries",
+		Help:      "Number of times a secondary request was retried",
+	})
+	ctx.GetMetricsRegistry().Register(m.retries)
+
+	m.shed = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: name,
+		Name:      "shed_requests",
+		Help:      "Number of requests which weren't mirrored because the heap was over max_heap_bytes",
+	})
+	ctx.GetMetricsRegistry().Register(m.shed)
+
+	m.capped = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: name,
+		Name:      "capped_requests",
+		Help:      "Number of requests which weren't mirrored because max_in_flight was reached",
+	})
+	ctx.GetMetricsRegistry().Register(m.capped)
+
+	m.duplicates = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: name,
+		Name:      "duplicate_requests",
+		Help:      "Number of mirrored requests which weren't sent to the secondary because they duplicated a recent one",
+	})
+	ctx.GetMetricsRegistry().Register(m.duplicates)
+
+	m.primaryErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: name,
+		Name:      "primary_errors",
+		Help:      "Number of mirrored requests whose primary failed, which were still compared or recorded",
+	})
+	ctx.GetMetricsRegistry().Register(m.primaryErrors)
+
+	m.excluded = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: name,
+		Name:      "excluded_requests",
+		Help:      "Number of mirrored requests which weren't compared because their secondary failed",
+	})
+	ctx.GetMetricsRegistry().Register(m.excluded)
+
+	m.disconnected = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: name,
+		Name:      "comparisons_after_disconnect",
+		Help:      "Number of comparisons completed after the client disconnected",
+	})
+	ctx.GetMetricsRegistry().Register(m.disconnected)
+
+	m.timeouts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: name,
+		Name:      "timeouts_total",
+		Help:      "Number of primary and secondary requests which failed because their deadline was exceeded or they were canceled",
+	}, []string{"role", "reason"})
+	for _, role := range []string{"primary", "secondary"} {
+		for _, reason := range contextOutcomes {
+			m.timeouts.WithLabelValues(role, reason) // so every outcome is exported, even before it happens
+		}
+	}
+	ctx.GetMetricsRegistry().Register(m.timeouts)
+
+	m.dropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: name,
+		Name:      "dropped_total",
+		Help:      "Number of secondary requests dropped by the worker pool, by reason",
+	}, []string{"reason"})
+	ctx.GetMetricsRegistry().Register(m.dropped)
+
+	m.responses = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: name,
+		Name:      "responses",
+		Help:      "Number of responses from the primary and secondary, by status class",
+	}, []string{"handler", "status_class"})
+	ctx.GetMetricsRegistry().Register(m.responses)
+}
+
+// statusClass is the class of an HTTP status, like "2xx". A handler error without a status is served as a 500 by Caddy.
+func statusClass(status int, err error) string {
+	status = errorStatus(status, err)
+	if status < 100 || status > 599 {
+		return "unknown"
+	}
+	return strconv.Itoa(status/100) + "xx"
+}
+
+// errorStatus is the status of a response which ended with err: the status the handler wrote, if it wrote one, or else
+// the status Caddy responds to the error with
+func errorStatus(status int, err error) int {
+	if status == 0 && err != nil {
+		status = http.StatusInternalServerError
+		var he caddyhttp.HandlerError
+		if errors.As(err, &he) && he.StatusCode != 0 {
+			status = he.StatusCode
+		}
+	}
+	return status
+}
+
+// labelValues are the values of the variable labels of timing and match metrics, for a request's route
+func (m *metrics) labelValues(route string) []string {
+	if m.routes == nil {
+		return nil
+	}
+	return []string{route}
+}
+
+// labelLimiter caps the number of distinct values of a label. Values beyond the limit are replaced with "other".
+type labelLimiter struct {
+	limit int
+
+	mu   sync.Mutex
+	seen map[string]struct{}
+}
+
+func newLabelLimiter(limit int) *labelLimiter {
+	return &labelLimiter{limit: limit, seen: make(map[string]struct{})}
+}
+
+func (l *labelLimiter) value(v string) string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.seen[v]; ok {
+		return v
+	}
+	if len(l.seen) >= l.limit {
+		return "other"
+	}
+	l.seen[v] = struct{}{}
+	return v
+}
+
+// signedBuckets are exponential buckets mirrored around zero, for histograms of differences. There are count buckets
+// on either side of zero, starting at ±start.
+func signedBuckets(start, factor float64, count int) []float64 {
+	positive := prometheus.ExponentialBuckets(start, factor, count)
+	buckets := make([]float64, 0, 2*count+1)
+	for i := count - 1; i >= 0; i-- {
+		buckets = append(buckets, -positive[i])
+	}
+	buckets = append(buckets, 0)
+	return append(buckets, positive...)
+}
+
+// provisionMatchRates registers a shadow_match_percent gauge for each comparer, computed over the window when scraped.
+// Unlike a ratio of counters, it doesn't need rate() to be meaningful, so it's simple to alert on.
+func (m *metrics) provisionMatchRates(ctx caddy.Context, name string, window time.Duration, comparers []string) {
+	m.matchWindows = make(map[string]*slidingWindow, len(comparers))
+	for _, comparer := range comparers {
+		w := newSlidingWindow(window, max(window/60, time.Second))
+		m.matchWindows[comparer] = w
+		ctx.GetMetricsRegistry().Register(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace:   name,
+			Name:        "shadow_match_percent",
+			Help:        "Percentage of compared responses that matched, over a sliding window",
+			ConstLabels: prometheus.Labels{"comparer": comparer},
+		}, func() float64 { return matchPercent(w) }))
+	}
+}
+
+// compared records a report in the match rate windows
+func (m *metrics) compared(rep Report) {
+	record := func(w *slidingWindow, match bool) {
+		if w == nil {
+			return
+		}
+		w.record(func(c *windowCounts) {
+			if match {
+				c.Matched++
+			} else {
+				c.Mismatched++
+			}
+		})
+	}
+
+	record(m.matchWindows["all"], rep.Match)
+	for _, res := range rep.Results {
+		if !res.Skipped {
+			record(m.matchWindows[res.Comparer], res.Match)
+		}
+	}
+}
+
+// matchPercent is the percentage of comparisons in the window which matched, or NaN if there were none
+func matchPercent(w *slidingWindow) float64 {
+	return w.sum().matchRate() * 100
+}
+
+// provisionHealth registers a gauge of whether the secondary is healthy
+func (m *metrics) provisionHealth(ctx caddy.Context, name string, healthy func() bool) {
+	ctx.GetMetricsRegistry().Register(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: name,
+		Name:      "secondary_healthy",
+		Help:      "Whether the secondary is passing health checks, and requests are mirrored to it",
+	}, func() float64 {
+		if healthy() {
+			return 1
+		}
+		return 0
+	}))
+}
+
+// provisionLag registers a gauge of how far behind the primary the secondary finishes on average, over the last minute
+func (m *metrics) provisionLag(ctx caddy.Context, name string, s *stats) {
+	ctx.GetMetricsRegistry().Register(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: name,
+		Name:      "secondary_lag_seconds",
+		Help:      "Average time secondary requests finished after their primaries, including queue wait and delay, over the last minute",
+	}, func() float64 { return s.recent.sum().secondaryLag().Seconds() }))
+}
+
+// provisionErrorBudget registers gauges of the secondary's success ratio over each error budget window, and of how much
+// of the error budget it has consumed
+func (m *metrics) provisionErrorBudget(ctx caddy.Context, name string, s *stats) {
+	for _, w := range s.budget.windows {
+		ctx.GetMetricsRegistry().Register(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace:   name,
+			Name:        "secondary_success_percent",
+			Help:        "Percentage of secondary requests which succeeded, over a rolling window",
+			ConstLabels: prometheus.Labels{"window": w.size().String()},
+		}, func() float64 {
+			counts := w.sum()
+			return successRatio(counts.SecondaryRequests, counts.SecondaryErrors) * 100
+		}))
+	}
+	ctx.GetMetricsRegistry().Register(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: name,
+		Name:      "error_budget_consumed_percent",
+		Help:      "Percentage of the secondary's error budget consumed since the config was loaded",
+	}, func() float64 {
+		totals := s.totals()
+		return s.budget.consumed(totals.SecondaryRequests, totals.SecondaryErrors) * 100
+	}))
+}
+
+// provisionSLO registers a gauge of whether the secondary met its objectives in the last evaluated window
+func (m *metrics) provisionSLO(ctx caddy.Context, name string, passing func() bool) {
+	ctx.GetMetricsRegistry().Register(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: name,
+		Name:      "slo_passing",
+		Help:      "Whether the secondary met every objective in the last evaluated SLO window",
+	}, func() float64 {
+		if passing() {
+			return 1
+		}
+		return 0
+	}))
+}
+
+// provisionGovernor registers a gauge of the fraction of the mirror rate the load governor lets through
+func (m *metrics) provisionGovernor(ctx caddy.Context, name string, rate func() float64) {
+	ctx.GetMetricsRegistry().Register(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: name,
+		Name:      "load_governor_rate",
+		Help:      "Fraction of the configured mirror rate let through by the load governor",
+	}, rate))
+}
+
+// provisionQuota registers gauges of how much of the mirrored request quota is used
+func (m *metrics) provisionQuota(ctx caddy.Context, name string, usage func() quotaUsage) {
+	for _, period := range []string{"day", "total"} {
+		ctx.GetMetricsRegistry().Register(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace:   name,
+			Name:        "quota_used",
+			Help:        "Number of mirrored requests counted against the quota, in the current UTC day or in total",
+			ConstLabels: prometheus.Labels{"period": period},
+		}, func() float64 {
+			u := usage()
+			if period == "day" {
+				return float64(u.UsedToday)
+			}
+			return float64(u.UsedTotal)
+		}))
+	}
+}
+
+// provisionInFlight registers gauges of the secondary requests and comparisons in flight
+func (m *metrics) provisionInFlight(ctx caddy.Context, name string, s *stats) {
+	for kind, count := range map[string]*atomic.Int64{"secondary": &s.inFlight, "comparison": &s.comparing} {
+		ctx.GetMetricsRegistry().Register(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace:   name,
+			Name:        "in_flight",
+			Help:        "Number of secondary requests, and comparisons waiting for them or running, in flight",
+			ConstLabels: prometheus.Labels{"kind": kind},
+		}, func() float64 { return float64(count.Load()) }))
+	}
 }
@@ -0,0 +1,83 @@
+package mirror
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func Test_metrics_compared(t *testing.T) {
+	m := metrics{matchWindows: map[string]*slidingWindow{
+		"all":  newSlidingWindow(5*time.Minute, 5*time.Second),
+		"body": newSlidingWindow(5*time.Minute, 5*time.Second),
+	}}
+
+	for i := range 4 {
+		m.compared(Report{
+			Match: i == 0,
+			Results: []Result{
+				{Comparer: "status", Match: true},
+				{Comparer: "body", Match: i < 3},
+				{Comparer: "header", Skipped: true},
+			},
+		})
+	}
+
+	if got := matchPercent(m.matchWindows["all"]); got != 25 {
+		t.Errorf("all match percent = %v, want 25", got)
+	}
+	if got := matchPercent(m.matchWindows["body"]); got != 75 {
+		t.Errorf("body match percent = %v, want 75", got)
+	}
+	if got := matchPercent(newSlidingWindow(time.Minute, time.Second)); !math.IsNaN(got) {
+		t.Errorf("match percent without comparisons = %v, want NaN", got)
+	}
+}
+
+func Test_statusClass(t *testing.T) {
+	tests := []struct {
+		status int
+		err    error
+		want   string
+	}{
+		{200, nil, "2xx"},
+		{304, nil, "3xx"},
+		{404, nil, "4xx"},
+		{503, nil, "5xx"},
+		{0, errors.New("oops"), "5xx"},
+		{0, caddyhttp.Error(http.StatusForbidden, errors.New("nope")), "4xx"},
+		{0, nil, "unknown"},
+	}
+	for _, tt := range tests {
+		if got := statusClass(tt.status, tt.err); got != tt.want {
+			t.Errorf("statusClass(%d, %v) = %s, want %s", tt.status, tt.err, got, tt.want)
+		}
+	}
+}
+
+func Test_signedBuckets(t *testing.T) {
+	got := signedBuckets(1, 10, 3)
+	want := []float64{-100, -10, -1, 0, 1, 10, 100}
+	if !slices.Equal(got, want) {
+		t.Errorf("signedBuckets() = %v, want %v", got, want)
+	}
+}
+
+func Test_labelLimiter(t *testing.T) {
+	l := newLabelLimiter(2)
+	for _, tt := range []struct{ in, want string }{
+		{"/a", "/a"},
+		{"/b", "/b"},
+		{"/c", "other"},
+		{"/a", "/a"},
+	} {
+		if got := l.value(tt.in); got != tt.want {
+			t.Errorf("value(%s) = %s, want %s", tt.in, got, tt.want)
+		}
+	}
+}
@@ -4,9 +4,9 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"io"
 	"log/slog"
 	"maps"
-	"math/rand/v2"
 	"net/http"
 	"sync"
 	"time"
@@ -17,6 +17,7 @@ import (
 
 var (
 	_ caddy.Provisioner           = (*Handler)(nil)
+	_ caddy.CleanerUpper          = (*Handler)(nil)
 	_ caddyhttp.MiddlewareHandler = (*Handler)(nil)
 )
 
@@ -38,28 +39,145 @@ func putBuf(buf *bytes.Buffer) {
 
 type slogger interface {
 	Error(string, ...any)
+	Warn(string, ...any)
 	Info(string, ...any)
+	Debug(string, ...any)
 }
 
 // Handler runs multiple handlers and aggregates their results
 type Handler struct {
 	ComparisonConfig
 	ReportingConfig
+	SecondaryRequestConfig
 
+	// Name identifies the handler in the admin API, at /mirror/<name>/. Defaults to MetricsName. Handlers without a
+	// name aren't available in the admin API.
+	Name string `json:"name,omitempty"`
+
+	// MetricsName, if set, enables the handler's Prometheus metrics, labeled with this name
 	MetricsName string `json:"metrics_name"`
 	metrics     metrics
+	// MetricsLabel, if set, is a placeholder whose value labels timing and match metrics as route, like
+	// {http.request.uri.path} or {http.vars.route}. At most MetricsLabelLimit distinct values are kept, defaulting to
+	// 100; any others are labeled "other".
+	MetricsLabel      string `json:"metrics_label,omitempty"`
+	MetricsLabelLimit int    `json:"metrics_label_limit,omitempty"`
+	// MatchRateWindow is the sliding window the shadow_match_percent gauges are computed over. Defaults to 5 minutes.
+	MatchRateWindow caddy.Duration `json:"match_rate_window,omitempty"`
+
+	// ComparersRaw are custom comparers, which run after any enabled by ComparisonConfig
+	ComparersRaw []json.RawMessage `json:"comparers,omitempty" caddy:"namespace=mirror.comparers inline_key=comparer"`
+	comparers    []Comparer
+
+	// ReportersRaw receive the results of every comparison, in addition to the handler's own log
+	ReportersRaw []json.RawMessage `json:"reporters,omitempty" caddy:"namespace=mirror.reporters inline_key=reporter"`
+	reporters    []Reporter
+
+	// CredentialsRaw add credentials for the secondary to mirrored requests, after secondary headers are filtered
+	CredentialsRaw []json.RawMessage `json:"secondary_credentials,omitempty" caddy:"namespace=mirror.credentials inline_key=credentials"`
+	credentials    []Credentials
 
+	// SecondaryRaw and PrimaryRaw are the subroutes which handle mirrored and original requests. The primary's
+	// response is sent to the client, and the secondary's is only compared.
 	SecondaryRaw       json.RawMessage `json:"secondary"`
 	PrimaryRaw         json.RawMessage `json:"primary"`
 	secondary, primary caddyhttp.MiddlewareHandler
 
+	// Timeout is a deadline for the secondary, as a duration string. Defaults to 30s. "0" or "none" disables it.
 	Timeout string `json:"secondary_timeout,omitempty"`
 	timeout time.Duration
+	// PrimaryTimeout, if set, is a deadline for the primary. By default, the primary has no deadline besides the ones
+	// the server or other handlers impose.
+	PrimaryTimeout caddy.Duration `json:"primary_timeout,omitempty"`
+	// Synchronous waits for the secondary, and compares the responses, before the handler returns. The primary's
+	// response is still sent first. It's meant for tests and low-traffic tools, where determinism matters more than
+	// the handler's latency. Extra copies from secondary_amplify, and WebSockets, are still mirrored in the background.
+	Synchronous bool `json:"synchronous,omitempty"`
 
+	// MirrorRate is the percentage of requests which are mirrored, from 0 to 100. Defaults to 100. A negative rate
+	// disables mirroring.
 	MirrorRate float64 `json:"mirror_rate,omitempty"`
+	// SamplingSeed, if set, makes every sampling decision a hash of the seed and the request's SamplingKey, instead of
+	// random, so the same requests are mirrored in every test run and on every replica
+	SamplingSeed uint64 `json:"sampling_seed,omitempty"`
+	// SamplingKey is a placeholder-enabled key identifying requests for SamplingSeed. Defaults to the request's
+	// method, host, and URI.
+	SamplingKey string `json:"sampling_key,omitempty"`
+	// draw, if set, replaces random draws for sampling decisions, as a function of the request and the decision's salt
+	draw func(r *http.Request, salt string) float64
+	// RampUpDuration, if set, ramps the mirror rate up from zero over this long after the handler is provisioned, so
+	// the secondary can warm up before it gets full volume
+	RampUpDuration caddy.Duration `json:"ramp_up_duration,omitempty"`
+	rampUp         *rampUp
+	// SlowStartDuration, if set, ramps the mirror rate up from zero over this long when mirroring resumes after it was
+	// suspended, like when the secondary recovers from failing health checks
+	SlowStartDuration caddy.Duration `json:"slow_start_duration,omitempty"`
+	slowStart         *rampUp
+	// MaxHeapBytes, if set, sheds mirrored requests while the process's heap is larger than this, so buffering
+	// responses for comparison doesn't add to memory pressure
+	MaxHeapBytes uint64 `json:"max_heap_bytes,omitempty"`
+	heap         *heapMonitor
+	// LoadGovernor, if set, reduces the mirror rate while the process is under CPU pressure
+	LoadGovernor *LoadGovernorConfig `json:"load_governor,omitempty"`
+	governor     *governor
+	// MaxMirroredPerDay and MaxMirrored, if set, stop mirroring once that many requests were mirrored in the current
+	// UTC day, or in total. Usage is kept across config reloads for handlers with a name, and the total can be reset
+	// through the admin API.
+	MaxMirroredPerDay int64 `json:"max_mirrored_requests_per_day,omitempty"`
+	MaxMirrored       int64 `json:"max_mirrored_requests,omitempty"`
+	quota             *quota
+	// WorkerPool, if set, sends secondary requests from a fixed pool of workers, dropping them when its queue is full
+	WorkerPool *WorkerPoolConfig `json:"worker_pool,omitempty"`
+	pool       *workerPool
+	// MaxInFlight, if set, caps the goroutines running for mirrored requests, for secondary requests and comparisons
+	// combined. Requests aren't mirrored while it's reached.
+	MaxInFlight   int64 `json:"max_in_flight,omitempty"`
+	inFlightLimit *inFlightLimit
+	// drain stops mirroring new requests, when started through the admin API
+	drain *drainer
+
+	// Exclude, if set, keeps matching requests from being mirrored at all
+	Exclude *ExcludeConfig `json:"exclude,omitempty"`
+	// Tenant, if set, reports the tenant of each request, and can mirror tenants at their own rates
+	Tenant *TenantConfig `json:"tenant,omitempty"`
+	// Dedupe, if set, sends each distinct request to the secondary only once per window
+	Dedupe *DedupeConfig `json:"dedupe,omitempty"`
+	dedupe *deduper
+
+	// SamplerRaw decides which requests are mirrored. If set, it takes the place of MirrorRate.
+	SamplerRaw json.RawMessage `json:"sampler,omitempty" caddy:"namespace=mirror.samplers inline_key=sampler"`
+	sampler    Sampler
+
+	headerAllow, headerDeny *headerMatcher
+
+	stats *stats
+	// recent are the last mismatches, if recent_mismatches is set
+	recent *mismatchRing
+	// Artifacts, if set, writes the artifacts of every mismatch to a directory, and references them in mismatch logs
+	Artifacts *ArtifactsConfig `json:"artifacts,omitempty"`
+	artifacts *artifactStore
+	// Alerts, if set, warn when the secondary crosses a threshold
+	Alerts *AlertConfig `json:"alerts,omitempty"`
+	// Scorecard, if set, keeps a pass or fail scorecard of the secondary, served by the admin API and logged
+	Scorecard *ScorecardConfig `json:"scorecard,omitempty"`
+	scorecard *scorecard
+	// ErrorBudget, if set, tracks the secondary's success ratio and how much of its error budget it has consumed
+	ErrorBudget *ErrorBudgetConfig `json:"error_budget,omitempty"`
+	// SLO, if set, evaluates the secondary against service level objectives, for a pass or fail verdict
+	SLO *SLOConfig `json:"slo,omitempty"`
+	// HealthCheck, if set, suspends mirroring while the secondary is unhealthy
+	HealthCheck *HealthCheckConfig `json:"health_check,omitempty"`
+	health      *healthChecker
+
+	// done is closed when the handler is cleaned up, to stop background work
+	done chan struct{}
 
 	slogger slogger
-	now     func() time.Time
+	// comparisonSlogger logs comparison results, as http.handlers.mirror[.<name>].comparisons
+	comparisonSlogger slogger
+	// accessSlogger logs secondary requests, if access_log is set, as http.handlers.mirror[.<name>].access
+	accessSlogger slogger
+	now           func() time.Time
 }
 
 func (h Handler) CaddyModule() caddy.ModuleInfo {
@@ -69,54 +187,242 @@ func (h Handler) CaddyModule() caddy.ModuleInfo {
 	}
 }
 
+// cloneRequest clones a request for the secondary. Context values which handlers change while they run are copied, so
+// the primary's and secondary's routes don't see each other's changes, or race on them.
 func cloneRequest(r *http.Request) *http.Request {
 	ctx := r.Context()
 	ctx = context.WithValue(
 		ctx,
 		caddyhttp.VarsCtxKey,
-		maps.Clone( // The vars map isn't concurrency safe, so we'll clone it for the mirrored request
+		deepCopyVars( // The vars map isn't concurrency safe, so we'll clone it for the mirrored request
 			ctx.Value(caddyhttp.VarsCtxKey).(map[string]any),
 		),
 	)
+	if groups, ok := ctx.Value(routeGroupCtxKey).(map[string]struct{}); ok {
+		ctx = context.WithValue(ctx, routeGroupCtxKey, maps.Clone(groups))
+	}
+	if orig, ok := ctx.Value(caddyhttp.OriginalRequestCtxKey).(http.Request); ok && orig.URL != nil {
+		u := *orig.URL
+		orig.URL = &u
+		ctx = context.WithValue(ctx, caddyhttp.OriginalRequestCtxKey, orig)
+	}
+	if _, ok := ctx.Value(caddyhttp.ExtraLogFieldsCtxKey).(*caddyhttp.ExtraLogFields); ok {
+		// Otherwise, fields the secondary's handlers add would end up in the primary's access log
+		ctx = context.WithValue(ctx, caddyhttp.ExtraLogFieldsCtxKey, new(caddyhttp.ExtraLogFields))
+	}
 
-	return r.Clone(ctx)
+	sr := r.Clone(ctx)
+	if repl, ok := ctx.Value(caddy.ReplacerCtxKey).(*caddy.Replacer); ok {
+		cloneReplacer(sr, repl)
+	}
+	return sr
 }
 
 func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) (err error) {
-	if !h.shouldMirror() { // Fractional mirroring. If this returns false, we only call primary
+	if h.Exclude.excludes(r) {
+		setDecision(r, false)
+		return h.primary.ServeHTTP(w, r, next)
+	}
+	if isWebSocketUpgrade(r) {
+		return h.serveWebSocket(w, r, next)
+	}
+	mirrored := h.shouldMirror(r)
+	h.stats.sampled(mirrored)
+	id := setDecision(r, mirrored)
+	if !mirrored { // Fractional mirroring. If this returns false, we only call primary
 		return h.primary.ServeHTTP(w, r, next)
 	}
 
+	route := h.routeLabel(r)
+
 	var primaryBuf, shadowBuf *bytes.Buffer
+	var summary RequestSummary
 	if h.shouldCompare() { // Only prepare buffers if we anticipate needing them for secondary response comparison
 		primaryBuf, shadowBuf = getBuf(), getBuf()
+		summary = summarizeRequest(r)
+		summary.Route = route
+		summary.Tenant = h.Tenant.fromRequest(r)
 	}
 
+	// Duplicates are only known once the body is read, but the request is fingerprinted as the client sent it
+	fp := h.dedupe.fingerprint(r)
+
+	if h.IdentityEncoding == identityEncodingBoth {
+		// The client's Accept-Encoding is put back once the primary is done, so the request is logged as it was sent
+		acceptEncoding, ok := r.Header["Accept-Encoding"]
+		r.Header.Set("Accept-Encoding", "identity")
+		defer func() {
+			if ok {
+				r.Header["Accept-Encoding"] = acceptEncoding
+			} else {
+				r.Header.Del("Accept-Encoding")
+			}
+		}()
+	}
 	sr := cloneRequest(r)
+	h.rewriteSecondary(sr)
+	copies := h.cloneCopies(r)
 
-	pRecorder := caddyhttp.NewResponseRecorder(w, primaryBuf, h.shouldBuffer)
-	sRecorder := caddyhttp.NewResponseRecorder(&NopResponseWriter{}, shadowBuf, h.shouldBuffer)
+	// Event streams aren't buffered, so they're hashed as they're written instead
+	var pEvents, sEvents *eventHasher
+	pw, sw := w, http.ResponseWriter(&NopResponseWriter{})
+	if h.shouldCompare() {
+		pEvents, sEvents = &eventHasher{ResponseWriter: pw}, &eventHasher{ResponseWriter: sw}
+		pw, sw = pEvents, sEvents
+	}
+	pRecorder := caddyhttp.NewResponseRecorder(pw, primaryBuf, h.shouldBuffer)
+	sRecorder := caddyhttp.NewResponseRecorder(sw, shadowBuf, h.shouldBuffer)
 
+	var srbuf *bytes.Buffer
+	// tee is set if the body is copied to the secondary as the primary reads it
+	var tee *teeBody
+	// tooLarge is set if the body is over MaxBodyBytes, which for bodies of unknown length is only known once it's read
+	var tooLarge bool
 	if r.Body != nil { // Body is strictly read-once, can't be cloned. So we multiplex it to secondary
-		prbuf, srbuf := getBuf(), getBuf()
-		defer putBuf(prbuf)
-		defer putBuf(srbuf)
-		r.Body, sr.Body = duplex(r.Body, prbuf, srbuf)
+		srbuf = getBuf()
+		if expectsContinue(r) {
+			// Reading the body up front would send 100 Continue before the primary decides whether it wants the body
+			tee = newTeeBody(r.Body, srbuf, h.MaxBodyBytes)
+			r.Body, sr.Body = tee, http.NoBody
+		} else {
+			prbuf := getBuf()
+			defer putBuf(prbuf)
+			r.Body, sr.Body = duplex(r.Body, prbuf, srbuf, h.MaxBodyBytes)
+			tooLarge = sr.Body == nil
+			// Trailers of chunked bodies are only known once the body is read, after the request was cloned
+			sr.Trailer = r.Trailer.Clone()
+		}
+	}
+
+	// Time to first byte of each response, if metrics are enabled
+	var pTiming, sTiming responseTiming
+	// sDropped is set if the secondary request was dropped by the worker pool, and never sent
+	var sDropped bool
+	var sErr error
+	// pDone and sDone are when each handler finished, for how far behind the secondary is. sDone is only set if the
+	// secondary request was sent.
+	var pDone, sDone time.Time
+
+	secondaryHandler := h.secondaryHandler()
+	// abortSecondary cancels the secondary if the primary fails, if on_primary_error is cancel
+	abortSecondary := func() {}
+	if h.OnPrimaryError == primaryErrorCancel {
+		abort := make(chan struct{})
+		abortSecondary = func() { close(abort) }
+		secondaryHandler = abortHandler{MiddlewareHandler: secondaryHandler, abort: abort}
 	}
 
 	wg := sync.WaitGroup{}
 	wg.Add(1)
-	go func() { // Handle only the secondary request asynchronously
+	h.stats.started()
+	secondary := func(dropped bool) { // Handle only the secondary request asynchronously
 		defer wg.Done()
-		sErr := h.requestProcessor("secondary", h.secondary)(sRecorder, sr, next)
-		if sErr != nil { // TODO: Make sure that this error is handled as idiomatically and safely as possible
-			h.slogger.Error("secondary_handler_error", slog.String("error", sErr.Error()))
+		defer h.stats.finished()
+		defer h.inFlightLimit.release(1)
+		if srbuf != nil {
+			// The secondary can still be reading its body after the primary is done, so its buffer is only released here
+			defer putBuf(srbuf)
+			// The primary can still be reading the body, so it has to stop copying it before the buffer is released
+			defer tee.finish()
+		}
+		if dropped {
+			sDropped = true
+			return
+		}
+		if tee != nil {
+			select {
+			case <-tee.done:
+			case <-h.done:
+				return
+			}
+			tooLarge = tee.overLimit
 		}
-	}()
+		if tooLarge {
+			h.slogger.Info("secondary_body_too_large", slog.Int64("limit", h.MaxBodyBytes))
+			return
+		}
+		if tee != nil {
+			if !tee.complete {
+				// The primary didn't read the whole body, so the client never sent it
+				h.slogger.Info("secondary_body_unread")
+				return
+			}
+			sr.Body = io.NopCloser(srbuf)
+			sr.Trailer = r.Trailer.Clone()
+		}
+		if fp != nil {
+			var body []byte
+			if srbuf != nil {
+				body = srbuf.Bytes()
+			}
+			if !h.dedupe.first(fp, body) {
+				// Duplicates aren't sent, so there's nothing to compare
+				sDropped = true
+				if h.MetricsName != "" {
+					h.metrics.duplicates.Inc()
+				}
+				return
+			}
+		}
+		if delay := h.secondaryDelay(); delay > 0 {
+			timer := time.NewTimer(delay)
+			defer timer.Stop()
+			select {
+			case <-timer.C:
+			case <-h.done:
+				return
+			}
+		}
+		if srbuf != nil && h.shouldCompare() && summary.Tenant == "" {
+			// The body is complete by now, and still as the client sent it
+			summary.Tenant = h.Tenant.fromBody(srbuf.Bytes())
+		}
+		if len(copies) > 0 {
+			var body []byte
+			if srbuf != nil {
+				// Copied, since the buffer is released once the secondary is done with it
+				body = bytes.Clone(srbuf.Bytes())
+			}
+			h.sendCopies(copies, body, sr.Trailer, route, next)
+		}
+		if !h.prepareSecondary(sr) {
+			return
+		}
+		// Errors are logged by the request processor
+		sErr = h.requestProcessor("secondary", secondaryHandler, route, &sTiming)(sRecorder, sr, h.secondaryNext(next))
+		sDone = h.now()
+		if h.AccessLog {
+			h.logAccess(sr, sRecorder, sTiming.total, sErr)
+		}
+	}
+	if h.pool != nil {
+		h.pool.submit(secondary)
+	} else {
+		go secondary(false)
+	}
+	if h.Synchronous {
+		// Even if the primary fails, the secondary is done by the time the handler returns
+		defer wg.Wait()
+	}
 
-	err = h.requestProcessor("primary", h.primary)(pRecorder, r, next)
+	err = h.requestProcessor("primary", h.primary, route, &pTiming)(pRecorder, r, next)
+	pDone = h.now()
+	// Whether or not the primary read the body, the secondary can't wait for it any longer
+	tee.finish()
+	pErr := err
 	if err != nil {
-		return err
+		// If the client went away, the primary usually fails too. The mirrored request carries on regardless, unless
+		// secondary_context is cancel, so it's still compared if the primary had responded. If the primary failed on
+		// its own, on_primary_error decides.
+		clientGone := r.Context().Err() != nil
+		if clientGone && pRecorder.Status() == 0 || !clientGone && !h.reportsPrimaryErrors() {
+			abortSecondary()
+			if h.waitsForSecondary() {
+				// Nothing will wait for the secondary after all
+				h.inFlightLimit.release(1)
+			}
+			return err
+		}
 	}
 
 	var pBytes []byte
@@ -124,37 +430,136 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyht
 		// We don't want the mirrored request to block sending a response downstream. So here we send the primary response
 		// *without* waiting for the secondary request to complete.
 		pBytes = pRecorder.Buffer().Bytes()
-		w.WriteHeader(pRecorder.Status())
-		_, err = w.Write(pBytes)
+		if err == nil {
+			w.WriteHeader(pRecorder.Status())
+			_, err = w.Write(pBytes)
+		}
 	}
+	// The request's context is only cancelled before the handler returns if the client disconnected
+	disconnected := r.Context().Err() != nil
 
-	if h.shouldCompare() {
-		// If we're doing comparison, let's spin up a new goroutine so we can avoid blocking. This way downstream
-		// handlers and clients are able to know we're done with our ResponseWriter here.
-		go func() {
-			defer putBuf(primaryBuf)
-			defer putBuf(shadowBuf)
+	if h.waitsForSecondary() {
+		// If we're doing comparison, or recording metrics for both responses, let's spin up a new goroutine so we can
+		// avoid blocking. This way downstream handlers and clients are able to know we're done with our ResponseWriter
+		// here.
+		h.stats.comparisonStarted()
+		waitAndCompare := func() {
+			defer h.stats.comparisonFinished()
+			defer h.inFlightLimit.release(1)
 			// Wait for the mirrored request to complete before attempting to compare.
 			wg.Wait()
+			if sDropped {
+				if h.shouldCompare() {
+					putBuf(primaryBuf)
+					putBuf(shadowBuf)
+				}
+				return
+			}
+			if !sDone.IsZero() {
+				// Queue wait and delay, plus however much longer the secondary took
+				h.stats.lagged(sDone.Sub(pDone))
+			}
+			if h.MetricsName != "" {
+				h.metrics.bodySizeDelta.Observe(float64(sRecorder.Size() - pRecorder.Size()))
+				if pTiming.ttfb > 0 && sTiming.ttfb > 0 {
+					h.metrics.ttfbDelta.WithLabelValues(h.metrics.labelValues(route)...).Observe((sTiming.ttfb - pTiming.ttfb).Seconds())
+				}
+			}
+			if !h.shouldCompare() {
+				return
+			}
+
+			defer putBuf(primaryBuf)
+			defer putBuf(shadowBuf)
+			if disconnected && h.SkipDisconnected {
+				return
+			}
 			var sBytes []byte
 			if sRecorder.Buffered() {
 				sBytes = sRecorder.Buffer().Bytes()
-				h.compareBody(pBytes, sBytes)
 			}
-			h.compareHeaders(pRecorder.Header(), sRecorder.Header())
-			h.compareStatus(pRecorder.Status(), sRecorder.Status())
-		}()
+			primary := ResponseArtifact{
+				Status:   errorStatus(pRecorder.Status(), pErr),
+				Header:   pRecorder.Header(),
+				Body:     pBytes,
+				Buffered: pRecorder.Buffered(),
+				Duration: pTiming.total,
+			}
+			secondary := ResponseArtifact{
+				Status:   errorStatus(sRecorder.Status(), sErr),
+				Header:   sRecorder.Header(),
+				Body:     sBytes,
+				Buffered: sRecorder.Buffered(),
+				Duration: sTiming.total,
+			}
+			if pErr != nil {
+				primary.Error = pErr.Error()
+			}
+			if sErr != nil {
+				secondary.Error = sErr.Error()
+			}
+			if h.Decompress {
+				h.decompressArtifact("primary", &primary)
+				h.decompressArtifact("secondary", &secondary)
+			}
+			primary.Events, primary.EventsHash = pEvents.sum()
+			secondary.Events, secondary.EventsHash = sEvents.sum()
+			h.compare(id, summary, primary, secondary)
+			if disconnected && h.MetricsName != "" {
+				h.metrics.disconnected.Inc()
+			}
+		}
+		if h.Synchronous {
+			// The client gets the primary's response before the secondary is waited for
+			_ = http.NewResponseController(w).Flush()
+			waitAndCompare()
+		} else {
+			go waitAndCompare()
+		}
 	}
 
 	return err
 }
 
-func (h *Handler) requestProcessor(name string, inner caddyhttp.MiddlewareHandler) func(wr http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+// routeLabel returns the value of the MetricsLabel placeholder for r, or "" if requests aren't labeled by route
+func (h *Handler) routeLabel(r *http.Request) string {
+	if h.MetricsName == "" || h.MetricsLabel == "" {
+		return ""
+	}
+	repl := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	return h.metrics.routes.value(repl.ReplaceAll(h.MetricsLabel, ""))
+}
+
+// prepareSecondary transforms the mirrored request's body and adds credentials, right before it's sent. If either
+// fails, the error is logged, and it returns false, since the request shouldn't be sent.
+func (h *Handler) prepareSecondary(sr *http.Request) bool {
+	if err := h.bodyTransform.apply(sr); err != nil {
+		h.slogger.Error("secondary_body_error", slog.String("error", err.Error()))
+		return false
+	}
+	for _, c := range h.credentials {
+		if err := c.Apply(sr); err != nil {
+			h.slogger.Error("secondary_credentials_error", slog.String("error", err.Error()))
+			return false
+		}
+	}
+	return true
+}
+
+// responseTiming is how long a handler took to respond
+type responseTiming struct {
+	// ttfb is the time to first byte, which is only measured if metrics are enabled
+	ttfb time.Duration
+	// total is how long the handler took, from when the request body was read, if metrics are enabled
+	total time.Duration
+}
+
+// requestProcessor runs a handler, recording its metrics, labeled by route, and stats. Its timing is stored in timing.
+func (h *Handler) requestProcessor(name string, inner caddyhttp.MiddlewareHandler, route string, timing *responseTiming) func(wr http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
 	return func(wr http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
-		// Even though there may be a timeout provided by another handler, we really want to make sure we keep our
-		// goroutines tidy. We're enforcing a timeout on all request processing as mitigation for the possibility of
-		// goroutine leaks and connection leaks.
-		ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), h.timeout)
+		recorder, _ := wr.(caddyhttp.ResponseRecorder)
+
+		ctx, cancel := h.handlerContext(name, r.Context())
 		defer cancel()
 		r = r.WithContext(ctx)
 		startedAt := h.now()
@@ -174,29 +579,137 @@ func (h *Handler) requestProcessor(name string, inner caddyhttp.MiddlewareHandle
 			// TimedWriter lets us capture the time when we first start receiving a response body, and the time when we
 			// first receive a response status, allowing us to track time to first byte.
 			wr = NewTimedWriter(wr, func() {
-				h.metrics.ttfb[name].Observe(time.Since(startedAt).Seconds())
+				timing.ttfb = time.Since(startedAt)
+				h.metrics.ttfb[name].WithLabelValues(h.metrics.labelValues(route)...).Observe(timing.ttfb.Seconds())
 			})
 		}
 		err := inner.ServeHTTP(wr, r, next)
+		timing.total = time.Since(startedAt)
 		if h.MetricsName != "" {
-			h.metrics.totalTime[name].Observe(time.Since(startedAt).Seconds())
+			h.metrics.totalTime[name].WithLabelValues(h.metrics.labelValues(route)...).Observe(timing.total.Seconds())
+			if recorder != nil {
+				h.metrics.responses.WithLabelValues(name, statusClass(recorder.Status(), err)).Inc()
+				h.metrics.bodySize[name].Observe(float64(recorder.Size()))
+			}
+		}
+		if recorder != nil {
+			h.stats.observe(name, timing.total, recorder.Status(), err)
 		}
 		if err != nil {
-			h.slogger.Error(name+"_handler_error", slog.String("error", err.Error()))
+			class := classifyError(err)
+			if name == "secondary" && h.MetricsName != "" {
+				h.metrics.errors.WithLabelValues(class).Inc()
+			}
+			// Timeouts and cancellations are told apart from the handler's own failures
+			msg := name + "_handler_error"
+			outcome := contextOutcome(ctx, err)
+			switch outcome {
+			case contextDeadlineExceeded:
+				msg = name + "_handler_timeout"
+			case contextCanceled:
+				msg = name + "_handler_canceled"
+			}
+			if outcome != "" && h.MetricsName != "" {
+				h.metrics.timeouts.WithLabelValues(name, outcome).Inc()
+			}
+			h.slogger.Error(msg, slog.String("error", err.Error()), slog.String("class", class))
 		}
 		return err
 	}
 }
 
-func (h *Handler) shouldMirror() bool {
-	switch h.MirrorRate {
-	case 1:
-		return true
-	case 0:
-		return true
-	case -1:
+// handlerContext is the context a handler runs with. The primary runs with the original request's context, and only
+// gets a deadline if primary_timeout is set, so a short secondary_timeout can't cut off live responses.
+func (h *Handler) handlerContext(name string, parent context.Context) (context.Context, context.CancelFunc) {
+	if name == "primary" {
+		if h.PrimaryTimeout > 0 {
+			return context.WithTimeout(parent, time.Duration(h.PrimaryTimeout))
+		}
+		return parent, func() {}
+	}
+
+	// Even though there may be a timeout provided by another handler, we really want to make sure we keep our
+	// goroutines tidy. We're enforcing a timeout on secondary requests as mitigation for the possibility of goroutine
+	// leaks and connection leaks.
+	ctx, cancelParent := h.secondaryContext(parent)
+	if h.timeout == 0 {
+		// secondary_timeout was disabled, for secondaries which are expected to run long
+		return ctx, cancelParent
+	}
+	ctx, cancel := context.WithTimeout(ctx, h.timeout)
+	return ctx, func() {
+		cancel()
+		cancelParent()
+	}
+}
+
+// Cleanup implements caddy.CleanerUpper
+func (h *Handler) Cleanup() error {
+	if h.done != nil {
+		close(h.done)
+	}
+	if h.Name != "" {
+		namedHandlers.unregister(h.Name, h)
+	}
+	return nil
+}
+
+// setDecision sets the mirror_sampled var on the original request, and the mirror_correlation_id var if it's mirrored,
+// so the routes and logs after the mirror can tell whether it was. The mirrored request inherits both. It returns the
+// correlation ID, which is also the ID of the request's report.
+func setDecision(r *http.Request, mirrored bool) (id string) {
+	if mirrored {
+		id = newUUID()
+	}
+	if r.Context().Value(caddyhttp.VarsCtxKey) == nil {
+		return id
+	}
+	caddyhttp.SetVar(r.Context(), "mirror_sampled", mirrored)
+	if mirrored {
+		caddyhttp.SetVar(r.Context(), "mirror_correlation_id", id)
+	}
+	return id
+}
+
+func (h *Handler) shouldMirror(r *http.Request) bool {
+	if h.MaxBodyBytes > 0 && r.ContentLength > h.MaxBodyBytes {
+		return false
+	}
+	if h.draw != nil {
+		r = withSamplingDraw(r, h.draw)
+	}
+	if h.drain.active() || !h.health.healthy() || !h.rampUp.sample(SamplingRand(r, "ramp_up")) ||
+		!h.slowStart.sample(SamplingRand(r, "slow_start")) || !h.governor.sample(SamplingRand(r, "load_governor")) {
+		return false
+	}
+	var sampled bool
+	if tenantSampled, ok := h.Tenant.sample(h.Tenant.fromRequest(r), SamplingRand(r, "tenant")); ok {
+		sampled = tenantSampled
+	} else if h.sampler != nil {
+		sampled = h.sampler.Sample(r)
+	} else {
+		sampled = sampleRate(h.MirrorRate, SamplingRand(r, "mirror_rate"))
+	}
+
+	if !sampled {
+		return false
+	}
+	if h.heap.overLimit() {
+		if h.MetricsName != "" {
+			h.metrics.shed.Inc()
+		}
+		return false
+	}
+	if !h.inFlightLimit.acquire(h.goroutinesPerMirror()) {
+		if h.MetricsName != "" {
+			h.metrics.capped.Inc()
+		}
+		return false
+	}
+	// The quota is checked last, so only requests which are actually mirrored use it up
+	if !h.quota.take() {
+		h.inFlightLimit.release(h.goroutinesPerMirror())
 		return false
-	default:
-		return rand.Float64() < h.MirrorRate
 	}
+	return true
 }
@@ -23,16 +23,19 @@ func (f benchHandlerFunc) ServeHTTP(w http.ResponseWriter, r *http.Request, next
 type nullLogger struct{}
 
 func (nullLogger) Error(string, ...any) {}
+func (nullLogger) Warn(string, ...any)  {}
 func (nullLogger) Info(string, ...any)  {}
+func (nullLogger) Debug(string, ...any) {}
 
 func makeHandler(mirrorRate float64, compareBody bool) *Handler {
 	h := &Handler{
 		ComparisonConfig: ComparisonConfig{
 			CompareBody: compareBody,
 		},
-		MirrorRate: mirrorRate,
-		slogger:    nullLogger{},
-		now:        time.Now,
+		MirrorRate:        mirrorRate,
+		slogger:           nullLogger{},
+		comparisonSlogger: nullLogger{},
+		now:               time.Now,
 		// Avoid zero timeout; we don't call Provision() in benchmarks
 		timeout: 30 * time.Second,
 	}
@@ -3,20 +3,27 @@ package mirror
 import (
 	"context"
 	"fmt"
+	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
 	"io"
 	"log/slog"
+	"mime/multipart"
 	"net/http"
+	"net/http/httptest"
 	"os"
+	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
 
 type sloggerMock struct {
-	err  func(str string, in ...any)
-	info func(str string, in ...any)
+	err   func(str string, in ...any)
+	warn  func(str string, in ...any)
+	info  func(str string, in ...any)
+	debug func(str string, in ...any)
 }
 
 func (s *sloggerMock) Error(str string, in ...any) {
@@ -25,12 +32,24 @@ func (s *sloggerMock) Error(str string, in ...any) {
 	}
 }
 
+func (s *sloggerMock) Warn(str string, in ...any) {
+	if s.warn != nil {
+		s.warn(str, in...)
+	}
+}
+
 func (s *sloggerMock) Info(str string, in ...any) {
 	if s.info != nil {
 		s.info(str, in...)
 	}
 }
 
+func (s *sloggerMock) Debug(str string, in ...any) {
+	if s.debug != nil {
+		s.debug(str, in...)
+	}
+}
+
 type middlewareHandlerFunc func(http.ResponseWriter, *http.Request, caddyhttp.Handler) error
 
 func (f middlewareHandlerFunc) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
@@ -68,7 +87,7 @@ func TestHandler_ServeHTTP(t *testing.T) {
 		},
 	}
 
-	hnd.slogger = slog
+	hnd.comparisonSlogger = slog
 	hnd.now = time.Now
 
 	hnd.ServeHTTP(&NopResponseWriter{}, r, nil)
@@ -257,11 +276,12 @@ func TestHandler_ServeHTTPWithComparisons(t *testing.T) {
 				ComparisonConfig: ComparisonConfig{
 					CompareBody: true,
 				},
-				secondary: tt.fields.secondary(wg.Done),
-				primary:   tt.fields.primary(wg.Done),
-				timeout:   time.Hour, // Just an absurdly long timeout to make it easy to debug with delve
-				now:       time.Now,
-				slogger:   slog.New(slog.NewJSONHandler(os.Stdout, nil)),
+				secondary:         tt.fields.secondary(wg.Done),
+				primary:           tt.fields.primary(wg.Done),
+				timeout:           time.Hour, // Just an absurdly long timeout to make it easy to debug with delve
+				now:               time.Now,
+				slogger:           slog.New(slog.NewJSONHandler(os.Stdout, nil)),
+				comparisonSlogger: slog.New(slog.NewJSONHandler(os.Stdout, nil)),
 			}
 
 			if err := h.ServeHTTP(tt.args.w, tt.args.r, tt.args.next); (err != nil) != tt.wantErr {
@@ -380,11 +400,12 @@ func TestHandler_ServeHTTPNoComparison(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			h := &Handler{
-				secondary: tt.fields.secondary,
-				primary:   tt.fields.primary,
-				timeout:   time.Hour, // Just an absurdly long timeout to make it easy to debug with delve
-				now:       time.Now,
-				slogger:   slog.New(slog.NewJSONHandler(os.Stdout, nil)),
+				secondary:         tt.fields.secondary,
+				primary:           tt.fields.primary,
+				timeout:           time.Hour, // Just an absurdly long timeout to make it easy to debug with delve
+				now:               time.Now,
+				slogger:           slog.New(slog.NewJSONHandler(os.Stdout, nil)),
+				comparisonSlogger: slog.New(slog.NewJSONHandler(os.Stdout, nil)),
 			}
 			if err := h.ServeHTTP(tt.args.w, tt.args.r, tt.args.next); (err != nil) != tt.wantErr {
 				t.Errorf("ServeHTTP() error = %v, wantErr %v", err, tt.wantErr)
@@ -394,3 +415,580 @@ func TestHandler_ServeHTTPNoComparison(t *testing.T) {
 	// Wait a bit for goroutines
 	time.Sleep(time.Second)
 }
+
+func TestHandler_handlerContext(t *testing.T) {
+	h := &Handler{timeout: time.Second}
+
+	parent, cancelParent := context.WithCancel(context.Background())
+	ctx, cancel := h.handlerContext("primary", parent)
+	defer cancel()
+	if _, ok := ctx.Deadline(); ok {
+		t.Errorf("primary has a deadline without primary_timeout")
+	}
+
+	sctx, scancel := h.handlerContext("secondary", parent)
+	defer scancel()
+	if _, ok := sctx.Deadline(); !ok {
+		t.Errorf("secondary has no deadline")
+	}
+
+	cancelParent()
+	if ctx.Err() == nil {
+		t.Errorf("primary wasn't canceled with the original request")
+	}
+	if sctx.Err() != nil {
+		t.Errorf("detached secondary was canceled with the original request")
+	}
+
+	h.timeout = 0
+	sctx, scancel = h.handlerContext("secondary", context.Background())
+	defer scancel()
+	if _, ok := sctx.Deadline(); ok {
+		t.Errorf("secondary has a deadline with secondary_timeout disabled")
+	}
+
+	h.PrimaryTimeout = caddy.Duration(time.Minute)
+	ctx, cancel = h.handlerContext("primary", context.Background())
+	defer cancel()
+	if deadline, ok := ctx.Deadline(); !ok || time.Until(deadline) > time.Minute {
+		t.Errorf("primary deadline = %v, %v, want within primary_timeout", deadline, ok)
+	}
+}
+
+// readTracker records whether a request body was read, which a client expecting 100 Continue only allows once the
+// server asks for it
+type readTracker struct {
+	io.Reader
+	read bool
+}
+
+func (r *readTracker) Read(p []byte) (int, error) {
+	r.read = true
+	return r.Reader.Read(p)
+}
+
+func (r *readTracker) Close() error { return nil }
+
+func TestHandler_ServeHTTP_expectContinue(t *testing.T) {
+	tests := []struct {
+		name          string
+		primaryReads  bool
+		wantSecondary bool
+	}{
+		{"primary reads the body", true, true},
+		{"primary rejects the body", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := &readTracker{Reader: strings.NewReader("large upload")}
+			var secondaryBody string
+			var secondaryCalled bool
+			wg := sync.WaitGroup{}
+			wg.Add(1)
+			h := &Handler{
+				MirrorRate: 1,
+				slogger: &sloggerMock{info: func(str string, in ...any) {
+					if str == "secondary_body_unread" {
+						wg.Done()
+					}
+				}},
+				now: time.Now,
+				primary: middlewareHandlerFunc(func(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+					if body.read {
+						t.Errorf("the body was read before the primary asked for it")
+					}
+					if !tt.primaryReads {
+						w.WriteHeader(http.StatusUnauthorized)
+						return nil
+					}
+					_, _ = io.ReadAll(r.Body)
+					w.WriteHeader(http.StatusOK)
+					return nil
+				}),
+				secondary: middlewareHandlerFunc(func(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+					defer wg.Done()
+					secondaryCalled = true
+					bs, _ := io.ReadAll(r.Body)
+					secondaryBody = string(bs)
+					return nil
+				}),
+			}
+
+			r, _ := http.NewRequest(http.MethodPut, "http://example.com/upload", body)
+			r.Header.Set("Expect", "100-continue")
+			r = r.WithContext(context.WithValue(r.Context(), caddyhttp.VarsCtxKey, make(map[string]any)))
+			if err := h.ServeHTTP(&NopResponseWriter{}, r, nil); err != nil {
+				t.Fatal(err)
+			}
+			wg.Wait()
+
+			if secondaryCalled != tt.wantSecondary {
+				t.Errorf("secondary called = %v, want %v", secondaryCalled, tt.wantSecondary)
+			}
+			if tt.wantSecondary && secondaryBody != "large upload" {
+				t.Errorf("secondary body = %q, want %q", secondaryBody, "large upload")
+			}
+		})
+	}
+}
+
+func TestHandler_ServeHTTP_clientDisconnect(t *testing.T) {
+	tests := []struct {
+		name         string
+		skip         bool
+		wantCompared bool
+	}{
+		{"compared by default", false, true},
+		{"skip_disconnected", true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, disconnect := context.WithCancel(context.WithValue(context.Background(), caddyhttp.VarsCtxKey, make(map[string]any)))
+			defer disconnect()
+			var compared atomic.Bool
+			h := &Handler{
+				ComparisonConfig: ComparisonConfig{CompareStatus: true, SkipDisconnected: tt.skip},
+				MirrorRate:       1,
+				stats:            newStats(),
+				slogger:          nullLogger{},
+				comparisonSlogger: &sloggerMock{info: func(str string, in ...any) {
+					if str == "shadow_mismatch" {
+						compared.Store(true)
+					}
+				}},
+				now: time.Now,
+				primary: middlewareHandlerFunc(func(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+					w.WriteHeader(http.StatusOK)
+					disconnect()
+					_, err := w.Write([]byte("Hello, world!"))
+					if err == nil {
+						err = context.Canceled
+					}
+					return err
+				}),
+				secondary: middlewareHandlerFunc(func(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+					if r.Context().Err() != nil {
+						return fmt.Errorf("the secondary was cancelled with the client")
+					}
+					w.WriteHeader(http.StatusInternalServerError)
+					return nil
+				}),
+			}
+
+			r, _ := http.NewRequestWithContext(ctx, http.MethodGet, "http://example.com", nil)
+			if err := h.ServeHTTP(&NopResponseWriter{}, r, nil); err == nil {
+				t.Errorf("ServeHTTP() error = nil, want the primary's error")
+			}
+			for h.stats.comparing.Load() > 0 {
+				time.Sleep(time.Millisecond)
+			}
+
+			if compared.Load() != tt.wantCompared {
+				t.Errorf("compared = %v, want %v", compared.Load(), tt.wantCompared)
+			}
+		})
+	}
+}
+
+func TestHandler_ServeHTTP_chunkedBody(t *testing.T) {
+	type received struct {
+		contentLength int64
+		body, trailer string
+	}
+	secondary := make(chan received, 1)
+	h := &Handler{
+		MirrorRate:        1,
+		slogger:           nullLogger{},
+		comparisonSlogger: nullLogger{},
+		now:               time.Now,
+		primary: middlewareHandlerFunc(func(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+			_, _ = io.ReadAll(r.Body)
+			w.WriteHeader(http.StatusOK)
+			return nil
+		}),
+		secondary: middlewareHandlerFunc(func(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+			bs, _ := io.ReadAll(r.Body)
+			secondary <- received{r.ContentLength, string(bs), r.Trailer.Get("Grpc-Status")}
+			return nil
+		}),
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r = r.WithContext(context.WithValue(r.Context(), caddyhttp.VarsCtxKey, make(map[string]any)))
+		_ = h.ServeHTTP(w, r, nil)
+	}))
+	defer srv.Close()
+
+	// A body without a length is sent chunked, with its trailers after it
+	pr, pw := io.Pipe()
+	go func() {
+		_, _ = pw.Write([]byte("streamed "))
+		_, _ = pw.Write([]byte("upload"))
+		_ = pw.Close()
+	}()
+	r, _ := http.NewRequest(http.MethodPost, srv.URL, pr)
+	r.Trailer = http.Header{"Grpc-Status": {"0"}}
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	got := <-secondary
+	if want := (received{-1, "streamed upload", "0"}); got != want {
+		t.Errorf("secondary received %+v, want %+v", got, want)
+	}
+}
+
+func TestHandler_ServeHTTP_multipartBody(t *testing.T) {
+	type form struct {
+		fields, file string
+	}
+	parse := func(r *http.Request) form {
+		if err := r.ParseMultipartForm(1 << 20); err != nil {
+			return form{fields: err.Error()}
+		}
+		fh, _, err := r.FormFile("file")
+		if err != nil {
+			return form{fields: err.Error()}
+		}
+		defer fh.Close()
+		bs, _ := io.ReadAll(fh)
+		return form{r.MultipartForm.Value["description"][0], string(bs)}
+	}
+	primary, secondary := make(chan form, 1), make(chan form, 1)
+	h := &Handler{
+		SecondaryRequestConfig: SecondaryRequestConfig{HeaderAllow: []string{"Accept"}},
+		headerAllow:            newHeaderMatcher([]string{"Accept"}),
+		MirrorRate:             1,
+		slogger:                nullLogger{},
+		comparisonSlogger:      nullLogger{},
+		now:                    time.Now,
+		primary: middlewareHandlerFunc(func(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+			primary <- parse(r)
+			w.WriteHeader(http.StatusOK)
+			return nil
+		}),
+		secondary: middlewareHandlerFunc(func(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+			secondary <- parse(r)
+			return nil
+		}),
+	}
+
+	body := new(strings.Builder)
+	mw := multipart.NewWriter(body)
+	_ = mw.WriteField("description", "quarterly report")
+	fw, _ := mw.CreateFormFile("file", "report.csv")
+	_, _ = fw.Write([]byte("a,b\n1,2\n"))
+	_ = mw.Close()
+
+	r := httptest.NewRequest(http.MethodPost, "http://example.com/upload", strings.NewReader(body.String()))
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	r = r.WithContext(context.WithValue(r.Context(), caddyhttp.VarsCtxKey, make(map[string]any)))
+	if err := h.ServeHTTP(&NopResponseWriter{}, r, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	want := form{"quarterly report", "a,b\n1,2\n"}
+	if got := <-primary; got != want {
+		t.Errorf("primary received %+v, want %+v", got, want)
+	}
+	if got := <-secondary; got != want {
+		t.Errorf("secondary received %+v, want %+v", got, want)
+	}
+}
+
+func TestHandler_ServeHTTP_onPrimaryError(t *testing.T) {
+	tests := []struct {
+		mode         string
+		wantReport   bool
+		wantResults  []string
+		wantCanceled bool
+	}{
+		{primaryErrorSkip, false, nil, false},
+		{primaryErrorRecord, true, nil, false},
+		{primaryErrorCompareStatus, true, []string{"status"}, false},
+		{primaryErrorCompare, true, []string{"status", "body"}, false},
+		{primaryErrorCancel, false, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			var rep *Report
+			secondaryDone := make(chan bool, 1)
+			h := &Handler{
+				ComparisonConfig:  ComparisonConfig{CompareStatus: true, CompareBody: true, OnPrimaryError: tt.mode},
+				MirrorRate:        1,
+				stats:             newStats(),
+				slogger:           nullLogger{},
+				comparisonSlogger: nullLogger{},
+				now:               time.Now,
+				reporters: []Reporter{reporterFunc(func(r Report) {
+					rep = &r
+				})},
+				primary: middlewareHandlerFunc(func(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+					return caddyhttp.Error(http.StatusBadGateway, fmt.Errorf("upstream unreachable"))
+				}),
+				secondary: middlewareHandlerFunc(func(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+					select {
+					case <-r.Context().Done():
+						secondaryDone <- true
+					case <-time.After(100 * time.Millisecond):
+						secondaryDone <- false
+					}
+					w.WriteHeader(http.StatusOK)
+					return nil
+				}),
+			}
+
+			r, _ := http.NewRequest(http.MethodGet, "http://example.com", nil)
+			r = r.WithContext(context.WithValue(r.Context(), caddyhttp.VarsCtxKey, make(map[string]any)))
+			if err := h.ServeHTTP(&NopResponseWriter{}, r, nil); err == nil {
+				t.Errorf("ServeHTTP() error = nil, want the primary's error")
+			}
+			if canceled := <-secondaryDone; canceled != tt.wantCanceled {
+				t.Errorf("secondary canceled = %v, want %v", canceled, tt.wantCanceled)
+			}
+			for h.stats.comparing.Load() > 0 {
+				time.Sleep(time.Millisecond)
+			}
+
+			if (rep != nil) != tt.wantReport {
+				t.Fatalf("reported = %v, want %v", rep != nil, tt.wantReport)
+			}
+			if rep == nil {
+				return
+			}
+			var results []string
+			for _, res := range rep.Results {
+				results = append(results, res.Comparer)
+			}
+			if !slices.Equal(results, tt.wantResults) {
+				t.Errorf("results = %v, want %v", results, tt.wantResults)
+			}
+			if rep.Primary.Error == "" || rep.Primary.Status != http.StatusBadGateway {
+				t.Errorf("primary error = %q, status = %d, want the error and 502", rep.Primary.Error, rep.Primary.Status)
+			}
+		})
+	}
+}
+
+func TestHandler_ServeHTTP_onPrimaryErrorCompare(t *testing.T) {
+	var rep *Report
+	h := &Handler{
+		ComparisonConfig:  ComparisonConfig{CompareStatus: true, CompareBody: true, OnPrimaryError: primaryErrorCompare},
+		MirrorRate:        1,
+		stats:             newStats(),
+		slogger:           nullLogger{},
+		comparisonSlogger: nullLogger{},
+		now:               time.Now,
+		reporters: []Reporter{reporterFunc(func(r Report) {
+			rep = &r
+		})},
+		primary: middlewareHandlerFunc(func(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = w.Write([]byte(`{"error":"legacy"}`))
+			return fmt.Errorf("connection reset")
+		}),
+		secondary: middlewareHandlerFunc(func(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+			w.WriteHeader(http.StatusOK)
+			_, _ = w.Write([]byte(`{"ok":true}`))
+			return nil
+		}),
+	}
+
+	r, _ := http.NewRequest(http.MethodGet, "http://example.com", nil)
+	r = r.WithContext(context.WithValue(r.Context(), caddyhttp.VarsCtxKey, make(map[string]any)))
+	if err := h.ServeHTTP(&NopResponseWriter{}, r, nil); err == nil {
+		t.Errorf("ServeHTTP() error = nil, want the primary's error")
+	}
+	for h.stats.comparing.Load() > 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	if rep == nil {
+		t.Fatal("the request wasn't reported")
+	}
+	if rep.Primary.Status != http.StatusInternalServerError || string(rep.Primary.Body) != `{"error":"legacy"}` {
+		t.Errorf("primary = %d %s, want what it wrote before failing", rep.Primary.Status, rep.Primary.Body)
+	}
+	if rep.Primary.Error != "connection reset" {
+		t.Errorf("primary error = %q, want connection reset", rep.Primary.Error)
+	}
+	if string(rep.Secondary.Body) != `{"ok":true}` || rep.Match {
+		t.Errorf("secondary = %s, match = %v, want its body and a mismatch", rep.Secondary.Body, rep.Match)
+	}
+}
+
+func TestHandler_ServeHTTP_identityEncoding(t *testing.T) {
+	tests := []struct {
+		mode          string
+		wantPrimary   string
+		wantSecondary string
+	}{
+		{"", "gzip, br", "gzip, br"},
+		{identityEncodingSecondary, "gzip, br", "identity"},
+		{identityEncodingBoth, "identity", "identity"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			var primary string
+			secondary := make(chan string, 1)
+			h := &Handler{
+				ComparisonConfig:  ComparisonConfig{CompareStatus: true, IdentityEncoding: tt.mode},
+				MirrorRate:        1,
+				stats:             newStats(),
+				slogger:           nullLogger{},
+				comparisonSlogger: nullLogger{},
+				now:               time.Now,
+				primary: middlewareHandlerFunc(func(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+					primary = r.Header.Get("Accept-Encoding")
+					return nil
+				}),
+				secondary: middlewareHandlerFunc(func(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+					secondary <- r.Header.Get("Accept-Encoding")
+					return nil
+				}),
+			}
+
+			r, _ := http.NewRequest(http.MethodGet, "http://example.com", nil)
+			r.Header.Set("Accept-Encoding", "gzip, br")
+			r = r.WithContext(context.WithValue(r.Context(), caddyhttp.VarsCtxKey, make(map[string]any)))
+			if err := h.ServeHTTP(&NopResponseWriter{}, r, nil); err != nil {
+				t.Fatal(err)
+			}
+			if primary != tt.wantPrimary {
+				t.Errorf("primary Accept-Encoding = %q, want %q", primary, tt.wantPrimary)
+			}
+			if got := <-secondary; got != tt.wantSecondary {
+				t.Errorf("secondary Accept-Encoding = %q, want %q", got, tt.wantSecondary)
+			}
+			if got := r.Header.Get("Accept-Encoding"); got != "gzip, br" {
+				t.Errorf("original Accept-Encoding = %q, want it put back", got)
+			}
+		})
+	}
+}
+
+func TestHandler_ServeHTTP_decisionVars(t *testing.T) {
+	var rep *Report
+	var secondaryID any
+	h := &Handler{
+		ComparisonConfig:  ComparisonConfig{CompareStatus: true},
+		Exclude:           &ExcludeConfig{Paths: []string{"/health"}},
+		MirrorRate:        1,
+		stats:             newStats(),
+		slogger:           nullLogger{},
+		comparisonSlogger: nullLogger{},
+		now:               time.Now,
+		reporters: []Reporter{reporterFunc(func(r Report) {
+			rep = &r
+		})},
+		primary: middlewareHandlerFunc(func(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+			w.WriteHeader(http.StatusOK)
+			return nil
+		}),
+		secondary: middlewareHandlerFunc(func(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+			secondaryID = caddyhttp.GetVar(r.Context(), "mirror_correlation_id")
+			w.WriteHeader(http.StatusOK)
+			return nil
+		}),
+	}
+	if err := h.Exclude.provision(); err != nil {
+		t.Fatal(err)
+	}
+	serve := func(target string) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, target, nil)
+		r = r.WithContext(context.WithValue(r.Context(), caddyhttp.VarsCtxKey, make(map[string]any)))
+		if err := h.ServeHTTP(&NopResponseWriter{}, r, nil); err != nil {
+			t.Fatal(err)
+		}
+		for h.stats.comparing.Load() > 0 {
+			time.Sleep(time.Millisecond)
+		}
+		return r
+	}
+
+	r := serve("/users")
+	id, _ := caddyhttp.GetVar(r.Context(), "mirror_correlation_id").(string)
+	if got := caddyhttp.GetVar(r.Context(), "mirror_sampled"); got != true {
+		t.Errorf("mirror_sampled = %v, want true", got)
+	}
+	if id == "" {
+		t.Fatal("mirror_correlation_id wasn't set")
+	}
+	if secondaryID != id {
+		t.Errorf("the secondary's mirror_correlation_id = %v, want %s", secondaryID, id)
+	}
+	if rep == nil || rep.ID != id {
+		t.Errorf("report ID = %v, want %s", rep, id)
+	}
+
+	r = serve("/health")
+	if got := caddyhttp.GetVar(r.Context(), "mirror_sampled"); got != false {
+		t.Errorf("mirror_sampled = %v for an excluded request, want false", got)
+	}
+	if got := caddyhttp.GetVar(r.Context(), "mirror_correlation_id"); got != nil {
+		t.Errorf("mirror_correlation_id = %v for an excluded request, want none", got)
+	}
+}
+
+// writeNotifier closes written the first time the response is written to
+type writeNotifier struct {
+	NopResponseWriter
+	written chan struct{}
+}
+
+func (w *writeNotifier) Write(bs []byte) (int, error) {
+	select {
+	case <-w.written:
+	default:
+		close(w.written)
+	}
+	return len(bs), nil
+}
+
+func TestHandler_ServeHTTP_synchronous(t *testing.T) {
+	w := &writeNotifier{written: make(chan struct{})}
+	var reports []Report
+	h := &Handler{
+		ComparisonConfig:  ComparisonConfig{CompareBody: true},
+		Synchronous:       true,
+		MirrorRate:        1,
+		stats:             newStats(),
+		slogger:           nullLogger{},
+		comparisonSlogger: nullLogger{},
+		now:               time.Now,
+		reporters: []Reporter{reporterFunc(func(rep Report) {
+			reports = append(reports, rep)
+		})},
+		primary: middlewareHandlerFunc(func(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+			_, _ = w.Write([]byte("Hello, world!"))
+			return nil
+		}),
+		secondary: middlewareHandlerFunc(func(sw http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+			// The primary's response is sent before the secondary is waited for
+			<-w.written
+			_, _ = sw.Write([]byte("Hello, world!"))
+			return nil
+		}),
+	}
+
+	for range 3 {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r = r.WithContext(context.WithValue(r.Context(), caddyhttp.VarsCtxKey, make(map[string]any)))
+		if err := h.ServeHTTP(w, r, nil); err != nil {
+			t.Fatal(err)
+		}
+		// Nothing is waited for, since the handler already did
+		if inFlight, comparing := h.stats.inFlight.Load(), h.stats.comparing.Load(); inFlight != 0 || comparing != 0 {
+			t.Errorf("in flight = %d, comparing = %d after ServeHTTP returned, want 0", inFlight, comparing)
+		}
+	}
+	if len(reports) != 3 {
+		t.Fatalf("reports = %d, want 3", len(reports))
+	}
+	for _, rep := range reports {
+		if !rep.Match {
+			t.Errorf("report = %+v, want a match", rep)
+		}
+	}
+}
@@ -0,0 +1,229 @@
+// Package mirrortest runs mirror handlers in tests, against httptest servers standing in for the primary and secondary.
+// Requests are served synchronously: Do returns once the secondary has responded and every comparison was reported, so
+// tests don't need to wait or poll for results.
+package mirrortest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+
+	mirror "github.com/dotvezz/caddy-mirror"
+)
+
+var (
+	_ caddy.Provisioner           = (*proxy)(nil)
+	_ caddyhttp.MiddlewareHandler = (*proxy)(nil)
+	_ mirror.Reporter             = (*collector)(nil)
+)
+
+func init() {
+	caddy.RegisterModule(proxy{})
+	caddy.RegisterModule(collector{})
+}
+
+// harnesses are the live harnesses, by ID, so their collectors can find them
+var (
+	harnesses sync.Map
+	lastID    atomic.Int64
+)
+
+// Harness is a provisioned mirror handler, with httptest servers as its primary and secondary
+type Harness struct {
+	Primary, Secondary *httptest.Server
+	// Timeout is how long Do waits for the secondary and comparisons before failing the test. Defaults to 10s.
+	Timeout time.Duration
+
+	t       testing.TB
+	id      string
+	handler *mirror.Handler
+
+	mu      sync.Mutex
+	reports []mirror.Report
+}
+
+// New starts httptest servers for primary and secondary, and provisions h, a mirror handler configured as it would be
+// in JSON, to proxy to them. Its PrimaryRaw and SecondaryRaw are replaced, and a reporter is added which collects its
+// reports. Handlers without a Name are given one, since the harness looks them up through the admin API. Everything is
+// cleaned up when the test ends.
+func New(t testing.TB, h *mirror.Handler, primary, secondary http.Handler) *Harness {
+	t.Helper()
+
+	hs := &Harness{
+		Primary:   httptest.NewServer(primary),
+		Secondary: httptest.NewServer(secondary),
+		Timeout:   10 * time.Second,
+		t:         t,
+		id:        strconv.FormatInt(lastID.Add(1), 10),
+		handler:   h,
+	}
+	t.Cleanup(hs.Primary.Close)
+	t.Cleanup(hs.Secondary.Close)
+	harnesses.Store(hs.id, hs)
+	t.Cleanup(func() { harnesses.Delete(hs.id) })
+
+	h.PrimaryRaw = subroute(hs.Primary.URL)
+	h.SecondaryRaw = subroute(hs.Secondary.URL)
+	h.ReportersRaw = append(h.ReportersRaw, mustMarshal(map[string]string{"reporter": "mirrortest", "harness": hs.id}))
+	if h.Name == "" {
+		h.Name = "mirrortest-" + hs.id
+	}
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	t.Cleanup(cancel)
+	if err := h.Provision(ctx); err != nil {
+		t.Fatalf("error provisioning mirror handler: %v", err)
+	}
+	t.Cleanup(func() { _ = h.Cleanup() })
+
+	return hs
+}
+
+// Result is the outcome of a request served by the harness
+type Result struct {
+	// Response is the response the client got, from the primary
+	Response *http.Response
+	// Err is the error the mirror handler returned, if any
+	Err error
+	// Reports are the reports of the request's comparisons. It's empty if the request wasn't mirrored or compared.
+	Reports []mirror.Report
+}
+
+// Do serves a request, like one from httptest.NewRequest, through the mirror handler, and waits for its secondary
+// request and comparisons to finish
+func (hs *Harness) Do(r *http.Request) Result {
+	hs.t.Helper()
+
+	rec := httptest.NewRecorder()
+	r = caddyhttp.PrepareRequest(r, caddy.NewReplacer(), rec, nil)
+	err := hs.handler.ServeHTTP(rec, r, caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error {
+		return nil
+	}))
+	hs.wait()
+
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	res := Result{Response: rec.Result(), Err: err, Reports: hs.reports}
+	hs.reports = nil
+	return res
+}
+
+// wait polls the handler's stats until nothing is in flight, or fails the test once the timeout is over
+func (hs *Harness) wait() {
+	hs.t.Helper()
+
+	deadline := time.Now().Add(hs.Timeout)
+	routes := new(mirror.AdminAPI).Routes()
+	for {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/mirror/"+hs.handler.Name+"/stats", nil)
+		if err := routes[0].Handler.ServeHTTP(rec, req); err != nil {
+			hs.t.Fatalf("error getting mirror stats: %v", err)
+		}
+		var stats struct {
+			InFlight  int64 `json:"in_flight"`
+			Comparing int64 `json:"comparing"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &stats); err != nil {
+			hs.t.Fatalf("error decoding mirror stats: %v", err)
+		}
+		if stats.InFlight == 0 && stats.Comparing == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			hs.t.Fatalf("mirrored request still in flight after %s", hs.Timeout)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func (hs *Harness) report(rep mirror.Report) {
+	// The bodies are pooled buffers, which are reused once Report returns
+	rep.Primary.Body = bytes.Clone(rep.Primary.Body)
+	rep.Secondary.Body = bytes.Clone(rep.Secondary.Body)
+
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	hs.reports = append(hs.reports, rep)
+}
+
+// subroute is the JSON of a subroute which proxies every request to target
+func subroute(target string) json.RawMessage {
+	return mustMarshal(map[string]any{
+		"routes": []any{
+			map[string]any{
+				"handle": []any{
+					map[string]string{"handler": "mirrortest_proxy", "url": target},
+				},
+			},
+		},
+	})
+}
+
+func mustMarshal(v any) json.RawMessage {
+	bs, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	return bs
+}
+
+// proxy proxies requests to a harness's server. It's a module so it can be configured in a subroute, like the primary
+// and secondary of a real config.
+type proxy struct {
+	URL string `json:"url"`
+	rp  *httputil.ReverseProxy
+}
+
+func (proxy) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.mirrortest_proxy",
+		New: func() caddy.Module { return new(proxy) },
+	}
+}
+
+// Provision implements caddy.Provisioner
+func (p *proxy) Provision(_ caddy.Context) error {
+	target, err := url.Parse(p.URL)
+	if err != nil {
+		return fmt.Errorf("error parsing url: %w", err)
+	}
+	p.rp = httputil.NewSingleHostReverseProxy(target)
+	return nil
+}
+
+func (p *proxy) ServeHTTP(w http.ResponseWriter, r *http.Request, _ caddyhttp.Handler) error {
+	p.rp.ServeHTTP(w, r)
+	return nil
+}
+
+// collector reports to a harness
+type collector struct {
+	Harness string `json:"harness"`
+}
+
+func (collector) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "mirror.reporters.mirrortest",
+		New: func() caddy.Module { return new(collector) },
+	}
+}
+
+func (c *collector) Report(rep mirror.Report) {
+	if hs, ok := harnesses.Load(c.Harness); ok {
+		hs.(*Harness).report(rep)
+	}
+}
@@ -0,0 +1,41 @@
+package mirrortest
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	mirror "github.com/dotvezz/caddy-mirror"
+)
+
+func TestHarness_Do(t *testing.T) {
+	respond := func(body string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/plain")
+			_, _ = io.WriteString(w, body)
+		}
+	}
+	h := &mirror.Handler{
+		ComparisonConfig: mirror.ComparisonConfig{CompareStatus: true, CompareBody: true},
+		ReportingConfig:  mirror.ReportingConfig{NoLog: true},
+	}
+	hs := New(t, h, respond("Hello, world!"), respond("Hi, world!"))
+
+	for range 3 {
+		res := hs.Do(httptest.NewRequest(http.MethodGet, "/greeting", nil))
+		if res.Err != nil {
+			t.Fatalf("Do() error = %v", res.Err)
+		}
+		if body, _ := io.ReadAll(res.Response.Body); string(body) != "Hello, world!" {
+			t.Errorf("Do() response body = %q, want the primary's", body)
+		}
+		if len(res.Reports) != 1 {
+			t.Fatalf("Do() reports = %d, want 1", len(res.Reports))
+		}
+		rep := res.Reports[0]
+		if rep.Match || rep.Request.Path() != "/greeting" || string(rep.Secondary.Body) != "Hi, world!" {
+			t.Errorf("Do() report = %+v, want a body mismatch for /greeting", rep)
+		}
+	}
+}
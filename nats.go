@@ -0,0 +1,147 @@
+package mirror
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+
+	"github.com/nats-io/nats.go"
+)
+
+var (
+	_ Reporter              = (*NATSReporter)(nil)
+	_ caddy.Provisioner     = (*NATSReporter)(nil)
+	_ caddy.CleanerUpper    = (*NATSReporter)(nil)
+	_ caddyfile.Unmarshaler = (*NATSReporter)(nil)
+)
+
+func init() {
+	caddy.RegisterModule(NATSReporter{})
+}
+
+// NATSReporter publishes every report as a JSON Event to a NATS subject, optionally through JetStream so events are
+// persisted by the server.
+type NATSReporter struct {
+	// URL of the NATS server, or a comma-separated list of servers. Defaults to nats://127.0.0.1:4222.
+	URL     string `json:"url,omitempty"`
+	Subject string `json:"subject"`
+	// JetStream publishes to a JetStream stream instead of core NATS. The stream must already exist and capture Subject.
+	JetStream bool `json:"jetstream,omitempty"`
+	// IncludeArtifacts adds both full responses to each event
+	IncludeArtifacts bool `json:"include_artifacts,omitempty"`
+
+	conn    *nats.Conn
+	js      nats.JetStreamContext
+	slogger slogger
+}
+
+func (NATSReporter) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "mirror.reporters.nats",
+		New: func() caddy.Module { return new(NATSReporter) },
+	}
+}
+
+// Provision implements caddy.Provisioner
+func (n *NATSReporter) Provision(ctx caddy.Context) (err error) {
+	if n.Subject == "" {
+		return fmt.Errorf("nats reporter requires a subject")
+	}
+	if n.URL == "" {
+		n.URL = nats.DefaultURL
+	}
+
+	n.slogger = ctx.Slogger()
+
+	// Don't fail to start just because NATS is unavailable. Events published while disconnected are buffered by the
+	// client, up to its reconnect buffer size.
+	n.conn, err = nats.Connect(n.URL,
+		nats.Name("caddy-mirror"),
+		nats.RetryOnFailedConnect(true),
+		nats.MaxReconnects(-1),
+		nats.ErrorHandler(func(_ *nats.Conn, _ *nats.Subscription, err error) {
+			n.slogger.Error("nats_reporter_error", slog.String("error", err.Error()))
+		}),
+	)
+	if err != nil {
+		return fmt.Errorf("error connecting to nats: %w", err)
+	}
+
+	if n.JetStream {
+		n.js, err = n.conn.JetStream(nats.PublishAsyncErrHandler(func(_ nats.JetStream, _ *nats.Msg, err error) {
+			n.slogger.Error("nats_reporter_error", slog.String("error", err.Error()))
+		}))
+		if err != nil {
+			n.conn.Close()
+			n.conn = nil
+			return fmt.Errorf("error creating jetstream context: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// Cleanup implements caddy.CleanerUpper. Pending events are flushed before the connection is closed.
+func (n *NATSReporter) Cleanup() error {
+	// Cleanup is called even if Provision failed, before the connection was made
+	if n.conn == nil {
+		return nil
+	}
+	if n.js != nil {
+		select {
+		case <-n.js.PublishAsyncComplete():
+		case <-time.After(5 * time.Second):
+		}
+	}
+	return n.conn.Drain()
+}
+
+func (n *NATSReporter) Report(rep Report) {
+	data, err := json.Marshal(newEvent(rep, n.IncludeArtifacts))
+	if err != nil {
+		n.slogger.Error("nats_reporter_error", slog.String("error", err.Error()))
+		return
+	}
+
+	if n.js != nil {
+		// Acks are handled asynchronously, and failures are reported through the PublishAsyncErrHandler
+		_, err = n.js.PublishAsync(n.Subject, data)
+	} else {
+		err = n.conn.Publish(n.Subject, data)
+	}
+	if err != nil {
+		n.slogger.Error("nats_reporter_error", slog.String("error", err.Error()))
+	}
+}
+
+func (n *NATSReporter) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume reporter name
+	if d.NextArg() {
+		n.Subject = d.Val()
+	}
+	for d.NextBlock(0) {
+		switch d.Val() {
+		case "url":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			n.URL = d.Val()
+		case "subject":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			n.Subject = d.Val()
+		case "jetstream":
+			n.JetStream = true
+		case "include_artifacts":
+			n.IncludeArtifacts = true
+		default:
+			return d.Errf("unrecognized nats reporter option '%s'", d.Val())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,17 @@
+package mirror
+
+import (
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestNATSReporter_CleanupInvalid(t *testing.T) {
+	n := &NATSReporter{}
+	if err := n.Provision(caddy.Context{}); err == nil {
+		t.Fatal("Provision() accepted a config without a subject")
+	}
+	if err := n.Cleanup(); err != nil {
+		t.Errorf("Cleanup() = %v", err)
+	}
+}
@@ -0,0 +1,506 @@
+package mirror
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+var (
+	_ Reporter              = (*OTLPReporter)(nil)
+	_ caddy.Provisioner     = (*OTLPReporter)(nil)
+	_ caddy.CleanerUpper    = (*OTLPReporter)(nil)
+	_ caddyfile.Unmarshaler = (*OTLPReporter)(nil)
+)
+
+func init() {
+	caddy.RegisterModule(OTLPReporter{})
+}
+
+// maxOTLPPending is the most log records held between exports. Records beyond it are dropped.
+const maxOTLPPending = 8192
+
+// OTLPReporter exports comparison results over OTLP/HTTP, as log records and counters. Mismatched reports are exported
+// as log records, and every comparison is counted by comparer and outcome. Records are batched and exported in the
+// background.
+type OTLPReporter struct {
+	// Endpoint is the base URL of the OTLP/HTTP receiver. /v1/logs and /v1/metrics are appended to it. Defaults to
+	// http://localhost:4318.
+	Endpoint string `json:"endpoint,omitempty"`
+	// Headers are added to every export, for example for authentication. Values may contain global placeholders.
+	Headers map[string]string `json:"headers,omitempty"`
+	// ServiceName is the service.name resource attribute. Defaults to "caddy".
+	ServiceName string `json:"service_name,omitempty"`
+	// Interval between exports. Defaults to 10s.
+	Interval caddy.Duration `json:"interval,omitempty"`
+	// LogMatches exports matched reports as log records too, not just mismatches
+	LogMatches bool `json:"log_matches,omitempty"`
+
+	client   *http.Client
+	headers  http.Header
+	resource otlpResource
+	started  time.Time
+	slogger  slogger
+
+	mu       *sync.Mutex
+	pending  []otlpLogRecord
+	dropped  int
+	counters map[otlpCounterKey]int64
+
+	done, stopped chan struct{}
+}
+
+type otlpCounterKey struct {
+	name, comparer, outcome string
+}
+
+func (OTLPReporter) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "mirror.reporters.otlp",
+		New: func() caddy.Module { return new(OTLPReporter) },
+	}
+}
+
+// Provision implements caddy.Provisioner
+func (o *OTLPReporter) Provision(ctx caddy.Context) error {
+	if o.Endpoint == "" {
+		o.Endpoint = "http://localhost:4318"
+	}
+	o.Endpoint = strings.TrimSuffix(o.Endpoint, "/")
+	if o.ServiceName == "" {
+		o.ServiceName = "caddy"
+	}
+	if o.Interval == 0 {
+		o.Interval = caddy.Duration(10 * time.Second)
+	}
+
+	repl := caddy.NewReplacer()
+	o.headers = make(http.Header, len(o.Headers))
+	for k, v := range o.Headers {
+		o.headers.Set(k, repl.ReplaceKnown(v, ""))
+	}
+
+	o.slogger = ctx.Slogger()
+	o.start()
+	return nil
+}
+
+// start starts the background exporter
+func (o *OTLPReporter) start() {
+	o.client = &http.Client{Timeout: 10 * time.Second}
+	o.resource = otlpResource{Attributes: []otlpKeyValue{otlpString("service.name", o.ServiceName)}}
+	o.started = time.Now()
+	o.mu = new(sync.Mutex)
+	o.counters = make(map[otlpCounterKey]int64)
+	o.done, o.stopped = make(chan struct{}), make(chan struct{})
+	go o.run()
+}
+
+// Cleanup implements caddy.CleanerUpper. Anything not yet exported is exported before returning, and anything reported
+// afterward is dropped.
+func (o *OTLPReporter) Cleanup() error {
+	close(o.done)
+	<-o.stopped
+	return nil
+}
+
+func (o *OTLPReporter) run() {
+	defer close(o.stopped)
+	ticker := time.NewTicker(time.Duration(o.Interval))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-o.done:
+			o.export()
+			return
+		case <-ticker.C:
+			o.export()
+		}
+	}
+}
+
+func (o *OTLPReporter) Report(rep Report) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	// Comparisons still running after a config reload report after Cleanup, once nothing would export them
+	select {
+	case <-o.done:
+		if !rep.Match || o.LogMatches {
+			o.slogger.Error("otlp_reporter_dropped", slog.Int("records", 1), slog.String("id", rep.ID))
+		}
+		return
+	default:
+	}
+
+	match := "false"
+	if rep.Match {
+		match = "true"
+	}
+	o.counters[otlpCounterKey{name: "mirror.reports", outcome: match}]++
+	for _, res := range rep.Results {
+		o.counters[otlpCounterKey{name: "mirror.comparisons", comparer: res.Comparer, outcome: resultOutcome(res)}]++
+	}
+
+	if rep.Match && !o.LogMatches {
+		return
+	}
+	if len(o.pending) >= maxOTLPPending {
+		o.dropped++
+		return
+	}
+	o.pending = append(o.pending, newOTLPLogRecord(rep))
+}
+
+// resultOutcome is "match", "mismatch", or "skipped"
+func resultOutcome(res Result) string {
+	switch {
+	case res.Skipped:
+		return "skipped"
+	case res.Match:
+		return "match"
+	default:
+		return "mismatch"
+	}
+}
+
+func newOTLPLogRecord(rep Report) otlpLogRecord {
+	path, query, _ := strings.Cut(rep.Request.URI, "?")
+	rec := otlpLogRecord{
+		TimeUnixNano:         otlpTime(rep.Time),
+		ObservedTimeUnixNano: otlpTime(time.Now()),
+		SeverityNumber:       9, // INFO
+		SeverityText:         "INFO",
+		Body:                 otlpValue{StringValue: ptr("shadow_match")},
+		Attributes: []otlpKeyValue{
+			otlpString("http.request.method", rep.Request.Method),
+			otlpString("server.address", rep.Request.Host),
+			otlpString("url.path", path),
+			otlpBool("mirror.match", rep.Match),
+			otlpInt("mirror.primary.status", rep.Primary.Status),
+			otlpInt("mirror.secondary.status", rep.Secondary.Status),
+			otlpString("mirror.event_id", rep.ID),
+		},
+		TraceID: rep.Request.TraceID,
+		SpanID:  rep.Request.SpanID,
+	}
+	if query != "" {
+		rec.Attributes = append(rec.Attributes, otlpString("url.query", query))
+	}
+	if rep.Request.Tenant != "" {
+		rec.Attributes = append(rec.Attributes, otlpString("mirror.tenant", rep.Request.Tenant))
+	}
+	if rep.Category != "" {
+		rec.Attributes = append(rec.Attributes, otlpString("mirror.category", rep.Category))
+	}
+	if !rep.Match {
+		rec.SeverityNumber, rec.SeverityText = 13, "WARN"
+		rec.Body.StringValue = ptr("shadow_mismatch")
+	}
+
+	var mismatched []string
+	for _, res := range eventResults(rep, false) {
+		if res.Match || res.Skipped {
+			continue
+		}
+		mismatched = append(mismatched, res.Comparer)
+		for k, v := range res.Details {
+			s, ok := v.(string)
+			if !ok {
+				bs, _ := json.Marshal(v)
+				s = string(bs)
+			}
+			rec.Attributes = append(rec.Attributes, otlpString("mirror."+res.Comparer+"."+k, s))
+		}
+	}
+	if len(mismatched) > 0 {
+		values := make([]otlpValue, len(mismatched))
+		for i, c := range mismatched {
+			values[i] = otlpValue{StringValue: ptr(c)}
+		}
+		rec.Attributes = append(rec.Attributes, otlpKeyValue{
+			Key:   "mirror.mismatched_comparers",
+			Value: otlpValue{ArrayValue: &otlpArray{Values: values}},
+		})
+	}
+
+	return rec
+}
+
+// export sends pending log records and the current value of every counter
+func (o *OTLPReporter) export() {
+	o.mu.Lock()
+	records, dropped := o.pending, o.dropped
+	o.pending, o.dropped = nil, 0
+	counters := make(map[otlpCounterKey]int64, len(o.counters))
+	for k, v := range o.counters {
+		counters[k] = v
+	}
+	o.mu.Unlock()
+
+	if dropped > 0 {
+		o.slogger.Error("otlp_reporter_dropped", slog.Int("records", dropped))
+	}
+
+	scope := otlpScope{Name: "github.com/dotvezz/caddy-mirror"}
+	if len(records) > 0 {
+		err := o.post("/v1/logs", otlpLogsRequest{ResourceLogs: []otlpResourceLogs{{
+			Resource:  o.resource,
+			ScopeLogs: []otlpScopeLogs{{Scope: scope, LogRecords: records}},
+		}}})
+		if err != nil {
+			o.slogger.Error("otlp_reporter_error", slog.String("error", err.Error()))
+		}
+	}
+
+	if len(counters) > 0 {
+		err := o.post("/v1/metrics", otlpMetricsRequest{ResourceMetrics: []otlpResourceMetrics{{
+			Resource:     o.resource,
+			ScopeMetrics: []otlpScopeMetrics{{Scope: scope, Metrics: o.sums(counters)}},
+		}}})
+		if err != nil {
+			o.slogger.Error("otlp_reporter_error", slog.String("error", err.Error()))
+		}
+	}
+}
+
+// sums converts counters to cumulative, monotonic OTLP sums
+func (o *OTLPReporter) sums(counters map[otlpCounterKey]int64) []otlpMetric {
+	keys := make([]otlpCounterKey, 0, len(counters))
+	for k := range counters {
+		keys = append(keys, k)
+	}
+	slices.SortFunc(keys, func(a, b otlpCounterKey) int {
+		return strings.Compare(a.name+"\x00"+a.comparer+"\x00"+a.outcome, b.name+"\x00"+b.comparer+"\x00"+b.outcome)
+	})
+
+	now := otlpTime(time.Now())
+	var metrics []otlpMetric
+	for _, k := range keys {
+		if len(metrics) == 0 || metrics[len(metrics)-1].Name != k.name {
+			metrics = append(metrics, otlpMetric{
+				Name:        k.name,
+				Description: otlpDescriptions[k.name],
+				Unit:        "1",
+				Sum: &otlpSum{
+					AggregationTemporality: 2, // CUMULATIVE
+					IsMonotonic:            true,
+				},
+			})
+		}
+
+		var attrs []otlpKeyValue
+		if k.comparer != "" {
+			attrs = append(attrs, otlpString("comparer", k.comparer))
+		}
+		if k.name == "mirror.reports" {
+			attrs = append(attrs, otlpString("match", k.outcome))
+		} else {
+			attrs = append(attrs, otlpString("outcome", k.outcome))
+		}
+
+		sum := metrics[len(metrics)-1].Sum
+		sum.DataPoints = append(sum.DataPoints, otlpNumberDataPoint{
+			Attributes:        attrs,
+			StartTimeUnixNano: otlpTime(o.started),
+			TimeUnixNano:      now,
+			AsInt:             strconv.FormatInt(counters[k], 10),
+		})
+	}
+	return metrics
+}
+
+var otlpDescriptions = map[string]string{
+	"mirror.reports":     "Number of compared requests, by whether every comparison matched",
+	"mirror.comparisons": "Number of comparisons, by comparer and outcome",
+}
+
+func (o *OTLPReporter) post(path string, payload any) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), o.client.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, o.Endpoint+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header = o.headers.Clone()
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("%s responded with status %d", path, resp.StatusCode)
+	}
+	return nil
+}
+
+func (o *OTLPReporter) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume reporter name
+	if d.NextArg() {
+		o.Endpoint = d.Val()
+	}
+	for d.NextBlock(0) {
+		switch d.Val() {
+		case "endpoint":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			o.Endpoint = d.Val()
+		case "header":
+			args := d.RemainingArgs()
+			if len(args) != 2 {
+				return d.Err("header requires a name and a value")
+			}
+			if o.Headers == nil {
+				o.Headers = make(map[string]string)
+			}
+			o.Headers[args[0]] = args[1]
+		case "service_name":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			o.ServiceName = d.Val()
+		case "interval":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("error parsing interval: %v", err)
+			}
+			o.Interval = caddy.Duration(dur)
+		case "log_matches":
+			o.LogMatches = true
+		default:
+			return d.Errf("unrecognized otlp reporter option '%s'", d.Val())
+		}
+	}
+	return nil
+}
+
+// The types below are the subset of the OTLP/HTTP JSON encoding needed to export logs and sums. 64-bit integers are
+// encoded as strings, as the protobuf JSON mapping requires.
+
+type otlpLogsRequest struct {
+	ResourceLogs []otlpResourceLogs `json:"resourceLogs"`
+}
+
+type otlpResourceLogs struct {
+	Resource  otlpResource    `json:"resource"`
+	ScopeLogs []otlpScopeLogs `json:"scopeLogs"`
+}
+
+type otlpScopeLogs struct {
+	Scope      otlpScope       `json:"scope"`
+	LogRecords []otlpLogRecord `json:"logRecords"`
+}
+
+type otlpLogRecord struct {
+	TimeUnixNano         string         `json:"timeUnixNano"`
+	ObservedTimeUnixNano string         `json:"observedTimeUnixNano"`
+	SeverityNumber       int            `json:"severityNumber"`
+	SeverityText         string         `json:"severityText"`
+	Body                 otlpValue      `json:"body"`
+	Attributes           []otlpKeyValue `json:"attributes"`
+	TraceID              string         `json:"traceId,omitempty"`
+	SpanID               string         `json:"spanId,omitempty"`
+}
+
+type otlpMetricsRequest struct {
+	ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+}
+
+type otlpResourceMetrics struct {
+	Resource     otlpResource       `json:"resource"`
+	ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+}
+
+type otlpScopeMetrics struct {
+	Scope   otlpScope    `json:"scope"`
+	Metrics []otlpMetric `json:"metrics"`
+}
+
+type otlpMetric struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description,omitempty"`
+	Unit        string   `json:"unit,omitempty"`
+	Sum         *otlpSum `json:"sum,omitempty"`
+}
+
+type otlpSum struct {
+	AggregationTemporality int                   `json:"aggregationTemporality"`
+	IsMonotonic            bool                  `json:"isMonotonic"`
+	DataPoints             []otlpNumberDataPoint `json:"dataPoints"`
+}
+
+type otlpNumberDataPoint struct {
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	TimeUnixNano      string         `json:"timeUnixNano"`
+	AsInt             string         `json:"asInt"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpKeyValue struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string    `json:"stringValue,omitempty"`
+	BoolValue   *bool      `json:"boolValue,omitempty"`
+	IntValue    *string    `json:"intValue,omitempty"`
+	ArrayValue  *otlpArray `json:"arrayValue,omitempty"`
+}
+
+type otlpArray struct {
+	Values []otlpValue `json:"values"`
+}
+
+func otlpString(k, v string) otlpKeyValue {
+	return otlpKeyValue{Key: k, Value: otlpValue{StringValue: &v}}
+}
+
+func otlpBool(k string, v bool) otlpKeyValue {
+	return otlpKeyValue{Key: k, Value: otlpValue{BoolValue: &v}}
+}
+
+func otlpInt(k string, v int) otlpKeyValue {
+	return otlpKeyValue{Key: k, Value: otlpValue{IntValue: ptr(strconv.Itoa(v))}}
+}
+
+func otlpTime(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
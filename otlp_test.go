@@ -0,0 +1,117 @@
+package mirror
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestOTLPReporter_Report(t *testing.T) {
+	var mu sync.Mutex
+	var logs otlpLogsRequest
+	var metrics otlpMetricsRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.URL.Path {
+		case "/v1/logs":
+			_ = json.NewDecoder(r.Body).Decode(&logs)
+		case "/v1/metrics":
+			_ = json.NewDecoder(r.Body).Decode(&metrics)
+		}
+	}))
+	defer srv.Close()
+
+	o := &OTLPReporter{
+		Endpoint:    srv.URL,
+		ServiceName: "caddy",
+		Interval:    caddy.Duration(time.Hour),
+		headers:     http.Header{},
+		slogger:     nullLogger{},
+	}
+	o.start()
+
+	o.Report(Report{
+		Time:    time.Now(),
+		Request: RequestSummary{Method: "GET", URI: "/a?b=c", TraceID: "4bf92f3577b34da6a3ce929d0e0e4736"},
+		Results: []Result{{Comparer: "status", Match: true}, {Comparer: "body"}},
+	})
+	o.Report(Report{
+		Time:    time.Now(),
+		Request: RequestSummary{Method: "GET", URI: "/"},
+		Results: []Result{{Comparer: "status", Match: true}, {Comparer: "body", Match: true}},
+		Match:   true,
+	})
+	_ = o.Cleanup()
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if len(logs.ResourceLogs) != 1 {
+		t.Fatalf("expected logs to be exported")
+	}
+	records := logs.ResourceLogs[0].ScopeLogs[0].LogRecords
+	if len(records) != 1 {
+		t.Fatalf("expected only the mismatch to be logged, got %d records", len(records))
+	}
+	if *records[0].Body.StringValue != "shadow_mismatch" || records[0].TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("unexpected log record: %+v", records[0])
+	}
+
+	got := make(map[string]string)
+	for _, m := range metrics.ResourceMetrics[0].ScopeMetrics[0].Metrics {
+		for _, dp := range m.Sum.DataPoints {
+			key := m.Name
+			for _, attr := range dp.Attributes {
+				key += " " + attr.Key + "=" + *attr.Value.StringValue
+			}
+			got[key] = dp.AsInt
+		}
+	}
+	want := map[string]string{
+		"mirror.reports match=false":                        "1",
+		"mirror.reports match=true":                         "1",
+		"mirror.comparisons comparer=status outcome=match":  "2",
+		"mirror.comparisons comparer=body outcome=match":    "1",
+		"mirror.comparisons comparer=body outcome=mismatch": "1",
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("expected %s to be %s, got %q", k, v, got[k])
+		}
+	}
+}
+
+func TestOTLPReporter_ReportAfterCleanup(t *testing.T) {
+	var exported int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/logs" {
+			exported++
+		}
+	}))
+	defer srv.Close()
+
+	var dropped []string
+	o := &OTLPReporter{
+		Endpoint:    srv.URL,
+		ServiceName: "caddy",
+		Interval:    caddy.Duration(time.Hour),
+		headers:     http.Header{},
+		slogger:     &sloggerMock{err: func(msg string, _ ...any) { dropped = append(dropped, msg) }},
+	}
+	o.start()
+	_ = o.Cleanup()
+
+	o.Report(Report{ID: "abc", Time: time.Now(), Results: []Result{{Comparer: "body"}}})
+	if len(o.pending) != 0 || exported != 0 {
+		t.Errorf("expected the record to be dropped, got %d pending and %d exported", len(o.pending), exported)
+	}
+	if len(dropped) != 1 || dropped[0] != "otlp_reporter_dropped" {
+		t.Errorf("logged %v, want otlp_reporter_dropped", dropped)
+	}
+}
@@ -0,0 +1,161 @@
+package mirror
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+var _ caddyfile.Unmarshaler = (*WorkerPoolConfig)(nil)
+
+const (
+	// dropQueueFull is a request dropped because the queue was full, under the newest drop policy
+	dropQueueFull = "queue_full"
+	// dropEvicted is a queued request dropped to make room for a newer one, under the oldest drop policy
+	dropEvicted = "evicted"
+	// dropShutdown is a queued request dropped because the handler was cleaned up before it ran
+	dropShutdown = "shutdown"
+)
+
+// WorkerPoolConfig sends secondary requests from a fixed pool of workers, through a bounded queue, instead of a new
+// goroutine per request. When the queue is full, requests are dropped by the drop policy.
+type WorkerPoolConfig struct {
+	// Workers is how many secondary requests are sent at once. Defaults to 10.
+	Workers int `json:"workers,omitempty"`
+	// QueueDepth is how many secondary requests can wait for a worker. Defaults to 100.
+	QueueDepth int `json:"queue_depth,omitempty"`
+	// DropPolicy is which request is dropped when the queue is full: "newest" drops the incoming request, and "oldest"
+	// drops the request which has waited longest, to make room for it. Defaults to newest.
+	DropPolicy string `json:"drop_policy,omitempty"`
+}
+
+func (c *WorkerPoolConfig) provision() error {
+	if c.Workers == 0 {
+		c.Workers = 10
+	}
+	if c.QueueDepth == 0 {
+		c.QueueDepth = 100
+	}
+	switch c.DropPolicy {
+	case "":
+		c.DropPolicy = "newest"
+	case "newest", "oldest":
+	default:
+		return fmt.Errorf("unrecognized worker_pool drop_policy '%s'", c.DropPolicy)
+	}
+	return nil
+}
+
+func (c *WorkerPoolConfig) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume "worker_pool"
+	if d.NextArg() {
+		workers, err := strconv.Atoi(d.Val())
+		if err != nil {
+			return d.Errf("error parsing workers: %v", err)
+		}
+		c.Workers = workers
+	}
+	for d.NextBlock(0) {
+		opt := d.Val()
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		switch opt {
+		case "workers", "queue_depth":
+			n, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("error parsing %s: %v", opt, err)
+			}
+			if opt == "workers" {
+				c.Workers = n
+			} else {
+				c.QueueDepth = n
+			}
+		case "drop_policy":
+			c.DropPolicy = d.Val()
+		default:
+			return d.Errf("unrecognized worker_pool option '%s'", opt)
+		}
+	}
+	return nil
+}
+
+// poolJob sends one secondary request. If dropped is true, the request won't be sent, and the job only cleans up.
+type poolJob func(dropped bool)
+
+// workerPool runs jobs on a fixed number of workers, from a bounded queue
+type workerPool struct {
+	oldest bool
+	jobs   chan poolJob
+	done   <-chan struct{}
+	// onDrop is called with the reason for each dropped job
+	onDrop func(reason string)
+}
+
+// newWorkerPool starts the pool's workers, which run until done is closed
+func newWorkerPool(cfg WorkerPoolConfig, done <-chan struct{}, onDrop func(string)) *workerPool {
+	p := &workerPool{
+		oldest: cfg.DropPolicy == "oldest",
+		jobs:   make(chan poolJob, cfg.QueueDepth),
+		done:   done,
+		onDrop: onDrop,
+	}
+	for range cfg.Workers {
+		go p.work()
+	}
+	return p
+}
+
+func (p *workerPool) work() {
+	for {
+		select {
+		case <-p.done:
+			// Whatever is still queued will never run
+			for {
+				select {
+				case job := <-p.jobs:
+					p.drop(job, dropShutdown)
+				default:
+					return
+				}
+			}
+		case job := <-p.jobs:
+			job(false)
+		}
+	}
+}
+
+// submit queues a job, or drops it or an older job if the queue is full
+func (p *workerPool) submit(job poolJob) {
+	select {
+	case <-p.done:
+		p.drop(job, dropShutdown)
+		return
+	default:
+	}
+
+	for {
+		select {
+		case p.jobs <- job:
+			return
+		default:
+		}
+
+		if !p.oldest {
+			p.drop(job, dropQueueFull)
+			return
+		}
+		select {
+		case old := <-p.jobs:
+			p.drop(old, dropEvicted)
+		default:
+			// A worker took a job in the meantime, so there's room now
+		}
+	}
+}
+
+func (p *workerPool) drop(job poolJob, reason string) {
+	job(true)
+	p.onDrop(reason)
+}
@@ -0,0 +1,85 @@
+package mirror
+
+import (
+	"slices"
+	"sync"
+	"testing"
+)
+
+func Test_workerPool(t *testing.T) {
+	tests := []struct {
+		policy      string
+		wantRan     []int
+		wantDropped []string
+	}{
+		{"newest", []int{0, 1}, []string{dropQueueFull, dropQueueFull}},
+		{"oldest", []int{0, 3}, []string{dropEvicted, dropEvicted}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			cfg := WorkerPoolConfig{Workers: 1, QueueDepth: 1, DropPolicy: tt.policy}
+			if err := cfg.provision(); err != nil {
+				t.Fatal(err)
+			}
+
+			var mu sync.Mutex
+			var ran []int
+			var dropped []string
+			done := make(chan struct{})
+			defer close(done)
+			p := newWorkerPool(cfg, done, func(reason string) {
+				mu.Lock()
+				defer mu.Unlock()
+				dropped = append(dropped, reason)
+			})
+
+			// The first job holds the only worker until it's released, so the rest have to queue
+			release, started := make(chan struct{}), make(chan struct{})
+			var wg sync.WaitGroup
+			for i := range 4 {
+				wg.Add(1)
+				p.submit(func(drop bool) {
+					defer wg.Done()
+					if drop {
+						return
+					}
+					if i == 0 {
+						close(started)
+						<-release
+					}
+					mu.Lock()
+					defer mu.Unlock()
+					ran = append(ran, i)
+				})
+				if i == 0 {
+					<-started
+				}
+			}
+			close(release)
+			wg.Wait()
+
+			if !slices.Equal(ran, tt.wantRan) || !slices.Equal(dropped, tt.wantDropped) {
+				t.Errorf("ran %v and dropped %v, want %v and %v", ran, dropped, tt.wantRan, tt.wantDropped)
+			}
+		})
+	}
+}
+
+func Test_workerPool_shutdown(t *testing.T) {
+	done := make(chan struct{})
+	close(done)
+	var reasons []string
+	p := newWorkerPool(WorkerPoolConfig{Workers: 1, QueueDepth: 1}, done, func(reason string) { reasons = append(reasons, reason) })
+
+	var dropped bool
+	p.submit(func(drop bool) { dropped = drop })
+	if !dropped || !slices.Equal(reasons, []string{dropShutdown}) {
+		t.Errorf("job submitted after shutdown wasn't dropped: %v", reasons)
+	}
+}
+
+func TestWorkerPoolConfig_provision(t *testing.T) {
+	if err := (&WorkerPoolConfig{DropPolicy: "random"}).provision(); err == nil {
+		t.Errorf("provision() with an unknown drop_policy error = nil")
+	}
+}
@@ -1,15 +1,16 @@
 package mirror
 
 import (
+	"cmp"
 	"fmt"
+	"log/slog"
 	"time"
 
 	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyevents"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
-
-	"github.com/itchyny/gojq"
-
-	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	"go.uber.org/zap/exp/zapslog"
 )
 
 // Provision implements caddy.Provisioner
@@ -19,9 +20,34 @@ func (h *Handler) Provision(ctx caddy.Context) (err error) {
 		return
 	}
 
-	h.slogger = ctx.Slogger()
+	switch h.Logger {
+	case "", loggerSlog, loggerZap:
+	default:
+		return fmt.Errorf("unrecognized logger '%s'", h.Logger)
+	}
+	h.slogger = h.newSlogger(ctx, h.loggerName(""))
+	h.comparisonSlogger = h.newSlogger(ctx, h.loggerName(comparisonsLogger))
+	if h.AccessLog {
+		h.accessSlogger = h.newSlogger(ctx, h.loggerName(accessLogger))
+	}
+
+	return h.provision(ctx)
+}
+
+// provision sets up everything but the primary, the secondary, and the loggers, which come from Caddy's config, or from
+// New's arguments and options
+func (h *Handler) provision(ctx caddy.Context) (err error) {
+	if h.now == nil { // Unless WithClock set it
+		h.now = time.Now
+	}
 
-	h.now = time.Now
+	h.headerAllow = newHeaderMatcher(h.HeaderAllow)
+	h.headerDeny = newHeaderMatcher(h.HeaderDeny)
+
+	h.stats = newStats()
+	h.drain = newDrainer(h.stats, h.slogger, h.now)
+	h.recent = newMismatchRing(h.RecentMismatches)
+	h.done = make(chan struct{})
 
 	if h.MirrorRate == 0 { // default to 100 if it's empty/zero in the json.
 		h.MirrorRate = 1.0
@@ -29,18 +55,111 @@ func (h *Handler) Provision(ctx caddy.Context) (err error) {
 		h.MirrorRate = h.MirrorRate / 100
 	}
 
-	if len(h.CompareJQ) > 0 {
-		h.compareJQ = make([]*gojq.Query, len(h.CompareJQ))
-		for i, qStr := range h.CompareJQ {
-			h.compareJQ[i], err = gojq.Parse(string(qStr))
-			if err != nil {
-				return fmt.Errorf("error parsing jq query %d: %w", i, err)
-			}
+	if h.RampUpDuration > 0 {
+		h.rampUp = newRampUp(time.Duration(h.RampUpDuration), h.now)
+	}
+	if h.SlowStartDuration > 0 {
+		// Slow start only begins when mirroring resumes, so it starts out ramped up
+		h.slowStart = &rampUp{duration: time.Duration(h.SlowStartDuration), now: h.now}
+	}
+
+	if h.MaxHeapBytes > 0 {
+		h.heap = newHeapMonitor(h.MaxHeapBytes, h.slogger)
+		go h.heap.watch(time.Second, h.done)
+	}
+
+	if h.SamplingSeed != 0 && h.draw == nil { // Unless WithSamplingRand set it
+		h.draw = seededDraw(h.SamplingSeed, cmp.Or(h.SamplingKey, defaultSamplingKey))
+	}
+
+	if h.Exclude != nil {
+		if err := h.Exclude.provision(); err != nil {
+			return err
+		}
+	}
+	if h.Tenant != nil {
+		if err := h.Tenant.provision(); err != nil {
+			return err
+		}
+	}
+	if h.Dedupe != nil {
+		h.Dedupe.provision()
+		h.dedupe = newDeduper(*h.Dedupe, h.now)
+	}
+
+	if h.LoadGovernor != nil {
+		h.LoadGovernor.provision()
+		h.governor = newGovernor(*h.LoadGovernor, h.slogger)
+		if h.MetricsName != "" {
+			h.metrics.provisionGovernor(ctx, h.MetricsName, h.governor.rate)
+		}
+		go h.governor.watch(h.done)
+	}
+
+	if h.MaxInFlight > 0 {
+		h.inFlightLimit = newInFlightLimit(h.MaxInFlight)
+	}
+
+	if h.SamplerRaw != nil {
+		mod, err := ctx.LoadModule(h, "SamplerRaw")
+		if err != nil {
+			return fmt.Errorf("error loading sampler: %w", err)
+		}
+		h.sampler = mod.(Sampler)
+	}
+
+	err = h.ComparisonConfig.provision()
+	if err != nil {
+		return err
+	}
+
+	var level LogLevel
+	if h.LogLevel != nil {
+		level = *h.LogLevel
+	}
+	if err := validateLogLevels(level, h.MismatchLogLevels); err != nil {
+		return fmt.Errorf("error validating log levels: %w", err)
+	}
+
+	err = h.SecondaryRequestConfig.provision()
+	if err != nil {
+		return err
+	}
+
+	if h.ComparersRaw != nil {
+		mods, err := ctx.LoadModule(h, "ComparersRaw")
+		if err != nil {
+			return fmt.Errorf("error loading comparers: %w", err)
+		}
+		for _, mod := range mods.([]any) {
+			h.comparers = append(h.comparers, mod.(Comparer))
+		}
+	}
+
+	if h.ReportersRaw != nil {
+		mods, err := ctx.LoadModule(h, "ReportersRaw")
+		if err != nil {
+			return fmt.Errorf("error loading reporters: %w", err)
+		}
+		for _, mod := range mods.([]any) {
+			h.reporters = append(h.reporters, mod.(Reporter))
+		}
+	}
+
+	if h.CredentialsRaw != nil {
+		mods, err := ctx.LoadModule(h, "CredentialsRaw")
+		if err != nil {
+			return fmt.Errorf("error loading secondary credentials: %w", err)
+		}
+		for _, mod := range mods.([]any) {
+			h.credentials = append(h.credentials, mod.(Credentials))
 		}
 	}
 
 	h.timeout = 30 * time.Second
-	if h.Timeout != "" {
+	if h.Timeout == "none" {
+		h.timeout = 0
+	} else if h.Timeout != "" {
 		h.timeout, err = time.ParseDuration(h.Timeout)
 		if err != nil {
 			return fmt.Errorf("error parsing timeout: %w", err)
@@ -49,28 +168,169 @@ func (h *Handler) Provision(ctx caddy.Context) (err error) {
 
 	if h.MetricsName != "" {
 		// If metrics are enabled, assume that always includes basic performance metrics
-		h.metrics.provision(ctx, h.MetricsName)
+		var routes *labelLimiter
+		if h.MetricsLabel != "" {
+			if h.MetricsLabelLimit == 0 {
+				h.MetricsLabelLimit = 100
+			}
+			routes = newLabelLimiter(h.MetricsLabelLimit)
+		}
+		h.metrics.provision(ctx, h.MetricsName, routes)
+		h.metrics.provisionInFlight(ctx, h.MetricsName, h.stats)
+		h.metrics.provisionLag(ctx, h.MetricsName, h.stats)
+
+		window := 5 * time.Minute
+		if h.MatchRateWindow > 0 {
+			window = time.Duration(h.MatchRateWindow)
+		}
+		comparers := []string{"all"}
+		if h.CompareStatus {
+			comparers = append(comparers, "status")
+		}
+		if h.CompareBody || len(h.compareJQ) > 0 {
+			comparers = append(comparers, "body")
+		}
+		if h.CompareEvents {
+			comparers = append(comparers, "events")
+		}
+		if h.CompareLatency != nil {
+			comparers = append(comparers, "latency")
+		}
+		h.metrics.provisionMatchRates(ctx, h.MetricsName, window, comparers)
 	}
 
-	// Add metrics for comparisons if enabled
-	if h.CompareBody || h.CompareJQ != nil {
-		h.metrics.match = prometheus.NewCounter(prometheus.CounterOpts{
-			Namespace: h.MetricsName,
-			Name:      "shadow_body_match",
-			Help:      "Number of responses that matched",
-		})
-		h.metrics.mismatch = prometheus.NewCounter(prometheus.CounterOpts{
-			Namespace: h.MetricsName,
-			Name:      "shadow_body_mismatch",
-			Help:      "Number of responses that did not match",
+	if h.WorkerPool != nil {
+		if err := h.WorkerPool.provision(); err != nil {
+			return err
+		}
+		h.pool = newWorkerPool(*h.WorkerPool, h.done, func(reason string) {
+			if h.MetricsName != "" {
+				h.metrics.dropped.WithLabelValues(reason).Inc()
+			}
 		})
-		_ = ctx.GetMetricsRegistry().Register(h.metrics.match)
-		_ = ctx.GetMetricsRegistry().Register(h.metrics.mismatch)
+	}
+
+	if h.Artifacts != nil {
+		if err := h.Artifacts.provision(); err != nil {
+			return err
+		}
+		h.artifacts, err = newArtifactStore(*h.Artifacts, h.slogger, h.now)
+		if err != nil {
+			return err
+		}
+		if h.Artifacts.retained() {
+			go h.artifacts.watch(h.done)
+		}
+	}
+
+	if h.SummaryInterval > 0 {
+		go h.summarize(time.Duration(h.SummaryInterval), h.done)
+	}
+	if h.Scorecard != nil {
+		h.Scorecard.provision()
+		h.scorecard = newScorecard(*h.Scorecard, h.now)
+		go h.logScorecards(time.Duration(h.Scorecard.LogInterval), h.done)
+	}
+
+	if h.Name == "" {
+		h.Name = h.MetricsName
+	}
+	if h.Name != "" {
+		namedHandlers.register(h.Name, h)
+	}
+
+	if h.MaxMirroredPerDay > 0 || h.MaxMirrored > 0 {
+		h.quota = newQuota(h.now, h.slogger)
+		if h.Name != "" {
+			h.quota = quotas.loadOrRegister(h.Name, h.quota)
+		}
+		h.quota.setLimits(h.MaxMirroredPerDay, h.MaxMirrored)
+		if h.MetricsName != "" {
+			h.metrics.provisionQuota(ctx, h.MetricsName, h.quota.usage)
+		}
+	}
+
+	if h.Alerts != nil {
+		emit, err := eventEmitter(ctx)
+		if err != nil {
+			return err
+		}
+		h.Alerts.provision()
+		h.stats.primary.alertLatencies = new(reservoir)
+		h.stats.secondary.alertLatencies = new(reservoir)
+		a := &alerter{
+			cfg:     *h.Alerts,
+			name:    h.Name,
+			stats:   h.stats,
+			slogger: h.slogger,
+			emit:    emit,
+			firing:  make(map[string]bool),
+		}
+		go a.watch(h.done)
+	}
+
+	if h.ErrorBudget != nil {
+		if err := h.ErrorBudget.provision(); err != nil {
+			return err
+		}
+		h.stats.budget = newErrorBudget(*h.ErrorBudget)
+		if h.MetricsName != "" {
+			h.metrics.provisionErrorBudget(ctx, h.MetricsName, h.stats)
+		}
+	}
+
+	if h.SLO != nil {
+		emit, err := eventEmitter(ctx)
+		if err != nil {
+			return err
+		}
+		h.SLO.provision()
+		h.stats.secondary.sloLatencies = new(reservoir)
+		e := &sloEvaluator{
+			cfg:     *h.SLO,
+			name:    h.Name,
+			stats:   h.stats,
+			slogger: h.slogger,
+			emit:    emit,
+		}
+		if h.MetricsName != "" {
+			h.metrics.provisionSLO(ctx, h.MetricsName, e.passing.Load)
+		}
+		go e.watch(h.done)
+	}
+
+	if h.HealthCheck != nil {
+		emit, err := eventEmitter(ctx)
+		if err != nil {
+			return err
+		}
+		if err := h.HealthCheck.provision(); err != nil {
+			return err
+		}
+		h.health = newHealthChecker(*h.HealthCheck, h.Name, h.slogger, emit)
+		if h.slowStart != nil {
+			h.health.onHealthy = h.slowStart.restart
+		}
+		if h.MetricsName != "" {
+			h.metrics.provisionHealth(ctx, h.MetricsName, h.health.healthy)
+		}
+		go h.health.watch(h.done)
 	}
 
 	return nil
 }
 
+// eventEmitter returns a function emitting Caddy events from the handler
+func eventEmitter(ctx caddy.Context) (func(event string, data map[string]any), error) {
+	eventsApp, err := ctx.App("events")
+	if err != nil {
+		return nil, fmt.Errorf("error loading events app: %w", err)
+	}
+	return func(event string, data map[string]any) {
+		eventsApp.(*caddyevents.App).Emit(ctx, event, data)
+	}, nil
+}
+
 func (h *Handler) provisionHandlers(ctx caddy.Context) (err error) {
 	var mod any
 	mod, err = ctx.LoadModuleByID("http.handlers.subroute", h.SecondaryRaw)
@@ -99,3 +359,33 @@ func (h *Handler) provisionHandlers(ctx caddy.Context) (err error) {
 
 	return nil
 }
+
+// comparisonsLogger names the logger comparison results are logged through, apart from the handler's other logs, so
+// they can be written to their own sink with Caddy's logging config
+const comparisonsLogger = "comparisons"
+
+// loggerName names one of the handler's loggers. Named handlers log as http.handlers.mirror.<name>, so each route's logs
+// can be configured on their own.
+func (h *Handler) loggerName(sub string) string {
+	name := string(h.CaddyModule().ID)
+	if n := cmp.Or(h.Name, h.MetricsName); n != "" {
+		name += "." + n
+	}
+	if sub != "" {
+		name += "." + sub
+	}
+	return name
+}
+
+// newSlogger returns one of the handler's loggers, through slog or zap as configured
+func (h *Handler) newSlogger(ctx caddy.Context, name string) slogger {
+	if h.Logger == loggerZap {
+		return zapSlogger{zap.New(ctx.Logger().Core()).Named(name)}
+	}
+	return namedSlogger(ctx, name)
+}
+
+// namedSlogger returns a logger through Caddy's logging config with the given name, instead of the module's ID
+func namedSlogger(ctx caddy.Context, name string) *slog.Logger {
+	return slog.New(zapslog.NewHandler(ctx.Logger().Core(), zapslog.WithName(name)))
+}
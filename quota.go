@@ -0,0 +1,97 @@
+package mirror
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// quotas keep each named handler's quota usage across config reloads, so a reload doesn't hand out a fresh budget.
+// They're never unregistered, since the new config takes over the old config's quota.
+var quotas = newRegistry[*quota]()
+
+// quota is a budget of mirrored requests, per UTC day and in total. Methods are safe to call on a nil *quota, which
+// has no limit.
+type quota struct {
+	now     func() time.Time
+	slogger slogger
+
+	mu            sync.Mutex
+	perDay, total int64
+	// day is the UTC day usedToday counts, as days since the epoch
+	day                  int64
+	usedToday, usedTotal int64
+	// exhausted is whether the exhaustion of the current budget was logged
+	exhausted bool
+}
+
+// quotaUsage is a quota's limits and how much of them is used. Limits which aren't set are zero.
+type quotaUsage struct {
+	PerDay    int64 `json:"per_day,omitempty"`
+	UsedToday int64 `json:"used_today"`
+	Total     int64 `json:"total,omitempty"`
+	UsedTotal int64 `json:"used_total"`
+}
+
+func newQuota(now func() time.Time, slogger slogger) *quota {
+	return &quota{now: now, slogger: slogger}
+}
+
+// setLimits replaces the quota's limits, keeping its usage
+func (q *quota) setLimits(perDay, total int64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.perDay, q.total = perDay, total
+	q.exhausted = false
+}
+
+// rollover starts counting a new day's usage, if the day changed. It must be called with mu held.
+func (q *quota) rollover() {
+	day := q.now().UTC().Unix() / int64(24*time.Hour/time.Second)
+	if day != q.day {
+		q.day, q.usedToday = day, 0
+		q.exhausted = q.total > 0 && q.usedTotal >= q.total
+	}
+}
+
+// take uses up one request of the budget, and reports whether there was any left
+func (q *quota) take() bool {
+	if q == nil {
+		return true
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.rollover()
+
+	if q.perDay > 0 && q.usedToday >= q.perDay || q.total > 0 && q.usedTotal >= q.total {
+		if !q.exhausted {
+			q.exhausted = true
+			q.slogger.Warn("mirror_quota_exhausted",
+				slog.Int64("used_today", q.usedToday),
+				slog.Int64("per_day", q.perDay),
+				slog.Int64("used_total", q.usedTotal),
+				slog.Int64("total", q.total),
+			)
+		}
+		return false
+	}
+	q.usedToday++
+	q.usedTotal++
+	return true
+}
+
+func (q *quota) usage() quotaUsage {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.rollover()
+	return quotaUsage{PerDay: q.perDay, UsedToday: q.usedToday, Total: q.total, UsedTotal: q.usedTotal}
+}
+
+// reset clears the quota's usage, so mirroring resumes
+func (q *quota) reset() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.usedToday, q.usedTotal = 0, 0
+	q.exhausted = false
+}
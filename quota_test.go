@@ -0,0 +1,85 @@
+package mirror
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func Test_quota_take(t *testing.T) {
+	now := time.Date(2024, 5, 1, 23, 0, 0, 0, time.UTC)
+	q := newQuota(func() time.Time { return now }, nullLogger{})
+	q.setLimits(2, 3)
+
+	take := func(n int) (taken int) {
+		for range n {
+			if q.take() {
+				taken++
+			}
+		}
+		return taken
+	}
+
+	if got := take(5); got != 2 {
+		t.Errorf("took %d on the first day, want the daily limit of 2", got)
+	}
+
+	now = now.Add(2 * time.Hour)
+	if got := take(5); got != 1 {
+		t.Errorf("took %d on the second day, want the 1 left of the total", got)
+	}
+	if u := q.usage(); u.UsedToday != 1 || u.UsedTotal != 3 {
+		t.Errorf("usage() = %+v, want 1 today and 3 in total", u)
+	}
+
+	q.reset()
+	if got := take(5); got != 2 {
+		t.Errorf("took %d after a reset, want 2", got)
+	}
+
+	var unset *quota
+	if !unset.take() {
+		t.Errorf("nil take() = false")
+	}
+}
+
+func Test_registry_loadOrRegister(t *testing.T) {
+	r := newRegistry[*quota]()
+	first := r.loadOrRegister("q", new(quota))
+	if got := r.loadOrRegister("q", new(quota)); got != first {
+		t.Errorf("loadOrRegister() replaced an existing value")
+	}
+}
+
+func TestAdminAPI_resetQuota(t *testing.T) {
+	h := &Handler{Name: "quota-test", quota: newQuota(time.Now, nullLogger{})}
+	h.quota.setLimits(0, 1)
+	namedHandlers.register(h.Name, h)
+	defer namedHandlers.unregister(h.Name, h)
+
+	h.quota.take()
+	if h.quota.take() {
+		t.Fatalf("take() = true over the quota")
+	}
+
+	err := new(AdminAPI).serve(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/mirror/quota-test/quota/reset", nil))
+	if apiErr, ok := err.(caddy.APIError); !ok || apiErr.HTTPStatus != http.StatusMethodNotAllowed {
+		t.Errorf("serve() with GET error = %v, want 405", err)
+	}
+
+	w := httptest.NewRecorder()
+	if err := new(AdminAPI).serve(w, httptest.NewRequest(http.MethodPost, "/mirror/quota-test/quota/reset", nil)); err != nil {
+		t.Fatalf("serve() error = %v", err)
+	}
+	var got quotaUsage
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil || got.UsedTotal != 0 || got.Total != 1 {
+		t.Errorf("unexpected usage after reset: %s", w.Body)
+	}
+	if !h.quota.take() {
+		t.Errorf("take() = false after a reset")
+	}
+}
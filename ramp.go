@@ -0,0 +1,42 @@
+package mirror
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// rampUp scales the mirror rate linearly from zero to the configured rate, over a duration from when it starts. Methods
+// are safe to call on a nil *rampUp, which is always fully ramped up.
+type rampUp struct {
+	duration time.Duration
+	now      func() time.Time
+	// start is when the ramp started, in Unix nanoseconds
+	start atomic.Int64
+}
+
+func newRampUp(duration time.Duration, now func() time.Time) *rampUp {
+	r := &rampUp{duration: duration, now: now}
+	r.restart()
+	return r
+}
+
+// restart starts ramping up from zero again
+func (r *rampUp) restart() {
+	r.start.Store(r.now().UnixNano())
+}
+
+// factor is the fraction of the configured rate which is currently mirrored, from 0 to 1
+func (r *rampUp) factor() float64 {
+	if r == nil {
+		return 1
+	}
+	elapsed := r.now().UnixNano() - r.start.Load()
+	return min(max(float64(elapsed)/float64(r.duration), 0), 1)
+}
+
+// sample decides whether a request the sampler would mirror is let through, with probability factor, where u is a draw
+// from SamplingRand
+func (r *rampUp) sample(u float64) bool {
+	f := r.factor()
+	return f >= 1 || u < f
+}
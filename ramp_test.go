@@ -0,0 +1,46 @@
+package mirror
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_rampUp(t *testing.T) {
+	now := time.Unix(1000, 0)
+	r := newRampUp(10*time.Minute, func() time.Time { return now })
+
+	steps := []struct {
+		elapsed time.Duration
+		want    float64
+	}{
+		{0, 0},
+		{time.Minute, 0.1},
+		{5 * time.Minute, 0.5},
+		{10 * time.Minute, 1},
+		{time.Hour, 1},
+	}
+	for _, step := range steps {
+		now = time.Unix(1000, 0).Add(step.elapsed)
+		if got := r.factor(); got != step.want {
+			t.Errorf("factor() after %s = %v, want %v", step.elapsed, got, step.want)
+		}
+	}
+	if !r.sample(0.99) {
+		t.Errorf("sample() = false once ramped up")
+	}
+
+	r.restart()
+	if got := r.factor(); got != 0 {
+		t.Errorf("factor() after restart = %v, want 0", got)
+	}
+	for _, u := range []float64{0, 0.5, 0.99} {
+		if r.sample(u) {
+			t.Fatalf("sample(%v) = true at the start of the ramp", u)
+		}
+	}
+
+	var unset *rampUp
+	if got := unset.factor(); got != 1 {
+		t.Errorf("nil factor() = %v, want 1", got)
+	}
+}
@@ -0,0 +1,67 @@
+package mirror
+
+import "sync"
+
+// recentMismatch is a mismatch kept in memory for the admin API, with a diff of the response bodies. Diffs are
+// truncated, so memory use is bounded by the number of records.
+type recentMismatch struct {
+	Event
+}
+
+func newRecentMismatch(rep Report) recentMismatch {
+	rm := recentMismatch{Event: newEvent(rep, false)}
+	if rm.Diff == "" {
+		// Bodies are diffed even if they weren't compared, since they're usually why the request mismatched
+		rm.setDiff(bodyDiff(rep.Primary.Body, rep.Secondary.Body), rep.maxDiffBytes)
+	}
+	return rm
+}
+
+// mismatchRing keeps the last mismatches in a fixed-size ring buffer. Methods are safe to call on a nil *mismatchRing,
+// which keeps nothing.
+type mismatchRing struct {
+	mu      sync.Mutex
+	records []recentMismatch
+	// next is the index the next record is written to. Once the ring is full, it's also the oldest record.
+	next int
+	full bool
+}
+
+func newMismatchRing(size int) *mismatchRing {
+	if size <= 0 {
+		return nil
+	}
+	return &mismatchRing{records: make([]recentMismatch, size)}
+}
+
+func (r *mismatchRing) add(rep Report) {
+	if r == nil || rep.Match {
+		return
+	}
+
+	rm := newRecentMismatch(rep)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.records[r.next] = rm
+	r.next = (r.next + 1) % len(r.records)
+	r.full = r.full || r.next == 0
+}
+
+// list returns up to limit of the most recent mismatches, newest first
+func (r *mismatchRing) list(limit int) []recentMismatch {
+	if r == nil {
+		return nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := r.next
+	if r.full {
+		n = len(r.records)
+	}
+	out := make([]recentMismatch, 0, min(limit, n))
+	for i := 1; i <= n && len(out) < limit; i++ {
+		out = append(out, r.records[(r.next-i+len(r.records))%len(r.records)])
+	}
+	return out
+}
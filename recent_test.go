@@ -0,0 +1,52 @@
+package mirror
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func Test_mismatchRing(t *testing.T) {
+	r := newMismatchRing(3)
+	for i := range 5 {
+		r.add(Report{Request: RequestSummary{URI: "/" + strconv.Itoa(i)}})
+	}
+	r.add(Report{Match: true, Request: RequestSummary{URI: "/match"}})
+
+	var got []string
+	for _, rm := range r.list(10) {
+		got = append(got, rm.Request.URI)
+	}
+	if want := "/4 /3 /2"; strings.Join(got, " ") != want {
+		t.Errorf("list() = %v, want %s", got, want)
+	}
+	if n := len(r.list(2)); n != 2 {
+		t.Errorf("len(list(2)) = %d, want 2", n)
+	}
+
+	if newMismatchRing(0).list(10) != nil {
+		t.Errorf("disabled ring kept mismatches")
+	}
+}
+
+func Test_newRecentMismatch(t *testing.T) {
+	rep := Report{
+		Primary:   ResponseArtifact{Body: []byte("a\nb\nc\n")},
+		Secondary: ResponseArtifact{Body: []byte("a\nx\nc\n")},
+	}
+	rm := newRecentMismatch(rep)
+	if !strings.Contains(rm.Diff, "-b\n+x\n") || rm.DiffTruncated {
+		t.Errorf("unexpected diff %q, truncated %v", rm.Diff, rm.DiffTruncated)
+	}
+
+	rep.Secondary.Body = []byte(strings.Repeat("long line\n", defaultMaxDiffBytes/5))
+	rm = newRecentMismatch(rep)
+	if !rm.DiffTruncated || len(rm.Diff) > defaultMaxDiffBytes || !strings.HasSuffix(rm.Diff, "\n") {
+		t.Errorf("diff of %d bytes wasn't truncated to whole lines, truncated %v", len(rm.Diff), rm.DiffTruncated)
+	}
+
+	rep.maxDiffBytes = 1024
+	if rm = newRecentMismatch(rep); len(rm.Diff) > 1024 {
+		t.Errorf("diff of %d bytes wasn't truncated to max_diff_bytes", len(rm.Diff))
+	}
+}
@@ -0,0 +1,416 @@
+package mirror
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"mime"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+
+	"github.com/dotvezz/caddy-mirror/compare"
+)
+
+var (
+	_ Reporter              = (*LogReporter)(nil)
+	_ caddy.Provisioner     = (*LogReporter)(nil)
+	_ caddyfile.Unmarshaler = (*LogReporter)(nil)
+)
+
+func init() {
+	caddy.RegisterModule(LogReporter{})
+}
+
+// LogLevel is a level mismatches are logged at: debug, info, warn, or error. Mismatches logged at off aren't logged.
+type LogLevel string
+
+const (
+	logLevelDebug LogLevel = "debug"
+	logLevelInfo  LogLevel = "info"
+	logLevelWarn  LogLevel = "warn"
+	logLevelError LogLevel = "error"
+	logLevelOff   LogLevel = "off"
+)
+
+func (l LogLevel) validate() error {
+	switch l {
+	case "", logLevelDebug, logLevelInfo, logLevelWarn, logLevelError, logLevelOff:
+		return nil
+	}
+	return fmt.Errorf("unrecognized log level '%s'", l)
+}
+
+// logFunc returns the method of s which logs at the level. Defaults to Info.
+func (l LogLevel) logFunc(s slogger) func(string, ...any) {
+	switch l {
+	case logLevelOff:
+		return func(string, ...any) {}
+	case logLevelDebug:
+		return s.Debug
+	case logLevelWarn:
+		return s.Warn
+	case logLevelError:
+		return s.Error
+	}
+	return s.Info
+}
+
+const (
+	loggerSlog = "slog"
+	loggerZap  = "zap"
+)
+
+// ReportingConfig configures the handler's own mismatch log
+type ReportingConfig struct {
+	// NoLog disables the handler's own mismatch log. Reporters and metrics still see every comparison.
+	NoLog bool `json:"no_log,omitempty"`
+	// LogLevel is the level the handler's own mismatch logs are at. Defaults to info.
+	LogLevel *LogLevel `json:"log_level,omitempty"`
+	// MismatchLogLevels override LogLevel for the mismatches of particular comparers, by their name, like "body". Set
+	// one to off to only count its mismatches in metrics.
+	MismatchLogLevels map[string]LogLevel `json:"mismatch_log_levels,omitempty"`
+	// LogMatches also logs matched requests, as shadow_match at debug level, to confirm requests are being compared
+	LogMatches bool `json:"log_matches,omitempty"`
+	// AccessLog logs every secondary request, like Caddy's access log, as http.handlers.mirror[.<name>].access.
+	// Otherwise, the secondary's traffic is only logged if it errors or mismatches.
+	AccessLog bool `json:"access_log,omitempty"`
+	// HashBodies logs hashes of mismatched bodies instead of their content, for deployments which can't log bodies
+	HashBodies bool `json:"hash_bodies,omitempty"`
+	// OmitBodies leaves mismatched bodies out of the log, so JSON mismatches are logged by the paths which differ
+	OmitBodies bool `json:"omit_bodies,omitempty"`
+	// MaxDiffBytes bounds the size of body diffs in events, artifacts, and recent mismatches. Longer diffs are cut
+	// short, with a marker line counting the hunks left out. Defaults to 16KiB.
+	MaxDiffBytes int `json:"max_diff_bytes,omitempty"`
+	// Logger is what the handler logs through: slog, the default, or zap, which writes to Caddy's zap logger directly,
+	// with the same messages and fields
+	Logger string `json:"logger,omitempty"`
+
+	// SummaryInterval, if set, logs a summary of the handler's stats at this interval: how many requests were mirrored
+	// and matched, the paths with the most mismatches, and the latency and errors of both handlers.
+	SummaryInterval caddy.Duration `json:"summary_interval,omitempty"`
+
+	// RecentMismatches is how many of the most recent mismatches are kept in memory, with a diff of their bodies, for
+	// the admin API at /mirror/<name>/recent. Requires the handler to have a name.
+	RecentMismatches int `json:"recent_mismatches,omitempty"`
+}
+
+// RequestSummary identifies the request which was mirrored
+type RequestSummary struct {
+	Method string `json:"method"`
+	Host   string `json:"host"`
+	URI    string `json:"uri"`
+	// Tenant is the tenant the request is from, if the handler is configured to find it
+	Tenant string `json:"tenant,omitempty"`
+	// ContentType is the media type of the request's body, without parameters like its boundary
+	ContentType string `json:"content_type,omitempty"`
+
+	// TraceID and SpanID are taken from the request's W3C traceparent header, if it has one. Caddy's tracing handler
+	// sets it, so reports can be correlated with traces.
+	TraceID string `json:"trace_id,omitempty"`
+	SpanID  string `json:"span_id,omitempty"`
+
+	// Route is the value of the handler's metrics_label, if it has one
+	Route string `json:"route,omitempty"`
+}
+
+// Path is the request URI without its query
+func (s RequestSummary) Path() string {
+	path, _, _ := strings.Cut(s.URI, "?")
+	return path
+}
+
+// upload reports whether the request was a multipart/form-data upload
+func (s RequestSummary) upload() bool {
+	return s.ContentType == "multipart/form-data"
+}
+
+// Fingerprint is a stable hash identifying the request by method, host, and URI. Requests with the same fingerprint
+// are, as far as the mirror can tell, the same request.
+func (s RequestSummary) Fingerprint() string {
+	hash := sha256.Sum256([]byte(s.Method + " " + s.Host + s.URI))
+	return hex.EncodeToString(hash[:16])
+}
+
+func summarizeRequest(r *http.Request) RequestSummary {
+	s := RequestSummary{
+		Method: r.Method,
+		Host:   r.Host,
+		URI:    r.RequestURI,
+	}
+	s.ContentType, _, _ = mime.ParseMediaType(r.Header.Get("Content-Type"))
+
+	// traceparent is version-traceid-spanid-flags, like 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01
+	parts := strings.Split(r.Header.Get("traceparent"), "-")
+	if len(parts) == 4 && len(parts[1]) == 32 && len(parts[2]) == 16 {
+		s.TraceID, s.SpanID = parts[1], parts[2]
+	}
+
+	return s
+}
+
+// Report is the outcome of every comparison for a single mirrored request
+type Report struct {
+	// ID identifies the report, so it can be correlated across reporters and logs
+	ID      string
+	Time    time.Time
+	Request RequestSummary
+	Results []Result
+	// Match is true if every comparison which wasn't skipped or advisory matched
+	Match bool
+	// Category is the category of the first classify rule which matched a mismatch, if any did
+	Category string
+	// Excluded is true if the request wasn't compared because its secondary failed, and exclude_secondary_errors is set
+	Excluded bool
+	// Artifacts references where the mismatch's artifacts were written, if artifacts is set: their URL, or the path of
+	// their directory
+	Artifacts string
+
+	// Primary and Secondary are the compared responses. Their bodies are pooled buffers, which are only valid until
+	// Report returns. Reporters which keep a Report around must copy them.
+	Primary, Secondary ResponseArtifact
+
+	// maxDiffBytes bounds the diffs of the report's events and artifacts, if it's set
+	maxDiffBytes int
+}
+
+// Reporter receives a Report for every compared request, matched or not. Reporters are loaded from the
+// mirror.reporters namespace, so reports can be fanned out to any number of destinations.
+//
+// Report is called from a goroutine separate from the request, and must be safe for concurrent use. Reporters which
+// send reports over the network should avoid blocking for long, since the comparison goroutine lives until every
+// reporter returns.
+type Reporter interface {
+	Report(Report)
+}
+
+// LogReporter logs every mismatched comparison result. Unless no_log is set, the handler always reports through a
+// LogReporter using its own logger, at its log_level.
+type LogReporter struct {
+	// Level is the level mismatches are logged at. Defaults to info.
+	Level LogLevel `json:"level,omitempty"`
+	// Levels override Level for the mismatches of particular comparers, by their name
+	Levels map[string]LogLevel `json:"levels,omitempty"`
+	// Matches also logs matched requests, as shadow_match at debug level
+	Matches bool `json:"matches,omitempty"`
+	// HashBodies logs hashes and lengths of mismatched bodies, and how many lines their diff adds and removes, instead
+	// of their content. Values read from bodies, like upload fields, and header values are hashed too.
+	HashBodies bool `json:"hash_bodies,omitempty"`
+	// OmitBodies leaves mismatched bodies out, so JSON mismatches are logged by their diff_paths and json_patch
+	OmitBodies bool `json:"omit_bodies,omitempty"`
+
+	slogger slogger
+}
+
+func (LogReporter) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "mirror.reporters.log",
+		New: func() caddy.Module { return new(LogReporter) },
+	}
+}
+
+// Provision implements caddy.Provisioner
+func (l *LogReporter) Provision(ctx caddy.Context) error {
+	// Declared reporters don't know their handler, so they share the comparisons logger of unnamed handlers
+	l.slogger = namedSlogger(ctx, (&Handler{}).loggerName(comparisonsLogger))
+	return validateLogLevels(l.Level, l.Levels)
+}
+
+// validateLogLevels validates a level, and the levels of particular comparers
+func validateLogLevels(level LogLevel, levels map[string]LogLevel) error {
+	if err := level.validate(); err != nil {
+		return err
+	}
+	for comparer, level := range levels {
+		if err := level.validate(); err != nil {
+			return fmt.Errorf("%s mismatches: %w", comparer, err)
+		}
+	}
+	return nil
+}
+
+func (l *LogReporter) Report(rep Report) {
+	if rep.Primary.Error != "" {
+		l.slogger.Info("shadow_primary_error",
+			slog.String("id", rep.ID),
+			requestAttr(rep.Request),
+			slog.String("error", rep.Primary.Error),
+			slog.Int("primary_status", rep.Primary.Status),
+			slog.Int("shadow_status", rep.Secondary.Status),
+		)
+	}
+	if rep.Excluded {
+		l.slogger.Info("shadow_excluded",
+			slog.String("id", rep.ID),
+			requestAttr(rep.Request),
+			slog.String("error", rep.Secondary.Error),
+			slog.Int("primary_status", rep.Primary.Status),
+			slog.Int("shadow_status", rep.Secondary.Status),
+		)
+		return
+	}
+	if l.Matches && rep.Match {
+		l.logMatch(rep)
+	}
+	for _, res := range rep.Results {
+		if res.Match || res.Skipped {
+			continue
+		}
+		level, ok := l.Levels[res.Comparer]
+		if !ok {
+			level = l.Level
+		}
+		log := level.logFunc(l.slogger)
+
+		attrs := make([]any, 0, len(res.Attrs)+4)
+		attrs = append(attrs, slog.String("id", rep.ID), slog.String("comparer", res.Comparer), requestAttr(rep.Request))
+		if rep.Category != "" {
+			attrs = append(attrs, slog.String("category", rep.Category))
+		}
+		if rep.Artifacts != "" {
+			attrs = append(attrs, slog.String("artifacts", rep.Artifacts))
+		}
+		resAttrs := res.Attrs
+		if l.OmitBodies || rep.Artifacts != "" {
+			// Bodies, and everything else holding their content, are in the artifacts
+			resAttrs = slices.DeleteFunc(slices.Clone(resAttrs), func(attr slog.Attr) bool {
+				switch attr.Key {
+				case "primary_body", "shadow_body":
+					return true
+				case "json_patch", "primary_hex", "shadow_hex":
+					return rep.Artifacts != ""
+				}
+				return false
+			})
+		}
+		if l.HashBodies {
+			resAttrs = hashedAttrs(resAttrs)
+			if res.Comparer == "body" {
+				if added, removed, ok := diffStats(rep.Primary.Body, rep.Secondary.Body); ok {
+					resAttrs = append(resAttrs, slog.Int("lines_added", added), slog.Int("lines_removed", removed))
+				}
+			}
+		}
+		for _, attr := range resAttrs {
+			attrs = append(attrs, attr)
+		}
+		log("shadow_mismatch", attrs...)
+	}
+}
+
+// requestAttr is the request group of mismatch logs
+func requestAttr(req RequestSummary) slog.Attr {
+	attrs := []any{
+		slog.String("method", req.Method),
+		slog.String("host", req.Host),
+		slog.String("uri", req.URI),
+	}
+	if req.Tenant != "" {
+		attrs = append(attrs, slog.String("tenant", req.Tenant))
+	}
+	return slog.Group("request", attrs...)
+}
+
+// hashedAttrs replaces the content of bodies in a comparer's attributes with their SHA-256 and length, and the values of
+// headers and fields with their SHA-256, so content never reaches the logs
+func hashedAttrs(attrs []slog.Attr) []slog.Attr {
+	hashed := make([]slog.Attr, 0, len(attrs))
+	for _, attr := range attrs {
+		v := attr.Value.Resolve()
+		switch {
+		case attr.Key == "primary_body" || attr.Key == "shadow_body":
+			s := v.String()
+			hashed = append(hashed, slog.String(attr.Key+"_sha256", sha256Hex([]byte(s))), slog.Int(attr.Key+"_length", len(s)))
+		case attr.Key == "primary_values" || attr.Key == "shadow_values" ||
+			attr.Key == "added_values" || attr.Key == "removed_values":
+			hashed = append(hashed, slog.String(attr.Key+"_sha256", sha256Hex([]byte(fmt.Sprint(v.Any())))))
+		case attr.Key == "primary_hex" || attr.Key == "shadow_hex":
+			// Previews of binary bodies are content too, and their hashes are already logged
+		case attr.Key == "json_patch":
+			// Operations keep their paths, which come from the bodies' structure, but not their values
+			ops, ok := v.Any().([]compare.PatchOperation)
+			if !ok {
+				// A patch from another comparer may be of any type, so all of it is hashed
+				bs, _ := json.Marshal(v.Any())
+				hashed = append(hashed, slog.String(attr.Key+"_sha256", sha256Hex(bs)))
+				continue
+			}
+			patch := slices.Clone(ops)
+			for i := range patch {
+				patch[i].Value = nil
+			}
+			hashed = append(hashed, slog.Any(attr.Key, patch))
+		case v.Kind() == slog.KindGroup:
+			hashed = append(hashed, slog.Attr{Key: attr.Key, Value: slog.GroupValue(hashedAttrs(v.Group())...)})
+		default:
+			hashed = append(hashed, attr)
+		}
+	}
+	return hashed
+}
+
+func sha256Hex(bs []byte) string {
+	hash := sha256.Sum256(bs)
+	return hex.EncodeToString(hash[:])
+}
+
+// logMatch logs a compact shadow_match for a matched request, with the comparers which weren't skipped. Requests which
+// weren't compared at all aren't logged.
+func (l *LogReporter) logMatch(rep Report) {
+	var compared []string
+	for _, res := range rep.Results {
+		if !res.Skipped {
+			compared = append(compared, res.Comparer)
+		}
+	}
+	if len(compared) == 0 {
+		return
+	}
+	l.slogger.Debug("shadow_match",
+		slog.String("id", rep.ID),
+		slog.String("path", rep.Request.Path()),
+		slog.Int("primary_status", rep.Primary.Status),
+		slog.Int("shadow_status", rep.Secondary.Status),
+		slog.Duration("primary_duration", rep.Primary.Duration),
+		slog.Duration("shadow_duration", rep.Secondary.Duration),
+		slog.Any("compared", compared),
+	)
+}
+
+func (l *LogReporter) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume reporter name
+	if d.NextArg() {
+		l.Level = LogLevel(d.Val())
+	}
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	for d.NextBlock(0) {
+		switch d.Val() {
+		case "matches":
+			l.Matches = true
+		case "hash_bodies":
+			l.HashBodies = true
+		case "omit_bodies":
+			l.OmitBodies = true
+		case "level":
+			var comparer, level string
+			if !d.Args(&comparer, &level) {
+				return d.ArgErr()
+			}
+			if l.Levels == nil {
+				l.Levels = make(map[string]LogLevel)
+			}
+			l.Levels[comparer] = LogLevel(level)
+		default:
+			return d.Errf("unrecognized log reporter option '%s'", d.Val())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,250 @@
+package mirror
+
+import (
+	"bytes"
+	"cmp"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestRequestSummary_Fingerprint(t *testing.T) {
+	a := RequestSummary{Method: "GET", Host: "example.com", URI: "/a?b=c"}
+	if a.Fingerprint() != a.Fingerprint() {
+		t.Errorf("expected fingerprint to be stable")
+	}
+	if a.Path() != "/a" {
+		t.Errorf("Path() = %q, want %q", a.Path(), "/a")
+	}
+
+	b := a
+	b.Method = "POST"
+	if a.Fingerprint() == b.Fingerprint() {
+		t.Errorf("expected different methods to have different fingerprints")
+	}
+}
+
+func Test_summarizeRequest(t *testing.T) {
+	r := httptest.NewRequest("GET", "/a?b=c", nil)
+	r.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+
+	s := summarizeRequest(r)
+	if s.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || s.SpanID != "00f067aa0ba902b7" {
+		t.Errorf("unexpected trace context: %+v", s)
+	}
+
+	r.Header.Set("traceparent", "garbage")
+	if s = summarizeRequest(r); s.TraceID != "" || s.SpanID != "" {
+		t.Errorf("expected no trace context, got %+v", s)
+	}
+}
+
+func TestLogReporter_ReportLevel(t *testing.T) {
+	rep := Report{Results: []Result{{Comparer: "status"}, {Comparer: "body", Match: true}}}
+	for _, level := range []LogLevel{"", logLevelDebug, logLevelInfo, logLevelWarn, logLevelError} {
+		t.Run(string(level), func(t *testing.T) {
+			logged := make(map[string][]string)
+			logAt := func(name string) func(string, ...any) {
+				return func(msg string, in ...any) {
+					for _, attr := range in {
+						if a, ok := attr.(slog.Attr); ok && a.Key == "comparer" {
+							msg += " " + a.Value.String()
+						}
+					}
+					logged[name] = append(logged[name], msg)
+				}
+			}
+			l := &LogReporter{Level: level, slogger: &sloggerMock{
+				err: logAt("error"), warn: logAt("warn"), info: logAt("info"), debug: logAt("debug"),
+			}}
+			l.Report(rep)
+
+			want := cmp.Or(string(level), "info")
+			if len(logged) != 1 || len(logged[want]) != 1 || logged[want][0] != "shadow_mismatch status" {
+				t.Errorf("logged %v, want shadow_mismatch of status at %s", logged, want)
+			}
+		})
+	}
+
+	if err := LogLevel("verbose").validate(); err == nil {
+		t.Errorf("validate() accepted an unrecognized level")
+	}
+}
+
+func TestLogReporter_ReportMatches(t *testing.T) {
+	tests := []struct {
+		name    string
+		results []Result
+		want    []string
+	}{
+		{"compared", []Result{{Comparer: "status", Match: true}, {Comparer: "body", Skipped: true}}, []string{"shadow_match"}},
+		{"all skipped", []Result{{Comparer: "body", Skipped: true}}, nil},
+		{"mismatch", []Result{{Comparer: "status"}}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var logged []string
+			var compared any
+			l := &LogReporter{Matches: true, slogger: &sloggerMock{debug: func(msg string, in ...any) {
+				logged = append(logged, msg)
+				for _, attr := range in {
+					if a := attr.(slog.Attr); a.Key == "compared" {
+						compared = a.Value.Any()
+					}
+				}
+			}}}
+			rep := Report{Request: RequestSummary{URI: "/orders?page=2"}, Results: tt.results, Match: true}
+			for _, res := range tt.results {
+				rep.Match = rep.Match && (res.Match || res.Skipped)
+			}
+			l.Report(rep)
+
+			if !slices.Equal(logged, tt.want) {
+				t.Errorf("logged %v, want %v", logged, tt.want)
+			}
+			if tt.want != nil && !slices.Equal(compared.([]string), []string{"status"}) {
+				t.Errorf("compared = %v, want [status]", compared)
+			}
+		})
+	}
+}
+
+func TestLogReporter_ReportLevels(t *testing.T) {
+	rep := Report{Results: []Result{{Comparer: "status"}, {Comparer: "header"}, {Comparer: "body"}}}
+	logged := make(map[string][]string)
+	logAt := func(name string) func(string, ...any) {
+		return func(msg string, _ ...any) { logged[name] = append(logged[name], msg) }
+	}
+	l := &LogReporter{
+		Level:   logLevelInfo,
+		Levels:  map[string]LogLevel{"header": logLevelWarn, "body": logLevelOff},
+		slogger: &sloggerMock{err: logAt("error"), warn: logAt("warn"), info: logAt("info"), debug: logAt("debug")},
+	}
+	l.Report(rep)
+
+	want := map[string][]string{"info": {"shadow_mismatch"}, "warn": {"shadow_mismatch"}}
+	if len(logged) != len(want) || !slices.Equal(logged["info"], want["info"]) || !slices.Equal(logged["warn"], want["warn"]) {
+		t.Errorf("logged %v, want %v", logged, want)
+	}
+
+	if err := validateLogLevels(logLevelInfo, map[string]LogLevel{"body": "quiet"}); err == nil {
+		t.Errorf("validateLogLevels() accepted an unrecognized level")
+	}
+}
+
+func TestLogReporter_ReportHashBodies(t *testing.T) {
+	primary := ResponseArtifact{Body: []byte(`{"name":"Ada","card":"4111"}`), Buffered: true}
+	secondary := ResponseArtifact{Body: []byte(`{"name":"Ada","card":"4242"}`), Buffered: true}
+	rep := Report{
+		Primary:   primary,
+		Secondary: secondary,
+		Results: []Result{
+			(&BodyComparer{}).Compare(primary, secondary),
+			HeaderComparer{Headers: []string{"X-Session"}}.Compare(
+				ResponseArtifact{Header: http.Header{"X-Session": {"secret-a"}}},
+				ResponseArtifact{Header: http.Header{"X-Session": {"secret-b"}}},
+			),
+		},
+	}
+	buf := new(bytes.Buffer)
+	l := &LogReporter{HashBodies: true, slogger: slog.New(slog.NewJSONHandler(buf, nil))}
+	l.Report(rep)
+
+	out := buf.String()
+	for _, content := range []string{"4111", "4242", "secret-a", "secret-b"} {
+		if strings.Contains(out, content) {
+			t.Errorf("logged %q:\n%s", content, out)
+		}
+	}
+	bodyHash := sha256.Sum256(primary.Body)
+	for _, want := range []string{
+		`"primary_body_sha256":"` + hex.EncodeToString(bodyHash[:]) + `"`,
+		`"shadow_body_length":28`,
+		`"lines_added":1`,
+		`"lines_removed":1`,
+		`"primary_values_sha256":`,
+		`"json_patch":[{"op":"replace","path":"/card"}]`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("didn't log %s:\n%s", want, out)
+		}
+	}
+}
+
+func Test_hashedAttrs_foreignPatch(t *testing.T) {
+	// An arbiter or custom comparer may report a json_patch of its own type
+	patch := []map[string]any{{"op": "replace", "path": "/card", "value": "4242"}}
+	hashed := attrsToMap(hashedAttrs([]slog.Attr{slog.Any("json_patch", patch)}))
+
+	bs, _ := json.Marshal(patch)
+	if _, ok := hashed["json_patch"]; ok || hashed["json_patch_sha256"] != sha256Hex(bs) {
+		t.Errorf("hashedAttrs() = %v, want json_patch hashed", hashed)
+	}
+}
+
+func TestLogReporter_ReportOmitBodies(t *testing.T) {
+	primary := ResponseArtifact{Body: []byte(`{"items":[{"price":5}],"total":5}`), Buffered: true}
+	secondary := ResponseArtifact{Body: []byte(`{"items":[{"price":6}],"total":6}`), Buffered: true}
+	rep := Report{Primary: primary, Secondary: secondary, Results: []Result{(&BodyComparer{}).Compare(primary, secondary)}}
+	buf := new(bytes.Buffer)
+	l := &LogReporter{OmitBodies: true, slogger: slog.New(slog.NewJSONHandler(buf, nil))}
+	l.Report(rep)
+
+	out := buf.String()
+	if strings.Contains(out, `"primary_body":`) || strings.Contains(out, `"shadow_body":`) {
+		t.Errorf("logged bodies:\n%s", out)
+	}
+	if want := `"diff_paths":["/items/0/price","/total"]`; !strings.Contains(out, want) {
+		t.Errorf("didn't log %s:\n%s", want, out)
+	}
+}
+
+func TestLogReporter_ReportArtifacts(t *testing.T) {
+	primary := ResponseArtifact{Body: []byte(`{"total":5}`), Buffered: true}
+	secondary := ResponseArtifact{Body: []byte(`{"total":6}`), Buffered: true}
+	rep := Report{
+		Primary:   primary,
+		Secondary: secondary,
+		Results:   []Result{(&BodyComparer{}).Compare(primary, secondary)},
+		Artifacts: "/var/lib/mirror/2024/01/02/15/150405.000000000-1a2b3c4d",
+	}
+	buf := new(bytes.Buffer)
+	l := &LogReporter{slogger: slog.New(slog.NewJSONHandler(buf, nil))}
+	l.Report(rep)
+
+	out := buf.String()
+	for _, content := range []string{`"primary_body":`, `"shadow_body":`, `"json_patch":`} {
+		if strings.Contains(out, content) {
+			t.Errorf("logged %s with artifacts:\n%s", content, out)
+		}
+	}
+	for _, want := range []string{`"artifacts":"` + rep.Artifacts + `"`, `"diff_paths":["/total"]`} {
+		if !strings.Contains(out, want) {
+			t.Errorf("didn't log %s:\n%s", want, out)
+		}
+	}
+}
+
+func TestHandler_loggerName(t *testing.T) {
+	tests := []struct {
+		h    Handler
+		sub  string
+		want string
+	}{
+		{Handler{}, "", "http.handlers.mirror"},
+		{Handler{}, comparisonsLogger, "http.handlers.mirror.comparisons"},
+		{Handler{Name: "checkout"}, comparisonsLogger, "http.handlers.mirror.checkout.comparisons"},
+		{Handler{MetricsName: "users"}, "", "http.handlers.mirror.users"},
+	}
+	for _, tt := range tests {
+		if got := tt.h.loggerName(tt.sub); got != tt.want {
+			t.Errorf("loggerName(%q) = %q, want %q", tt.sub, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package mirror
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+var _ caddyfile.Unmarshaler = (*RetryPolicy)(nil)
+
+// RetryPolicy retries failed secondary requests, so transient failures in the shadow environment don't get in the way of
+// comparisons. The primary is never retried.
+type RetryPolicy struct {
+	// Retries is how many times a request may be retried. Defaults to 2.
+	Retries int `json:"retries,omitempty"`
+	// Backoff is how long to wait before the first retry, doubling for each one after. Defaults to 100ms.
+	Backoff caddy.Duration `json:"backoff,omitempty"`
+	// RetryOn are the failures which are retried: error classes (timeout, connection, handler, or panic), statuses like
+	// 503, or status classes like 5xx. Defaults to connection, 502, 503, and 504.
+	RetryOn []string `json:"retry_on,omitempty"`
+}
+
+func (p *RetryPolicy) provision() {
+	if p.Retries == 0 {
+		p.Retries = 2
+	}
+	if p.Backoff == 0 {
+		p.Backoff = caddy.Duration(100 * time.Millisecond)
+	}
+	if len(p.RetryOn) == 0 {
+		p.RetryOn = []string{errorConnection, "502", "503", "504"}
+	}
+}
+
+// retryable reports whether an attempt which ended with this status and error should be retried
+func (p *RetryPolicy) retryable(status int, err error) bool {
+	if err != nil {
+		if slices.Contains(p.RetryOn, classifyError(err)) {
+			return true
+		}
+		var he caddyhttp.HandlerError
+		if !errors.As(err, &he) {
+			return false
+		}
+		status = he.StatusCode
+	}
+	if status < 100 {
+		return false
+	}
+	return slices.Contains(p.RetryOn, strconv.Itoa(status)) || slices.Contains(p.RetryOn, strconv.Itoa(status/100)+"xx")
+}
+
+func (p *RetryPolicy) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume "secondary_retry"
+	if d.NextArg() {
+		retries, err := strconv.Atoi(d.Val())
+		if err != nil {
+			return d.Errf("error parsing retries: %v", err)
+		}
+		p.Retries = retries
+	}
+	for d.NextBlock(0) {
+		opt := d.Val()
+		args := d.RemainingArgs()
+		if len(args) < 1 {
+			return d.ArgErr()
+		}
+		switch opt {
+		case "retries":
+			retries, err := strconv.Atoi(args[0])
+			if err != nil {
+				return d.Errf("error parsing retries: %v", err)
+			}
+			p.Retries = retries
+		case "backoff":
+			dur, err := caddy.ParseDuration(args[0])
+			if err != nil {
+				return d.Errf("error parsing backoff: %v", err)
+			}
+			p.Backoff = caddy.Duration(dur)
+		case "retry_on":
+			p.RetryOn = append(p.RetryOn, args...)
+		default:
+			return d.Errf("unrecognized secondary_retry option '%s'", opt)
+		}
+	}
+	return nil
+}
+
+// retryHandler runs a handler until it succeeds, or fails in a way which isn't retryable, or runs out of retries. Each
+// attempt's response is buffered, and only the last is written through.
+type retryHandler struct {
+	caddyhttp.MiddlewareHandler
+
+	policy *RetryPolicy
+	// onRetry is called before each retry
+	onRetry func()
+}
+
+func (rh retryHandler) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	// The body has to be sent again for each attempt
+	var body []byte
+	if r.Body != nil && r.Body != http.NoBody {
+		var err error
+		body, err = io.ReadAll(r.Body)
+		if err != nil {
+			return fmt.Errorf("error reading body: %w", err)
+		}
+	}
+
+	buf := getBuf()
+	defer putBuf(buf)
+	backoff := time.Duration(rh.policy.Backoff)
+	for attempt := 0; ; attempt++ {
+		ar := cloneAttempt(r)
+		if body != nil {
+			ar.Body = io.NopCloser(bytes.NewReader(body))
+		}
+		buf.Reset()
+		rec := caddyhttp.NewResponseRecorder(&NopResponseWriter{}, buf, func(int, http.Header) bool { return true })
+		err := rh.MiddlewareHandler.ServeHTTP(rec, ar, next)
+
+		if attempt == rh.policy.Retries || !rh.policy.retryable(rec.Status(), err) {
+			return replay(w, rec, err)
+		}
+
+		rh.onRetry()
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-r.Context().Done():
+			timer.Stop()
+			return replay(w, rec, err)
+		}
+		backoff *= 2
+	}
+}
+
+// cloneAttempt clones a request for one attempt. Handlers like rewrite and uri change the request's URL, headers, and
+// vars in place, so each attempt starts from the request as it was before the first, rather than applying them again.
+// The replacer is shared, so values the last attempt sets, like the upstream it was proxied to, are still logged.
+func cloneAttempt(r *http.Request) *http.Request {
+	ctx := r.Context()
+	if vars, ok := ctx.Value(caddyhttp.VarsCtxKey).(map[string]any); ok {
+		ctx = context.WithValue(ctx, caddyhttp.VarsCtxKey, deepCopyVars(vars))
+	}
+	return r.Clone(ctx)
+}
+
+// replay writes a recorded response through to w, and passes on its error
+func replay(w http.ResponseWriter, rec caddyhttp.ResponseRecorder, err error) error {
+	if rec.Status() != 0 {
+		for name, values := range rec.Header() {
+			w.Header()[name] = values
+		}
+		w.WriteHeader(rec.Status())
+		_, _ = w.Write(rec.Buffer().Bytes())
+	}
+	return err
+}
@@ -0,0 +1,130 @@
+package mirror
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func TestRetryPolicy_retryable(t *testing.T) {
+	p := &RetryPolicy{}
+	p.provision()
+
+	tests := []struct {
+		status int
+		err    error
+		want   bool
+	}{
+		{200, nil, false},
+		{500, nil, false},
+		{503, nil, true},
+		{0, caddyhttp.Error(http.StatusBadGateway, errors.New("dial tcp: connection refused")), true},
+		{0, errors.New("oops"), false},
+	}
+	for _, tt := range tests {
+		if got := p.retryable(tt.status, tt.err); got != tt.want {
+			t.Errorf("retryable(%d, %v) = %v, want %v", tt.status, tt.err, got, tt.want)
+		}
+	}
+
+	p.RetryOn = []string{"5xx"}
+	if !p.retryable(500, nil) {
+		t.Errorf("retryable(500) with 5xx = false, want true")
+	}
+}
+
+func Test_retryHandler(t *testing.T) {
+	tests := []struct {
+		name         string
+		statuses     []int
+		wantAttempts int
+		wantStatus   int
+	}{
+		{"succeeds", []int{200}, 1, 200},
+		{"succeeds after a retry", []int{503, 200}, 2, 200},
+		{"runs out of retries", []int{503, 503, 503, 503}, 3, 503},
+		{"not retryable", []int{500, 200}, 1, 500},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var attempts, retries int
+			inner := middlewareHandlerFunc(func(w http.ResponseWriter, r *http.Request, _ caddyhttp.Handler) error {
+				body, _ := io.ReadAll(r.Body)
+				if string(body) != "payload" {
+					t.Errorf("attempt %d body = %q, want payload", attempts, body)
+				}
+				w.WriteHeader(tt.statuses[attempts])
+				_, _ = w.Write([]byte("attempt " + string(rune('1'+attempts))))
+				attempts++
+				return nil
+			})
+			rh := retryHandler{
+				MiddlewareHandler: inner,
+				policy:            &RetryPolicy{Retries: 2, Backoff: caddy.Duration(time.Millisecond)},
+				onRetry:           func() { retries++ },
+			}
+			rh.policy.provision()
+
+			w := httptest.NewRecorder()
+			err := rh.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/", strings.NewReader("payload")), nil)
+			if err != nil {
+				t.Fatalf("ServeHTTP() error = %v", err)
+			}
+			if attempts != tt.wantAttempts || retries != tt.wantAttempts-1 {
+				t.Errorf("attempts = %d, retries = %d, want %d attempts", attempts, retries, tt.wantAttempts)
+			}
+			if w.Code != tt.wantStatus || w.Body.String() != "attempt "+string(rune('0'+attempts)) {
+				t.Errorf("response = %d %s, want %d from the last attempt", w.Code, w.Body, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func Test_retryHandler_rewrite(t *testing.T) {
+	var paths []string
+	var attempts int
+	// Like a secondary route with rewrite * /api{uri}, which changes the request in place
+	inner := middlewareHandlerFunc(func(w http.ResponseWriter, r *http.Request, _ caddyhttp.Handler) error {
+		if caddyhttp.GetVar(r.Context(), "rewritten") != nil {
+			t.Errorf("attempt %d sees the vars of the one before it", attempts)
+		}
+		r.URL.Path = "/api" + r.URL.Path
+		r.Header.Set("X-Attempt", "rewritten"+r.Header.Get("X-Attempt"))
+		caddyhttp.SetVar(r.Context(), "rewritten", true)
+		paths = append(paths, r.URL.Path+" "+r.Header.Get("X-Attempt"))
+
+		attempts++
+		if attempts < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		return nil
+	})
+	rh := retryHandler{
+		MiddlewareHandler: inner,
+		policy:            &RetryPolicy{Retries: 2, Backoff: caddy.Duration(time.Millisecond)},
+		onRetry:           func() {},
+	}
+	rh.policy.provision()
+
+	r := httptest.NewRequest(http.MethodGet, "/users", nil)
+	r = r.WithContext(context.WithValue(r.Context(), caddyhttp.VarsCtxKey, make(map[string]any)))
+	if err := rh.ServeHTTP(httptest.NewRecorder(), r, nil); err != nil {
+		t.Fatalf("ServeHTTP() error = %v", err)
+	}
+	want := []string{"/api/users rewritten", "/api/users rewritten", "/api/users rewritten"}
+	if !slices.Equal(paths, want) {
+		t.Errorf("attempts saw %v, want %v", paths, want)
+	}
+	if r.URL.Path != "/users" {
+		t.Errorf("request path = %s after retries, want it unchanged", r.URL.Path)
+	}
+}
@@ -0,0 +1,409 @@
+package mirror
+
+import (
+	"bytes"
+	"context"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+var (
+	_ Reporter              = (*S3Reporter)(nil)
+	_ caddy.Provisioner     = (*S3Reporter)(nil)
+	_ caddy.CleanerUpper    = (*S3Reporter)(nil)
+	_ caddyfile.Unmarshaler = (*S3Reporter)(nil)
+)
+
+func init() {
+	caddy.RegisterModule(S3Reporter{})
+}
+
+const (
+	s3Workers   = 4
+	s3QueueSize = 64
+)
+
+// S3Reporter uploads the artifacts of every mismatch to an S3-compatible bucket. Each mismatch is uploaded to its own
+// directory, named <prefix><yyyy>/<mm>/<dd>/<hh>/<time>-<random>/, holding the report, both bodies, and a diff.
+//
+// Uploads happen in the background. If uploads fall behind, new mismatches are dropped rather than queued without
+// bound.
+type S3Reporter struct {
+	// Bucket is the name of the bucket mismatches are uploaded to
+	Bucket string `json:"bucket"`
+	// Region of the bucket. Defaults to us-east-1.
+	Region string `json:"region,omitempty"`
+	// Endpoint is the base URL of the S3-compatible service. Defaults to AWS S3 in Region.
+	Endpoint string `json:"endpoint,omitempty"`
+	// PathStyle addresses the bucket in the URL path instead of the host name. Most self-hosted services need this.
+	PathStyle bool `json:"path_style,omitempty"`
+	// Prefix is prepended to every object key. Defaults to "mirror/".
+	Prefix string `json:"prefix,omitempty"`
+	// Compression of uploaded files. One of "gzip" (default), "zstd", or "none".
+	Compression string `json:"compression,omitempty"`
+	// EncryptionKey, if set, encrypts uploaded files with AES-256-GCM, after they're compressed. It's 32 bytes, hex or
+	// base64 encoded, and may contain global placeholders like {file./run/secrets/artifacts_key}.
+	EncryptionKey string `json:"encryption_key,omitempty"`
+
+	// Credentials default to the AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY, and AWS_SESSION_TOKEN environment variables.
+	// Values may contain global placeholders like {file./run/secrets/s3_secret}.
+	AccessKeyID     string `json:"access_key_id,omitempty"`
+	SecretAccessKey string `json:"secret_access_key,omitempty"`
+	SessionToken    string `json:"session_token,omitempty"`
+
+	client  *s3Client
+	zstd    *zstd.Encoder
+	aead    cipher.AEAD
+	queue   chan []artifactUpload
+	done    chan struct{}
+	wg      *sync.WaitGroup
+	ctx     context.Context
+	cancel  context.CancelFunc
+	slogger slogger
+}
+
+type artifactUpload struct {
+	dir string
+	artifactFile
+}
+
+func (S3Reporter) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "mirror.reporters.s3",
+		New: func() caddy.Module { return new(S3Reporter) },
+	}
+}
+
+// Provision implements caddy.Provisioner
+func (s *S3Reporter) Provision(ctx caddy.Context) (err error) {
+	if s.Bucket == "" {
+		return fmt.Errorf("s3 reporter requires a bucket")
+	}
+	if s.Region == "" {
+		s.Region = "us-east-1"
+	}
+	if s.Endpoint == "" {
+		s.Endpoint = "https://s3." + s.Region + ".amazonaws.com"
+	}
+	if s.Prefix == "" {
+		s.Prefix = "mirror/"
+	}
+
+	switch s.Compression {
+	case "":
+		s.Compression = "gzip"
+	case "gzip", "none":
+	case "zstd":
+		s.zstd, err = zstd.NewWriter(nil)
+		if err != nil {
+			return fmt.Errorf("error creating zstd encoder: %w", err)
+		}
+	default:
+		return fmt.Errorf("unrecognized s3 compression '%s'", s.Compression)
+	}
+
+	if s.EncryptionKey != "" {
+		s.aead, err = newArtifactCipher(s.EncryptionKey)
+		if err != nil {
+			return fmt.Errorf("error parsing s3 encryption_key: %w", err)
+		}
+	}
+
+	endpoint, err := url.Parse(s.Endpoint)
+	if err != nil {
+		return fmt.Errorf("error parsing s3 endpoint: %w", err)
+	}
+
+	repl := caddy.NewReplacer()
+	credential := func(v, env string) string {
+		if v == "" {
+			return os.Getenv(env)
+		}
+		return repl.ReplaceKnown(v, "")
+	}
+	s.client = &s3Client{
+		endpoint:     endpoint,
+		bucket:       s.Bucket,
+		region:       s.Region,
+		pathStyle:    s.PathStyle,
+		accessKeyID:  credential(s.AccessKeyID, "AWS_ACCESS_KEY_ID"),
+		secretKey:    credential(s.SecretAccessKey, "AWS_SECRET_ACCESS_KEY"),
+		sessionToken: credential(s.SessionToken, "AWS_SESSION_TOKEN"),
+		http:         &http.Client{Timeout: 30 * time.Second},
+	}
+	if s.client.accessKeyID == "" || s.client.secretKey == "" {
+		return fmt.Errorf("s3 reporter requires credentials")
+	}
+
+	s.slogger = ctx.Slogger()
+	s.start()
+	return nil
+}
+
+// start starts the upload workers
+func (s *S3Reporter) start() {
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	s.queue = make(chan []artifactUpload, s3QueueSize)
+	s.done = make(chan struct{})
+	s.wg = new(sync.WaitGroup)
+	for range s3Workers {
+		s.wg.Add(1)
+		go s.work()
+	}
+}
+
+// Cleanup implements caddy.CleanerUpper. Queued uploads are given a few seconds to finish. The queue is never closed,
+// since comparisons still running after a config reload may report to it; mismatches reported after Cleanup are dropped.
+func (s *S3Reporter) Cleanup() error {
+	// Cleanup is called even if Provision failed, before the workers were started
+	if s.done == nil {
+		return nil
+	}
+	close(s.done)
+
+	stopped := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(10 * time.Second):
+	}
+	s.cancel()
+	return nil
+}
+
+func (s *S3Reporter) Report(rep Report) {
+	if rep.Match {
+		return
+	}
+
+	dir := s.Prefix + artifactDir(rep) + "/"
+	files := mismatchArtifacts(rep)
+	uploads := make([]artifactUpload, len(files))
+	for i, f := range files {
+		uploads[i] = artifactUpload{dir: dir, artifactFile: f}
+	}
+
+	select {
+	case <-s.done:
+		s.slogger.Error("s3_reporter_dropped", slog.String("key", dir))
+		return
+	default:
+	}
+	select {
+	case s.queue <- uploads:
+	default:
+		s.slogger.Error("s3_reporter_dropped", slog.String("key", dir))
+	}
+}
+
+func (s *S3Reporter) work() {
+	defer s.wg.Done()
+	for {
+		select {
+		case uploads := <-s.queue:
+			s.uploadAll(uploads)
+		case <-s.done:
+			// Finish what's already queued, then stop
+			for {
+				select {
+				case uploads := <-s.queue:
+					s.uploadAll(uploads)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// uploadAll uploads the artifacts of one mismatch, stopping at the first error
+func (s *S3Reporter) uploadAll(uploads []artifactUpload) {
+	for _, u := range uploads {
+		err := s.upload(u)
+		if err != nil {
+			s.slogger.Error("s3_reporter_error", slog.String("key", u.dir+u.Name), slog.String("error", err.Error()))
+			return
+		}
+	}
+}
+
+func (s *S3Reporter) upload(u artifactUpload) error {
+	f := encryptArtifact(compressArtifact(u.artifactFile, s.Compression, s.zstd), s.aead)
+	return s.client.put(s.ctx, u.dir+f.Name, f.ContentType, f.Data)
+}
+
+func (s *S3Reporter) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume reporter name
+	if d.NextArg() {
+		s.Bucket = d.Val()
+	}
+	for d.NextBlock(0) {
+		opt := d.Val()
+		if opt == "path_style" {
+			s.PathStyle = true
+			continue
+		}
+
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		switch opt {
+		case "bucket":
+			s.Bucket = d.Val()
+		case "region":
+			s.Region = d.Val()
+		case "endpoint":
+			s.Endpoint = d.Val()
+		case "prefix":
+			s.Prefix = d.Val()
+		case "compression":
+			s.Compression = d.Val()
+		case "encryption_key":
+			s.EncryptionKey = d.Val()
+		case "access_key_id":
+			s.AccessKeyID = d.Val()
+		case "secret_access_key":
+			s.SecretAccessKey = d.Val()
+		case "session_token":
+			s.SessionToken = d.Val()
+		default:
+			return d.Errf("unrecognized s3 reporter option '%s'", opt)
+		}
+	}
+	return nil
+}
+
+// s3Client puts objects into a bucket, signing requests with AWS Signature Version 4
+type s3Client struct {
+	endpoint     *url.URL
+	bucket       string
+	region       string
+	pathStyle    bool
+	accessKeyID  string
+	secretKey    string
+	sessionToken string
+	http         *http.Client
+}
+
+func (c *s3Client) put(ctx context.Context, key, contentType string, body []byte) error {
+	u := *c.endpoint
+	if c.pathStyle {
+		key = c.bucket + "/" + key
+	} else {
+		u.Host = c.bucket + "." + u.Host
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + key
+	u.RawPath = s3EscapePath(u.Path)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	if c.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", c.sessionToken)
+	}
+	c.sign(req, body, time.Now())
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("s3 responded with status %d: %s", resp.StatusCode, msg)
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	return nil
+}
+
+// sign adds a Signature Version 4 Authorization header to the request, signing every header already set
+func (c *s3Client) sign(req *http.Request, body []byte, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	payloadHash := sha256.Sum256(body)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+	req.Header.Set("X-Amz-Date", amzDate)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	slices.Sort(names)
+
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s3EscapePath(req.URL.Path),
+		req.URL.Query().Encode(),
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+
+	scope := date + "/" + c.region + "/s3/aws4_request"
+	canonicalHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+c.secretKey), date)
+	key = hmacSHA256(key, c.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+c.accessKeyID+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+// s3EscapePath percent-encodes everything in a path except unreserved characters and slashes, as SigV4 requires
+func s3EscapePath(p string) string {
+	var sb strings.Builder
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("-._~/", c) >= 0 {
+			sb.WriteByte(c)
+		} else {
+			_, _ = fmt.Fprintf(&sb, "%%%02X", c)
+		}
+	}
+	return sb.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
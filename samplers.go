@@ -0,0 +1,483 @@
+package mirror
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"hash/fnv"
+	"maps"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+
+	"golang.org/x/time/rate"
+)
+
+var (
+	_ Sampler               = (*RandomSampler)(nil)
+	_ Sampler               = (*HashSampler)(nil)
+	_ Sampler               = (*RateLimitSampler)(nil)
+	_ Sampler               = (*PathSampler)(nil)
+	_ Sampler               = (*ExpressionSampler)(nil)
+	_ Sampler               = (*HeaderSampler)(nil)
+	_ caddy.Provisioner     = (*RandomSampler)(nil)
+	_ caddy.Provisioner     = (*HashSampler)(nil)
+	_ caddy.Provisioner     = (*RateLimitSampler)(nil)
+	_ caddy.Provisioner     = (*PathSampler)(nil)
+	_ caddy.Provisioner     = (*ExpressionSampler)(nil)
+	_ caddy.Provisioner     = (*HeaderSampler)(nil)
+	_ caddyfile.Unmarshaler = (*RandomSampler)(nil)
+	_ caddyfile.Unmarshaler = (*HashSampler)(nil)
+	_ caddyfile.Unmarshaler = (*RateLimitSampler)(nil)
+	_ caddyfile.Unmarshaler = (*PathSampler)(nil)
+	_ caddyfile.Unmarshaler = (*ExpressionSampler)(nil)
+	_ caddyfile.Unmarshaler = (*HeaderSampler)(nil)
+)
+
+func init() {
+	caddy.RegisterModule(RandomSampler{})
+	caddy.RegisterModule(HashSampler{})
+	caddy.RegisterModule(RateLimitSampler{})
+	caddy.RegisterModule(PathSampler{})
+	caddy.RegisterModule(ExpressionSampler{})
+	caddy.RegisterModule(HeaderSampler{})
+}
+
+// Sampler decides whether a request should be mirrored. Samplers are loaded from the mirror.samplers namespace, so new
+// sampling strategies can be added as Caddy plugins.
+//
+// Sample is called on the request's own goroutine before anything is mirrored, so it should be fast and must be safe
+// for concurrent use. Random decisions should be drawn with SamplingRand, so they're reproducible with sampling_seed.
+type Sampler interface {
+	Sample(r *http.Request) bool
+}
+
+type samplingDrawCtxKey struct{}
+
+// SamplingRand returns a value in the range [0.0, 1.0) for a random sampling decision about r. Normally it's random, but
+// with the handler's sampling_seed, it's a hash of the seed, the request's sampling key, and salt, so the same request
+// gets the same decision in every test run and on every replica. salt tells apart the decisions made about the same
+// request, like the name of the sampler.
+func SamplingRand(r *http.Request, salt string) float64 {
+	if draw, ok := r.Context().Value(samplingDrawCtxKey{}).(func(string) float64); ok {
+		return draw(salt)
+	}
+	return rand.Float64()
+}
+
+// defaultSamplingKey identifies a request for seeded sampling decisions, unless sampling_key is set
+const defaultSamplingKey = "{http.request.method} {http.request.host}{http.request.uri}"
+
+// seededDraw draws sampling decisions from a hash of the seed, the request's key, and the decision's salt
+func seededDraw(seed uint64, key string) func(r *http.Request, salt string) float64 {
+	prefix := strconv.FormatUint(seed, 10) + "\x00"
+	return func(r *http.Request, salt string) float64 {
+		return hashFraction(prefix + salt + "\x00" + replacer(r).ReplaceAll(key, ""))
+	}
+}
+
+// withSamplingDraw returns r with draw in its context, for SamplingRand
+func withSamplingDraw(r *http.Request, draw func(r *http.Request, salt string) float64) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), samplingDrawCtxKey{}, func(salt string) float64 {
+		return draw(r, salt)
+	}))
+}
+
+// sampleRate is the behavior of mirror_rate, where rate is on a 0.0 to 1.0 scale, and u is a draw from SamplingRand.
+// Zero is treated as unset, and mirrors everything.
+func sampleRate(rate, u float64) bool {
+	switch rate {
+	case 1:
+		return true
+	case 0:
+		return true
+	case -1:
+		return false
+	default:
+		return u < rate
+	}
+}
+
+// parseRate parses a percentage like "50" or "50%"
+func parseRate(s string) (float64, error) {
+	return strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
+}
+
+// RandomSampler mirrors a random percentage of requests. This is the same behavior as mirror_rate.
+type RandomSampler struct {
+	// Rate is the percentage of requests to mirror, from 0 to 100
+	Rate float64 `json:"rate"`
+}
+
+func (RandomSampler) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "mirror.samplers.random",
+		New: func() caddy.Module { return new(RandomSampler) },
+	}
+}
+
+// Provision implements caddy.Provisioner
+func (s *RandomSampler) Provision(_ caddy.Context) error {
+	s.Rate = s.Rate / 100
+	return nil
+}
+
+func (s *RandomSampler) Sample(r *http.Request) bool {
+	return SamplingRand(r, "random") < s.Rate
+}
+
+func (s *RandomSampler) UnmarshalCaddyfile(d *caddyfile.Dispenser) (err error) {
+	d.Next() // consume sampler name
+	if !d.NextArg() {
+		return d.ArgErr()
+	}
+	s.Rate, err = parseRate(d.Val())
+	if err != nil {
+		return d.Errf("error parsing rate: %v", err)
+	}
+	return nil
+}
+
+// HashSampler mirrors a percentage of requests chosen by hashing a key, so the same key is always either mirrored or
+// not. This is useful for keeping whole user sessions on one side of the sample.
+type HashSampler struct {
+	// Rate is the percentage of keys to mirror, from 0 to 100
+	Rate float64 `json:"rate"`
+	// Key is a placeholder-enabled string which is hashed to make the sampling decision. Defaults to the client IP.
+	Key string `json:"key,omitempty"`
+}
+
+func (HashSampler) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "mirror.samplers.hash",
+		New: func() caddy.Module { return new(HashSampler) },
+	}
+}
+
+// Provision implements caddy.Provisioner
+func (s *HashSampler) Provision(_ caddy.Context) error {
+	s.Rate = s.Rate / 100
+	if s.Key == "" {
+		s.Key = "{http.request.remote.host}"
+	}
+	return nil
+}
+
+func (s *HashSampler) Sample(r *http.Request) bool {
+	key := s.Key
+	if repl, ok := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer); ok {
+		key = repl.ReplaceAll(key, "")
+	}
+
+	return hashFraction(key) < s.Rate
+}
+
+// hashFraction maps a key to a stable, uniformly distributed value in the range [0.0, 1.0)
+func hashFraction(key string) float64 {
+	hash := fnv.New64a()
+	_, _ = hash.Write([]byte(key))
+
+	// FNV alone distributes short, similar keys poorly in the high bits, so finish with the splitmix64 mixer
+	x := hash.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+
+	return float64(x>>11) / (1 << 53)
+}
+
+func (s *HashSampler) UnmarshalCaddyfile(d *caddyfile.Dispenser) (err error) {
+	d.Next() // consume sampler name
+	args := d.RemainingArgs()
+	if len(args) < 1 || len(args) > 2 {
+		return d.Err("hash sampler requires a rate and an optional key")
+	}
+	s.Rate, err = parseRate(args[0])
+	if err != nil {
+		return d.Errf("error parsing rate: %v", err)
+	}
+	if len(args) == 2 {
+		s.Key = args[1]
+	}
+	return nil
+}
+
+// RateLimitSampler mirrors requests up to a fixed rate, regardless of how much traffic the primary receives
+type RateLimitSampler struct {
+	// RequestsPerSecond is how many requests are mirrored per second, at most
+	RequestsPerSecond float64 `json:"requests_per_second"`
+	// Burst is the most requests which can be mirrored at once. Defaults to RequestsPerSecond, rounded up.
+	Burst int `json:"burst,omitempty"`
+
+	limiter *rate.Limiter
+}
+
+func (RateLimitSampler) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "mirror.samplers.rate_limit",
+		New: func() caddy.Module { return new(RateLimitSampler) },
+	}
+}
+
+// Provision implements caddy.Provisioner
+func (s *RateLimitSampler) Provision(_ caddy.Context) error {
+	if s.Burst == 0 {
+		s.Burst = int(math.Ceil(s.RequestsPerSecond))
+	}
+	s.limiter = rate.NewLimiter(rate.Limit(s.RequestsPerSecond), s.Burst)
+	return nil
+}
+
+func (s *RateLimitSampler) Sample(_ *http.Request) bool {
+	return s.limiter.Allow()
+}
+
+func (s *RateLimitSampler) UnmarshalCaddyfile(d *caddyfile.Dispenser) (err error) {
+	d.Next() // consume sampler name
+	args := d.RemainingArgs()
+	if len(args) < 1 || len(args) > 2 {
+		return d.Err("rate_limit sampler requires requests per second and an optional burst")
+	}
+	s.RequestsPerSecond, err = strconv.ParseFloat(args[0], 64)
+	if err != nil {
+		return d.Errf("error parsing requests per second: %v", err)
+	}
+	if len(args) == 2 {
+		s.Burst, err = strconv.Atoi(args[1])
+		if err != nil {
+			return d.Errf("error parsing burst: %v", err)
+		}
+	}
+	return nil
+}
+
+// PathSampler mirrors a random percentage of requests, with a different percentage for each family of endpoints, by
+// the longest path prefix which matches the request's path. Prefixes match whole path segments, so /search matches
+// /search and /search/users, but not /searches.
+type PathSampler struct {
+	// Rates are percentages of requests to mirror, from 0 to 100, by path prefix
+	Rates map[string]float64 `json:"rates"`
+	// Default is the percentage of requests to mirror whose path doesn't match any prefix. Defaults to 100.
+	Default *float64 `json:"default,omitempty"`
+
+	// prefixes are the prefixes of Rates, longest first
+	prefixes    []string
+	rates       map[string]float64
+	defaultRate float64
+}
+
+func (PathSampler) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "mirror.samplers.path",
+		New: func() caddy.Module { return new(PathSampler) },
+	}
+}
+
+// Provision implements caddy.Provisioner
+func (s *PathSampler) Provision(_ caddy.Context) error {
+	s.defaultRate = 1
+	if s.Default != nil {
+		s.defaultRate = *s.Default / 100
+	}
+	s.rates = make(map[string]float64, len(s.Rates))
+	for prefix, rate := range s.Rates {
+		if !strings.HasPrefix(prefix, "/") {
+			return fmt.Errorf("path sampler prefix '%s' must start with /", prefix)
+		}
+		s.rates[prefix] = rate / 100
+	}
+	s.prefixes = slices.SortedFunc(maps.Keys(s.rates), func(a, b string) int { return cmp.Compare(len(b), len(a)) })
+	return nil
+}
+
+func (s *PathSampler) Sample(r *http.Request) bool {
+	return SamplingRand(r, "path") < s.rate(r.URL.Path)
+}
+
+// rate is the rate for the longest prefix matching p, or the default rate
+func (s *PathSampler) rate(p string) float64 {
+	for _, prefix := range s.prefixes {
+		trimmed := strings.TrimSuffix(prefix, "/")
+		if p == prefix || p == trimmed || strings.HasPrefix(p, trimmed+"/") {
+			return s.rates[prefix]
+		}
+	}
+	return s.defaultRate
+}
+
+func (s *PathSampler) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume sampler name
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	for d.NextBlock(0) {
+		key := d.Val()
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		rate, err := parseRate(d.Val())
+		if err != nil {
+			return d.Errf("error parsing rate for %s: %v", key, err)
+		}
+		if key == "default" {
+			s.Default = &rate
+			continue
+		}
+		if s.Rates == nil {
+			s.Rates = make(map[string]float64)
+		}
+		s.Rates[key] = rate
+	}
+	return nil
+}
+
+// ExpressionSampler mirrors requests for which a CEL expression is true, in the same syntax as Caddy's expression
+// matcher, with access to placeholders and the request matcher functions, like header and vars. This allows conditions
+// a flat rate can't express, like only mirroring logged-in users from a beta cohort.
+type ExpressionSampler struct {
+	// Expr is the CEL expression, like {http.request.header.X-Beta} == "true"
+	Expr string `json:"expr"`
+	// Rate is the percentage of matching requests to mirror, from 0 to 100. Defaults to 100.
+	Rate *float64 `json:"rate,omitempty"`
+
+	matcher *caddyhttp.MatchExpression
+	rate    float64
+}
+
+func (ExpressionSampler) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "mirror.samplers.expression",
+		New: func() caddy.Module { return new(ExpressionSampler) },
+	}
+}
+
+// Provision implements caddy.Provisioner
+func (s *ExpressionSampler) Provision(ctx caddy.Context) error {
+	s.rate = 1
+	if s.Rate != nil {
+		s.rate = *s.Rate / 100
+	}
+	s.matcher = &caddyhttp.MatchExpression{Expr: s.Expr}
+	if err := s.matcher.Provision(ctx); err != nil {
+		return fmt.Errorf("error compiling expression: %w", err)
+	}
+	return nil
+}
+
+// Sample doesn't mirror requests the expression fails to evaluate for. The expression matcher logs the error.
+func (s *ExpressionSampler) Sample(r *http.Request) bool {
+	matched, err := s.matcher.MatchWithError(r)
+	if err != nil || !matched {
+		return false
+	}
+	return s.rate >= 1 || SamplingRand(r, "expression") < s.rate
+}
+
+func (s *ExpressionSampler) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume sampler name
+	// Like Caddy's expression matcher, an unquoted expression keeps its quotes
+	switch d.CountRemainingArgs() {
+	case 0:
+		return d.Err("expression sampler requires an expression")
+	case 1:
+		d.NextArg()
+		s.Expr = d.Val()
+	default:
+		s.Expr = strings.Join(d.RemainingArgsRaw(), " ")
+	}
+	for d.NextBlock(0) {
+		switch d.Val() {
+		case "rate":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			rate, err := parseRate(d.Val())
+			if err != nil {
+				return d.Errf("error parsing rate: %v", err)
+			}
+			s.Rate = &rate
+		default:
+			return d.Errf("unrecognized expression sampler option '%s'", d.Val())
+		}
+	}
+	return nil
+}
+
+// HeaderSampler mirrors only requests with a header matching a value or regular expression, like X-Beta-User: true, so
+// shadow testing can be scoped to a cohort chosen by an upstream auth layer. With neither, requests with the header are
+// mirrored, whatever its value.
+type HeaderSampler struct {
+	// Header is the name of the header requests must have to be mirrored
+	Header string `json:"header"`
+	// Values are values which match exactly. Any of them matches.
+	Values []string `json:"values,omitempty"`
+	// Regexp is a regular expression which matches values
+	Regexp string `json:"regexp,omitempty"`
+
+	regexp *regexp.Regexp
+}
+
+func (HeaderSampler) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "mirror.samplers.header",
+		New: func() caddy.Module { return new(HeaderSampler) },
+	}
+}
+
+// Provision implements caddy.Provisioner
+func (s *HeaderSampler) Provision(_ caddy.Context) (err error) {
+	if s.Header == "" {
+		return fmt.Errorf("header sampler requires a header")
+	}
+	if s.Regexp != "" {
+		s.regexp, err = regexp.Compile(s.Regexp)
+		if err != nil {
+			return fmt.Errorf("error compiling regexp: %w", err)
+		}
+	}
+	return nil
+}
+
+func (s *HeaderSampler) Sample(r *http.Request) bool {
+	values := r.Header.Values(s.Header)
+	if len(s.Values) == 0 && s.regexp == nil {
+		return len(values) > 0
+	}
+	for _, v := range values {
+		if slices.Contains(s.Values, v) || s.regexp != nil && s.regexp.MatchString(v) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *HeaderSampler) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume sampler name
+	if !d.NextArg() {
+		return d.Err("header sampler requires a header")
+	}
+	s.Header = d.Val()
+	s.Values = d.RemainingArgs()
+	for d.NextBlock(0) {
+		switch d.Val() {
+		case "regexp":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			s.Regexp = d.Val()
+		default:
+			return d.Errf("unrecognized header sampler option '%s'", d.Val())
+		}
+	}
+	return nil
+}
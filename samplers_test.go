@@ -0,0 +1,211 @@
+package mirror
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"strconv"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func TestHashSampler_Sample(t *testing.T) {
+	s := &HashSampler{Rate: 50}
+	_ = s.Provision(caddy.Context{})
+
+	request := func(user string) *http.Request {
+		r, _ := http.NewRequest("GET", "http://example.com", nil)
+		repl := caddy.NewReplacer()
+		repl.Set("http.request.remote.host", user)
+		return r.WithContext(context.WithValue(r.Context(), caddy.ReplacerCtxKey, repl))
+	}
+
+	sampled := 0
+	for i := range 1000 {
+		user := string(rune('a'+i%26)) + string(rune('a'+i/26))
+		first := s.Sample(request(user))
+		if first != s.Sample(request(user)) {
+			t.Fatalf("expected the same key to always get the same sampling decision")
+		}
+		if first {
+			sampled++
+		}
+	}
+
+	if sampled < 400 || sampled > 600 {
+		t.Errorf("expected roughly half of keys to be sampled, got %d of 1000", sampled)
+	}
+}
+
+func TestRateLimitSampler_Sample(t *testing.T) {
+	s := &RateLimitSampler{RequestsPerSecond: 1, Burst: 3}
+	_ = s.Provision(caddy.Context{})
+
+	r, _ := http.NewRequest("GET", "http://example.com", nil)
+	sampled := 0
+	for range 10 {
+		if s.Sample(r) {
+			sampled++
+		}
+	}
+
+	if sampled != 3 {
+		t.Errorf("expected only the burst to be sampled, got %d", sampled)
+	}
+}
+
+func TestPathSampler_Sample(t *testing.T) {
+	s := new(PathSampler)
+	d := caddyfile.NewTestDispenser(`path {
+		/search 100%
+		/search/internal 0
+		/checkout 1
+		default 0
+	}`)
+	if err := s.UnmarshalCaddyfile(d); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Provision(caddy.Context{}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]float64{
+		"/search":            1,
+		"/search/users":      1,
+		"/searches":          0,
+		"/search/internal/x": 0,
+		"/checkout/cart":     0.01,
+		"/users":             0,
+	}
+	for p, want := range tests {
+		if got := s.rate(p); got != want {
+			t.Errorf("rate(%s) = %v, want %v", p, got, want)
+		}
+	}
+
+	r, _ := http.NewRequest("GET", "http://example.com/search?q=a", nil)
+	if !s.Sample(r) {
+		t.Errorf("expected a request to a 100%% prefix to be sampled")
+	}
+
+	if err := (&PathSampler{Rates: map[string]float64{"search": 1}}).Provision(caddy.Context{}); err == nil {
+		t.Errorf("Provision() accepted a prefix without a leading /")
+	}
+}
+
+func TestExpressionSampler_Sample(t *testing.T) {
+	s := new(ExpressionSampler)
+	d := caddyfile.NewTestDispenser(`expression {http.request.header.X-Cohort} == "beta" && header({'Cookie': '*session=*'})`)
+	if err := s.UnmarshalCaddyfile(d); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	if err := s.Provision(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	request := func(cohort, cookie string) *http.Request {
+		r, _ := http.NewRequest("GET", "http://example.com", nil)
+		r.Header.Set("X-Cohort", cohort)
+		r.Header.Set("Cookie", cookie)
+		repl := caddyhttp.NewTestReplacer(r)
+		return r.WithContext(context.WithValue(r.Context(), caddy.ReplacerCtxKey, repl))
+	}
+	if !s.Sample(request("beta", "session=abc")) {
+		t.Errorf("expected a logged-in beta user to be sampled")
+	}
+	if s.Sample(request("beta", "")) {
+		t.Errorf("expected an anonymous beta user not to be sampled")
+	}
+	if s.Sample(request("stable", "session=abc")) {
+		t.Errorf("expected a stable user not to be sampled")
+	}
+
+	zero := 0.0
+	s.Rate = &zero
+	_ = s.Provision(ctx)
+	if s.Sample(request("beta", "session=abc")) {
+		t.Errorf("expected a rate of 0 not to sample")
+	}
+
+	if err := (&ExpressionSampler{Expr: "not valid ("}).Provision(ctx); err == nil {
+		t.Errorf("Provision() accepted an invalid expression")
+	}
+}
+
+func TestHeaderSampler_Sample(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		header http.Header
+		want   bool
+	}{
+		{"value", "header X-Beta-User true", http.Header{"X-Beta-User": {"true"}}, true},
+		{"other value", "header X-Beta-User true yes", http.Header{"X-Beta-User": {"false"}}, false},
+		{"missing", "header X-Beta-User true", http.Header{}, false},
+		{"regexp", "header X-Beta-User {\n regexp ^(?i)(true|yes)$\n}", http.Header{"X-Beta-User": {"Yes"}}, true},
+		{"present", "header X-Cohort", http.Header{"X-Cohort": {"any"}}, true},
+		{"absent", "header X-Cohort", http.Header{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := new(HeaderSampler)
+			if err := s.UnmarshalCaddyfile(caddyfile.NewTestDispenser(tt.config)); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Provision(caddy.Context{}); err != nil {
+				t.Fatal(err)
+			}
+			r, _ := http.NewRequest("GET", "http://example.com", nil)
+			r.Header = tt.header
+			if got := s.Sample(r); got != tt.want {
+				t.Errorf("Sample() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandler_shouldMirror_samplingSeed(t *testing.T) {
+	request := func(uri string) *http.Request {
+		r, _ := http.NewRequest("GET", "http://example.com"+uri, nil)
+		repl := caddyhttp.NewTestReplacer(r)
+		return r.WithContext(context.WithValue(r.Context(), caddy.ReplacerCtxKey, repl))
+	}
+	decisions := func(seed uint64) (d []bool) {
+		h := &Handler{MirrorRate: 0.5, draw: seededDraw(seed, defaultSamplingKey)}
+		for i := range 200 {
+			d = append(d, h.shouldMirror(request("/users/"+strconv.Itoa(i))))
+		}
+		return d
+	}
+
+	first := decisions(42)
+	if !slices.Equal(first, decisions(42)) {
+		t.Errorf("the same seed made different decisions")
+	}
+	if slices.Equal(first, decisions(43)) {
+		t.Errorf("different seeds made the same decisions")
+	}
+	if n := len(slices.DeleteFunc(slices.Clone(first), func(b bool) bool { return !b })); n < 70 || n > 130 {
+		t.Errorf("expected roughly half of requests to be mirrored, got %d of 200", n)
+	}
+
+	// Each decision gets its own draw, so they aren't correlated
+	r := withSamplingDraw(request("/"), seededDraw(42, defaultSamplingKey))
+	if SamplingRand(r, "ramp_up") == SamplingRand(r, "mirror_rate") {
+		t.Errorf("different decisions got the same draw")
+	}
+
+	h := &Handler{MirrorRate: 0.5, draw: func(*http.Request, string) float64 { return 0.75 }}
+	if h.shouldMirror(request("/")) {
+		t.Errorf("shouldMirror() = true with a draw over the rate")
+	}
+	h.draw = func(*http.Request, string) float64 { return 0.25 }
+	if !h.shouldMirror(request("/")) {
+		t.Errorf("shouldMirror() = false with a draw under the rate")
+	}
+}
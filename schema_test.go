@@ -0,0 +1,507 @@
+package mirror
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	_ "github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+)
+
+var updateSchema = flag.Bool("update", false, "rewrite config.schema.json")
+
+// TestConfigSchema checks config.schema.json describes the handler's config as it is. After changing the config, run
+// it with -update to regenerate the schema.
+func TestConfigSchema(t *testing.T) {
+	g := newSchemaGenerator(t)
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(g.handler()); err != nil {
+		t.Fatal(err)
+	}
+	got := buf.Bytes()
+
+	// Every option is described, so it can be found without reading the source
+	for _, name := range g.undocumented {
+		t.Errorf("%s has no doc comment", name)
+	}
+
+	if *updateSchema {
+		if err := os.WriteFile("config.schema.json", got, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile("config.schema.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Error("config.schema.json is out of date, run go test -run TestConfigSchema -update")
+	}
+}
+
+// jsonSchema is the subset of JSON Schema which config.schema.json uses
+type jsonSchema struct {
+	Schema               string                 `json:"$schema,omitempty"`
+	ID                   string                 `json:"$id,omitempty"`
+	Title                string                 `json:"title,omitempty"`
+	Description          string                 `json:"description,omitempty"`
+	Ref                  string                 `json:"$ref,omitempty"`
+	Type                 any                    `json:"type,omitempty"`
+	Const                any                    `json:"const,omitempty"`
+	Enum                 []string               `json:"enum,omitempty"`
+	Minimum              *float64               `json:"minimum,omitempty"`
+	Required             []string               `json:"required,omitempty"`
+	Properties           map[string]*jsonSchema `json:"properties,omitempty"`
+	AdditionalProperties any                    `json:"additionalProperties,omitempty"`
+	Items                *jsonSchema            `json:"items,omitempty"`
+	OneOf                []*jsonSchema          `json:"oneOf,omitempty"`
+	Defs                 map[string]*jsonSchema `json:"$defs,omitempty"`
+}
+
+// schemaGenerator builds a schema from the config's types, with descriptions from their doc comments
+type schemaGenerator struct {
+	t testing.TB
+	// docs are the doc comments of the package's types, by name, and their fields, by type and field name
+	docs map[string]string
+	defs map[string]*jsonSchema
+	// undocumented are the config fields without doc comments
+	undocumented []string
+}
+
+var (
+	durationType   = reflect.TypeFor[caddy.Duration]()
+	rawMessageType = reflect.TypeFor[json.RawMessage]()
+	pkgPath        = reflect.TypeFor[Handler]().PkgPath()
+)
+
+// rawSchemas describe the raw JSON fields which aren't modules of a namespace
+var rawSchemas = map[string]*jsonSchema{
+	"primary":   {Ref: "#/$defs/subroute"},
+	"secondary": {Ref: "#/$defs/subroute"},
+}
+
+func newSchemaGenerator(t testing.TB) *schemaGenerator {
+	g := &schemaGenerator{
+		t:    t,
+		docs: make(map[string]string),
+		defs: map[string]*jsonSchema{
+			"duration": {
+				Description: "A duration, like 1.5s, 2m, or 1d, or an integer number of nanoseconds",
+				Type:        []string{"string", "integer"},
+			},
+			"subroute": {
+				Description: "An http.handlers.subroute handler, whose routes handle the request. In the Caddyfile, " +
+					"these are the directives in the primary or secondary block.",
+				Type: "object",
+				Properties: map[string]*jsonSchema{
+					"routes": {Description: "The routes, as in any HTTP server", Type: "array", Items: &jsonSchema{Type: "object"}},
+				},
+			},
+		},
+	}
+	files, err := filepath.Glob("*.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fset := token.NewFileSet()
+	for _, name := range files {
+		if strings.HasSuffix(name, "_test.go") {
+			continue
+		}
+		f, err := parser.ParseFile(fset, name, nil, parser.ParseComments)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, decl := range f.Decls {
+			gen, ok := decl.(*ast.GenDecl)
+			if !ok || gen.Tok != token.TYPE {
+				continue
+			}
+			for _, spec := range gen.Specs {
+				ts := spec.(*ast.TypeSpec)
+				doc := ts.Doc
+				if doc == nil && len(gen.Specs) == 1 {
+					doc = gen.Doc
+				}
+				g.docs[ts.Name.Name] = docText(doc)
+				st, ok := ts.Type.(*ast.StructType)
+				if !ok {
+					continue
+				}
+				// Fields without their own doc comment share the one of the field right above them, like
+				// MetricsLabel and MetricsLabelLimit
+				var prevDoc string
+				var prevLine int
+				for _, field := range st.Fields.List {
+					line := fset.Position(field.Pos()).Line
+					fieldDoc := docText(field.Doc)
+					if fieldDoc == "" && line == prevLine+1 {
+						fieldDoc = prevDoc
+					}
+					for _, name := range field.Names {
+						g.docs[ts.Name.Name+"."+name.Name] = fieldDoc
+					}
+					prevDoc, prevLine = fieldDoc, fset.Position(field.End()).Line
+				}
+			}
+		}
+	}
+	return g
+}
+
+func docText(doc *ast.CommentGroup) string {
+	return strings.Join(strings.Fields(doc.Text()), " ")
+}
+
+// handler is the schema of the handler's config
+func (g *schemaGenerator) handler() *jsonSchema {
+	schema := g.object(reflect.TypeFor[Handler]())
+	schema.Properties["handler"] = &jsonSchema{Description: "The handler's module name", Const: "mirror"}
+	schema.Schema = "https://json-schema.org/draft/2020-12/schema"
+	schema.ID = "https://github.com/dotvezz/caddy-mirror/config.schema.json"
+	schema.Title = "caddy-mirror handler"
+	schema.Description = "The http.handlers.mirror handler, as configured in Caddy's JSON config, or adapted from a " +
+		"Caddyfile with caddy adapt"
+	schema.Defs = g.defs
+	return schema
+}
+
+// object is the schema of a struct, with the fields of embedded structs inlined, as encoding/json does
+func (g *schemaGenerator) object(typ reflect.Type) *jsonSchema {
+	schema := &jsonSchema{
+		Type:                 "object",
+		Properties:           make(map[string]*jsonSchema),
+		AdditionalProperties: false,
+	}
+	// names are the JSON names of the fields, by their Go names, so descriptions can refer to options by the names
+	// they're configured with
+	names := make(map[string]string)
+	type ownedField struct {
+		reflect.StructField
+		owner string
+	}
+	var fields []ownedField
+	var collect func(typ reflect.Type)
+	collect = func(typ reflect.Type) {
+		for i := range typ.NumField() {
+			f := typ.Field(i)
+			tag := f.Tag.Get("json")
+			if f.Anonymous && tag == "" {
+				collect(f.Type)
+				continue
+			}
+			if !f.IsExported() || tag == "-" {
+				continue
+			}
+			name, _, _ := strings.Cut(tag, ",")
+			if name == "" {
+				g.t.Errorf("%s.%s has no json tag", typ.Name(), f.Name)
+				continue
+			}
+			names[f.Name] = name
+			fields = append(fields, ownedField{f, typ.Name()})
+		}
+	}
+	collect(typ)
+
+	for _, f := range fields {
+		doc := g.docs[f.owner+"."+f.Name]
+		if doc == "" {
+			g.undocumented = append(g.undocumented, f.owner+"."+f.Name)
+		}
+		name := names[f.Name]
+		prop := g.field(f.StructField, name)
+		prop.Description = renameFields(doc, names)
+		schema.Properties[name] = prop
+	}
+	schema.Description = renameFields(g.docs[typ.Name()], names)
+	return schema
+}
+
+var goFieldName = regexp.MustCompile(`\b[A-Z][A-Za-z]+\b`)
+
+// renameFields replaces the Go names of fields in a doc comment with their JSON names
+func renameFields(doc string, names map[string]string) string {
+	return goFieldName.ReplaceAllStringFunc(doc, func(word string) string {
+		if name, ok := names[word]; ok {
+			return name
+		}
+		return word
+	})
+}
+
+// field is the schema of a struct field, which may be a module, or list of modules, of a namespace
+func (g *schemaGenerator) field(f reflect.StructField, name string) *jsonSchema {
+	var namespace, inlineKey string
+	for _, opt := range strings.Fields(f.Tag.Get("caddy")) {
+		key, value, _ := strings.Cut(opt, "=")
+		switch key {
+		case "namespace":
+			namespace = value
+		case "inline_key":
+			inlineKey = value
+		}
+	}
+	switch {
+	case namespace != "" && f.Type == rawMessageType:
+		return g.modules(namespace, inlineKey)
+	case namespace != "" && f.Type.Kind() == reflect.Slice && f.Type.Elem() == rawMessageType:
+		return &jsonSchema{Type: "array", Items: g.modules(namespace, inlineKey)}
+	case f.Type == rawMessageType:
+		schema, ok := rawSchemas[name]
+		if !ok {
+			g.t.Errorf("no schema for the raw JSON of %s", name)
+			return &jsonSchema{}
+		}
+		return &jsonSchema{Ref: schema.Ref}
+	}
+	return g.value(f.Type)
+}
+
+// modules is the schema of a module in a namespace, which is one of the modules registered in it
+func (g *schemaGenerator) modules(namespace, inlineKey string) *jsonSchema {
+	schema := &jsonSchema{Ref: "#/$defs/" + namespace}
+	if _, ok := g.defs[namespace]; ok {
+		return schema
+	}
+	def := &jsonSchema{}
+	g.defs[namespace] = def
+	for _, info := range caddy.GetModules(namespace) {
+		typ := reflect.TypeOf(info.New())
+		if typ.Kind() == reflect.Pointer {
+			typ = typ.Elem()
+		}
+		mod := g.object(typ)
+		mod.Required = []string{inlineKey}
+		mod.Properties[inlineKey] = &jsonSchema{Const: info.ID.Name()}
+		g.defs[string(info.ID)] = mod
+		def.OneOf = append(def.OneOf, &jsonSchema{Ref: "#/$defs/" + string(info.ID)})
+	}
+	return schema
+}
+
+// value is the schema of a value of a type, with the config's structs in $defs
+func (g *schemaGenerator) value(typ reflect.Type) *jsonSchema {
+	if typ == durationType {
+		return &jsonSchema{Ref: "#/$defs/duration"}
+	}
+	switch typ.Kind() {
+	case reflect.Pointer:
+		return g.value(typ.Elem())
+	case reflect.Bool:
+		return &jsonSchema{Type: "boolean"}
+	case reflect.String:
+		return &jsonSchema{Type: "string"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return &jsonSchema{Type: "integer"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &jsonSchema{Type: "integer", Minimum: new(float64)}
+	case reflect.Float32, reflect.Float64:
+		return &jsonSchema{Type: "number"}
+	case reflect.Slice:
+		return &jsonSchema{Type: "array", Items: g.value(typ.Elem())}
+	case reflect.Map:
+		if typ.Key().Kind() != reflect.String {
+			g.t.Errorf("no schema for map keys of %s", typ)
+		}
+		return &jsonSchema{Type: "object", AdditionalProperties: g.value(typ.Elem())}
+	case reflect.Struct:
+		if typ.PkgPath() != pkgPath {
+			g.t.Errorf("no schema for %s", typ)
+			return &jsonSchema{}
+		}
+		if _, ok := g.defs[typ.Name()]; !ok {
+			g.defs[typ.Name()] = nil // Placeholder, for types which refer to themselves
+			g.defs[typ.Name()] = g.object(typ)
+		}
+		return &jsonSchema{Ref: "#/$defs/" + typ.Name()}
+	}
+	g.t.Errorf("no schema for %s", typ)
+	return &jsonSchema{}
+}
+
+// Test_renameFields checks references to options in descriptions use their JSON names
+func Test_renameFields(t *testing.T) {
+	names := map[string]string{"MetricsName": "metrics_name", "Name": "name"}
+	got := renameFields("Name identifies the handler. Defaults to MetricsName, unless Nameless.", names)
+	if want := "name identifies the handler. Defaults to metrics_name, unless Nameless."; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+// TestConfigSchema_caddyfile checks handlers adapted from a Caddyfile are described by the schema
+func TestConfigSchema_caddyfile(t *testing.T) {
+	adapted, _, err := caddyconfig.GetAdapter("caddyfile").Adapt([]byte(`:8080 {
+	route {
+		mirror {
+			name api
+			metrics api
+			mirror_rate 50%
+			sampler path {
+				/search 5%
+			}
+			compare_status
+			compare_body
+			compare_headers Content-Type
+			compare_jq .data
+			normalize "[0-9a-f-]{36}" uuid
+			classify known-issue-123 {
+				status 200 503
+			}
+			comparer latency 2x
+			reporter kafka {
+				brokers kafka-1:9092
+				topic shadow-results
+			}
+			secondary_credentials header X-Api-Key {env.STAGING_API_KEY}
+			secondary_retry 3 {
+				backoff 50ms
+			}
+			secondary_query dry_run true
+			secondary_amplify 4 250ms
+			worker_pool 20
+			health_check http://shadow.internal:8080/healthz {
+				interval 10s
+			}
+			scorecard 1h {
+				min_match_rate latency 95
+			}
+			secondary_timeout 5s
+			primary {
+				respond "primary"
+			}
+			secondary {
+				respond "secondary"
+			}
+		}
+	}
+}`), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var config any
+	if err := json.Unmarshal(adapted, &config); err != nil {
+		t.Fatal(err)
+	}
+	handlers := findHandlers(config, "mirror")
+	if len(handlers) != 1 {
+		t.Fatalf("adapted config has %d mirror handlers, want 1", len(handlers))
+	}
+
+	g := newSchemaGenerator(t)
+	schema := g.handler()
+	for _, err := range validate(schema, schema.Defs, handlers[0], "") {
+		t.Error(err)
+	}
+}
+
+// findHandlers finds the handlers of a module in an adapted config
+func findHandlers(v any, name string) []any {
+	var found []any
+	switch v := v.(type) {
+	case map[string]any:
+		if v["handler"] == name {
+			return []any{v}
+		}
+		for _, value := range v {
+			found = append(found, findHandlers(value, name)...)
+		}
+	case []any:
+		for _, value := range v {
+			found = append(found, findHandlers(value, name)...)
+		}
+	}
+	return found
+}
+
+// validate checks a value against a schema, as far as config.schema.json needs: types, properties, items, and oneOf
+func validate(schema *jsonSchema, defs map[string]*jsonSchema, v any, path string) []string {
+	if schema.Ref != "" {
+		return validate(defs[strings.TrimPrefix(schema.Ref, "#/$defs/")], defs, v, path)
+	}
+	if schema.OneOf != nil {
+		var matches int
+		for _, s := range schema.OneOf {
+			if len(validate(s, defs, v, path)) == 0 {
+				matches++
+			}
+		}
+		if matches != 1 {
+			return []string{fmt.Sprintf("%s matches %d of oneOf", path, matches)}
+		}
+		return nil
+	}
+	if schema.Const != nil && v != schema.Const {
+		return []string{fmt.Sprintf("%s is %v, want %v", path, v, schema.Const)}
+	}
+	switch v := v.(type) {
+	case map[string]any:
+		if schema.Type != "object" {
+			return []string{fmt.Sprintf("%s is an object, want %v", path, schema.Type)}
+		}
+		var errs []string
+		for _, key := range schema.Required {
+			if _, ok := v[key]; !ok {
+				errs = append(errs, fmt.Sprintf("%s.%s is required", path, key))
+			}
+		}
+		for key, value := range v {
+			prop, ok := schema.Properties[key]
+			if !ok {
+				if additional, ok := schema.AdditionalProperties.(*jsonSchema); ok {
+					prop = additional
+				} else if schema.AdditionalProperties == false {
+					errs = append(errs, fmt.Sprintf("%s.%s isn't in the schema", path, key))
+					continue
+				} else {
+					continue
+				}
+			}
+			errs = append(errs, validate(prop, defs, value, path+"."+key)...)
+		}
+		return errs
+	case []any:
+		if schema.Type != "array" {
+			return []string{fmt.Sprintf("%s is an array, want %v", path, schema.Type)}
+		}
+		var errs []string
+		for i, item := range v {
+			errs = append(errs, validate(schema.Items, defs, item, fmt.Sprintf("%s[%d]", path, i))...)
+		}
+		return errs
+	case string:
+		if schema.Type != "string" && !slices.Contains(asStrings(schema.Type), "string") && schema.Const == nil {
+			return []string{fmt.Sprintf("%s is a string, want %v", path, schema.Type)}
+		}
+	case float64:
+		if schema.Type != "number" && schema.Type != "integer" && !slices.Contains(asStrings(schema.Type), "integer") {
+			return []string{fmt.Sprintf("%s is a number, want %v", path, schema.Type)}
+		}
+	case bool:
+		if schema.Type != "boolean" {
+			return []string{fmt.Sprintf("%s is a boolean, want %v", path, schema.Type)}
+		}
+	}
+	return nil
+}
+
+func asStrings(typ any) []string {
+	types, _ := typ.([]string)
+	return types
+}
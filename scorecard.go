@@ -0,0 +1,275 @@
+package mirror
+
+import (
+	"log/slog"
+	"maps"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+var _ caddyfile.Unmarshaler = (*ScorecardConfig)(nil)
+
+const (
+	verdictPass    = "pass"
+	verdictFail    = "fail"
+	verdictPending = "pending"
+)
+
+// ScorecardConfig keeps a scorecard of the secondary over a sliding window, for a single pass or fail verdict on the
+// candidate. Each dimension is scored by its match rate: each comparer, latency, and "all", for whole reports. A
+// dimension passes if its match rate is at least its minimum, and is pending until it has enough comparisons.
+type ScorecardConfig struct {
+	// Window is how far back the scorecard covers. Defaults to 15m.
+	Window caddy.Duration `json:"window,omitempty"`
+	// LogInterval is how often the scorecard is logged, as shadow_scorecard. Defaults to 1m.
+	LogInterval caddy.Duration `json:"log_interval,omitempty"`
+	// MinComparisons is how many comparisons a dimension needs in the window for a verdict. Defaults to 100.
+	MinComparisons int64 `json:"min_comparisons,omitempty"`
+	// MinMatchRate is the lowest passing match rate, as a percentage, for dimensions without their own in
+	// MinMatchRates. Defaults to 99.
+	MinMatchRate *float64 `json:"min_match_rate,omitempty"`
+	// MinMatchRates are the lowest passing match rates of specific dimensions, like body or latency
+	MinMatchRates map[string]float64 `json:"min_match_rates,omitempty"`
+	// MaxLatencyIncrease is how much slower the secondary may respond than the primary, for a request to match on
+	// latency. Defaults to 100ms.
+	MaxLatencyIncrease caddy.Duration `json:"max_latency_increase,omitempty"`
+}
+
+func (c *ScorecardConfig) provision() {
+	if c.Window == 0 {
+		c.Window = caddy.Duration(15 * time.Minute)
+	}
+	if c.LogInterval == 0 {
+		c.LogInterval = caddy.Duration(time.Minute)
+	}
+	if c.MinComparisons == 0 {
+		c.MinComparisons = 100
+	}
+	if c.MinMatchRate == nil {
+		c.MinMatchRate = ptr(99.0)
+	}
+	if c.MaxLatencyIncrease == 0 {
+		c.MaxLatencyIncrease = caddy.Duration(100 * time.Millisecond)
+	}
+}
+
+func (c *ScorecardConfig) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume "scorecard"
+	if d.NextArg() {
+		window, err := caddy.ParseDuration(d.Val())
+		if err != nil {
+			return d.Errf("error parsing window: %v", err)
+		}
+		c.Window = caddy.Duration(window)
+	}
+	for d.NextBlock(0) {
+		opt := d.Val()
+		args := d.RemainingArgs()
+		if len(args) < 1 {
+			return d.ArgErr()
+		}
+		switch opt {
+		case "window", "log_interval", "max_latency_increase":
+			dur, err := caddy.ParseDuration(args[0])
+			if err != nil {
+				return d.Errf("error parsing %s: %v", opt, err)
+			}
+			switch opt {
+			case "window":
+				c.Window = caddy.Duration(dur)
+			case "log_interval":
+				c.LogInterval = caddy.Duration(dur)
+			default:
+				c.MaxLatencyIncrease = caddy.Duration(dur)
+			}
+		case "min_comparisons":
+			n, err := strconv.ParseInt(args[0], 10, 64)
+			if err != nil {
+				return d.Errf("error parsing min_comparisons: %v", err)
+			}
+			c.MinComparisons = n
+		case "min_match_rate":
+			// Either a rate for every dimension, or a dimension and its rate
+			if len(args) > 2 {
+				return d.ArgErr()
+			}
+			rate, err := strconv.ParseFloat(strings.TrimSuffix(args[len(args)-1], "%"), 64)
+			if err != nil {
+				return d.Errf("error parsing min_match_rate: %v", err)
+			}
+			if len(args) == 1 {
+				c.MinMatchRate = &rate
+				continue
+			}
+			if c.MinMatchRates == nil {
+				c.MinMatchRates = make(map[string]float64)
+			}
+			c.MinMatchRates[args[0]] = rate
+		default:
+			return d.Errf("unrecognized scorecard option '%s'", opt)
+		}
+	}
+	return nil
+}
+
+// minMatchRate is the lowest passing match rate of a dimension
+func (c *ScorecardConfig) minMatchRate(dimension string) float64 {
+	if rate, ok := c.MinMatchRates[dimension]; ok {
+		return rate
+	}
+	return *c.MinMatchRate
+}
+
+// scorecard counts matches and mismatches by dimension over a sliding window. Methods are safe to call on a nil
+// *scorecard, which records nothing.
+type scorecard struct {
+	cfg ScorecardConfig
+	now func() time.Time
+
+	mu sync.Mutex
+	// dimensions are created as they're first recorded, since comparers can skip every request they see
+	dimensions map[string]*slidingWindow
+}
+
+func newScorecard(cfg ScorecardConfig, now func() time.Time) *scorecard {
+	return &scorecard{cfg: cfg, now: now, dimensions: make(map[string]*slidingWindow)}
+}
+
+func (s *scorecard) dimension(name string) *slidingWindow {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	w, ok := s.dimensions[name]
+	if !ok {
+		window := time.Duration(s.cfg.Window)
+		w = newSlidingWindow(window, max(window/60, time.Second))
+		w.now = s.now
+		s.dimensions[name] = w
+	}
+	return w
+}
+
+// record scores a report. Unless a latency comparer scored it, latency is only scored if both handlers responded
+// without errors.
+func (s *scorecard) record(rep Report) {
+	if s == nil {
+		return
+	}
+	score := func(name string, match bool) {
+		s.dimension(name).record(func(c *windowCounts) {
+			if match {
+				c.Matched++
+			} else {
+				c.Mismatched++
+			}
+		})
+	}
+
+	score("all", rep.Match)
+	var latency bool
+	for _, res := range rep.Results {
+		if !res.Skipped {
+			score(res.Comparer, res.Match)
+		}
+		latency = latency || res.Comparer == "latency"
+	}
+	// A latency comparer's results take the place of the scorecard's own
+	if !latency && rep.Primary.Error == "" && rep.Secondary.Error == "" && rep.Primary.Duration > 0 && rep.Secondary.Duration > 0 {
+		score("latency", rep.Secondary.Duration-rep.Primary.Duration <= time.Duration(s.cfg.MaxLatencyIncrease))
+	}
+}
+
+// scorecardSnapshot is the scorecard as served by the admin API
+type scorecardSnapshot struct {
+	// Verdict fails if any dimension fails, and is pending until "all" has enough comparisons. Dimensions which are
+	// pending don't hold it back, since some comparers only see a few requests.
+	Verdict    string                        `json:"verdict"`
+	Window     string                        `json:"window"`
+	Dimensions map[string]scorecardDimension `json:"dimensions"`
+}
+
+type scorecardDimension struct {
+	Matched    int64 `json:"matched"`
+	Mismatched int64 `json:"mismatched"`
+	// MatchRate is a percentage. It's omitted if there were no comparisons.
+	MatchRate    *float64 `json:"match_rate,omitempty"`
+	MinMatchRate float64  `json:"min_match_rate"`
+	Verdict      string   `json:"verdict"`
+}
+
+func (s *scorecard) snapshot() scorecardSnapshot {
+	s.mu.Lock()
+	dimensions := maps.Clone(s.dimensions)
+	s.mu.Unlock()
+
+	snap := scorecardSnapshot{
+		Verdict:    verdictPass,
+		Window:     time.Duration(s.cfg.Window).String(),
+		Dimensions: make(map[string]scorecardDimension, len(dimensions)),
+	}
+	for name, w := range dimensions {
+		counts := w.sum()
+		dim := scorecardDimension{
+			Matched:      counts.Matched,
+			Mismatched:   counts.Mismatched,
+			MinMatchRate: s.cfg.minMatchRate(name),
+			Verdict:      verdictPending,
+		}
+		if rate := counts.matchRate() * 100; !math.IsNaN(rate) {
+			dim.MatchRate = &rate
+		}
+		if counts.Matched+counts.Mismatched >= s.cfg.MinComparisons {
+			dim.Verdict = verdictPass
+			if *dim.MatchRate < dim.MinMatchRate {
+				dim.Verdict = verdictFail
+				snap.Verdict = verdictFail
+			}
+		}
+		snap.Dimensions[name] = dim
+	}
+	if all, ok := snap.Dimensions["all"]; snap.Verdict != verdictFail && (!ok || all.Verdict == verdictPending) {
+		snap.Verdict = verdictPending
+	}
+	return snap
+}
+
+// logScorecards logs the scorecard every interval, until done is closed
+func (h *Handler) logScorecards(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			h.logScorecard(h.scorecard.snapshot())
+		}
+	}
+}
+
+func (h *Handler) logScorecard(snap scorecardSnapshot) {
+	attrs := []any{
+		slog.String("verdict", snap.Verdict),
+		slog.String("window", snap.Window),
+	}
+	for _, name := range slices.Sorted(maps.Keys(snap.Dimensions)) {
+		dim := snap.Dimensions[name]
+		dimAttrs := []any{
+			slog.String("verdict", dim.Verdict),
+			slog.Int64("matched", dim.Matched),
+			slog.Int64("mismatched", dim.Mismatched),
+		}
+		if dim.MatchRate != nil {
+			dimAttrs = append(dimAttrs, slog.Float64("match_rate", *dim.MatchRate))
+		}
+		attrs = append(attrs, slog.Group(name, dimAttrs...))
+	}
+	h.slogger.Info("shadow_scorecard", attrs...)
+}
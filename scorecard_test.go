@@ -0,0 +1,83 @@
+package mirror
+
+import (
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+func TestScorecardConfig_UnmarshalCaddyfile(t *testing.T) {
+	c := new(ScorecardConfig)
+	d := caddyfile.NewTestDispenser(`scorecard 1h {
+		min_match_rate 99.5%
+		min_match_rate latency 95
+		min_comparisons 10
+	}`)
+	if err := c.UnmarshalCaddyfile(d); err != nil {
+		t.Fatal(err)
+	}
+	c.provision()
+	if time.Duration(c.Window) != time.Hour || c.MinComparisons != 10 {
+		t.Errorf("window = %v, min_comparisons = %d, want 1h, 10", time.Duration(c.Window), c.MinComparisons)
+	}
+	if c.minMatchRate("body") != 99.5 || c.minMatchRate("latency") != 95 {
+		t.Errorf("min match rates = %v, %v, want 99.5, 95", c.minMatchRate("body"), c.minMatchRate("latency"))
+	}
+}
+
+func Test_scorecard(t *testing.T) {
+	now := time.Now()
+	cfg := ScorecardConfig{MinComparisons: 4, MinMatchRates: map[string]float64{"latency": 50}}
+	cfg.provision()
+	s := newScorecard(cfg, func() time.Time { return now })
+	report := func(bodyMatch bool, secondaryDuration time.Duration) Report {
+		return Report{
+			Match: bodyMatch,
+			Results: []Result{
+				{Comparer: "status", Match: true},
+				{Comparer: "body", Match: bodyMatch},
+				{Comparer: "upload", Skipped: true},
+			},
+			Primary:   ResponseArtifact{Duration: 10 * time.Millisecond},
+			Secondary: ResponseArtifact{Duration: secondaryDuration},
+		}
+	}
+
+	s.record(report(true, 20*time.Millisecond))
+	if got := s.snapshot().Verdict; got != verdictPending {
+		t.Errorf("verdict = %s with too few comparisons, want pending", got)
+	}
+
+	for range 3 {
+		s.record(report(true, time.Second))
+	}
+	snap := s.snapshot()
+	if snap.Verdict != verdictFail {
+		t.Errorf("verdict = %s with latency failing, want fail", snap.Verdict)
+	}
+	if dim := snap.Dimensions["latency"]; dim.Verdict != verdictFail || *dim.MatchRate != 25 {
+		t.Errorf("latency = %+v, want a 25%% match rate, failing", dim)
+	}
+	if _, ok := snap.Dimensions["upload"]; ok {
+		t.Errorf("skipped results were scored")
+	}
+	s.cfg.MinMatchRates["latency"] = 20
+	if got := s.snapshot().Verdict; got != verdictPass {
+		t.Errorf("verdict = %s, want pass", got)
+	}
+
+	s.record(report(false, 20*time.Millisecond))
+	snap = s.snapshot()
+	if snap.Verdict != verdictFail || snap.Dimensions["body"].Verdict != verdictFail {
+		t.Errorf("verdict = %s, body = %s after a mismatch, want fail", snap.Verdict, snap.Dimensions["body"].Verdict)
+	}
+
+	now = now.Add(time.Duration(cfg.Window))
+	if got := s.snapshot().Verdict; got != verdictPending {
+		t.Errorf("verdict = %s once the window passed, want pending", got)
+	}
+
+	var none *scorecard
+	none.record(report(true, 0))
+}
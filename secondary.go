@@ -0,0 +1,321 @@
+package mirror
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// SecondaryRequestConfig controls what the mirrored request sent to the secondary carries over from the original
+type SecondaryRequestConfig struct {
+	// HeaderAllow, if set, are the only request headers copied to the secondary. A name ending in * matches every
+	// header with that prefix. Content-Type, Content-Length, and Content-Encoding are copied anyway, since they describe
+	// the body, unless they're denied.
+	HeaderAllow []string `json:"secondary_header_allow,omitempty"`
+	// HeaderDeny are request headers which aren't copied to the secondary, even if they're allowed. A name ending in *
+	// matches every header with that prefix.
+	HeaderDeny []string `json:"secondary_header_deny,omitempty"`
+
+	// StripCredentials removes the Authorization and Cookie headers from the mirrored request
+	StripCredentials bool `json:"secondary_strip_credentials,omitempty"`
+	// Authorization and Cookie, if set, replace those headers in the mirrored request. Placeholders are supported, like
+	// {env.SHADOW_TOKEN}.
+	Authorization string `json:"secondary_authorization,omitempty"`
+	Cookie        string `json:"secondary_cookie,omitempty"`
+
+	// Query rewrites the mirrored request's query parameters, so the secondary can tell shadow traffic apart
+	Query *QueryRewrite `json:"secondary_query,omitempty"`
+
+	// Host, if set, replaces the mirrored request's Host header. Placeholders are supported.
+	Host string `json:"secondary_host,omitempty"`
+
+	// Vars are set on the mirrored request, so routes in the secondary can match on them. The mirror_secondary var is
+	// always set to true. Values support placeholders.
+	Vars map[string]string `json:"secondary_vars,omitempty"`
+
+	// Delay defers sending the mirrored request, to smooth load on the secondary and keep it from contending with the
+	// primary over shared dependencies. Up to DelayJitter more is added at random.
+	Delay       caddy.Duration `json:"secondary_delay,omitempty"`
+	DelayJitter caddy.Duration `json:"secondary_delay_jitter,omitempty"`
+
+	// Retry, if set, retries secondary requests which fail
+	Retry *RetryPolicy `json:"secondary_retry,omitempty"`
+
+	// Amplify, if set, sends several copies of each mirrored request to the secondary, to load test it
+	Amplify *AmplifyConfig `json:"secondary_amplify,omitempty"`
+
+	// Context is how the secondary's context relates to the original request's: "detached" isn't cancelled with the
+	// original request, "deadline" isn't cancelled with it but keeps its deadline, if it has one, and "cancel" is
+	// cancelled with it. The secondary_timeout always applies. Defaults to detached.
+	Context string `json:"secondary_context,omitempty"`
+
+	// BodyJQ transforms a JSON request body with a jq program, like '.dry_run = true'. BodyTemplate replaces the body
+	// with a Go template instead. Only one can be set. If the transform fails, the request isn't sent to the secondary.
+	BodyJQ        JQQuery `json:"secondary_body_jq,omitempty"`
+	BodyTemplate  string  `json:"secondary_body_template,omitempty"`
+	bodyTransform *bodyTransform
+
+	// Next is what the secondary's chain runs into when it ends: "terminal", a no-op, so handlers after the mirror only
+	// run for the primary, or "chain", those same handlers, for the mirrored request. Defaults to terminal.
+	Next string `json:"secondary_next,omitempty"`
+
+	// MaxBodyBytes, if set, is the largest request body which is mirrored. Requests with larger bodies are only sent to
+	// the primary, which still gets the whole body. The length of chunked bodies is checked as they're read.
+	MaxBodyBytes int64 `json:"secondary_max_body_bytes,omitempty"`
+
+	// WebSocket is how WebSocket upgrades are handled: "bypass" only sends them to the primary, and "handshake" also
+	// mirrors the handshake, closing the secondary's connection once it's upgraded. Defaults to bypass.
+	WebSocket string `json:"websocket,omitempty"`
+}
+
+func (c *SecondaryRequestConfig) provision() (err error) {
+	if c.Retry != nil {
+		c.Retry.provision()
+	}
+	if c.Amplify != nil {
+		if err := c.Amplify.provision(); err != nil {
+			return err
+		}
+	}
+	switch c.Context {
+	case "", contextDetached, contextDeadline, contextCancel:
+	default:
+		return fmt.Errorf("unrecognized secondary_context '%s'", c.Context)
+	}
+	switch c.Next {
+	case "", nextTerminal, nextChain:
+	default:
+		return fmt.Errorf("unrecognized secondary_next '%s'", c.Next)
+	}
+	switch c.WebSocket {
+	case "", webSocketBypass, webSocketHandshake:
+	default:
+		return fmt.Errorf("unrecognized websocket mode '%s'", c.WebSocket)
+	}
+	c.bodyTransform, err = newBodyTransform(c.BodyJQ, c.BodyTemplate)
+	return err
+}
+
+const (
+	contextDetached = "detached"
+	contextDeadline = "deadline"
+	contextCancel   = "cancel"
+)
+
+const (
+	nextTerminal = "terminal"
+	nextChain    = "chain"
+)
+
+// terminal ends the secondary's chain, like the end of a route does
+var terminal caddyhttp.Handler = caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error { return nil })
+
+// secondaryNext is the handler the secondary's chain runs into when it ends
+func (c *SecondaryRequestConfig) secondaryNext(next caddyhttp.Handler) caddyhttp.Handler {
+	if c.Next == nextChain {
+		return next
+	}
+	return terminal
+}
+
+// secondaryContext derives the secondary's context from the original request's context, by the context mode
+func (c *SecondaryRequestConfig) secondaryContext(parent context.Context) (context.Context, context.CancelFunc) {
+	switch c.Context {
+	case contextCancel:
+		return parent, func() {}
+	case contextDeadline:
+		if deadline, ok := parent.Deadline(); ok {
+			return context.WithDeadline(context.WithoutCancel(parent), deadline)
+		}
+	}
+	return context.WithoutCancel(parent), func() {}
+}
+
+// secondaryDelay is how long to wait before sending a mirrored request
+func (c *SecondaryRequestConfig) secondaryDelay() time.Duration {
+	delay := time.Duration(c.Delay)
+	if c.DelayJitter > 0 {
+		delay += rand.N(time.Duration(c.DelayJitter))
+	}
+	return delay
+}
+
+// QueryRewrite changes query parameters. Parameters are deleted, then set, then added. Values support placeholders.
+type QueryRewrite struct {
+	// Set replaces every value of a parameter, or adds it if it's missing
+	Set map[string]string `json:"set,omitempty"`
+	// Add adds a value to a parameter, keeping any it already has
+	Add map[string]string `json:"add,omitempty"`
+	// Delete removes parameters
+	Delete []string `json:"delete,omitempty"`
+}
+
+// headerMatcher matches header names, exactly or by prefix
+type headerMatcher struct {
+	names    map[string]struct{}
+	prefixes []string
+}
+
+func newHeaderMatcher(patterns []string) *headerMatcher {
+	if len(patterns) == 0 {
+		return nil
+	}
+	m := &headerMatcher{names: make(map[string]struct{}, len(patterns))}
+	for _, p := range patterns {
+		if prefix, ok := strings.CutSuffix(p, "*"); ok {
+			m.prefixes = append(m.prefixes, strings.ToLower(prefix))
+		} else {
+			m.names[http.CanonicalHeaderKey(p)] = struct{}{}
+		}
+	}
+	return m
+}
+
+// match reports whether a canonical header name matches
+func (m *headerMatcher) match(name string) bool {
+	if _, ok := m.names[name]; ok {
+		return true
+	}
+	lower := strings.ToLower(name)
+	for _, prefix := range m.prefixes {
+		if strings.HasPrefix(lower, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// rewriteSecondary changes a mirrored request as configured, before it's sent to the secondary
+func (h *Handler) rewriteSecondary(r *http.Request) {
+	h.filterHeaders(r.Header)
+	h.replaceCredentials(r)
+	h.rewriteQuery(r)
+	if h.IdentityEncoding != "" {
+		r.Header.Set("Accept-Encoding", "identity")
+	}
+	if h.Host != "" {
+		r.Host = replacer(r).ReplaceKnown(h.Host, "")
+	}
+	h.setVars(r)
+}
+
+// setVars sets vars on a mirrored request. Its vars are a copy of the original request's, so this doesn't change the
+// primary's.
+func (h *Handler) setVars(r *http.Request) {
+	if r.Context().Value(caddyhttp.VarsCtxKey) == nil {
+		return
+	}
+	caddyhttp.SetVar(r.Context(), "mirror_secondary", true)
+	if len(h.Vars) == 0 {
+		return
+	}
+	repl := replacer(r)
+	for name, value := range h.Vars {
+		caddyhttp.SetVar(r.Context(), name, repl.ReplaceKnown(value, ""))
+	}
+}
+
+// secondaryHandler wraps the secondary to recover its panics, and retry it if configured
+func (h *Handler) secondaryHandler() caddyhttp.MiddlewareHandler {
+	var secondary caddyhttp.MiddlewareHandler = recoverHandler{h.secondary}
+	if h.Retry != nil {
+		secondary = retryHandler{MiddlewareHandler: secondary, policy: h.Retry, onRetry: func() {
+			if h.MetricsName != "" {
+				h.metrics.retries.Inc()
+			}
+		}}
+	}
+	return secondary
+}
+
+// abortHandler cancels a handler's context when abort is closed
+type abortHandler struct {
+	caddyhttp.MiddlewareHandler
+
+	abort <-chan struct{}
+}
+
+func (ah abortHandler) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	go func() {
+		select {
+		case <-ah.abort:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ah.MiddlewareHandler.ServeHTTP(w, r.WithContext(ctx), next)
+}
+
+// replacer returns the request's replacer, or a new one if it doesn't have one
+func replacer(r *http.Request) *caddy.Replacer {
+	if repl, ok := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer); ok {
+		return repl
+	}
+	return caddy.NewReplacer()
+}
+
+// replaceCredentials strips or replaces the credentials in a mirrored request
+func (h *Handler) replaceCredentials(r *http.Request) {
+	if h.StripCredentials {
+		r.Header.Del("Authorization")
+		r.Header.Del("Cookie")
+	}
+	if h.Authorization == "" && h.Cookie == "" {
+		return
+	}
+
+	repl := replacer(r)
+	if h.Authorization != "" {
+		r.Header.Set("Authorization", repl.ReplaceKnown(h.Authorization, ""))
+	}
+	if h.Cookie != "" {
+		r.Header.Set("Cookie", repl.ReplaceKnown(h.Cookie, ""))
+	}
+}
+
+// rewriteQuery applies the query rewrite to a mirrored request
+func (h *Handler) rewriteQuery(r *http.Request) {
+	if h.Query == nil {
+		return
+	}
+
+	repl := replacer(r)
+	q := r.URL.Query()
+	for _, name := range h.Query.Delete {
+		q.Del(name)
+	}
+	for name, value := range h.Query.Set {
+		q.Set(name, repl.ReplaceKnown(value, ""))
+	}
+	for name, value := range h.Query.Add {
+		q.Add(name, repl.ReplaceKnown(value, ""))
+	}
+	r.URL.RawQuery = q.Encode()
+	r.RequestURI = r.URL.RequestURI()
+}
+
+// bodyHeaders describe the request body, which is mirrored as it is, so they're kept even if they aren't allowed.
+// Without its Content-Type, a multipart body's boundary would be lost.
+var bodyHeaders = []string{"Content-Type", "Content-Length", "Content-Encoding"}
+
+// filterHeaders removes the headers the secondary shouldn't see from a mirrored request's headers
+func (h *Handler) filterHeaders(header http.Header) {
+	if h.headerAllow == nil && h.headerDeny == nil {
+		return
+	}
+	for name := range header {
+		allowed := h.headerAllow == nil || h.headerAllow.match(name) || slices.Contains(bodyHeaders, name)
+		if !allowed || (h.headerDeny != nil && h.headerDeny.match(name)) {
+			delete(header, name)
+		}
+	}
+}
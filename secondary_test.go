@@ -0,0 +1,220 @@
+package mirror
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func TestHandler_filterHeaders(t *testing.T) {
+	tests := []struct {
+		name        string
+		allow, deny []string
+		want        []string
+	}{
+		{"none", nil, nil, []string{"Accept", "Authorization", "Content-Type", "Cookie", "X-Internal-Token", "X-Request-Id"}},
+		{"deny", nil, []string{"authorization", "cookie"}, []string{"Accept", "Content-Type", "X-Internal-Token", "X-Request-Id"}},
+		{"deny prefix", nil, []string{"x-internal-*"}, []string{"Accept", "Authorization", "Content-Type", "Cookie", "X-Request-Id"}},
+		{"allow", []string{"Accept", "X-*"}, nil, []string{"Accept", "Content-Type", "X-Internal-Token", "X-Request-Id"}},
+		{"allow and deny", []string{"Accept", "X-*"}, []string{"X-Internal-*"}, []string{"Accept", "Content-Type", "X-Request-Id"}},
+		{"deny body headers", nil, []string{"Content-Type"}, []string{"Accept", "Authorization", "Cookie", "X-Internal-Token", "X-Request-Id"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &Handler{headerAllow: newHeaderMatcher(tt.allow), headerDeny: newHeaderMatcher(tt.deny)}
+			header := http.Header{
+				"Accept":           {"*/*"},
+				"Authorization":    {"Bearer secret"},
+				"Content-Type":     {"multipart/form-data; boundary=xyz"},
+				"Cookie":           {"session=secret"},
+				"X-Internal-Token": {"secret"},
+				"X-Request-Id":     {"1"},
+			}
+			h.filterHeaders(header)
+
+			var got []string
+			for name := range header {
+				got = append(got, name)
+			}
+			slices.Sort(got)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("headers = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandler_replaceCredentials(t *testing.T) {
+	t.Setenv("SHADOW_TOKEN", "shadow")
+	tests := []struct {
+		name       string
+		cfg        SecondaryRequestConfig
+		wantAuth   string
+		wantCookie string
+	}{
+		{"unchanged", SecondaryRequestConfig{}, "Bearer client", "session=client"},
+		{"strip", SecondaryRequestConfig{StripCredentials: true}, "", ""},
+		{
+			"replace",
+			SecondaryRequestConfig{Authorization: "Bearer {env.SHADOW_TOKEN}"},
+			"Bearer shadow", "session=client",
+		},
+		{
+			"strip and replace",
+			SecondaryRequestConfig{StripCredentials: true, Cookie: "session=staging"},
+			"", "session=staging",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.Header.Set("Authorization", "Bearer client")
+			r.Header.Set("Cookie", "session=client")
+
+			h := &Handler{SecondaryRequestConfig: tt.cfg}
+			h.replaceCredentials(r)
+			if got := r.Header.Get("Authorization"); got != tt.wantAuth {
+				t.Errorf("Authorization = %q, want %q", got, tt.wantAuth)
+			}
+			if got := r.Header.Get("Cookie"); got != tt.wantCookie {
+				t.Errorf("Cookie = %q, want %q", got, tt.wantCookie)
+			}
+		})
+	}
+}
+
+func TestHandler_rewriteQuery(t *testing.T) {
+	h := &Handler{SecondaryRequestConfig: SecondaryRequestConfig{Query: &QueryRewrite{
+		Set:    map[string]string{"dry_run": "true"},
+		Add:    map[string]string{"tag": "shadow"},
+		Delete: []string{"token"},
+	}}}
+	r := httptest.NewRequest(http.MethodGet, "/orders?id=1&tag=a&token=secret&dry_run=false", nil)
+	h.rewriteQuery(r)
+
+	if want := "/orders?dry_run=true&id=1&tag=a&tag=shadow"; r.URL.RequestURI() != want || r.RequestURI != want {
+		t.Errorf("URI = %s (RequestURI %s), want %s", r.URL.RequestURI(), r.RequestURI, want)
+	}
+}
+
+func TestHandler_rewriteSecondary(t *testing.T) {
+	h := &Handler{SecondaryRequestConfig: SecondaryRequestConfig{Host: "{env.SHADOW_HOST}"}}
+	t.Setenv("SHADOW_HOST", "staging.example.com")
+	r := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	h.rewriteSecondary(r)
+	if r.Host != "staging.example.com" {
+		t.Errorf("Host = %s, want staging.example.com", r.Host)
+	}
+}
+
+func TestHandler_setVars(t *testing.T) {
+	h := &Handler{SecondaryRequestConfig: SecondaryRequestConfig{Vars: map[string]string{"environment": "staging"}}}
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r = r.WithContext(context.WithValue(r.Context(), caddyhttp.VarsCtxKey, map[string]any{"existing": "kept"}))
+
+	sr := cloneRequest(r)
+	h.setVars(sr)
+
+	if got := caddyhttp.GetVar(sr.Context(), "mirror_secondary"); got != true {
+		t.Errorf("mirror_secondary = %v, want true", got)
+	}
+	if got := caddyhttp.GetVar(sr.Context(), "environment"); got != "staging" {
+		t.Errorf("environment = %v, want staging", got)
+	}
+	if got := caddyhttp.GetVar(sr.Context(), "existing"); got != "kept" {
+		t.Errorf("existing = %v, want kept", got)
+	}
+	if got := caddyhttp.GetVar(r.Context(), "mirror_secondary"); got != nil {
+		t.Errorf("mirror_secondary was set on the original request")
+	}
+}
+
+func TestSecondaryRequestConfig_secondaryDelay(t *testing.T) {
+	c := SecondaryRequestConfig{Delay: caddy.Duration(100 * time.Millisecond)}
+	if got := c.secondaryDelay(); got != 100*time.Millisecond {
+		t.Errorf("secondaryDelay() = %v, want 100ms", got)
+	}
+
+	c.DelayJitter = caddy.Duration(50 * time.Millisecond)
+	for range 100 {
+		if got := c.secondaryDelay(); got < 100*time.Millisecond || got >= 150*time.Millisecond {
+			t.Fatalf("secondaryDelay() with jitter = %v, want [100ms, 150ms)", got)
+		}
+	}
+}
+
+func TestSecondaryRequestConfig_secondaryContext(t *testing.T) {
+	deadline := time.Now().Add(time.Hour)
+	tests := []struct {
+		mode         string
+		wantDeadline bool
+		wantCanceled bool
+	}{
+		{"", false, false},
+		{contextDetached, false, false},
+		{contextDeadline, true, false},
+		{contextCancel, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			parent, cancelParent := context.WithDeadline(context.Background(), deadline)
+			c := &SecondaryRequestConfig{Context: tt.mode}
+			if err := c.provision(); err != nil {
+				t.Fatal(err)
+			}
+			ctx, cancel := c.secondaryContext(parent)
+			defer cancel()
+			cancelParent()
+
+			if got, ok := ctx.Deadline(); ok != tt.wantDeadline || ok && !got.Equal(deadline) {
+				t.Errorf("Deadline() = %v, %v, want the original deadline: %v", got, ok, tt.wantDeadline)
+			}
+			if canceled := ctx.Err() != nil; canceled != tt.wantCanceled {
+				t.Errorf("canceled with the original request = %v, want %v", canceled, tt.wantCanceled)
+			}
+		})
+	}
+
+	if err := (&SecondaryRequestConfig{Context: "sometimes"}).provision(); err == nil {
+		t.Errorf("provision() with an unknown secondary_context error = nil")
+	}
+}
+
+func TestSecondaryRequestConfig_secondaryNext(t *testing.T) {
+	var ran bool
+	next := caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error {
+		ran = true
+		return nil
+	})
+	tests := []struct {
+		mode    string
+		wantRan bool
+	}{
+		{"", false},
+		{nextTerminal, false},
+		{nextChain, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			ran = false
+			c := &SecondaryRequestConfig{Next: tt.mode}
+			if err := c.provision(); err != nil {
+				t.Fatal(err)
+			}
+			_ = c.secondaryNext(next).ServeHTTP(&NopResponseWriter{}, httptest.NewRequest(http.MethodGet, "/", nil))
+			if ran != tt.wantRan {
+				t.Errorf("ran the real next = %v, want %v", ran, tt.wantRan)
+			}
+		})
+	}
+
+	if err := (&SecondaryRequestConfig{Next: "sometimes"}).provision(); err == nil {
+		t.Errorf("provision() with an unknown secondary_next error = nil")
+	}
+}
@@ -0,0 +1,73 @@
+package mirror
+
+import (
+	"log/slog"
+	runtimemetrics "runtime/metrics"
+	"sync/atomic"
+	"time"
+)
+
+// heapSample is the runtime metric compared against max_heap_bytes: memory occupied by live and not-yet-swept heap
+// objects
+const heapSample = "/memory/classes/heap/objects:bytes"
+
+// heapMonitor periodically reads the process's heap usage, and tracks whether it's over a limit. Reading runtime
+// metrics on every request would be too slow, so it's only read every interval. Methods are safe to call on a nil
+// *heapMonitor, which is never over the limit.
+type heapMonitor struct {
+	limit   uint64
+	slogger slogger
+	// read returns the current heap usage in bytes
+	read func() uint64
+
+	over atomic.Bool
+}
+
+func newHeapMonitor(limit uint64, slogger slogger) *heapMonitor {
+	return &heapMonitor{limit: limit, slogger: slogger, read: readHeap}
+}
+
+func readHeap() uint64 {
+	sample := []runtimemetrics.Sample{{Name: heapSample}}
+	runtimemetrics.Read(sample)
+	if sample[0].Value.Kind() != runtimemetrics.KindUint64 {
+		return 0
+	}
+	return sample[0].Value.Uint64()
+}
+
+// overLimit reports whether mirrored requests should be shed
+func (m *heapMonitor) overLimit() bool {
+	return m != nil && m.over.Load()
+}
+
+// watch checks heap usage every interval, until done is closed
+func (m *heapMonitor) watch(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		m.check()
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// check reads heap usage once, and logs when shedding starts or stops
+func (m *heapMonitor) check() {
+	heap := m.read()
+	over := heap > m.limit
+	if over == m.over.Swap(over) {
+		return
+	}
+
+	attrs := []any{slog.Uint64("heap_bytes", heap), slog.Uint64("max_heap_bytes", m.limit)}
+	if over {
+		m.slogger.Warn("memory_pressure_shedding", attrs...)
+	} else {
+		m.slogger.Info("memory_pressure_resolved", attrs...)
+	}
+}
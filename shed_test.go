@@ -0,0 +1,48 @@
+package mirror
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func Test_heapMonitor(t *testing.T) {
+	var logged []string
+	heap := uint64(100)
+	m := newHeapMonitor(200, &sloggerMock{
+		warn: func(str string, _ ...any) { logged = append(logged, str) },
+		info: func(str string, _ ...any) { logged = append(logged, str) },
+	})
+	m.read = func() uint64 { return heap }
+
+	h := &Handler{MirrorRate: 1, heap: m}
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	m.check()
+	if !h.shouldMirror(r) {
+		t.Errorf("shouldMirror() = false under the limit")
+	}
+
+	heap = 300
+	m.check()
+	m.check()
+	if h.shouldMirror(r) {
+		t.Errorf("shouldMirror() = true over the limit")
+	}
+
+	heap = 100
+	m.check()
+	if !h.shouldMirror(r) {
+		t.Errorf("shouldMirror() = false after heap usage dropped")
+	}
+
+	if len(logged) != 2 || logged[0] != "memory_pressure_shedding" || logged[1] != "memory_pressure_resolved" {
+		t.Errorf("logged = %v, want shedding then resolved", logged)
+	}
+}
+
+func Test_readHeap(t *testing.T) {
+	if readHeap() == 0 {
+		t.Errorf("readHeap() = 0")
+	}
+}
@@ -0,0 +1,197 @@
+package mirror
+
+import (
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+var _ caddyfile.Unmarshaler = (*SLOConfig)(nil)
+
+// SLOConfig sets service level objectives for the secondary, judged on its own rather than against the primary. Every
+// window, the secondary's requests during it are evaluated against each objective which is set, for a single pass or
+// fail verdict. The verdict is logged as shadow_slo, emitted as a mirror_slo event, and kept in the slo_passing gauge.
+type SLOConfig struct {
+	// Window is how often objectives are evaluated, against the requests since the last evaluation. Defaults to 5m.
+	Window caddy.Duration `json:"window,omitempty"`
+	// MinRequests is how many secondary requests a window needs to be evaluated. Windows with fewer requests leave the
+	// verdict as it was. Defaults to 100.
+	MinRequests int64 `json:"min_requests,omitempty"`
+
+	// MaxP50, MaxP95, and MaxP99 are the slowest acceptable percentiles of the secondary's latency
+	MaxP50 *caddy.Duration `json:"max_p50,omitempty"`
+	MaxP95 *caddy.Duration `json:"max_p95,omitempty"`
+	MaxP99 *caddy.Duration `json:"max_p99,omitempty"`
+	// MaxErrorRate is the highest acceptable percentage of secondary requests which fail, with a handler error or a
+	// 5xx response
+	MaxErrorRate *float64 `json:"max_error_rate,omitempty"`
+}
+
+func (c *SLOConfig) provision() {
+	if c.Window == 0 {
+		c.Window = caddy.Duration(5 * time.Minute)
+	}
+	if c.MinRequests == 0 {
+		c.MinRequests = 100
+	}
+}
+
+func (c *SLOConfig) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume "slo"
+	if d.NextArg() {
+		window, err := caddy.ParseDuration(d.Val())
+		if err != nil {
+			return d.Errf("error parsing window: %v", err)
+		}
+		c.Window = caddy.Duration(window)
+	}
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	for d.NextBlock(0) {
+		opt := d.Val()
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		switch opt {
+		case "window", "max_p50", "max_p95", "max_p99":
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("error parsing %s: %v", opt, err)
+			}
+			switch opt {
+			case "window":
+				c.Window = caddy.Duration(dur)
+			case "max_p50":
+				c.MaxP50 = ptr(caddy.Duration(dur))
+			case "max_p95":
+				c.MaxP95 = ptr(caddy.Duration(dur))
+			default:
+				c.MaxP99 = ptr(caddy.Duration(dur))
+			}
+		case "min_requests":
+			n, err := strconv.ParseInt(d.Val(), 10, 64)
+			if err != nil {
+				return d.Errf("error parsing min_requests: %v", err)
+			}
+			c.MinRequests = n
+		case "max_error_rate":
+			rate, err := strconv.ParseFloat(strings.TrimSuffix(d.Val(), "%"), 64)
+			if err != nil {
+				return d.Errf("error parsing max_error_rate: %v", err)
+			}
+			c.MaxErrorRate = &rate
+		default:
+			return d.Errf("unrecognized slo option '%s'", opt)
+		}
+	}
+	return nil
+}
+
+// sloEvaluator evaluates a handler's secondary against its objectives, and keeps the last verdict
+type sloEvaluator struct {
+	cfg     SLOConfig
+	name    string
+	stats   *stats
+	slogger slogger
+	// emit emits a Caddy event
+	emit func(event string, data map[string]any)
+
+	last statsTotals
+	// passing is whether the last evaluated window met every objective. It's false until a window is evaluated, so
+	// nothing is promoted on no evidence.
+	passing atomic.Bool
+}
+
+// sloObjective is the outcome of evaluating one objective. Latencies are in seconds, and error rates in percent.
+type sloObjective struct {
+	objective string
+	value     float64
+	target    float64
+	met       bool
+}
+
+// watch evaluates the objectives every window, until done is closed
+func (e *sloEvaluator) watch(done <-chan struct{}) {
+	ticker := time.NewTicker(time.Duration(e.cfg.Window))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			e.evaluate()
+		}
+	}
+}
+
+// evaluate evaluates every objective against the secondary's requests since the last evaluation, and reports the
+// verdict
+func (e *sloEvaluator) evaluate() {
+	totals := e.stats.totals()
+	window := totals.sub(e.last)
+	e.last = totals
+	latencies := e.stats.secondary.sloLatencies.reset()
+	if window.SecondaryRequests < e.cfg.MinRequests {
+		return
+	}
+
+	var objectives []sloObjective
+	for _, p := range []struct {
+		objective string
+		max       *caddy.Duration
+		value     float64
+	}{
+		{"p50", e.cfg.MaxP50, latencies.P50},
+		{"p95", e.cfg.MaxP95, latencies.P95},
+		{"p99", e.cfg.MaxP99, latencies.P99},
+	} {
+		if p.max != nil {
+			target := time.Duration(*p.max).Seconds()
+			objectives = append(objectives, sloObjective{p.objective, p.value, target, p.value <= target})
+		}
+	}
+	if e.cfg.MaxErrorRate != nil {
+		rate := float64(window.SecondaryErrors) / float64(window.SecondaryRequests) * 100
+		objectives = append(objectives, sloObjective{"error_rate", rate, *e.cfg.MaxErrorRate, rate <= *e.cfg.MaxErrorRate})
+	}
+
+	passing := true
+	attrs := []any{
+		slog.String("window", time.Duration(e.cfg.Window).String()),
+		slog.Int64("requests", window.SecondaryRequests),
+	}
+	data := map[string]any{
+		"handler":  e.name,
+		"requests": window.SecondaryRequests,
+	}
+	for _, o := range objectives {
+		passing = passing && o.met
+		attrs = append(attrs, slog.Group(o.objective,
+			slog.Float64("value", o.value),
+			slog.Float64("target", o.target),
+			slog.Bool("met", o.met),
+		))
+		data[o.objective] = map[string]any{"value": o.value, "target": o.target, "met": o.met}
+	}
+	e.passing.Store(passing)
+
+	verdict := verdictPass
+	if !passing {
+		verdict = verdictFail
+	}
+	attrs = append([]any{slog.String("verdict", verdict)}, attrs...)
+	data["verdict"] = verdict
+	if passing {
+		e.slogger.Info("shadow_slo", attrs...)
+	} else {
+		e.slogger.Warn("shadow_slo", attrs...)
+	}
+	e.emit("mirror_slo", data)
+}
@@ -0,0 +1,91 @@
+package mirror
+
+import (
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+func Test_sloEvaluator_evaluate(t *testing.T) {
+	var logged []string
+	var events []map[string]any
+	e := &sloEvaluator{
+		cfg: SLOConfig{
+			MinRequests:  10,
+			MaxP99:       ptr(caddy.Duration(300 * time.Millisecond)),
+			MaxErrorRate: ptr(1.0),
+		},
+		name:  "test",
+		stats: newStats(),
+		slogger: &sloggerMock{
+			warn: func(str string, in ...any) { logged = append(logged, "warn:"+str) },
+			info: func(str string, in ...any) { logged = append(logged, "info:"+str) },
+		},
+		emit: func(event string, data map[string]any) {
+			events = append(events, data)
+		},
+	}
+	e.stats.secondary.sloLatencies = new(reservoir)
+
+	requests := func(n int, latency time.Duration, status int) {
+		for range n {
+			e.stats.observe("secondary", latency, status, nil)
+		}
+	}
+
+	// Too few requests to evaluate, so the verdict stays failing until there's evidence
+	requests(5, 10*time.Millisecond, 200)
+	e.evaluate()
+	if len(events) != 0 || e.passing.Load() {
+		t.Fatalf("window below min_requests was evaluated: %v", events)
+	}
+
+	requests(100, 10*time.Millisecond, 200)
+	e.evaluate()
+	if !e.passing.Load() || len(events) != 1 || events[0]["verdict"] != verdictPass {
+		t.Errorf("evaluate() within objectives = %v, want a pass", events)
+	}
+
+	requests(98, 10*time.Millisecond, 200)
+	requests(2, time.Second, 503)
+	e.evaluate()
+	if e.passing.Load() || len(events) != 2 || events[1]["verdict"] != verdictFail {
+		t.Fatalf("evaluate() over max_error_rate = %v, want a fail", events)
+	}
+	if errorRate := events[1]["error_rate"].(map[string]any); errorRate["value"] != 2.0 || errorRate["met"] != false {
+		t.Errorf("error_rate = %v, want 2 and unmet", errorRate)
+	}
+	// Only 2% of requests were slow, so the p99 is still one of them
+	if p99 := events[1]["p99"].(map[string]any); p99["met"] != false {
+		t.Errorf("p99 = %v, want unmet", p99)
+	}
+	if want := "info:shadow_slo warn:shadow_slo"; len(logged) != 2 || logged[0]+" "+logged[1] != want {
+		t.Errorf("logged = %v, want %s", logged, want)
+	}
+}
+
+func TestSLOConfig_UnmarshalCaddyfile(t *testing.T) {
+	var c SLOConfig
+	err := c.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`slo 10m {
+		min_requests 50
+		max_p99 300ms
+		max_error_rate 0.1%
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Window != caddy.Duration(10*time.Minute) || c.MinRequests != 50 || *c.MaxP99 != caddy.Duration(300*time.Millisecond) || *c.MaxErrorRate != 0.1 {
+		t.Errorf("UnmarshalCaddyfile() = %+v", c)
+	}
+	if c.MaxP50 != nil || c.MaxP95 != nil {
+		t.Errorf("UnmarshalCaddyfile() set objectives which weren't configured")
+	}
+
+	if err := new(SLOConfig).UnmarshalCaddyfile(caddyfile.NewTestDispenser(`slo {
+		max_p999 1s
+	}`)); err == nil {
+		t.Error("UnmarshalCaddyfile() with an unknown objective didn't fail")
+	}
+}
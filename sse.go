@@ -0,0 +1,142 @@
+package mirror
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"log/slog"
+	"mime"
+	"net/http"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+var (
+	_ Comparer              = EventStreamComparer{}
+	_ caddyfile.Unmarshaler = (*EventStreamComparer)(nil)
+)
+
+func init() {
+	caddy.RegisterModule(EventStreamComparer{})
+}
+
+// isEventStream reports whether a response is a stream of Server-Sent Events. Event streams are never buffered, since
+// they may never end.
+func isEventStream(hdr http.Header) bool {
+	mediaType, _, _ := mime.ParseMediaType(hdr.Get("Content-Type"))
+	return mediaType == "text/event-stream"
+}
+
+// eventHasher passes a response through, and if it's an event stream, keeps a rolling hash of its events as they're
+// written. Comments and the id and retry fields are left out of the hash, since they're expected to differ.
+type eventHasher struct {
+	http.ResponseWriter
+
+	hash hash.Hash
+	// line is the current line, until it's complete, and event is the current event's fields
+	line, event []byte
+	events      int
+}
+
+func (e *eventHasher) WriteHeader(status int) {
+	if !informational(status) && isEventStream(e.Header()) {
+		e.hash = sha256.New()
+	}
+	e.ResponseWriter.WriteHeader(status)
+}
+
+func (e *eventHasher) Write(p []byte) (int, error) {
+	if e.hash != nil {
+		e.feed(p)
+	}
+	return e.ResponseWriter.Write(p)
+}
+
+// feed splits p into lines, and hashes each event once the blank line ending it is written
+func (e *eventHasher) feed(p []byte) {
+	for len(p) > 0 {
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			e.line = append(e.line, p...)
+			return
+		}
+		e.line = append(e.line, p[:i]...)
+		p = p[i+1:]
+
+		line := bytes.TrimSuffix(e.line, []byte{'\r'})
+		field, _, _ := bytes.Cut(line, []byte{':'})
+		switch {
+		case len(line) == 0:
+			if len(e.event) > 0 {
+				e.hash.Write(e.event)
+				e.hash.Write([]byte{'\n'})
+				e.events++
+				e.event = e.event[:0]
+			}
+		case len(field) == 0, string(field) == "id", string(field) == "retry":
+			// Comments, and fields which are expected to differ
+		default:
+			e.event = append(e.event, line...)
+			e.event = append(e.event, '\n')
+		}
+		e.line = e.line[:0]
+	}
+}
+
+// sum returns the number of events and their hash, or zero values if the response wasn't an event stream
+func (e *eventHasher) sum() (int, string) {
+	if e == nil || e.hash == nil {
+		return 0, ""
+	}
+	return e.events, hex.EncodeToString(e.hash.Sum(nil))
+}
+
+// Unwrap lets http.ResponseController reach the wrapped writer
+func (e *eventHasher) Unwrap() http.ResponseWriter {
+	return e.ResponseWriter
+}
+
+// FlushError flushes through to the wrapped writer, so events are still delivered as they're written
+func (e *eventHasher) FlushError() error {
+	return http.NewResponseController(e.ResponseWriter).Flush()
+}
+
+// Push implements http.Pusher, since http.ResponseController can't reach it through Unwrap
+func (e *eventHasher) Push(target string, opts *http.PushOptions) error {
+	return push(e.ResponseWriter, target, opts)
+}
+
+// EventStreamComparer compares Server-Sent Event streams by the hashes of their events. Streams which weren't event
+// streams on both sides are skipped.
+type EventStreamComparer struct{}
+
+func (EventStreamComparer) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "mirror.comparers.events",
+		New: func() caddy.Module { return new(EventStreamComparer) },
+	}
+}
+
+func (EventStreamComparer) Compare(primary, secondary ResponseArtifact) Result {
+	res := Result{Comparer: "events"}
+	if primary.EventsHash == "" || secondary.EventsHash == "" {
+		res.Skipped = true
+		return res
+	}
+	res.Match = primary.EventsHash == secondary.EventsHash
+	res.Attrs = []slog.Attr{
+		slog.Int("primary_events", primary.Events),
+		slog.Int("shadow_events", secondary.Events),
+	}
+	return res
+}
+
+func (*EventStreamComparer) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume comparer name
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	return nil
+}
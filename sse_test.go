@@ -0,0 +1,78 @@
+package mirror
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func Test_eventHasher(t *testing.T) {
+	stream := func(chunks ...string) (int, string) {
+		e := &eventHasher{ResponseWriter: httptest.NewRecorder()}
+		e.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+		e.WriteHeader(http.StatusOK)
+		for _, chunk := range chunks {
+			_, _ = e.Write([]byte(chunk))
+		}
+		return e.sum()
+	}
+
+	events, hash := stream("event: tick\ndata: 1\n\n", "data: 2\n\n")
+	if events != 2 {
+		t.Errorf("events = %d, want 2", events)
+	}
+
+	// Split across writes, with CRLFs, comments, and different ids and retries
+	if gotEvents, got := stream(": hello\r\nid: 7\r\nevent: ti", "ck\r\ndata: 1\r\n\r\nretry: 10\nid: 8\ndata: 2\n", "\n"); got != hash || gotEvents != events {
+		t.Errorf("sum() = %d, %s, want %d, %s", gotEvents, got, events, hash)
+	}
+	if _, got := stream("event: tick\ndata: 1\n\n", "data: 3\n\n"); got == hash {
+		t.Errorf("sum() of different events = %s, want a different hash", got)
+	}
+	// An event isn't hashed until it's finished
+	if gotEvents, _ := stream("event: tick\ndata: 1\n\n", "data: 2\n"); gotEvents != 1 {
+		t.Errorf("events = %d, want 1", gotEvents)
+	}
+}
+
+func Test_eventHasher_notEventStream(t *testing.T) {
+	e := &eventHasher{ResponseWriter: httptest.NewRecorder()}
+	e.Header().Set("Content-Type", "application/json")
+	e.WriteHeader(http.StatusOK)
+	_, _ = e.Write([]byte("data: 1\n\n"))
+	if events, hash := e.sum(); events != 0 || hash != "" {
+		t.Errorf("sum() = %d, %s, want 0 and no hash", events, hash)
+	}
+}
+
+func TestHandler_shouldBuffer_eventStream(t *testing.T) {
+	h := &Handler{ComparisonConfig: ComparisonConfig{CompareBody: true}}
+	hdr := http.Header{"Content-Type": {"text/event-stream"}}
+	if h.shouldBuffer(http.StatusOK, hdr) {
+		t.Errorf("shouldBuffer() = true for an event stream")
+	}
+}
+
+func TestEventStreamComparer_Compare(t *testing.T) {
+	tests := []struct {
+		name                string
+		primary, secondary  ResponseArtifact
+		wantMatch, wantSkip bool
+	}{
+		{"match", ResponseArtifact{Events: 2, EventsHash: "a"}, ResponseArtifact{Events: 2, EventsHash: "a"}, true, false},
+		{"mismatch", ResponseArtifact{Events: 2, EventsHash: "a"}, ResponseArtifact{Events: 1, EventsHash: "b"}, false, false},
+		{"not event streams", ResponseArtifact{}, ResponseArtifact{}, false, true},
+		{"one event stream", ResponseArtifact{Events: 2, EventsHash: "a"}, ResponseArtifact{}, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := EventStreamComparer{}.Compare(tt.primary, tt.secondary)
+			if res.Skipped != tt.wantSkip {
+				t.Errorf("Skipped = %v, want %v", res.Skipped, tt.wantSkip)
+			}
+			if !tt.wantSkip && res.Match != tt.wantMatch {
+				t.Errorf("Match = %v, want %v", res.Match, tt.wantMatch)
+			}
+		})
+	}
+}
@@ -0,0 +1,188 @@
+package mirror
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var _ http.Handler = (*Mirror)(nil)
+
+// Mirror is a Handler for plain net/http services, which don't run Caddy. Requests are served by the primary, and
+// mirrored to the secondary, just as they are in Caddy.
+type Mirror struct {
+	h      *Handler
+	ctx    caddy.Context
+	cancel context.CancelFunc
+}
+
+// Option configures a Mirror. WithClock and WithSamplingRand can also be applied to a Handler before it's provisioned,
+// for tests against it.
+type Option func(*Handler)
+
+// New returns a Mirror, which serves requests with primary, and mirrors them to secondary. By default, every request is
+// mirrored, nothing is compared, and logs go to slog.Default(). Options configure the rest, as their Caddyfile and JSON
+// equivalents do. Close stops its background work once it's no longer needed.
+func New(primary, secondary http.Handler, opts ...Option) (*Mirror, error) {
+	logger := slog.Default()
+	h := &Handler{
+		primary:           httpHandler{primary},
+		secondary:         httpHandler{secondary},
+		slogger:           logger,
+		comparisonSlogger: logger,
+		accessSlogger:     logger,
+	}
+	for _, opt := range opts {
+		opt(h)
+	}
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	if err := h.provision(ctx); err != nil {
+		cancel()
+		return nil, err
+	}
+	return &Mirror{h: h, ctx: ctx, cancel: cancel}, nil
+}
+
+// ServeHTTP implements http.Handler
+func (m *Mirror) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// The handler relies on the request context Caddy's server sets up, like its vars
+	r = caddyhttp.PrepareRequest(r, caddy.NewReplacer(), w, nil)
+	err := m.h.ServeHTTP(w, r, caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error {
+		return nil
+	}))
+	if err != nil {
+		status := errorStatus(0, err)
+		http.Error(w, http.StatusText(status), status)
+	}
+}
+
+// Metrics is the registry of the Mirror's metrics, if WithMetrics was set. It can be served with promhttp.HandlerFor,
+// or gathered along with other registries.
+func (m *Mirror) Metrics() *prometheus.Registry {
+	return m.ctx.GetMetricsRegistry()
+}
+
+// Close stops the Mirror's background work. Requests which are still in flight aren't waited for.
+func (m *Mirror) Close() error {
+	err := m.h.Cleanup()
+	m.cancel()
+	return err
+}
+
+// httpHandler adapts a plain http.Handler to the primary or secondary. It's the end of its route, so it never calls
+// next.
+type httpHandler struct {
+	http.Handler
+}
+
+func (h httpHandler) ServeHTTP(w http.ResponseWriter, r *http.Request, _ caddyhttp.Handler) error {
+	h.Handler.ServeHTTP(w, r)
+	return nil
+}
+
+// WithMirrorRate sets the percentage of requests which are mirrored, like mirror_rate. -1 mirrors none.
+func WithMirrorRate(percent float64) Option {
+	return func(h *Handler) {
+		h.MirrorRate = percent
+	}
+}
+
+// WithSampler decides which requests are mirrored with s, instead of the mirror rate, like sampler
+func WithSampler(s Sampler) Option {
+	return func(h *Handler) {
+		h.sampler = s
+	}
+}
+
+// WithComparison sets which responses are compared, and how, like compare_body, compare_jq, and the other comparison
+// options
+func WithComparison(c ComparisonConfig) Option {
+	return func(h *Handler) {
+		h.ComparisonConfig = c
+	}
+}
+
+// WithComparers adds comparers, which run after any enabled by WithComparison, like comparer
+func WithComparers(comparers ...Comparer) Option {
+	return func(h *Handler) {
+		h.comparers = append(h.comparers, comparers...)
+	}
+}
+
+// WithReporting sets how comparisons are logged, like no_log, log_level, and the other reporting options. Its Logger
+// is ignored, since WithLogger sets the logger.
+func WithReporting(c ReportingConfig) Option {
+	return func(h *Handler) {
+		h.ReportingConfig = c
+	}
+}
+
+// WithReporters adds reporters, which receive every comparison's report, like reporter
+func WithReporters(reporters ...Reporter) Option {
+	return func(h *Handler) {
+		h.reporters = append(h.reporters, reporters...)
+	}
+}
+
+// WithSecondaryRequest sets how mirrored requests are rewritten and sent, like the secondary_* options
+func WithSecondaryRequest(c SecondaryRequestConfig) Option {
+	return func(h *Handler) {
+		h.SecondaryRequestConfig = c
+	}
+}
+
+// WithTimeout sets a deadline for the secondary, like secondary_timeout. 0 disables it. Defaults to 30s.
+func WithTimeout(d time.Duration) Option {
+	return func(h *Handler) {
+		h.Timeout = d.String()
+		if d == 0 {
+			h.Timeout = "none"
+		}
+	}
+}
+
+// WithSynchronous waits for the secondary, and compares the responses, before each request is done, like synchronous
+func WithSynchronous() Option {
+	return func(h *Handler) {
+		h.Synchronous = true
+	}
+}
+
+// WithMetrics enables metrics, like metrics, in the registry returned by Metrics. name prefixes them, like
+// metrics_name.
+func WithMetrics(name string) Option {
+	return func(h *Handler) {
+		h.MetricsName = name
+	}
+}
+
+// WithLogger logs through l, instead of slog.Default()
+func WithLogger(l *slog.Logger) Option {
+	return func(h *Handler) {
+		h.slogger, h.comparisonSlogger, h.accessSlogger = l, l, l
+	}
+}
+
+// WithClock tells the time with now, instead of time.Now, for report times, and the windows of ramps, quotas, dedupe,
+// and the scorecard. It's meant for tests which control the time.
+func WithClock(now func() time.Time) Option {
+	return func(h *Handler) {
+		h.now = now
+	}
+}
+
+// WithSamplingRand makes every sampling decision with draw, instead of random draws or sampling_seed. draw returns a
+// value in the range [0.0, 1.0) for a decision about r, like SamplingRand, and salt tells apart the decisions made
+// about the same request: "mirror_rate", "tenant", "ramp_up", "slow_start", "load_governor", or a sampler's own. It's
+// meant for tests which decide exactly which requests are mirrored.
+func WithSamplingRand(draw func(r *http.Request, salt string) float64) Option {
+	return func(h *Handler) {
+		h.draw = draw
+	}
+}
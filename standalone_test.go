@@ -0,0 +1,89 @@
+package mirror
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestNew(t *testing.T) {
+	respond := func(body string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			_, _ = io.WriteString(w, body)
+		}
+	}
+	var reports []Report
+	m, err := New(respond("Hello, world!"), respond("Hi, world!"),
+		WithComparison(ComparisonConfig{CompareStatus: true, CompareBody: true}),
+		WithReporting(ReportingConfig{NoLog: true}),
+		WithReporters(reporterFunc(func(rep Report) {
+			reports = append(reports, rep)
+		})),
+		WithSynchronous(),
+		WithMetrics("standalone"),
+		WithLogger(slog.New(slog.DiscardHandler)),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/greeting", nil))
+	if rec.Body.String() != "Hello, world!" {
+		t.Errorf("response body = %q, want the primary's", rec.Body.String())
+	}
+	if len(reports) != 1 || reports[0].Match {
+		t.Fatalf("reports = %+v, want a mismatch", reports)
+	}
+
+	families, err := m.Metrics().Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(families) == 0 {
+		t.Errorf("Metrics() gathered nothing")
+	}
+
+	if _, err := New(respond(""), respond(""), WithComparison(ComparisonConfig{CompareJQ: []JQQuery{"not valid ("}})); err == nil {
+		t.Errorf("New() accepted an invalid jq query")
+	}
+}
+
+func TestNew_clockAndSamplingRand(t *testing.T) {
+	now := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	var reports []Report
+	m, err := New(http.NotFoundHandler(), http.NotFoundHandler(),
+		WithMirrorRate(50),
+		WithComparison(ComparisonConfig{CompareStatus: true}),
+		WithReporting(ReportingConfig{NoLog: true}),
+		WithReporters(reporterFunc(func(rep Report) {
+			reports = append(reports, rep)
+		})),
+		WithSynchronous(),
+		WithClock(func() time.Time { return now }),
+		WithSamplingRand(func(r *http.Request, salt string) float64 {
+			if r.URL.Path == "/mirrored" {
+				return 0.1
+			}
+			return 0.9
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	for _, path := range []string{"/mirrored", "/not-mirrored"} {
+		m.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+	if len(reports) != 1 || reports[0].Request.URI != "/mirrored" {
+		t.Fatalf("reports = %+v, want one for /mirrored", reports)
+	}
+	if !reports[0].Time.Equal(now) {
+		t.Errorf("report time = %v, want %v", reports[0].Time, now)
+	}
+}
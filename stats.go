@@ -0,0 +1,484 @@
+package mirror
+
+import (
+	"math"
+	"math/rand/v2"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// latencySamples is the size of each handler's latency reservoir. Percentiles are estimated from at most this many
+	// samples per summary interval.
+	latencySamples = 2048
+	// maxMismatchPaths bounds the number of distinct paths counted per summary interval. Mismatches for paths beyond
+	// it are counted under "other".
+	maxMismatchPaths = 1000
+)
+
+// stats are live counters for a handler, kept whether or not metrics are enabled. Methods are safe to call on a nil
+// *stats, which records nothing.
+type stats struct {
+	mirrored, notMirrored atomic.Int64
+	inFlight              atomic.Int64
+	matched, mismatched   atomic.Int64
+	// excluded weren't compared because their secondary failed
+	excluded atomic.Int64
+	// comparing are the comparisons waiting for the secondary, or running
+	comparing atomic.Int64
+
+	primary, secondary handlerStats
+
+	// recent are the counts over the last minute
+	recent *slidingWindow
+	// budget tracks the secondary's success ratio, if error_budget is set
+	budget *errorBudget
+
+	mu            sync.Mutex
+	mismatchPaths map[string]int
+}
+
+// handlerStats are the stats for one of the primary or secondary handlers
+type handlerStats struct {
+	requests atomic.Int64
+	// errors are handler errors and 5xx responses
+	errors atomic.Int64
+
+	// latencies are sampled for summaries, alertLatencies for alerts, and sloLatencies for SLOs, if they're
+	// configured. Each is reset by its own reader.
+	latencies      reservoir
+	alertLatencies *reservoir
+	sloLatencies   *reservoir
+}
+
+// reservoir keeps a uniform sample of up to latencySamples values, without unbounded memory. Methods are safe to call
+// on a nil *reservoir, which keeps nothing.
+type reservoir struct {
+	mu      sync.Mutex
+	samples []float64
+	seen    int
+}
+
+func newStats() *stats {
+	return &stats{
+		recent:        newSlidingWindow(time.Minute, time.Second),
+		mismatchPaths: make(map[string]int),
+	}
+}
+
+func (s *stats) handler(name string) *handlerStats {
+	if name == "primary" {
+		return &s.primary
+	}
+	return &s.secondary
+}
+
+// sampled records whether a request was mirrored
+func (s *stats) sampled(mirrored bool) {
+	if s == nil {
+		return
+	}
+	if mirrored {
+		s.mirrored.Add(1)
+		s.recent.record(func(c *windowCounts) { c.Mirrored++ })
+	} else {
+		s.notMirrored.Add(1)
+		s.recent.record(func(c *windowCounts) { c.NotMirrored++ })
+	}
+}
+
+// started and finished track how many secondary requests are in flight
+func (s *stats) started() {
+	if s != nil {
+		s.inFlight.Add(1)
+	}
+}
+
+func (s *stats) finished() {
+	if s != nil {
+		s.inFlight.Add(-1)
+	}
+}
+
+// comparisonStarted and comparisonFinished track how many comparisons are running, or waiting for the secondary
+func (s *stats) comparisonStarted() {
+	if s != nil {
+		s.comparing.Add(1)
+	}
+}
+
+func (s *stats) comparisonFinished() {
+	if s != nil {
+		s.comparing.Add(-1)
+	}
+}
+
+// observe records a handled request's latency, and whether it failed
+func (s *stats) observe(name string, latency time.Duration, status int, err error) {
+	if s == nil {
+		return
+	}
+
+	hs := s.handler(name)
+	hs.requests.Add(1)
+	failed := err != nil || status >= 500
+	if failed {
+		hs.errors.Add(1)
+	}
+	count := func(c *windowCounts) {
+		if name == "primary" {
+			c.PrimaryRequests++
+			if failed {
+				c.PrimaryErrors++
+			}
+		} else {
+			c.SecondaryRequests++
+			if failed {
+				c.SecondaryErrors++
+			}
+		}
+	}
+	s.recent.record(count)
+	s.budget.record(count)
+
+	hs.latencies.add(latency.Seconds())
+	hs.alertLatencies.add(latency.Seconds())
+	hs.sloLatencies.add(latency.Seconds())
+}
+
+func (r *reservoir) add(v float64) {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.seen++
+	if len(r.samples) < latencySamples {
+		r.samples = append(r.samples, v)
+	} else if i := rand.IntN(r.seen); i < latencySamples {
+		r.samples[i] = v
+	}
+}
+
+// lagged records how long after the primary a secondary request finished. Secondaries which finished first count as
+// no lag.
+func (s *stats) lagged(lag time.Duration) {
+	if s == nil {
+		return
+	}
+	s.recent.record(func(c *windowCounts) {
+		c.lag += max(lag, 0)
+		c.lagged++
+	})
+}
+
+// compared records the outcome of a report
+func (s *stats) compared(rep Report) {
+	if s == nil {
+		return
+	}
+
+	if rep.Match {
+		s.matched.Add(1)
+		s.recent.record(func(c *windowCounts) { c.Matched++ })
+		return
+	}
+	s.mismatched.Add(1)
+	s.recent.record(func(c *windowCounts) { c.Mismatched++ })
+
+	path := rep.Request.Path()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.mismatchPaths[path]; !ok && len(s.mismatchPaths) >= maxMismatchPaths {
+		path = "other"
+	}
+	s.mismatchPaths[path]++
+}
+
+// exclude records a request which wasn't compared because its secondary failed
+func (s *stats) exclude() {
+	if s == nil {
+		return
+	}
+	s.excluded.Add(1)
+	s.recent.record(func(c *windowCounts) { c.Excluded++ })
+}
+
+// statsTotals are cumulative counts since the handler was provisioned
+type statsTotals struct {
+	Mirrored          int64 `json:"mirrored"`
+	NotMirrored       int64 `json:"not_mirrored"`
+	Matched           int64 `json:"matched"`
+	Mismatched        int64 `json:"mismatched"`
+	Excluded          int64 `json:"excluded"`
+	PrimaryRequests   int64 `json:"primary_requests"`
+	PrimaryErrors     int64 `json:"primary_errors"`
+	SecondaryRequests int64 `json:"secondary_requests"`
+	SecondaryErrors   int64 `json:"secondary_errors"`
+}
+
+func (s *stats) totals() statsTotals {
+	return statsTotals{
+		Mirrored:          s.mirrored.Load(),
+		NotMirrored:       s.notMirrored.Load(),
+		Matched:           s.matched.Load(),
+		Mismatched:        s.mismatched.Load(),
+		Excluded:          s.excluded.Load(),
+		PrimaryRequests:   s.primary.requests.Load(),
+		PrimaryErrors:     s.primary.errors.Load(),
+		SecondaryRequests: s.secondary.requests.Load(),
+		SecondaryErrors:   s.secondary.errors.Load(),
+	}
+}
+
+func (t statsTotals) sub(o statsTotals) statsTotals {
+	return statsTotals{
+		Mirrored:          t.Mirrored - o.Mirrored,
+		NotMirrored:       t.NotMirrored - o.NotMirrored,
+		Matched:           t.Matched - o.Matched,
+		Mismatched:        t.Mismatched - o.Mismatched,
+		Excluded:          t.Excluded - o.Excluded,
+		PrimaryRequests:   t.PrimaryRequests - o.PrimaryRequests,
+		PrimaryErrors:     t.PrimaryErrors - o.PrimaryErrors,
+		SecondaryRequests: t.SecondaryRequests - o.SecondaryRequests,
+		SecondaryErrors:   t.SecondaryErrors - o.SecondaryErrors,
+	}
+}
+
+// matchRate is the fraction of compared requests which matched, or NaN if none were compared
+func (t statsTotals) matchRate() float64 {
+	compared := t.Matched + t.Mismatched
+	if compared == 0 {
+		return math.NaN()
+	}
+	return float64(t.Matched) / float64(compared)
+}
+
+// latencyPercentiles are in seconds
+type latencyPercentiles struct {
+	P50 float64 `json:"p50"`
+	P95 float64 `json:"p95"`
+	P99 float64 `json:"p99"`
+}
+
+// reset returns the percentiles of the samples since the last reset, and starts a new sample
+func (r *reservoir) reset() latencyPercentiles {
+	r.mu.Lock()
+	samples := r.samples
+	r.samples, r.seen = make([]float64, 0, len(samples)), 0
+	r.mu.Unlock()
+
+	slices.Sort(samples)
+	return latencyPercentiles{
+		P50: percentile(samples, 0.50),
+		P95: percentile(samples, 0.95),
+		P99: percentile(samples, 0.99),
+	}
+}
+
+// percentile of sorted samples, using the nearest-rank method. It's zero without samples.
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(p*float64(len(sorted)))) - 1
+	return sorted[max(rank, 0)]
+}
+
+type pathCount struct {
+	Path  string `json:"path"`
+	Count int    `json:"count"`
+}
+
+// resetMismatchPaths returns the n paths with the most mismatches since the last reset, and starts counting again
+func (s *stats) resetMismatchPaths(n int) []pathCount {
+	s.mu.Lock()
+	counts := s.mismatchPaths
+	s.mismatchPaths = make(map[string]int)
+	s.mu.Unlock()
+
+	top := make([]pathCount, 0, len(counts))
+	for path, count := range counts {
+		top = append(top, pathCount{Path: path, Count: count})
+	}
+	slices.SortFunc(top, func(a, b pathCount) int {
+		if a.Count != b.Count {
+			return b.Count - a.Count
+		}
+		if a.Path < b.Path {
+			return -1
+		}
+		return 1
+	})
+	return top[:min(n, len(top))]
+}
+
+// windowCounts are the counts kept by a slidingWindow
+type windowCounts struct {
+	Mirrored          int64 `json:"mirrored"`
+	NotMirrored       int64 `json:"not_mirrored"`
+	Matched           int64 `json:"matched"`
+	Mismatched        int64 `json:"mismatched"`
+	Excluded          int64 `json:"excluded"`
+	PrimaryRequests   int64 `json:"primary_requests"`
+	PrimaryErrors     int64 `json:"primary_errors"`
+	SecondaryRequests int64 `json:"secondary_requests"`
+	SecondaryErrors   int64 `json:"secondary_errors"`
+
+	// lag is the total time secondary requests finished after their primaries, over lagged requests
+	lag    time.Duration
+	lagged int64
+}
+
+func (c *windowCounts) add(o windowCounts) {
+	c.Mirrored += o.Mirrored
+	c.NotMirrored += o.NotMirrored
+	c.Matched += o.Matched
+	c.Mismatched += o.Mismatched
+	c.Excluded += o.Excluded
+	c.PrimaryRequests += o.PrimaryRequests
+	c.PrimaryErrors += o.PrimaryErrors
+	c.SecondaryRequests += o.SecondaryRequests
+	c.SecondaryErrors += o.SecondaryErrors
+	c.lag += o.lag
+	c.lagged += o.lagged
+}
+
+// secondaryLag is how long after their primaries secondary requests finished on average, or zero if none did
+func (c windowCounts) secondaryLag() time.Duration {
+	if c.lagged == 0 {
+		return 0
+	}
+	return c.lag / time.Duration(c.lagged)
+}
+
+// matchRate is the fraction of compared requests which matched, or NaN if none were compared
+func (c windowCounts) matchRate() float64 {
+	compared := c.Matched + c.Mismatched
+	if compared == 0 {
+		return math.NaN()
+	}
+	return float64(c.Matched) / float64(compared)
+}
+
+// slidingWindow counts events over a trailing window of time, in fixed-size buckets. Old buckets are cleared as time
+// moves forward, so memory use is constant.
+type slidingWindow struct {
+	bucket time.Duration
+	now    func() time.Time
+
+	mu      sync.Mutex
+	buckets []windowCounts
+	// head is the index of the current bucket, and headAt is the bucket number of the current bucket since the epoch
+	head   int
+	headAt int64
+}
+
+func newSlidingWindow(size, bucket time.Duration) *slidingWindow {
+	return &slidingWindow{
+		bucket:  bucket,
+		now:     time.Now,
+		buckets: make([]windowCounts, max(int(size/bucket), 1)),
+	}
+}
+
+// advance moves head to the current bucket, clearing every bucket skipped over. It must be called with mu held.
+func (w *slidingWindow) advance() {
+	at := w.now().UnixNano() / int64(w.bucket)
+	steps := min(at-w.headAt, int64(len(w.buckets)))
+	for range steps {
+		w.head = (w.head + 1) % len(w.buckets)
+		w.buckets[w.head] = windowCounts{}
+	}
+	if at > w.headAt {
+		w.headAt = at
+	}
+}
+
+func (w *slidingWindow) record(fn func(*windowCounts)) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.advance()
+	fn(&w.buckets[w.head])
+}
+
+// sum returns the counts over the whole window
+func (w *slidingWindow) sum() windowCounts {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.advance()
+
+	var total windowCounts
+	for _, b := range w.buckets {
+		total.add(b)
+	}
+	return total
+}
+
+// size is the duration the window covers
+func (w *slidingWindow) size() time.Duration {
+	return w.bucket * time.Duration(len(w.buckets))
+}
+
+// statsSnapshot is the live state of a handler, as served by the admin API
+type statsSnapshot struct {
+	Name string `json:"name"`
+	// MirrorRate is the configured mirror_rate, as a percentage. It's omitted if a sampler is configured.
+	MirrorRate *float64 `json:"mirror_rate,omitempty"`
+	// EffectiveMirrorRate is the percentage of requests mirrored in the last minute
+	EffectiveMirrorRate *float64    `json:"effective_mirror_rate,omitempty"`
+	InFlight            int64       `json:"in_flight"`
+	Comparing           int64       `json:"comparing"`
+	Draining            bool        `json:"draining"`
+	Totals              statsTotals `json:"totals"`
+	LastMinute          lastMinute  `json:"last_minute"`
+	// Quota is omitted if no quota is set
+	Quota *quotaUsage `json:"quota,omitempty"`
+	// ErrorBudget is omitted if no error budget is set
+	ErrorBudget *errorBudgetSnapshot `json:"error_budget,omitempty"`
+}
+
+type lastMinute struct {
+	windowCounts
+	MirroredPerSecond float64  `json:"mirrored_per_second"`
+	MatchRate         *float64 `json:"match_rate,omitempty"`
+	// SecondaryLag is how long after their primaries secondary requests finished on average, in seconds
+	SecondaryLag float64 `json:"secondary_lag_seconds"`
+}
+
+func (h *Handler) statsSnapshot() statsSnapshot {
+	recent := h.stats.recent.sum()
+	snap := statsSnapshot{
+		Name:      h.Name,
+		InFlight:  h.stats.inFlight.Load(),
+		Comparing: h.stats.comparing.Load(),
+		Draining:  h.drain.active(),
+		Totals:    h.stats.totals(),
+		LastMinute: lastMinute{
+			windowCounts:      recent,
+			MirroredPerSecond: float64(recent.Mirrored) / h.stats.recent.size().Seconds(),
+			SecondaryLag:      recent.secondaryLag().Seconds(),
+		},
+	}
+
+	if h.sampler == nil {
+		snap.MirrorRate = ptr(h.MirrorRate * 100)
+	}
+	if seen := recent.Mirrored + recent.NotMirrored; seen > 0 {
+		snap.EffectiveMirrorRate = ptr(float64(recent.Mirrored) / float64(seen) * 100)
+	}
+	if rate := recent.matchRate(); !math.IsNaN(rate) {
+		snap.LastMinute.MatchRate = &rate
+	}
+	if h.quota != nil {
+		snap.Quota = ptr(h.quota.usage())
+	}
+	if h.stats.budget != nil {
+		snap.ErrorBudget = ptr(h.stats.budget.snapshot(snap.Totals))
+	}
+
+	return snap
+}
@@ -0,0 +1,169 @@
+package mirror
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func Test_percentile(t *testing.T) {
+	samples := make([]float64, 100)
+	for i := range samples {
+		samples[i] = float64(i + 1)
+	}
+
+	tests := []struct {
+		p    float64
+		want float64
+	}{
+		{0.50, 50},
+		{0.95, 95},
+		{0.99, 99},
+		{1, 100},
+	}
+	for _, tt := range tests {
+		if got := percentile(samples, tt.p); got != tt.want {
+			t.Errorf("percentile(%v) = %v, want %v", tt.p, got, tt.want)
+		}
+	}
+	if got := percentile(nil, 0.5); got != 0 {
+		t.Errorf("percentile of no samples = %v, want 0", got)
+	}
+}
+
+func TestHandler_logSummary(t *testing.T) {
+	var msg string
+	attrs := make(map[string]slog.Value)
+	h := &Handler{
+		stats: newStats(),
+		slogger: &sloggerMock{info: func(str string, in ...any) {
+			msg = str
+			for _, a := range in {
+				attr := a.(slog.Attr)
+				attrs[attr.Key] = attr.Value
+			}
+		}},
+	}
+
+	for i := range 10 {
+		h.stats.sampled(true)
+		h.stats.observe("primary", time.Duration(i+1)*time.Millisecond, 200, nil)
+		h.stats.observe("secondary", time.Duration(i+1)*time.Millisecond, 200, nil)
+		h.stats.compared(Report{Match: i < 8, Request: RequestSummary{URI: "/a?b=c"}})
+	}
+	h.stats.observe("secondary", time.Millisecond, 502, nil)
+	h.stats.observe("secondary", time.Millisecond, 0, errors.New("oops"))
+	h.stats.sampled(false)
+
+	h.logSummary(time.Minute, h.stats.totals())
+
+	if msg != "shadow_summary" {
+		t.Errorf("unexpected message %q", msg)
+	}
+	if got := attrs["mirrored"].Int64(); got != 10 {
+		t.Errorf("mirrored = %d, want 10", got)
+	}
+	if got := attrs["match_rate"].Float64(); got != 0.8 {
+		t.Errorf("match_rate = %v, want 0.8", got)
+	}
+
+	paths := attrs["top_mismatch_paths"].Group()
+	if len(paths) != 1 || paths[0].Key != "/a" || paths[0].Value.Int64() != 2 {
+		t.Errorf("unexpected top_mismatch_paths %v", paths)
+	}
+
+	secondary := make(map[string]slog.Value)
+	for _, a := range attrs["secondary"].Group() {
+		secondary[a.Key] = a.Value
+	}
+	if got := secondary["errors"].Int64(); got != 2 {
+		t.Errorf("secondary errors = %d, want 2", got)
+	}
+	if got := secondary["p50_seconds"].Float64(); got != 0.004 {
+		t.Errorf("secondary p50 = %v, want 0.004", got)
+	}
+
+	// Windows are reset after every summary
+	if paths := h.stats.resetMismatchPaths(5); len(paths) != 0 {
+		t.Errorf("expected mismatch paths to be reset, got %v", paths)
+	}
+}
+
+func Test_slidingWindow(t *testing.T) {
+	now := time.Unix(1000, 0)
+	w := newSlidingWindow(time.Minute, time.Second)
+	w.now = func() time.Time { return now }
+
+	mirror := func(c *windowCounts) { c.Mirrored++ }
+	w.record(mirror)
+	now = now.Add(30 * time.Second)
+	w.record(mirror)
+	w.record(mirror)
+	if got := w.sum().Mirrored; got != 3 {
+		t.Errorf("sum after 30s = %d, want 3", got)
+	}
+
+	now = now.Add(45 * time.Second)
+	if got := w.sum().Mirrored; got != 2 {
+		t.Errorf("sum after 75s = %d, want 2", got)
+	}
+
+	now = now.Add(time.Hour)
+	if got := w.sum().Mirrored; got != 0 {
+		t.Errorf("sum after an hour = %d, want 0", got)
+	}
+}
+
+func Test_stats_lagged(t *testing.T) {
+	s := newStats()
+	if got := s.recent.sum().secondaryLag(); got != 0 {
+		t.Errorf("secondaryLag() without requests = %v, want 0", got)
+	}
+
+	s.lagged(300 * time.Millisecond)
+	s.lagged(100 * time.Millisecond)
+	// A secondary which finished first isn't behind at all
+	s.lagged(-100 * time.Millisecond)
+	if got := s.recent.sum().secondaryLag(); got != 400*time.Millisecond/3 {
+		t.Errorf("secondaryLag() = %v, want %v", got, 400*time.Millisecond/3)
+	}
+}
+
+func TestAdminAPI_serveStats(t *testing.T) {
+	h := &Handler{Name: "stats-test", MirrorRate: 0.5, stats: newStats()}
+	namedHandlers.register(h.Name, h)
+	defer namedHandlers.unregister(h.Name, h)
+
+	h.stats.sampled(true)
+	h.stats.sampled(false)
+	h.stats.started()
+	h.stats.compared(Report{Match: true})
+	h.stats.observe("secondary", time.Millisecond, 500, nil)
+
+	w := httptest.NewRecorder()
+	if err := new(AdminAPI).serve(w, httptest.NewRequest(http.MethodGet, "/mirror/stats-test/stats", nil)); err != nil {
+		t.Fatalf("serve() error = %v", err)
+	}
+
+	var got statsSnapshot
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatalf("error decoding stats: %v", err)
+	}
+	if got.Name != "stats-test" || got.InFlight != 1 || *got.MirrorRate != 50 || *got.EffectiveMirrorRate != 50 {
+		t.Errorf("unexpected stats: %s", w.Body)
+	}
+	if got.Totals.Matched != 1 || got.LastMinute.SecondaryErrors != 1 || *got.LastMinute.MatchRate != 1 {
+		t.Errorf("unexpected counts: %s", w.Body)
+	}
+
+	err := new(AdminAPI).serve(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/mirror/nope/stats", nil))
+	if apiErr, ok := err.(caddy.APIError); !ok || apiErr.HTTPStatus != http.StatusNotFound {
+		t.Errorf("serve() for unknown handler error = %v, want 404", err)
+	}
+}
@@ -0,0 +1,442 @@
+package mirror
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+
+	"github.com/dgraph-io/badger/v2"
+)
+
+var (
+	_ Reporter              = (*StoreReporter)(nil)
+	_ caddy.Provisioner     = (*StoreReporter)(nil)
+	_ caddy.CleanerUpper    = (*StoreReporter)(nil)
+	_ caddyfile.Unmarshaler = (*StoreReporter)(nil)
+	_ caddy.Destructor      = (*mismatchStore)(nil)
+)
+
+func init() {
+	caddy.RegisterModule(StoreReporter{})
+}
+
+// stores are shared across config reloads by path, since a badger database can only be opened once
+var stores = caddy.NewUsagePool()
+
+// namedStores are the stores which can be queried through the admin API, by name
+var namedStores = newRegistry[*mismatchStore]()
+
+// MismatchRecord is a mismatched report, as recorded by the StoreReporter
+type MismatchRecord struct {
+	ID              string         `json:"id"`
+	Time            time.Time      `json:"time"`
+	Request         RequestSummary `json:"request"`
+	Path            string         `json:"path"`
+	PrimaryStatus   int            `json:"primary_status"`
+	SecondaryStatus int            `json:"secondary_status"`
+	// Signature identifies the shape of the mismatch, so the same kind of mismatch can be grouped across requests
+	Signature string        `json:"signature"`
+	Results   []EventResult `json:"results"`
+	// EventID is the ID of the report, as other reporters and the mismatch log know it
+	EventID string `json:"event_id,omitempty"`
+}
+
+// StoreReporter records every mismatch in an embedded database, indexed by time, path, status pair, and signature.
+// Records can be queried and aggregated through the admin API at /mirror/<name>/mismatches.
+type StoreReporter struct {
+	// Name identifies the store in the admin API. Defaults to "default".
+	Name string `json:"name,omitempty"`
+	// Path is the directory the database is kept in. Defaults to a directory named after the store in Caddy's data
+	// directory.
+	Path string `json:"path,omitempty"`
+	// Retention is how long mismatches are kept. Defaults to 7 days.
+	Retention caddy.Duration `json:"retention,omitempty"`
+
+	store   *mismatchStore
+	slogger slogger
+}
+
+func (StoreReporter) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "mirror.reporters.store",
+		New: func() caddy.Module { return new(StoreReporter) },
+	}
+}
+
+// Provision implements caddy.Provisioner
+func (s *StoreReporter) Provision(ctx caddy.Context) error {
+	if s.Name == "" {
+		s.Name = "default"
+	}
+	if s.Path == "" {
+		s.Path = filepath.Join(caddy.AppDataDir(), "mirror", s.Name)
+	}
+	if s.Retention == 0 {
+		s.Retention = caddy.Duration(7 * 24 * time.Hour)
+	}
+
+	slogger := ctx.Slogger()
+	s.slogger = slogger
+	val, _, err := stores.LoadOrNew(s.Path, func() (caddy.Destructor, error) {
+		return openMismatchStore(badger.DefaultOptions(s.Path).WithLogger(badgerLogger{slogger}))
+	})
+	if err != nil {
+		return fmt.Errorf("error opening mismatch store: %w", err)
+	}
+	s.store = val.(*mismatchStore)
+
+	namedStores.register(s.Name, s.store)
+
+	return nil
+}
+
+// Cleanup implements caddy.CleanerUpper. The database is closed once no config is using it anymore.
+func (s *StoreReporter) Cleanup() error {
+	deleted, err := stores.Delete(s.Path)
+	if deleted {
+		namedStores.unregister(s.Name, s.store)
+	}
+	return err
+}
+
+func (s *StoreReporter) Report(rep Report) {
+	if rep.Match {
+		return
+	}
+	err := s.store.record(newMismatchRecord(rep), time.Duration(s.Retention))
+	if err != nil {
+		s.slogger.Error("store_reporter_error", slog.String("id", rep.ID), slog.String("error", err.Error()))
+	}
+}
+
+func (s *StoreReporter) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume reporter name
+	if d.NextArg() {
+		s.Name = d.Val()
+	}
+	for d.NextBlock(0) {
+		switch d.Val() {
+		case "path":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			s.Path = d.Val()
+		case "retention":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("error parsing retention: %v", err)
+			}
+			s.Retention = caddy.Duration(dur)
+		default:
+			return d.Errf("unrecognized store reporter option '%s'", d.Val())
+		}
+	}
+	return nil
+}
+
+func newMismatchRecord(rep Report) MismatchRecord {
+	return MismatchRecord{
+		Time:            rep.Time,
+		Request:         rep.Request,
+		Path:            rep.Request.Path(),
+		PrimaryStatus:   rep.Primary.Status,
+		SecondaryStatus: rep.Secondary.Status,
+		Signature:       mismatchSignature(rep),
+		Results:         eventResults(rep, false),
+		EventID:         rep.ID,
+	}
+}
+
+// mismatchSignature hashes what mismatched, but not the values involved: which comparers mismatched, the status pair,
+// the names of mismatched headers, and, for JSON bodies, the paths of the values which differ.
+func mismatchSignature(rep Report) string {
+	var parts []string
+	for _, res := range rep.Results {
+		if res.Match || res.Skipped {
+			continue
+		}
+		switch res.Comparer {
+		case "status":
+			parts = append(parts, fmt.Sprintf("status:%d-%d", rep.Primary.Status, rep.Secondary.Status))
+		case "header":
+			for _, attr := range res.Attrs {
+				parts = append(parts, "header:"+attr.Key)
+			}
+		case "body":
+			// diff_paths are of what the comparer compared, so values ignored by normalize rules or jq queries don't
+			// set apart mismatches which are otherwise the same
+			var paths []string
+			for _, attr := range res.Attrs {
+				if attr.Key == "diff_paths" {
+					paths, _ = attr.Value.Any().([]string)
+				}
+			}
+			if paths == nil {
+				parts = append(parts, "body")
+			}
+			for _, path := range paths {
+				parts = append(parts, "body:"+path)
+			}
+		default:
+			parts = append(parts, res.Comparer)
+		}
+	}
+
+	hash := sha256.Sum256([]byte(strings.Join(parts, "\n")))
+	return hex.EncodeToString(hash[:8])
+}
+
+// MismatchFilter selects records from a mismatch store. Zero values match everything.
+type MismatchFilter struct {
+	Path string
+	// Status is a status pair, like "200-500"
+	Status    string
+	Signature string
+	Since     time.Time
+	Until     time.Time
+}
+
+func (f MismatchFilter) matches(rec MismatchRecord) bool {
+	return (f.Path == "" || f.Path == rec.Path) &&
+		(f.Status == "" || f.Status == statusPair(rec.PrimaryStatus, rec.SecondaryStatus)) &&
+		(f.Signature == "" || f.Signature == rec.Signature)
+}
+
+func statusPair(primary, secondary int) string {
+	return strconv.Itoa(primary) + "-" + strconv.Itoa(secondary)
+}
+
+// Key prefixes. Records are keyed by ID, which sorts by time, and every index key ends with the ID of its record.
+const (
+	recordPrefix    = "r/"
+	pathPrefix      = "p/"
+	statusPrefix    = "s/"
+	signaturePrefix = "g/"
+	idLen           = 12
+)
+
+type mismatchStore struct {
+	db   *badger.DB
+	seq  atomic.Uint32
+	done chan struct{}
+}
+
+func openMismatchStore(opts badger.Options) (*mismatchStore, error) {
+	db, err := badger.Open(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &mismatchStore{db: db, done: make(chan struct{})}
+	if !opts.InMemory {
+		go s.gc()
+	}
+	return s, nil
+}
+
+// gc periodically reclaims space from expired records, until the store is closed
+func (s *mismatchStore) gc() {
+	ticker := time.NewTicker(10 * time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			for s.db.RunValueLogGC(0.5) == nil {
+			}
+		}
+	}
+}
+
+// Destruct implements caddy.Destructor
+func (s *mismatchStore) Destruct() error {
+	close(s.done)
+	return s.db.Close()
+}
+
+func (s *mismatchStore) record(rec MismatchRecord, ttl time.Duration) error {
+	id := make([]byte, idLen)
+	binary.BigEndian.PutUint64(id, uint64(rec.Time.UnixNano()))
+	binary.BigEndian.PutUint32(id[8:], s.seq.Add(1))
+	rec.ID = hex.EncodeToString(id)
+
+	value, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(txn *badger.Txn) error {
+		entries := []*badger.Entry{
+			badger.NewEntry(indexKey(recordPrefix, "", id), value),
+			badger.NewEntry(indexKey(pathPrefix, rec.Path, id), nil),
+			badger.NewEntry(indexKey(statusPrefix, statusPair(rec.PrimaryStatus, rec.SecondaryStatus), id), nil),
+			badger.NewEntry(indexKey(signaturePrefix, rec.Signature, id), nil),
+		}
+		for _, e := range entries {
+			if ttl > 0 {
+				e = e.WithTTL(ttl)
+			}
+			if err := txn.SetEntry(e); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func indexKey(prefix, value string, id []byte) []byte {
+	key := []byte(prefix)
+	if prefix != recordPrefix {
+		key = append(append(key, value...), 0)
+	}
+	return append(key, id...)
+}
+
+// scan calls fn for every record matching the filter, newest first, until fn returns false
+func (s *mismatchStore) scan(f MismatchFilter, fn func(MismatchRecord) bool) error {
+	// Walk the most selective index available
+	prefix := []byte(recordPrefix)
+	switch {
+	case f.Signature != "":
+		prefix = indexKey(signaturePrefix, f.Signature, nil)
+	case f.Path != "":
+		prefix = indexKey(pathPrefix, f.Path, nil)
+	case f.Status != "":
+		prefix = indexKey(statusPrefix, f.Status, nil)
+	}
+
+	var since, until uint64
+	if !f.Since.IsZero() {
+		since = uint64(f.Since.UnixNano())
+	}
+	if !f.Until.IsZero() {
+		until = uint64(f.Until.UnixNano())
+	}
+
+	return s.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.IteratorOptions{Reverse: true, Prefix: prefix})
+		defer it.Close()
+
+		for it.Seek(append(bytes.Clone(prefix), 0xff)); it.Valid(); it.Next() {
+			key := it.Item().Key()
+			id := key[len(key)-idLen:]
+			ts := binary.BigEndian.Uint64(id)
+			if ts < since {
+				break
+			}
+			if until != 0 && ts > until {
+				continue
+			}
+
+			item, err := txn.Get(indexKey(recordPrefix, "", id))
+			if errors.Is(err, badger.ErrKeyNotFound) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+
+			var rec MismatchRecord
+			err = item.Value(func(val []byte) error {
+				return json.Unmarshal(val, &rec)
+			})
+			if err != nil {
+				return err
+			}
+
+			if f.matches(rec) && !fn(rec) {
+				return nil
+			}
+		}
+		return nil
+	})
+}
+
+// query returns up to limit records matching the filter, newest first
+func (s *mismatchStore) query(f MismatchFilter, limit int) ([]MismatchRecord, error) {
+	recs := make([]MismatchRecord, 0)
+	err := s.scan(f, func(rec MismatchRecord) bool {
+		recs = append(recs, rec)
+		return len(recs) < limit
+	})
+	return recs, err
+}
+
+// MismatchCount is the number of records sharing a value of the grouped field
+type MismatchCount struct {
+	Key   string `json:"key"`
+	Count int    `json:"count"`
+}
+
+// count groups the records matching the filter by path, status, or signature, and returns the limit largest groups
+func (s *mismatchStore) count(f MismatchFilter, groupBy string, limit int) ([]MismatchCount, error) {
+	var key func(MismatchRecord) string
+	switch groupBy {
+	case "path":
+		key = func(rec MismatchRecord) string { return rec.Path }
+	case "status":
+		key = func(rec MismatchRecord) string { return statusPair(rec.PrimaryStatus, rec.SecondaryStatus) }
+	case "signature":
+		key = func(rec MismatchRecord) string { return rec.Signature }
+	default:
+		return nil, fmt.Errorf("cannot group by '%s'", groupBy)
+	}
+
+	counts := make(map[string]int)
+	err := s.scan(f, func(rec MismatchRecord) bool {
+		counts[key(rec)]++
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	groups := make([]MismatchCount, 0, len(counts))
+	for k, n := range counts {
+		groups = append(groups, MismatchCount{Key: k, Count: n})
+	}
+	slices.SortFunc(groups, func(a, b MismatchCount) int {
+		if a.Count != b.Count {
+			return b.Count - a.Count
+		}
+		return strings.Compare(a.Key, b.Key)
+	})
+	if len(groups) > limit {
+		groups = groups[:limit]
+	}
+	return groups, nil
+}
+
+// badgerLogger sends badger's warnings and errors to Caddy's log, and drops everything else
+type badgerLogger struct {
+	slogger *slog.Logger
+}
+
+func (l badgerLogger) Errorf(format string, args ...any) {
+	l.slogger.Error(strings.TrimSpace(fmt.Sprintf(format, args...)))
+}
+
+func (l badgerLogger) Warningf(format string, args ...any) {
+	l.slogger.Warn(strings.TrimSpace(fmt.Sprintf(format, args...)))
+}
+
+func (badgerLogger) Infof(string, ...any)  {}
+func (badgerLogger) Debugf(string, ...any) {}
@@ -0,0 +1,147 @@
+package mirror
+
+import (
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/dgraph-io/badger/v2"
+)
+
+func Test_mismatchStore(t *testing.T) {
+	store, err := openMismatchStore(badger.DefaultOptions("").WithInMemory(true).WithLogger(nil))
+	if err != nil {
+		t.Fatalf("error opening store: %v", err)
+	}
+	defer store.Destruct()
+
+	start := time.Now()
+	reports := []Report{
+		{
+			Request:   RequestSummary{Method: "GET", URI: "/users/1?x=y"},
+			Results:   []Result{{Comparer: "status"}},
+			Primary:   ResponseArtifact{Status: 200},
+			Secondary: ResponseArtifact{Status: 500},
+		},
+		{
+			Request:   RequestSummary{Method: "GET", URI: "/users/1"},
+			Results:   []Result{bodyResult(`{"id":1,"name":"a"}`, `{"id":1,"name":"b"}`)},
+			Primary:   ResponseArtifact{Status: 200, Body: []byte(`{"id":1,"name":"a"}`)},
+			Secondary: ResponseArtifact{Status: 200, Body: []byte(`{"id":1,"name":"b"}`)},
+		},
+		{
+			Request:   RequestSummary{Method: "GET", URI: "/users/2"},
+			Results:   []Result{bodyResult(`{"id":2,"name":"c"}`, `{"id":2,"name":"d"}`)},
+			Primary:   ResponseArtifact{Status: 200, Body: []byte(`{"id":2,"name":"c"}`)},
+			Secondary: ResponseArtifact{Status: 200, Body: []byte(`{"id":2,"name":"d"}`)},
+		},
+	}
+	for i, rep := range reports {
+		rep.Time = start.Add(time.Duration(i) * time.Second)
+		if err := store.record(newMismatchRecord(rep), time.Hour); err != nil {
+			t.Fatalf("error recording mismatch: %v", err)
+		}
+	}
+
+	recs, err := store.query(MismatchFilter{}, 10)
+	if err != nil {
+		t.Fatalf("error querying: %v", err)
+	}
+	if len(recs) != 3 || recs[0].Request.URI != "/users/2" {
+		t.Errorf("expected all records newest first, got %+v", recs)
+	}
+
+	recs, _ = store.query(MismatchFilter{Path: "/users/1"}, 10)
+	if len(recs) != 2 {
+		t.Errorf("expected 2 records for path, got %d", len(recs))
+	}
+
+	recs, _ = store.query(MismatchFilter{Status: "200-500"}, 10)
+	if len(recs) != 1 || recs[0].Request.URI != "/users/1?x=y" {
+		t.Errorf("expected 1 record for status pair, got %+v", recs)
+	}
+
+	recs, _ = store.query(MismatchFilter{Since: start.Add(time.Second)}, 10)
+	if len(recs) != 2 {
+		t.Errorf("expected 2 records since, got %d", len(recs))
+	}
+
+	recs, _ = store.query(MismatchFilter{}, 1)
+	if len(recs) != 1 {
+		t.Errorf("expected limit to be respected, got %d", len(recs))
+	}
+
+	counts, err := store.count(MismatchFilter{}, "signature", 10)
+	if err != nil {
+		t.Fatalf("error counting: %v", err)
+	}
+	// Both body mismatches differ only at /name, so they share a signature
+	if len(counts) != 2 || counts[0].Count != 2 {
+		t.Errorf("expected body mismatches to share a signature, got %+v", counts)
+	}
+
+	recs, _ = store.query(MismatchFilter{Signature: counts[0].Key}, 10)
+	if len(recs) != 2 {
+		t.Errorf("expected 2 records for signature, got %d", len(recs))
+	}
+
+	counts, _ = store.count(MismatchFilter{}, "path", 1)
+	if len(counts) != 1 || counts[0].Key != "/users/1" || counts[0].Count != 2 {
+		t.Errorf("expected /users/1 to mismatch most, got %+v", counts)
+	}
+}
+
+// bodyResult compares two bodies with the body comparer
+func bodyResult(primary, secondary string) Result {
+	return (&BodyComparer{}).Compare(
+		ResponseArtifact{Body: []byte(primary), Buffered: true},
+		ResponseArtifact{Body: []byte(secondary), Buffered: true},
+	)
+}
+
+func Test_mismatchSignature(t *testing.T) {
+	c := &BodyComparer{Normalize: []NormalizeRule{{Pattern: `"trace":"[^"]*"`, Replacement: `"trace":""`}}}
+	if err := c.Provision(caddy.Context{}); err != nil {
+		t.Fatal(err)
+	}
+	signature := func(primary, secondary string) string {
+		p := ResponseArtifact{Body: []byte(primary), Buffered: true}
+		s := ResponseArtifact{Body: []byte(secondary), Buffered: true}
+		return mismatchSignature(Report{Primary: p, Secondary: s, Results: []Result{c.Compare(p, s)}})
+	}
+
+	// The trace differs in only one of them, but it's normalized, so it doesn't set them apart
+	a := signature(`{"name":"a","trace":"1"}`, `{"name":"b","trace":"2"}`)
+	b := signature(`{"name":"c","trace":"3"}`, `{"name":"d","trace":"3"}`)
+	if a != b {
+		t.Errorf("signatures differ by a normalized value: %s, %s", a, b)
+	}
+	if c := signature(`{"id":1,"trace":"1"}`, `{"id":2,"trace":"1"}`); c == a {
+		t.Errorf("signatures of mismatches at different paths are the same: %s", c)
+	}
+}
+
+func TestStoreReporter_ReportError(t *testing.T) {
+	store, err := openMismatchStore(badger.DefaultOptions("").WithInMemory(true).WithLogger(nil))
+	if err != nil {
+		t.Fatalf("error opening store: %v", err)
+	}
+	_ = store.Destruct()
+
+	var logged []string
+	s := &StoreReporter{Retention: caddy.Duration(time.Hour), store: store, slogger: &sloggerMock{
+		err: func(msg string, in ...any) {
+			for _, attr := range in {
+				if a, ok := attr.(slog.Attr); ok && a.Key == "id" && a.Value.String() == "abc" {
+					logged = append(logged, msg)
+				}
+			}
+		},
+	}}
+	s.Report(Report{ID: "abc", Time: time.Now(), Results: []Result{{Comparer: "status"}}})
+
+	if len(logged) != 1 || logged[0] != "store_reporter_error" {
+		t.Errorf("logged %v, want store_reporter_error with the report's id", logged)
+	}
+}
@@ -0,0 +1,69 @@
+package mirror
+
+import (
+	"log/slog"
+	"math"
+	"time"
+)
+
+// summarize logs a summary of the handler's stats every interval, until done is closed
+func (h *Handler) summarize(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	last := h.stats.totals()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			totals := h.stats.totals()
+			h.logSummary(interval, totals.sub(last))
+			last = totals
+		}
+	}
+}
+
+// logSummary logs the stats for the last interval
+func (h *Handler) logSummary(interval time.Duration, window statsTotals) {
+	attrs := []any{
+		slog.Duration("interval", interval),
+		slog.Int64("mirrored", window.Mirrored),
+		slog.Int64("not_mirrored", window.NotMirrored),
+		slog.Int64("matched", window.Matched),
+		slog.Int64("mismatched", window.Mismatched),
+	}
+	if h.ExcludeSecondaryErrors {
+		attrs = append(attrs, slog.Int64("excluded", window.Excluded))
+	}
+	if rate := window.matchRate(); !math.IsNaN(rate) {
+		attrs = append(attrs, slog.Float64("match_rate", rate))
+	}
+
+	paths := h.stats.resetMismatchPaths(5)
+	if len(paths) > 0 {
+		pathAttrs := make([]any, len(paths))
+		for i, p := range paths {
+			pathAttrs[i] = slog.Int(p.Path, p.Count)
+		}
+		attrs = append(attrs, slog.Group("top_mismatch_paths", pathAttrs...))
+	}
+
+	for _, name := range []string{"primary", "secondary"} {
+		hs := h.stats.handler(name)
+		p := hs.latencies.reset()
+		requests, errors := window.PrimaryRequests, window.PrimaryErrors
+		if name == "secondary" {
+			requests, errors = window.SecondaryRequests, window.SecondaryErrors
+		}
+		attrs = append(attrs, slog.Group(name,
+			slog.Int64("requests", requests),
+			slog.Int64("errors", errors),
+			slog.Float64("p50_seconds", p.P50),
+			slog.Float64("p95_seconds", p.P95),
+			slog.Float64("p99_seconds", p.P99),
+		))
+	}
+
+	h.slogger.Info("shadow_summary", attrs...)
+}
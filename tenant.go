@@ -0,0 +1,154 @@
+package mirror
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/itchyny/gojq"
+)
+
+var _ caddyfile.Unmarshaler = (*TenantConfig)(nil)
+
+// TenantConfig extracts a tenant ID from each request, from exactly one of a header, a path segment, or a jq query on
+// a JSON body. The tenant is reported as request.tenant, so mismatches can be told apart by tenant, and tenants can be
+// mirrored at their own rates.
+type TenantConfig struct {
+	// Header is a request header holding the tenant ID
+	Header string `json:"header,omitempty"`
+	// PathSegment is the position of the path segment holding the tenant ID, counting from 1, like 2 for
+	// /api/<tenant>/users
+	PathSegment int `json:"path_segment,omitempty"`
+	// Query is a jq query on the request's JSON body, like .tenant_id. Bodies are only read after requests are
+	// sampled, so tenants read from bodies are only reported, and can't have rates.
+	Query JQQuery `json:"query,omitempty"`
+	// Rates are percentages of each tenant's requests to mirror, from 0 to 100, by tenant ID. Other tenants' requests
+	// are sampled by mirror_rate or the sampler, like any other request.
+	Rates map[string]float64 `json:"rates,omitempty"`
+
+	query *gojq.Query
+	rates map[string]float64
+}
+
+func (c *TenantConfig) provision() (err error) {
+	sources := 0
+	for _, set := range []bool{c.Header != "", c.PathSegment > 0, c.Query != ""} {
+		if set {
+			sources++
+		}
+	}
+	if sources != 1 {
+		return fmt.Errorf("tenant requires exactly one of a header, path_segment, or query")
+	}
+	if c.Query != "" {
+		if len(c.Rates) > 0 {
+			return fmt.Errorf("tenant rates require a header or path_segment, since bodies are read after sampling")
+		}
+		c.query, err = gojq.Parse(string(c.Query))
+		if err != nil {
+			return fmt.Errorf("error parsing tenant query: %w", err)
+		}
+	}
+	c.rates = make(map[string]float64, len(c.Rates))
+	for tenant, rate := range c.Rates {
+		c.rates[tenant] = rate / 100
+	}
+	return nil
+}
+
+// fromRequest returns the tenant of a request from its header or path. It's safe to call on a nil *TenantConfig,
+// which never finds a tenant.
+func (c *TenantConfig) fromRequest(r *http.Request) string {
+	switch {
+	case c == nil:
+		return ""
+	case c.Header != "":
+		return r.Header.Get(c.Header)
+	case c.PathSegment > 0:
+		segments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		if c.PathSegment <= len(segments) {
+			return segments[c.PathSegment-1]
+		}
+	}
+	return ""
+}
+
+// fromBody returns the tenant of a request from its JSON body, if the tenant is read from bodies. The first value the
+// query produces is the tenant, if it's a string or number.
+func (c *TenantConfig) fromBody(body []byte) string {
+	if c == nil || c.query == nil {
+		return ""
+	}
+	var v any
+	if json.Unmarshal(body, &v) != nil {
+		return ""
+	}
+	out, _ := c.query.Run(v).Next()
+	switch out := out.(type) {
+	case string:
+		return out
+	case float64:
+		return strconv.FormatFloat(out, 'f', -1, 64)
+	case int:
+		return strconv.Itoa(out)
+	}
+	return ""
+}
+
+// sample decides whether to mirror a request from the tenant, where u is a draw from SamplingRand. ok is false if the
+// tenant doesn't have its own rate.
+func (c *TenantConfig) sample(tenant string, u float64) (sampled, ok bool) {
+	if c == nil || tenant == "" {
+		return false, false
+	}
+	rate, ok := c.rates[tenant]
+	if !ok {
+		return false, false
+	}
+	return u < rate, true
+}
+
+func (c *TenantConfig) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume "tenant"
+	var source, value string
+	if !d.Args(&source, &value) {
+		return d.ArgErr()
+	}
+	switch source {
+	case "header":
+		c.Header = value
+	case "path_segment":
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			return d.Errf("path_segment must be a positive number, not '%s'", value)
+		}
+		c.PathSegment = n
+	case "query":
+		c.Query = JQQuery(value)
+	default:
+		return d.Errf("unrecognized tenant source '%s'", source)
+	}
+	for d.NextBlock(0) {
+		switch d.Val() {
+		case "rate":
+			var tenant, rate string
+			if !d.Args(&tenant, &rate) {
+				return d.ArgErr()
+			}
+			r, err := parseRate(rate)
+			if err != nil {
+				return d.Errf("error parsing rate for %s: %v", tenant, err)
+			}
+			if c.Rates == nil {
+				c.Rates = make(map[string]float64)
+			}
+			c.Rates[tenant] = r
+		default:
+			return d.Errf("unrecognized tenant option '%s'", d.Val())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,156 @@
+package mirror
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func TestTenantConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		req    *http.Request
+		body   string
+		want   string
+	}{
+		{
+			name:   "header",
+			config: "tenant header X-Tenant-ID",
+			req:    httptest.NewRequest(http.MethodGet, "/users", nil),
+			want:   "acme",
+		},
+		{
+			name:   "path segment",
+			config: "tenant path_segment 2",
+			req:    httptest.NewRequest(http.MethodGet, "/api/globex/users", nil),
+			want:   "globex",
+		},
+		{
+			name:   "path too short",
+			config: "tenant path_segment 4",
+			req:    httptest.NewRequest(http.MethodGet, "/api/globex/users", nil),
+		},
+		{
+			name:   "string in body",
+			config: "tenant query .account.tenant",
+			req:    httptest.NewRequest(http.MethodPost, "/orders", nil),
+			body:   `{"account":{"tenant":"initech"}}`,
+			want:   "initech",
+		},
+		{
+			name:   "number in body",
+			config: "tenant query .tenant_id",
+			req:    httptest.NewRequest(http.MethodPost, "/orders", nil),
+			body:   `{"tenant_id":42}`,
+			want:   "42",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := new(TenantConfig)
+			if err := c.UnmarshalCaddyfile(caddyfile.NewTestDispenser(tt.config)); err != nil {
+				t.Fatal(err)
+			}
+			if err := c.provision(); err != nil {
+				t.Fatal(err)
+			}
+			tt.req.Header.Set("X-Tenant-ID", "acme")
+			got := c.fromRequest(tt.req)
+			if got == "" {
+				got = c.fromBody([]byte(tt.body))
+			}
+			if got != tt.want {
+				t.Errorf("tenant = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	for _, bad := range []*TenantConfig{
+		{},
+		{Header: "X-Tenant-ID", PathSegment: 1},
+		{Query: ".tenant", Rates: map[string]float64{"acme": 100}},
+	} {
+		if err := bad.provision(); err == nil {
+			t.Errorf("provision() accepted %+v", bad)
+		}
+	}
+}
+
+func TestTenantConfig_sample(t *testing.T) {
+	c := new(TenantConfig)
+	d := caddyfile.NewTestDispenser(`tenant header X-Tenant-ID {
+		rate acme 100%
+		rate globex 0
+	}`)
+	if err := c.UnmarshalCaddyfile(d); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.provision(); err != nil {
+		t.Fatal(err)
+	}
+	if sampled, ok := c.sample("acme", 0.99); !sampled || !ok {
+		t.Errorf("sample(acme) = %v, %v, want true, true", sampled, ok)
+	}
+	if sampled, ok := c.sample("globex", 0); sampled || !ok {
+		t.Errorf("sample(globex) = %v, %v, want false, true", sampled, ok)
+	}
+	if _, ok := c.sample("initech", 0); ok {
+		t.Errorf("sample(initech) has a rate, but initech isn't configured")
+	}
+
+	// A tenant's rate takes the place of the handler's rate
+	h := &Handler{MirrorRate: -1, Tenant: c}
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("X-Tenant-ID", "acme")
+	if !h.shouldMirror(r) {
+		t.Errorf("shouldMirror() = false for a tenant mirrored at 100%%")
+	}
+}
+
+func TestHandler_ServeHTTP_tenantFromBody(t *testing.T) {
+	tenant := &TenantConfig{Query: ".tenant"}
+	if err := tenant.provision(); err != nil {
+		t.Fatal(err)
+	}
+	var rep *Report
+	h := &Handler{
+		ComparisonConfig:  ComparisonConfig{CompareStatus: true},
+		Tenant:            tenant,
+		MirrorRate:        1,
+		stats:             newStats(),
+		slogger:           nullLogger{},
+		comparisonSlogger: nullLogger{},
+		now:               time.Now,
+		reporters: []Reporter{reporterFunc(func(r Report) {
+			rep = &r
+		})},
+		primary: middlewareHandlerFunc(func(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+			w.WriteHeader(http.StatusOK)
+			return nil
+		}),
+		secondary: middlewareHandlerFunc(func(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+			w.WriteHeader(http.StatusOK)
+			return nil
+		}),
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "http://example.com/orders", strings.NewReader(`{"tenant":"acme"}`))
+	r = r.WithContext(context.WithValue(r.Context(), caddyhttp.VarsCtxKey, make(map[string]any)))
+	if err := h.ServeHTTP(&NopResponseWriter{}, r, nil); err != nil {
+		t.Fatal(err)
+	}
+	for h.stats.comparing.Load() > 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	if rep == nil || rep.Request.Tenant != "acme" {
+		t.Errorf("report = %+v, want the tenant from the body", rep)
+	}
+}
@@ -0,0 +1,126 @@
+package mirror
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"text/template"
+
+	"github.com/itchyny/gojq"
+)
+
+// bodyTransform rewrites the body of a mirrored request, with a jq program or a template
+type bodyTransform struct {
+	jq       *gojq.Code
+	template *template.Template
+}
+
+// bodyTemplateData is what a body template is executed with
+type bodyTemplateData struct {
+	// Body is the original body, and JSON is the body decoded, or nil if it isn't JSON
+	Body   string
+	JSON   any
+	Method string
+	Host   string
+	URI    string
+}
+
+func newBodyTransform(jq JQQuery, tmpl string) (*bodyTransform, error) {
+	if jq == "" && tmpl == "" {
+		return nil, nil
+	}
+	if jq != "" && tmpl != "" {
+		return nil, fmt.Errorf("secondary_body_jq and secondary_body_template can't both be set")
+	}
+
+	t := new(bodyTransform)
+	if jq != "" {
+		q, err := gojq.Parse(string(jq))
+		if err != nil {
+			return nil, fmt.Errorf("error parsing secondary_body_jq: %w", err)
+		}
+		t.jq, err = gojq.Compile(q, gojq.WithFunction("uuid", 0, 0, func(any, []any) any { return newUUID() }))
+		if err != nil {
+			return nil, fmt.Errorf("error compiling secondary_body_jq: %w", err)
+		}
+		return t, nil
+	}
+
+	var err error
+	t.template, err = template.New("secondary_body_template").Funcs(template.FuncMap{
+		"uuid": newUUID,
+		"json": func(v any) (string, error) {
+			bs, err := json.Marshal(v)
+			return string(bs), err
+		},
+	}).Parse(tmpl)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing secondary_body_template: %w", err)
+	}
+	return t, nil
+}
+
+// apply replaces the request's body with the transformed body. Requests without a body are left alone.
+func (t *bodyTransform) apply(r *http.Request) error {
+	if t == nil || r.Body == nil || r.Body == http.NoBody {
+		return nil
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return fmt.Errorf("error reading body: %w", err)
+	}
+	if len(body) == 0 {
+		r.Body = http.NoBody
+		return nil
+	}
+
+	var decoded any
+	isJSON := json.Unmarshal(body, &decoded) == nil
+
+	var out []byte
+	if t.jq != nil {
+		if !isJSON {
+			return fmt.Errorf("body isn't JSON")
+		}
+		v, ok := t.jq.Run(decoded).Next()
+		if !ok {
+			return fmt.Errorf("jq program had no output")
+		}
+		if err, ok := v.(error); ok {
+			return fmt.Errorf("error running jq program: %w", err)
+		}
+		out, err = json.Marshal(v)
+		if err != nil {
+			return fmt.Errorf("error encoding jq output: %w", err)
+		}
+	} else {
+		data := bodyTemplateData{Body: string(body), Method: r.Method, Host: r.Host, URI: r.URL.RequestURI()}
+		if isJSON {
+			data.JSON = decoded
+		}
+		buf := new(bytes.Buffer)
+		if err := t.template.Execute(buf, data); err != nil {
+			return fmt.Errorf("error executing template: %w", err)
+		}
+		out = buf.Bytes()
+	}
+
+	r.Body = io.NopCloser(bytes.NewReader(out))
+	r.ContentLength = int64(len(out))
+	r.Header.Set("Content-Length", strconv.Itoa(len(out)))
+	return nil
+}
+
+// newUUID returns a random version 4 UUID
+func newUUID() string {
+	var b [16]byte
+	_, _ = rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
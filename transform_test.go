@@ -0,0 +1,92 @@
+package mirror
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func Test_bodyTransform_apply(t *testing.T) {
+	uuid := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+
+	tests := []struct {
+		name    string
+		jq      JQQuery
+		tmpl    string
+		body    string
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "jq",
+			jq:   ".dry_run = true | del(.card)",
+			body: `{"amount":10,"card":"4242"}`,
+			want: `{"amount":10,"dry_run":true}`,
+		},
+		{
+			name:    "jq on a body which isn't JSON",
+			jq:      ".dry_run = true",
+			body:    `amount=10`,
+			wantErr: true,
+		},
+		{
+			name: "template",
+			tmpl: `{"order":{{json .JSON.order}},"method":"{{.Method}}"}`,
+			body: `{"order":{"id":1}}`,
+			want: `{"order":{"id":1},"method":"POST"}`,
+		},
+		{
+			name: "template on a body which isn't JSON",
+			tmpl: `{{.Body}}&dry_run=true`,
+			body: `amount=10`,
+			want: `amount=10&dry_run=true`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bt, err := newBodyTransform(tt.jq, tt.tmpl)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tt.body))
+			err = bt.apply(r)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("apply() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			got, _ := io.ReadAll(r.Body)
+			if string(got) != tt.want || r.ContentLength != int64(len(tt.want)) {
+				t.Errorf("body = %s (length %d), want %s", got, r.ContentLength, tt.want)
+			}
+		})
+	}
+
+	t.Run("uuid", func(t *testing.T) {
+		bt, _ := newBodyTransform(`.idempotency_key = uuid`, "")
+		r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"idempotency_key":"abc"}`))
+		if err := bt.apply(r); err != nil {
+			t.Fatal(err)
+		}
+		got, _ := io.ReadAll(r.Body)
+		key := strings.TrimSuffix(strings.TrimPrefix(string(got), `{"idempotency_key":"`), `"}`)
+		if !uuid.MatchString(key) {
+			t.Errorf("idempotency_key = %s, want a UUID", key)
+		}
+	})
+
+	t.Run("no body", func(t *testing.T) {
+		bt, _ := newBodyTransform(".dry_run = true", "")
+		if err := bt.apply(httptest.NewRequest(http.MethodGet, "/", nil)); err != nil {
+			t.Errorf("apply() without a body error = %v", err)
+		}
+	})
+
+	if _, err := newBodyTransform(".a", "{{.Body}}"); err == nil {
+		t.Errorf("newBodyTransform() with both a jq program and a template didn't fail")
+	}
+}
@@ -0,0 +1,135 @@
+package mirror
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"mime/multipart"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+var (
+	_ Comparer              = UploadComparer{}
+	_ RequestAwareComparer  = UploadComparer{}
+	_ caddyfile.Unmarshaler = (*UploadComparer)(nil)
+)
+
+func init() {
+	caddy.RegisterModule(UploadComparer{})
+}
+
+// UploadComparer compares selected fields of the responses to multipart/form-data uploads, instead of their whole
+// bodies, which tend to echo back details like generated file names. Responses may be JSON objects, whose top-level
+// keys are fields, or URL-encoded or multipart forms. Responses to other requests are skipped.
+type UploadComparer struct {
+	// Fields are the names of the fields which are compared
+	Fields []string `json:"fields"`
+}
+
+func (UploadComparer) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "mirror.comparers.upload",
+		New: func() caddy.Module { return new(UploadComparer) },
+	}
+}
+
+// Compare compares the fields whatever the request was, since it isn't known
+func (c UploadComparer) Compare(primary, secondary ResponseArtifact) Result {
+	res := Result{Comparer: "upload"}
+	if !primary.Buffered || !secondary.Buffered {
+		res.Skipped = true
+		return res
+	}
+
+	pf, err := responseFields(primary)
+	if err != nil {
+		res.Attrs = []slog.Attr{slog.String("primary_error", err.Error())}
+		return res
+	}
+	sf, err := responseFields(secondary)
+	if err != nil {
+		res.Attrs = []slog.Attr{slog.String("shadow_error", err.Error())}
+		return res
+	}
+
+	res.Match = true
+	for _, name := range c.Fields {
+		pv, sv := pf[name], sf[name]
+		if !slices.Equal(pv, sv) {
+			res.Match = false
+			res.Attrs = append(res.Attrs, slog.Group(name,
+				slog.Any("primary_values", pv),
+				slog.Any("shadow_values", sv),
+			))
+		}
+	}
+	return res
+}
+
+func (c UploadComparer) CompareRequest(req RequestSummary, primary, secondary ResponseArtifact) Result {
+	if !req.upload() {
+		return Result{Comparer: "upload", Skipped: true}
+	}
+	return c.Compare(primary, secondary)
+}
+
+func (c *UploadComparer) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume comparer name
+	c.Fields = d.RemainingArgs()
+	if len(c.Fields) < 1 {
+		return d.Err("upload comparer requires at least one field name")
+	}
+	return nil
+}
+
+// responseFields reads a response body's fields by its Content-Type. JSON values which aren't strings are kept as JSON.
+func responseFields(a ResponseArtifact) (url.Values, error) {
+	mediaType, params, _ := mime.ParseMediaType(a.Header.Get("Content-Type"))
+	switch {
+	case mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"):
+		var obj map[string]json.RawMessage
+		if err := json.Unmarshal(a.Body, &obj); err != nil {
+			return nil, fmt.Errorf("error decoding JSON: %w", err)
+		}
+		fields := make(url.Values, len(obj))
+		for name, raw := range obj {
+			var s string
+			if json.Unmarshal(raw, &s) != nil {
+				compact := new(bytes.Buffer)
+				_ = json.Compact(compact, raw)
+				s = compact.String()
+			}
+			fields.Set(name, s)
+		}
+		return fields, nil
+	case mediaType == "application/x-www-form-urlencoded":
+		return url.ParseQuery(string(a.Body))
+	case mediaType == "multipart/form-data":
+		fields := make(url.Values)
+		mr := multipart.NewReader(bytes.NewReader(a.Body), params["boundary"])
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				return fields, nil
+			}
+			if err != nil {
+				return nil, fmt.Errorf("error reading multipart body: %w", err)
+			}
+			value, err := io.ReadAll(part)
+			if err != nil {
+				return nil, fmt.Errorf("error reading multipart body: %w", err)
+			}
+			fields.Add(part.FormName(), string(value))
+		}
+	default:
+		return nil, fmt.Errorf("can't read fields from '%s'", mediaType)
+	}
+}
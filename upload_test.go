@@ -0,0 +1,94 @@
+package mirror
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"testing"
+)
+
+func TestUploadComparer_CompareRequest(t *testing.T) {
+	multipartBody := func(fields map[string]string) ResponseArtifact {
+		buf := new(bytes.Buffer)
+		mw := multipart.NewWriter(buf)
+		for name, value := range fields {
+			_ = mw.WriteField(name, value)
+		}
+		_ = mw.Close()
+		return ResponseArtifact{Header: http.Header{"Content-Type": {mw.FormDataContentType()}}, Body: buf.Bytes(), Buffered: true}
+	}
+	jsonBody := func(body string) ResponseArtifact {
+		return ResponseArtifact{Header: http.Header{"Content-Type": {"application/json"}}, Body: []byte(body), Buffered: true}
+	}
+	upload := RequestSummary{Method: http.MethodPost, URI: "/files", ContentType: "multipart/form-data"}
+
+	tests := []struct {
+		name        string
+		req         RequestSummary
+		p, s        ResponseArtifact
+		wantMatch   bool
+		wantSkipped bool
+	}{
+		{
+			name:      "JSON fields match",
+			req:       upload,
+			p:         jsonBody(`{"id":"a1","size":1024,"meta":{"type": "png"}}`),
+			s:         jsonBody(`{"id":"b2","size":1024,"meta":{"type":"png"}}`),
+			wantMatch: true,
+		},
+		{
+			name: "JSON fields differ",
+			req:  upload,
+			p:    jsonBody(`{"size":1024,"meta":{"type":"png"}}`),
+			s:    jsonBody(`{"size":1000,"meta":{"type":"png"}}`),
+		},
+		{
+			name: "form fields",
+			req:  upload,
+			p: ResponseArtifact{
+				Header:   http.Header{"Content-Type": {"application/x-www-form-urlencoded"}},
+				Body:     []byte("id=a1&size=1024&meta=%7B%22type%22%3A%22png%22%7D"),
+				Buffered: true,
+			},
+			s:         multipartBody(map[string]string{"id": "b2", "size": "1024", "meta": `{"type":"png"}`}),
+			wantMatch: true,
+		},
+		{
+			name:        "not an upload",
+			req:         RequestSummary{Method: http.MethodGet, URI: "/files"},
+			p:           jsonBody(`{"size":1024}`),
+			s:           jsonBody(`{"size":1000}`),
+			wantSkipped: true,
+		},
+		{
+			name: "unreadable response",
+			req:  upload,
+			p:    ResponseArtifact{Header: http.Header{"Content-Type": {"text/plain"}}, Body: []byte("ok"), Buffered: true},
+			s:    jsonBody(`{"size":1024}`),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := UploadComparer{Fields: []string{"size", "meta"}}.CompareRequest(tt.req, tt.p, tt.s)
+			if res.Match != tt.wantMatch || res.Skipped != tt.wantSkipped {
+				t.Errorf("CompareRequest() match = %v, skipped = %v, want %v, %v (%v)", res.Match, res.Skipped, tt.wantMatch, tt.wantSkipped, res.Attrs)
+			}
+		})
+	}
+}
+
+func TestComparisonConfig_builtinComparers_upload(t *testing.T) {
+	c := ComparisonConfig{CompareBody: true, CompareUploadFields: []string{"size"}}
+	names := func(req RequestSummary) (names []string) {
+		for _, comparer := range c.builtinComparers(req) {
+			names = append(names, comparer.Compare(ResponseArtifact{}, ResponseArtifact{}).Comparer)
+		}
+		return names
+	}
+	if got := names(RequestSummary{ContentType: "multipart/form-data"}); len(got) != 1 || got[0] != "upload" {
+		t.Errorf("comparers for an upload = %v, want [upload]", got)
+	}
+	if got := names(RequestSummary{ContentType: "application/json"}); len(got) != 1 || got[0] != "body" {
+		t.Errorf("comparers for other requests = %v, want [body]", got)
+	}
+}
@@ -0,0 +1,64 @@
+package mirror
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+const (
+	webSocketBypass    = "bypass"
+	webSocketHandshake = "handshake"
+)
+
+// isWebSocketUpgrade reports whether r asks to upgrade the connection to a WebSocket
+func isWebSocketUpgrade(r *http.Request) bool {
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		return false
+	}
+	for _, value := range r.Header.Values("Connection") {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// serveWebSocket serves a WebSocket upgrade. The primary writes to the client directly, so it can hijack the
+// connection. In handshake mode, the handshake is also mirrored, but the secondary's connection is closed as soon as
+// it's upgraded. WebSocket traffic is never compared.
+func (h *Handler) serveWebSocket(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	mirrored := h.WebSocket == webSocketHandshake && h.shouldMirror(r)
+	h.stats.sampled(mirrored)
+	setDecision(r, mirrored)
+	if mirrored {
+		h.mirrorHandshake(r, next)
+	}
+	return h.primary.ServeHTTP(w, r, next)
+}
+
+// mirrorHandshake sends a WebSocket handshake to the secondary asynchronously
+func (h *Handler) mirrorHandshake(r *http.Request, next caddyhttp.Handler) {
+	route := h.routeLabel(r)
+	sr := cloneRequest(r)
+	h.rewriteSecondary(sr)
+	sr.Body = http.NoBody
+
+	h.stats.started()
+	go func() {
+		defer h.stats.finished()
+		// Nothing waits for the secondary, but it was counted as a mirrored request
+		defer h.inFlightLimit.release(h.goroutinesPerMirror())
+		if !h.prepareSecondary(sr) {
+			return
+		}
+		var timing responseTiming
+		rec := caddyhttp.NewResponseRecorder(&NopResponseWriter{}, nil, nil)
+		// Handshakes aren't retried, since retries are buffered, and an upgrade's status is never written through.
+		// Errors are logged by the request processor.
+		_ = h.requestProcessor("secondary", recoverHandler{h.secondary}, route, &timing)(rec, sr, h.secondaryNext(next))
+	}()
+}
@@ -0,0 +1,120 @@
+package mirror
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func Test_isWebSocketUpgrade(t *testing.T) {
+	tests := []struct {
+		name       string
+		connection string
+		upgrade    string
+		want       bool
+	}{
+		{"websocket", "Upgrade", "websocket", true},
+		{"token list", "keep-alive, upgrade", "WebSocket", true},
+		{"other protocol", "Upgrade", "h2c", false},
+		{"no connection upgrade", "keep-alive", "websocket", false},
+		{"plain request", "", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.connection != "" {
+				r.Header.Set("Connection", tt.connection)
+			}
+			if tt.upgrade != "" {
+				r.Header.Set("Upgrade", tt.upgrade)
+			}
+			if got := isWebSocketUpgrade(r); got != tt.want {
+				t.Errorf("isWebSocketUpgrade() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandler_ServeHTTP_webSocket(t *testing.T) {
+	tests := []struct {
+		name         string
+		mode         string
+		wantMirrored bool
+	}{
+		{"bypass by default", "", false},
+		{"handshake", webSocketHandshake, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var wg sync.WaitGroup
+			wg.Add(1)
+			var hijacked, mirrored bool
+			h := &Handler{
+				MirrorRate:        1,
+				slogger:           nullLogger{},
+				comparisonSlogger: nullLogger{},
+				now:               time.Now,
+				primary: middlewareHandlerFunc(func(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+					defer wg.Done()
+					_, _, err := http.NewResponseController(w).Hijack()
+					hijacked = err == nil
+					return nil
+				}),
+			}
+			h.WebSocket = tt.mode
+			var sWG sync.WaitGroup
+			if tt.wantMirrored {
+				sWG.Add(1)
+			}
+			h.secondary = middlewareHandlerFunc(func(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+				defer sWG.Done()
+				mirrored = true
+				w.WriteHeader(http.StatusSwitchingProtocols)
+				conn, _, err := http.NewResponseController(w).Hijack()
+				if err != nil {
+					return err
+				}
+				// The secondary's connection is closed as soon as it's upgraded
+				if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+					t.Errorf("Read() error = %v, want EOF", err)
+				}
+				return conn.Close()
+			})
+
+			r := httptest.NewRequest(http.MethodGet, "/ws", nil)
+			r.Header.Set("Connection", "Upgrade")
+			r.Header.Set("Upgrade", "websocket")
+			r = r.WithContext(context.WithValue(r.Context(), caddyhttp.VarsCtxKey, make(map[string]any)))
+			if err := h.ServeHTTP(&hijackableRecorder{httptest.NewRecorder()}, r, nil); err != nil {
+				t.Fatal(err)
+			}
+			wg.Wait()
+			sWG.Wait()
+
+			if !hijacked {
+				t.Errorf("the primary couldn't hijack the connection")
+			}
+			if mirrored != tt.wantMirrored {
+				t.Errorf("mirrored = %v, want %v", mirrored, tt.wantMirrored)
+			}
+		})
+	}
+}
+
+// hijackableRecorder is a response recorder which can be hijacked, like a client connection
+type hijackableRecorder struct {
+	*httptest.ResponseRecorder
+}
+
+func (w *hijackableRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return (&NopResponseWriter{}).Hijack()
+}
@@ -0,0 +1,88 @@
+package mirror
+
+import (
+	"log/slog"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// zapSlogger logs through a zap.Logger directly, instead of through slog. Attributes are converted to the same zap fields
+// zapslog would log, and are only converted for entries which pass the core's level and sampling.
+type zapSlogger struct {
+	logger *zap.Logger
+}
+
+func (z zapSlogger) Error(msg string, args ...any) { z.log(zapcore.ErrorLevel, msg, args) }
+func (z zapSlogger) Warn(msg string, args ...any)  { z.log(zapcore.WarnLevel, msg, args) }
+func (z zapSlogger) Info(msg string, args ...any)  { z.log(zapcore.InfoLevel, msg, args) }
+func (z zapSlogger) Debug(msg string, args ...any) { z.log(zapcore.DebugLevel, msg, args) }
+
+func (z zapSlogger) log(level zapcore.Level, msg string, args []any) {
+	if ce := z.logger.Check(level, msg); ce != nil {
+		ce.Write(zapFields(args)...)
+	}
+}
+
+// zapFields converts slog arguments, which are attributes or key-value pairs, to zap fields
+func zapFields(args []any) []zap.Field {
+	fields := make([]zap.Field, 0, len(args))
+	for len(args) > 0 {
+		var attr slog.Attr
+		switch arg := args[0].(type) {
+		case slog.Attr:
+			attr, args = arg, args[1:]
+		case string:
+			if len(args) == 1 {
+				attr, args = slog.String("!BADKEY", arg), nil
+			} else {
+				attr, args = slog.Any(arg, args[1]), args[2:]
+			}
+		default:
+			attr, args = slog.Any("!BADKEY", arg), args[1:]
+		}
+		fields = append(fields, zapField(attr))
+	}
+	return fields
+}
+
+func zapField(attr slog.Attr) zap.Field {
+	if attr.Equal(slog.Attr{}) {
+		return zap.Skip()
+	}
+	v := attr.Value.Resolve()
+	switch v.Kind() {
+	case slog.KindString:
+		return zap.String(attr.Key, v.String())
+	case slog.KindInt64:
+		return zap.Int64(attr.Key, v.Int64())
+	case slog.KindUint64:
+		return zap.Uint64(attr.Key, v.Uint64())
+	case slog.KindFloat64:
+		return zap.Float64(attr.Key, v.Float64())
+	case slog.KindBool:
+		return zap.Bool(attr.Key, v.Bool())
+	case slog.KindDuration:
+		return zap.Duration(attr.Key, v.Duration())
+	case slog.KindTime:
+		return zap.Time(attr.Key, v.Time())
+	case slog.KindGroup:
+		// Like slog, a group without a key is inlined
+		if attr.Key == "" {
+			return zap.Inline(zapGroup(v.Group()))
+		}
+		return zap.Object(attr.Key, zapGroup(v.Group()))
+	default:
+		return zap.Any(attr.Key, v.Any())
+	}
+}
+
+// zapGroup encodes a slog group as a zap object
+type zapGroup []slog.Attr
+
+func (g zapGroup) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	for _, attr := range g {
+		zapField(attr).AddTo(enc)
+	}
+	return nil
+}
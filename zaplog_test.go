@@ -0,0 +1,47 @@
+package mirror
+
+import (
+	"errors"
+	"log/slog"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/exp/zapslog"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func Test_zapSlogger(t *testing.T) {
+	args := []any{
+		slog.String("path", "/a"),
+		slog.Int("status", 200),
+		slog.Duration("duration", 1500*time.Millisecond),
+		slog.Group("body", slog.Float64("similarity", 0.5), slog.Bool("json", true)),
+		slog.Group("", slog.String("inlined", "yes")),
+		"error", errors.New("boom"),
+	}
+
+	core, logs := observer.New(zapcore.DebugLevel)
+	zapSlogger{zap.New(core).Named("http.handlers.mirror.comparisons")}.Warn("shadow_mismatch", args...)
+	slog.New(zapslog.NewHandler(core, zapslog.WithName("http.handlers.mirror.comparisons"))).Warn("shadow_mismatch", args...)
+
+	entries := logs.AllUntimed()
+	if len(entries) != 2 {
+		t.Fatalf("logged %d entries, want 2", len(entries))
+	}
+	zapEntry, slogEntry := entries[0], entries[1]
+	if zapEntry.LoggerName != slogEntry.LoggerName || zapEntry.Level != slogEntry.Level {
+		t.Errorf("zap logged as %s at %s, want %s at %s", zapEntry.LoggerName, zapEntry.Level, slogEntry.LoggerName, slogEntry.Level)
+	}
+	if got, want := zapEntry.ContextMap(), slogEntry.ContextMap(); !reflect.DeepEqual(got, want) {
+		t.Errorf("zap fields = %v, want the same as slog's, %v", got, want)
+	}
+
+	core, logs = observer.New(zapcore.InfoLevel)
+	zapSlogger{zap.New(core)}.Debug("shadow_match", slog.String("path", "/a"))
+	if logs.Len() != 0 {
+		t.Errorf("logged below the core's level")
+	}
+}